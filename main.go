@@ -27,8 +27,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -54,6 +56,20 @@ func main() {
 	}
 	taskName, configPath := os.Args[1], os.Args[2]
 
+	//handle check-config task specially; it must not fail on the first error,
+	//and must not connect to anything
+	if taskName == "check-config" {
+		switch {
+		case len(os.Args) == 3:
+			taskCheckConfig(configPath, true)
+		case len(os.Args) == 4 && os.Args[2] == "--syntax-only":
+			taskCheckConfig(os.Args[3], false)
+		default:
+			printUsageAndExit()
+		}
+		return
+	}
+
 	//load configuration
 	config := limes.NewConfiguration(configPath)
 
@@ -77,11 +93,7 @@ func main() {
 	}
 
 	//connect to cluster
-	cluster, exists := config.Clusters[clusterID]
-	if !exists {
-		util.LogFatal("no such cluster configured: " + clusterID)
-	}
-	err = cluster.Connect()
+	cluster, err := connectCluster(config, clusterID)
 	if err != nil {
 		util.LogFatal(err.Error())
 	}
@@ -110,6 +122,7 @@ func main() {
 
 var usageMessage = strings.Replace(strings.TrimSpace(`
 Usage:
+\t%s check-config [--syntax-only] <config-file>
 \t%s migrate <config-file>
 \t%s (collect|serve) <config-file> <cluster-id>
 \t%s test-scrape <config-file> <cluster-id> <project-id>
@@ -121,6 +134,54 @@ func printUsageAndExit() {
 	os.Exit(1)
 }
 
+func connectCluster(config limes.Configuration, clusterID string) (*limes.Cluster, error) {
+	cluster, exists := config.Clusters[clusterID]
+	if !exists {
+		return nil, errors.New("no such cluster configured: " + clusterID)
+	}
+	return cluster, cluster.Connect()
+}
+
+//connectForeignClusters connects to all clusters except for the one with the
+//given ID. Since the current cluster does not depend on them, errors are only
+//logged. Foreign clusters that could not be connected to cannot be written to.
+func connectForeignClusters(config limes.Configuration, currentClusterID string) {
+	for clusterID, cluster := range config.Clusters {
+		if clusterID == currentClusterID {
+			continue
+		}
+		err := cluster.Connect()
+		if err != nil {
+			util.LogError("cannot connect to cluster %s: %s", clusterID, err.Error())
+		}
+	}
+}
+
+//watchForReload reloads the configuration file on SIGHUP (see
+//limes.WatchForReload), connects to the reloaded cluster, and then calls
+//apply to swap the new configuration into the running task.
+func watchForReload(config limes.Configuration, cluster *limes.Cluster, apply func(limes.Configuration, *limes.Cluster) error) {
+	configPath := os.Args[2]
+	limes.WatchForReload(configPath, cluster.ID, config, func(newConfig limes.Configuration) error {
+		newCluster, err := connectCluster(newConfig, cluster.ID)
+		if err != nil {
+			return err
+		}
+		return apply(newConfig, newCluster)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// task: check-config
+
+func taskCheckConfig(configPath string, resolveSecrets bool) {
+	if !limes.CheckConfiguration(configPath, resolveSecrets) {
+		util.LogError("configuration check failed, see errors above")
+		os.Exit(1)
+	}
+	util.LogInfo("configuration is valid")
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // task: migrate
 
@@ -131,7 +192,7 @@ func taskMigrate(config limes.Configuration) {
 		os.Exit(1)
 	}
 
-	errs, ok := migrate.UpSync(config.Database.Location, config.Database.MigrationsPath)
+	errs, ok := migrate.UpSync(config.Database.Location.Value, config.Database.MigrationsPath)
 	if !ok {
 		util.LogError("migration failed, see errors on stderr")
 		for _, err := range errs {
@@ -145,7 +206,7 @@ var dbNotExistErrRx = regexp.MustCompile(`^pq: database "([^"]+)" does not exist
 
 func createDatabaseIfNotExist(config limes.Configuration) error {
 	//check if the database exists
-	db, err := sql.Open("postgres", config.Database.Location)
+	db, err := sql.Open("postgres", config.Database.Location.Value)
 	if err == nil {
 		//apparently the "database does not exist" error only occurs when trying to issue the first statement
 		_, err = db.Exec("SELECT 1")
@@ -162,7 +223,7 @@ func createDatabaseIfNotExist(config limes.Configuration) error {
 	dbName := match[1]
 
 	//remove the database name from the connection URL
-	dbURL, err := url.Parse(config.Database.Location)
+	dbURL, err := url.Parse(config.Database.Location.Value)
 	if err != nil {
 		return err
 	}
@@ -191,17 +252,40 @@ func taskCollect(config limes.Configuration, cluster *limes.Cluster, args []stri
 	//that for now, and instead construct worker threads in such a way that they
 	//can be terminated at any time without leaving the system in an inconsistent
 	//state, mostly through usage of DB transactions.)
-	for _, plugin := range cluster.QuotaPlugins {
+	var collectors []*collector.Collector
+	newCollector := func(plugin limes.QuotaPlugin) *collector.Collector {
 		c := collector.NewCollector(cluster, plugin, config.Collector)
-		go c.Scrape()
+		collectors = append(collectors, c)
+		return c
+	}
+	for serviceType, plugin := range cluster.QuotaPlugins {
+		for idx := uint(0); idx < config.Collector.ScrapeWorkersFor(serviceType); idx++ {
+			go newCollector(plugin).Scrape()
+		}
 	}
 
-	//start those collector threads which operate over all services simultaneously
-	c := collector.NewCollector(cluster, nil, config.Collector)
-	go c.CheckConsistency()
-	go c.ScanCapacity()
+	//start those collector threads which operate over all services
+	//simultaneously (each thread gets its own Collector instance, so that
+	//reloading the configuration does not race between threads)
+	go newCollector(nil).CheckConsistency()
+	go newCollector(nil).ScanCapacity()
+	go newCollector(nil).ExpireQuotaGrants()
+	go newCollector(nil).MeasureScrapeQueues()
+	go newCollector(nil).ApplyScheduledChanges(api.ApplyScheduledChange)
+	go newCollector(nil).CleanupHistory()
+
+	//have the scraping threads wake up immediately when a sync is requested
+	//through the API (if this fails, they will still poll for sync requests)
+	err := collector.ListenForSyncRequests(config.Database, cluster.ID)
+	if err != nil {
+		util.LogError("cannot listen for sync requests: %s", err.Error())
+	}
+
+	var currentCluster atomic.Value //contains *limes.Cluster
+	currentCluster.Store(cluster)
 	go func() {
 		for {
+			cluster := currentCluster.Load().(*limes.Cluster)
 			_, err := collector.ScanDomains(cluster, collector.ScanDomainsOpts{ScanAllProjects: true})
 			if err != nil {
 				util.LogError(err.Error())
@@ -210,9 +294,23 @@ func taskCollect(config limes.Configuration, cluster *limes.Cluster, args []stri
 		}
 	}()
 
+	dataMetrics := &collector.DataMetricsCollector{Cluster: cluster}
+	watchForReload(config, cluster, func(newConfig limes.Configuration, newCluster *limes.Cluster) error {
+		//the scraping threads are tied to their respective services
+		if !reflect.DeepEqual(cluster.IsServiceShared, newCluster.IsServiceShared) {
+			return errors.New("changes to the set of services (or to their \"shared\" flag) require a restart")
+		}
+		for _, c := range collectors {
+			c.Reload(newCluster)
+		}
+		dataMetrics.Reload(newCluster)
+		currentCluster.Store(newCluster)
+		return nil
+	})
+
 	//use main thread to emit Prometheus metrics
 	if config.Collector.ExposeDataMetrics {
-		prometheus.MustRegister(&collector.DataMetricsCollector{Cluster: cluster})
+		prometheus.MustRegister(dataMetrics)
 	}
 	http.Handle("/metrics", promhttp.Handler())
 	util.LogInfo("listening on " + config.Collector.MetricsListenAddress)
@@ -229,10 +327,19 @@ func taskServe(config limes.Configuration, cluster *limes.Cluster, args []string
 
 	mainRouter := mux.NewRouter()
 
+	//connect to the other clusters as well, so that write requests with the
+	//X-Limes-Cluster-Id header can be executed
+	connectForeignClusters(config, cluster.ID)
+
 	//hook up the v1 API (this code is structured so that a newer API version can
 	//be added easily later)
 	v1Router, v1VersionData := api.NewV1Router(cluster, config)
 	mainRouter.PathPrefix("/v1/").Handler(v1Router)
+	watchForReload(config, cluster, func(newConfig limes.Configuration, newCluster *limes.Cluster) error {
+		connectForeignClusters(newConfig, newCluster.ID)
+		v1Router.Reload(newCluster, newConfig)
+		return nil
+	})
 
 	//add the version advertisement that lists all available API versions
 	mainRouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -22,13 +22,18 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	policy "github.com/databus23/goslo.policy"
+	"github.com/gophercloud/gophercloud"
+	"github.com/sapcc/limes/pkg/collector"
 	"github.com/sapcc/limes/pkg/db"
 	"github.com/sapcc/limes/pkg/limes"
 	"github.com/sapcc/limes/pkg/test"
@@ -46,6 +51,8 @@ func setupTest(t *testing.T) (*limes.Cluster, http.Handler) {
 	//load test database
 	test.InitDatabase(t, "../test/migrations")
 	test.ExecSQLFile(t, "fixtures/start-data.sql")
+	timeNow = test.TimeNow
+	test.ResetTime()
 
 	//prepare test configuration
 	serviceTypes := []string{"shared", "unshared"}
@@ -367,6 +374,54 @@ func Test_ClusterOperations(t *testing.T) {
 		},
 	}.Check(t, router)
 	expectClusterCapacity(t, "shared", "shared", "capacity", -1, "")
+
+	//check PutCluster in dry-run mode
+	//NOTE: The dry-run tests come last because the SQLite driver used in tests
+	//does not isolate transactions, so we cannot check here that the DB remains
+	//unchanged. The error cases come first since they do not write anything.
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/clusters/east?dry_run&service=shared&resource=capacity",
+		ExpectStatusCode: 422,
+		ExpectJSON:       "./fixtures/cluster-put-dry-run-error.json",
+		RequestJSON: object{
+			"cluster": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "capacity": 100, "comment": "hundred"},
+							{"name": "things", "capacity": 100, "comment": "whatever"},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/clusters/east?dry_run&service=shared&resource=capacity",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/cluster-put-dry-run.json",
+		RequestJSON: object{
+			"cluster": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "capacity": 100, "comment": "hundred"},
+						},
+					},
+					{
+						"type": "unshared",
+						"resources": []object{
+							{"name": "capacity", "capacity": 202, "comment": "updated again"},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
 }
 
 func expectClusterCapacity(t *testing.T, clusterID, serviceType, resourceName string, capacity int64, comment string) {
@@ -504,14 +559,15 @@ func Test_DomainOperations(t *testing.T) {
 		Method:           "PUT",
 		Path:             "/v1/domains/uuid-for-germany",
 		ExpectStatusCode: 422,
-		ExpectBody:       p2s("cannot change shared/capacity quota: domain quota may not be smaller than sum of project quotas in that domain (20 B)\n"),
+		ExpectBody:       p2s("cannot change shared/capacity quota: domain quota may not be smaller than sum of project quotas in that domain (10 B)\n"),
 		RequestJSON: object{
 			"domain": object{
 				"services": []object{
 					{
 						"type": "shared",
 						"resources": []object{
-							//should fail because project quota sum exceeds new quota
+							//should fail because project quota sum exceeds new quota (only berlin
+							//counts since dresden subleases its quota from berlin)
 							{"name": "capacity", "quota": 1},
 						},
 					},
@@ -596,6 +652,47 @@ func Test_DomainOperations(t *testing.T) {
 		},
 	}.Check(t, router)
 	expectDomainQuota(t, "france", "shared", "capacity", 123)
+
+	//check PutDomain in dry-run mode
+	//(see Test_ClusterOperations for why these tests come last)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany?dry_run&service=shared",
+		ExpectStatusCode: 422,
+		ExpectJSON:       "./fixtures/domain-put-dry-run-error.json",
+		RequestJSON: object{
+			"domain": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "quota": 1},
+							{"name": "things", "quota": 40},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany?dry_run&service=shared",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/domain-put-dry-run.json",
+		RequestJSON: object{
+			"domain": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "quota": 1234},
+							{"name": "things", "quota": 30},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
 }
 
 func expectDomainQuota(t *testing.T, domainName, serviceType, resourceName string, expected uint64) {
@@ -744,8 +841,12 @@ func Test_ProjectOperations(t *testing.T) {
 		ExpectBody:       p2s(""),
 	}.Check(t, router)
 
-	//check SyncProject
+	//check SyncProject (this should also cancel the backoff after failed scrapes)
 	expectStaleProjectServices(t /*, nothing */)
+	_, err := db.DB.Exec(`UPDATE project_services SET scrape_backoff_until = ?`, time.Unix(3600, 0).UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
 	test.APIRequest{
 		Method:           "POST",
 		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-dresden/sync",
@@ -779,7 +880,7 @@ func Test_ProjectOperations(t *testing.T) {
 		Method:           "PUT",
 		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
 		ExpectStatusCode: 422,
-		ExpectBody:       p2s("cannot change shared/capacity quota: quota may not be lower than current usage\ncannot change shared/things quota: domain quota exceeded (maximum acceptable project quota is 20)\n"),
+		ExpectBody:       p2s("cannot change shared/capacity quota: quota may not be lower than current usage\ncannot change shared/things quota: domain quota exceeded (maximum acceptable project quota is 30)\n"),
 		RequestJSON: object{
 			"project": object{
 				"services": []object{
@@ -788,8 +889,9 @@ func Test_ProjectOperations(t *testing.T) {
 						"resources": []object{
 							//should fail because usage exceeds new quota
 							{"name": "capacity", "quota": 1},
-							//should fail because domain quota exceeded
-							{"name": "things", "quota": 30},
+							//should fail because domain quota exceeded (the quota of
+							//dresden does not count since it is subleased from berlin)
+							{"name": "things", "quota": 35},
 						},
 					},
 				},
@@ -812,7 +914,7 @@ func Test_ProjectOperations(t *testing.T) {
 					{
 						"type": "shared",
 						"resources": []object{
-							{"name": "capacity", "quota": 5},
+							{"name": "capacity", "quota": 12},
 						},
 					},
 				},
@@ -823,7 +925,7 @@ func Test_ProjectOperations(t *testing.T) {
 		actualQuota        uint64
 		actualBackendQuota uint64
 	)
-	err := db.DB.QueryRow(`
+	err = db.DB.QueryRow(`
 		SELECT pr.quota, pr.backend_quota FROM project_resources pr
 		JOIN project_services ps ON ps.id = pr.service_id
 		JOIN projects p ON p.id = ps.project_id
@@ -832,10 +934,10 @@ func Test_ProjectOperations(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if actualQuota != 5 {
+	if actualQuota != 12 {
 		t.Error("quota was not updated in database")
 	}
-	if actualBackendQuota == 5 {
+	if actualBackendQuota == 12 {
 		t.Error("backend quota was updated in database even though SetQuota failed")
 	}
 
@@ -851,7 +953,7 @@ func Test_ProjectOperations(t *testing.T) {
 					{
 						"type": "shared",
 						"resources": []object{
-							{"name": "capacity", "quota": 6},
+							{"name": "capacity", "quota": 13},
 						},
 					},
 				},
@@ -867,17 +969,17 @@ func Test_ProjectOperations(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if actualQuota != 6 {
+	if actualQuota != 13 {
 		t.Error("quota was not updated in database")
 	}
-	if actualBackendQuota != 6 {
+	if actualBackendQuota != 13 {
 		t.Error("backend quota was not updated in database")
 	}
 	//double-check with the plugin that the write was durable, and also that
 	//SetQuota sent *all* quotas for that service (even for resources that were
 	//not touched) as required by the QuotaPlugin interface documentation
 	expectBackendQuota := map[string]uint64{
-		"capacity": 6,  //as set above
+		"capacity": 13, //as set above
 		"things":   10, //unchanged
 	}
 	backendQuota, exists := plugin.OverrideQuota["uuid-for-berlin"]
@@ -887,39 +989,2044 @@ func Test_ProjectOperations(t *testing.T) {
 	if !reflect.DeepEqual(expectBackendQuota, backendQuota) {
 		t.Errorf("expected backend quota %#v, but got %#v", expectBackendQuota, backendQuota)
 	}
-}
 
-func expectStaleProjectServices(t *testing.T, pairs ...string) {
-	queryStr := `
-		SELECT p.name, ps.type
-		  FROM projects p JOIN project_services ps ON ps.project_id = p.id
-		 WHERE ps.stale
-		 ORDER BY p.name, ps.type
-	`
-	var actualPairs []string
+	//check PutProject with a quota template (the template's quotas apply to
+	//all resources that are not given explicitly)
+	cluster.Config.QuotaTemplates = limes.QuotaTemplateConfiguration{
+		Templates: map[string]limes.QuotaTemplate{
+			"medium": {"unshared": {"things": 11, "capacity": 10}},
+		},
+	}
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("no such quota template: large\n"),
+		RequestJSON: object{
+			"project": object{"template": "large"},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/project-put-template.json",
+		RequestJSON: object{
+			"project": object{
+				"template": "medium",
+				"services": []object{
+					{
+						"type": "unshared",
+						"resources": []object{
+							{"name": "capacity", "quota": 12},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
 
-	err := db.ForeachRow(db.DB, queryStr, nil, func(rows *sql.Rows) error {
-		var (
-			projectName string
-			serviceType string
-		)
-		err := rows.Scan(&projectName, &serviceType)
-		if err != nil {
-			return err
+	//check PutProject with time-limited quotas
+	putCapacityWithExpiry := func(quota, expiresAt uint64) object {
+		return object{
+			"project": object{
+				"services": []object{
+					{
+						"type": "unshared",
+						"resources": []object{
+							{"name": "capacity", "quota": quota, "expires_at": expiresAt},
+						},
+					},
+				},
+			},
 		}
-		actualPairs = append(actualPairs, fmt.Sprintf("%s:%s", projectName, serviceType))
-		return nil
-	})
-	if err != nil {
-		t.Fatal(err.Error())
 	}
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot change unshared/capacity quota: expiry time must be in the future\n"),
+		RequestJSON:      putCapacityWithExpiry(20, 0),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot change unshared/capacity quota: quota with expiry must be higher than the quota after expiry (12 B)\n"),
+		RequestJSON:      putCapacityWithExpiry(11, 3600),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/project-put-expiry.json",
+		RequestJSON:      putCapacityWithExpiry(20, 3600),
+	}.Check(t, router)
+	//extending the grant keeps the quota that is restored after expiry
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/project-put-expiry-extended.json",
+		RequestJSON:      putCapacityWithExpiry(20, 7200),
+	}.Check(t, router)
 
-	if !reflect.DeepEqual(pairs, actualPairs) {
-		t.Errorf("expected stale project services %v, but got %v", pairs, actualPairs)
+	//check PutProject in dry-run mode (the backend should not see the new quota)
+	//(see Test_ClusterOperations for why these tests come last)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin?dry_run",
+		ExpectStatusCode: 422,
+		ExpectJSON:       "./fixtures/project-put-dry-run-error.json",
+		RequestJSON: object{
+			"project": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "quota": 1},
+							{"name": "things", "quota": 15},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin?dry_run",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/project-put-dry-run.json",
+		RequestJSON: object{
+			"project": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "quota": 11},
+							{"name": "things", "quota": 10},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	backendQuota, exists = plugin.OverrideQuota["uuid-for-berlin"]
+	if !exists || backendQuota["capacity"] != 13 {
+		t.Errorf("expected backend quota to remain unchanged in dry-run mode, but got %#v", backendQuota)
 	}
 }
 
-//p2s makes a "pointer to string".
-func p2s(val string) *string {
-	return &val
+func Test_BulkProjectOperations(t *testing.T) {
+	cluster, router := setupTest(t)
+
+	//check PutProjects error cases
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such project: uuid-for-paris\n"),
+		RequestJSON: object{
+			"projects": []object{
+				{"id": "uuid-for-paris", "services": []object{}},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("project uuid-for-berlin appears multiple times in the request\n"),
+		RequestJSON: object{
+			"projects": []object{
+				{"id": "uuid-for-berlin", "services": []object{}},
+				{"id": "uuid-for-berlin", "services": []object{}},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects",
+		ExpectStatusCode: 422,
+		ExpectJSON:       "./fixtures/projects-put-bulk-error.json",
+		RequestJSON: object{
+			"projects": []object{
+				{
+					"id": "uuid-for-berlin",
+					"services": []object{
+						{
+							"type": "shared",
+							"resources": []object{
+								//should fail because the sum of all project quotas exceeds the domain quota
+								{"name": "things", "quota": 35},
+							},
+						},
+					},
+				},
+				{
+					"id": "uuid-for-dresden",
+					"services": []object{
+						{
+							"type": "shared",
+							"resources": []object{
+								//should fail because usage exceeds new quota
+								{"name": "capacity", "quota": 1},
+								//should fail because the quota of the parent project is exceeded
+								//(even with the new quota for berlin)
+								{"name": "things", "quota": 40},
+							},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectProjectQuota(t, "berlin", "shared", "things", 10)
+	expectProjectQuota(t, "dresden", "shared", "things", 10)
+
+	//check PutProjects in dry-run mode
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects?dry_run",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/projects-put-bulk-dry-run.json",
+		RequestJSON: object{
+			"projects": []object{
+				{
+					"id": "uuid-for-dresden",
+					"services": []object{
+						{
+							"type":      "shared",
+							"resources": []object{{"name": "capacity", "quota": 2}},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectProjectQuota(t, "dresden", "shared", "capacity", 10)
+
+	//check PutProjects happy path: a rebalancing where the raise comes before
+	//the lowering (this would fail with separate PutProject calls in this
+	//order because the domain quota would be exceeded temporarily)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/projects-put-bulk.json",
+		RequestJSON: object{
+			"projects": []object{
+				{
+					"id": "uuid-for-berlin",
+					"services": []object{
+						{
+							"type":      "shared",
+							"resources": []object{{"name": "capacity", "quota": 18}},
+						},
+					},
+				},
+				{
+					"id": "uuid-for-dresden",
+					"services": []object{
+						{
+							"type": "shared",
+							"resources": []object{
+								{"name": "capacity", "quota": 2},
+								{"name": "things", "quota": 10},
+							},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectProjectQuota(t, "berlin", "shared", "capacity", 18)
+	expectProjectQuota(t, "dresden", "shared", "capacity", 2)
+	plugin := cluster.QuotaPlugins["shared"].(*test.Plugin)
+	if plugin.OverrideQuota["uuid-for-berlin"]["capacity"] != 18 {
+		t.Error("quota for berlin was not sent to backend")
+	}
+	if plugin.OverrideQuota["uuid-for-dresden"]["capacity"] != 2 {
+		t.Error("quota for dresden was not sent to backend")
+	}
+
+	//check PutProjects with backend errors
+	plugin.SetQuotaFails = true
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects",
+		ExpectStatusCode: 202,
+		ExpectJSON:       "./fixtures/projects-put-bulk-backend-error.json",
+		RequestJSON: object{
+			"projects": []object{
+				{
+					"id": "uuid-for-berlin",
+					"services": []object{
+						{
+							"type":      "shared",
+							"resources": []object{{"name": "capacity", "quota": 3}},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectProjectQuota(t, "berlin", "shared", "capacity", 3)
+}
+
+func Test_ProjectSubtreeQuotas(t *testing.T) {
+	_, router := setupTest(t)
+
+	//add a grandchild project below dresden, so that the subtree of berlin has
+	//two levels
+	_, err := db.DB.Exec(`INSERT INTO projects (id, domain_id, name, uuid, parent_uuid) VALUES (5, 1, 'leipzig', 'uuid-for-leipzig', 'uuid-for-dresden')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB.Exec(`INSERT INTO project_services (id, project_id, type, scraped_at) VALUES (9, 5, 'shared', 99)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB.Exec(`INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (9, 'things', 0, 0, 0, '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putThings := func(projectName string, quota uint64) object {
+		return object{
+			"project": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": quota}},
+					},
+				},
+			},
+		}
+	}
+
+	//leipzig subleases its quota from berlin (not from dresden), and berlin's
+	//quota is already fully subleased to dresden
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-leipzig",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot change shared/things quota: parent project quota exceeded (maximum acceptable project quota is 0)\n"),
+		RequestJSON:      putThings("leipzig", 1),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 200,
+		RequestJSON:      putThings("berlin", 15),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-leipzig",
+		ExpectStatusCode: 200,
+		RequestJSON:      putThings("leipzig", 5),
+	}.Check(t, router)
+	expectProjectQuota(t, "leipzig", "shared", "things", 5)
+
+	//berlin cannot be lowered below the quota sum of its whole subtree
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot change shared/things quota: quota may not be lower than sum of child project quotas (15)\n"),
+		RequestJSON:      putThings("berlin", 14),
+	}.Check(t, router)
+
+	//dresden does not sublease its quota to leipzig, so it can be lowered below
+	//the quota of leipzig
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-dresden",
+		ExpectStatusCode: 200,
+		RequestJSON:      putThings("dresden", 2),
+	}.Check(t, router)
+	expectProjectQuota(t, "dresden", "shared", "things", 2)
+
+	//the reports show the quota sum of the whole subtree for berlin, and only
+	//the quota of berlin counts towards the domain quota
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin?service=shared&resource=things",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/project-get-berlin-subtree.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany?service=shared&resource=things",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/domain-get-germany-subtree.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot change shared/things quota: domain quota exceeded (maximum acceptable project quota is 30)\n"),
+		RequestJSON:      putThings("berlin", 31),
+	}.Check(t, router)
+}
+
+func Test_QuotaTransferOperations(t *testing.T) {
+	cluster, router := setupTest(t)
+
+	//check PostQuotaTransfer error cases
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/quota-transfers",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("source and target project must be different\n"),
+		RequestJSON: object{
+			"transfer": object{
+				"source_project_id": "uuid-for-berlin",
+				"target_project_id": "uuid-for-berlin",
+				"services":          []object{},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/quota-transfers",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such project: uuid-for-paris\n"),
+		RequestJSON: object{
+			"transfer": object{
+				"source_project_id": "uuid-for-berlin",
+				"target_project_id": "uuid-for-paris",
+				"services":          []object{},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/quota-transfers",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot transfer shared/things quota: source project only has a quota of 10\ncannot transfer shared/unknown quota: no such resource\n"),
+		RequestJSON: object{
+			"transfer": object{
+				"source_project_id": "uuid-for-berlin",
+				"target_project_id": "uuid-for-dresden",
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "things", "quota": 20},
+							{"name": "unknown", "quota": 1},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/quota-transfers",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot change shared/capacity quota: quota may not be lower than current usage\n"),
+		RequestJSON: object{
+			"transfer": object{
+				"source_project_id": "uuid-for-dresden",
+				"target_project_id": "uuid-for-berlin",
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "capacity", "quota": 9}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	//berlin is the parent of dresden, so dresden's final quota may not exceed berlin's final quota
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/quota-transfers",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot change shared/capacity quota: quota may not be lower than sum of child project quotas (11 B)\ncannot change shared/capacity quota: parent project quota exceeded (maximum acceptable project quota is 9 B)\n"),
+		RequestJSON: object{
+			"transfer": object{
+				"source_project_id": "uuid-for-berlin",
+				"target_project_id": "uuid-for-dresden",
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "capacity", "quota": 1}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectProjectQuota(t, "berlin", "shared", "capacity", 10)
+	expectProjectQuota(t, "dresden", "shared", "capacity", 10)
+
+	//check PostQuotaTransfer happy path
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/quota-transfers",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/quota-transfer.json",
+		RequestJSON: object{
+			"transfer": object{
+				"source_project_id": "uuid-for-dresden",
+				"target_project_id": "uuid-for-berlin",
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "quota": 8},
+							{"name": "things", "quota": 3},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectProjectQuota(t, "berlin", "shared", "capacity", 18)
+	expectProjectQuota(t, "berlin", "shared", "things", 13)
+	expectProjectQuota(t, "dresden", "shared", "capacity", 2)
+	expectProjectQuota(t, "dresden", "shared", "things", 7)
+	plugin := cluster.QuotaPlugins["shared"].(*test.Plugin)
+	expectBackendQuota := map[string]map[string]uint64{
+		"uuid-for-berlin":  {"capacity": 18, "things": 13},
+		"uuid-for-dresden": {"capacity": 2, "things": 7},
+	}
+	if !reflect.DeepEqual(expectBackendQuota, plugin.OverrideQuota) {
+		t.Errorf("expected backend quota %#v, but got %#v", expectBackendQuota, plugin.OverrideQuota)
+	}
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/audit?action=transfer_quota",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/quota-transfer-audit.json",
+	}.Check(t, router)
+
+	//two interleaved transfers out of the same project are both validated
+	//against the same source quota, but only the first one to be written may
+	//go through (in Postgres, PostQuotaTransfer additionally holds row locks that
+	//serialize concurrent transfers, but SQLite cannot run them concurrently)
+	var (
+		berlin, dresden  db.Project
+		transferAmount   = ServiceQuotas{"shared": ResourceQuotas{"things": ResourceQuota{ValueWithUnit: limes.ValueWithUnit{Value: 1, Unit: limes.UnitUnspecified}}}}
+		transfersUpdates [2][]projectQuotaUpdate
+	)
+	err := db.DB.SelectOne(&berlin, `SELECT * FROM projects WHERE name = $1`, "berlin")
+	if err == nil {
+		err = db.DB.SelectOne(&dresden, `SELECT * FROM projects WHERE name = $1`, "dresden")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := range transfersUpdates {
+		sourceQuotas, targetQuotas, errors, err := prepareQuotaTransfer(tx, cluster, &dresden, &berlin, transferAmount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(errors) > 0 {
+			t.Fatalf("unexpected validation errors: %v", errors)
+		}
+		sourceUpdates, sourceVerdicts, err := prepareProjectQuotaUpdates(tx, cluster, &dresden, nil, nil, sourceQuotas, true, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetUpdates, targetVerdicts, err := prepareProjectQuotaUpdates(tx, cluster, &berlin, nil, nil, targetQuotas, true, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sourceVerdicts.Errors())+len(targetVerdicts.Errors()) > 0 {
+			t.Fatalf("unexpected validation errors: %v %v", sourceVerdicts.Errors(), targetVerdicts.Errors())
+		}
+		transfersUpdates[idx] = append(sourceUpdates, targetUpdates...)
+	}
+	err = applyProjectQuotaUpdates(tx, transfersUpdates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyProjectQuotaUpdates(tx, transfersUpdates[1])
+	if err != errConcurrentQuotaUpdate {
+		t.Errorf("expected second transfer to fail with %q, but got %v", errConcurrentQuotaUpdate, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the quota was moved exactly once
+	expectProjectQuota(t, "berlin", "shared", "things", 14)
+	expectProjectQuota(t, "dresden", "shared", "things", 6)
+
+	//transferring quota out of a time-limited quota keeps the grant, and moves
+	//the quota after expiry along with the transfer (otherwise the rest of the
+	//time-limited quota would silently become permanent)
+	var dresdenServiceID int64
+	err = db.DB.QueryRow(`SELECT id FROM project_services WHERE project_id = $1 AND type = $2`, dresden.ID, "shared").Scan(&dresdenServiceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DB.Insert(&db.ProjectQuotaGrant{ServiceID: dresdenServiceID, ResourceName: "things", PreviousQuota: 4, ExpiresAt: time.Unix(86400, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/quota-transfers",
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"transfer": object{
+				"source_project_id": "uuid-for-dresden",
+				"target_project_id": "uuid-for-berlin",
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 1}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectProjectQuota(t, "berlin", "shared", "things", 15)
+	expectProjectQuota(t, "dresden", "shared", "things", 5)
+	expectQuotaGrant(t, "berlin", "shared", "things", nil)
+	expectQuotaGrant(t, "dresden", "shared", "things", p2u64(3))
+
+	//an explicit PUT without expiry time makes the quota permanent
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-dresden",
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"project": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 6}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	expectQuotaGrant(t, "dresden", "shared", "things", nil)
+}
+
+//expectQuotaGrant checks the quota after expiry of the grant for the given
+//project resource, or that there is no grant if expectedPreviousQuota is nil.
+func expectQuotaGrant(t *testing.T, projectName, serviceType, resourceName string, expectedPreviousQuota *uint64) {
+	t.Helper()
+	var previousQuota []uint64
+	_, err := db.DB.Select(&previousQuota, `
+		SELECT g.previous_quota FROM project_quota_grants g
+		JOIN project_services ps ON ps.id = g.service_id
+		JOIN projects p ON p.id = ps.project_id
+		WHERE p.name = ? AND ps.type = ? AND g.resource_name = ?`,
+		projectName, serviceType, resourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case expectedPreviousQuota == nil && len(previousQuota) > 0:
+		t.Errorf("expected no quota grant for %s/%s/%s, but got one with previous quota %d",
+			projectName, serviceType, resourceName, previousQuota[0])
+	case expectedPreviousQuota != nil && len(previousQuota) == 0:
+		t.Errorf("expected quota grant for %s/%s/%s, but got none", projectName, serviceType, resourceName)
+	case expectedPreviousQuota != nil && previousQuota[0] != *expectedPreviousQuota:
+		t.Errorf("expected quota grant for %s/%s/%s with previous quota %d, but got %d",
+			projectName, serviceType, resourceName, *expectedPreviousQuota, previousQuota[0])
+	}
+}
+
+func expectProjectQuota(t *testing.T, projectName, serviceType, resourceName string, expected uint64) {
+	var actualQuota uint64
+	err := db.DB.QueryRow(`
+		SELECT pr.quota FROM project_resources pr
+		JOIN project_services ps ON ps.id = pr.service_id
+		JOIN projects p ON p.id = ps.project_id
+		WHERE p.name = ? AND ps.type = ? AND pr.name = ?`,
+		projectName, serviceType, resourceName).Scan(&actualQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actualQuota != expected {
+		t.Errorf(
+			"expected project quota for %s/%s/%s to be %d, but got %d",
+			projectName, serviceType, resourceName, expected, actualQuota,
+		)
+	}
+}
+
+func expectStaleProjectServices(t *testing.T, pairs ...string) {
+	queryStr := `
+		SELECT p.name, ps.type
+		  FROM projects p JOIN project_services ps ON ps.project_id = p.id
+		 WHERE ps.stale AND ps.scrape_backoff_until IS NULL
+		 ORDER BY p.name, ps.type
+	`
+	var actualPairs []string
+
+	err := db.ForeachRow(db.DB, queryStr, nil, func(rows *sql.Rows) error {
+		var (
+			projectName string
+			serviceType string
+		)
+		err := rows.Scan(&projectName, &serviceType)
+		if err != nil {
+			return err
+		}
+		actualPairs = append(actualPairs, fmt.Sprintf("%s:%s", projectName, serviceType))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !reflect.DeepEqual(pairs, actualPairs) {
+		t.Errorf("expected stale project services %v, but got %v", pairs, actualPairs)
+	}
+}
+
+//p2s makes a "pointer to string".
+func p2s(val string) *string {
+	return &val
+}
+
+//p2u64 makes a "pointer to uint64".
+func p2u64(val uint64) *uint64 {
+	return &val
+}
+
+func Test_QuotaRequestOperations(t *testing.T) {
+	cluster, router := setupTest(t)
+
+	//check PostProjectQuotaRequest error cases
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot request shared/unknown quota: no such resource\n"),
+		RequestJSON: object{
+			"request": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "unknown", "quota": 20}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("no quotas requested\n"),
+		RequestJSON:      object{"request": object{"comment": "empty"}},
+	}.Check(t, router)
+
+	//check PostProjectQuotaRequest and PostDomainQuotaRequest happy path
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests",
+		ExpectStatusCode: 201,
+		ExpectJSON:       "fixtures/request-post-berlin.json",
+		RequestJSON: object{
+			"request": object{
+				"comment": "need more things",
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 20}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests",
+		ExpectStatusCode: 201,
+		RequestJSON: object{
+			"request": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 35}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/requests",
+		ExpectStatusCode: 201,
+		RequestJSON: object{
+			"request": object{
+				"services": []object{
+					{
+						"type":      "unshared",
+						"resources": []object{{"name": "things", "quota": 60}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+
+	//check ListQuotaRequests and friends
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/requests",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/request-list-pending.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/requests",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/request-list-pending.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-france/requests",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"requests":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-dresden/requests",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"requests":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/requests?state=unknown",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid value for state: unknown\n"),
+	}.Check(t, router)
+
+	//check ApproveProjectQuotaRequest: request exceeds domain quota
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests/2/approve",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("cannot approve quota request:\ncannot change shared/things quota: domain quota exceeded (maximum acceptable project quota is 30)\n"),
+	}.Check(t, router)
+
+	//check ApproveProjectQuotaRequest: request belongs to a different project or to the domain
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-dresden/requests/1/approve",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such quota request\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests/3/approve",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such quota request\n"),
+	}.Check(t, router)
+
+	//check ApproveProjectQuotaRequest happy path
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests/1/approve",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/request-approve-berlin.json",
+		RequestJSON:      object{"request": object{"comment": "granted"}},
+	}.Check(t, router)
+	var actualQuota uint64
+	err := db.DB.QueryRow(`
+		SELECT pr.quota FROM project_resources pr
+		JOIN project_services ps ON ps.id = pr.service_id
+		JOIN projects p ON p.id = ps.project_id
+		WHERE p.name = ? AND ps.type = ? AND pr.name = ?`,
+		"berlin", "shared", "things").Scan(&actualQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actualQuota != 20 {
+		t.Error("quota was not updated in database")
+	}
+	plugin := cluster.QuotaPlugins["shared"].(*test.Plugin)
+	if plugin.OverrideQuota["uuid-for-berlin"]["things"] != 20 {
+		t.Error("quota was not sent to backend")
+	}
+
+	//check that a decided request cannot be decided again
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests/1/reject",
+		ExpectStatusCode: 409,
+		ExpectBody:       p2s("quota request 1 has already been approved\n"),
+	}.Check(t, router)
+
+	//check RejectProjectQuotaRequest and ApproveDomainQuotaRequest
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests/2/reject",
+		ExpectStatusCode: 200,
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/requests/3/approve",
+		ExpectStatusCode: 200,
+	}.Check(t, router)
+	err = db.DB.QueryRow(`
+		SELECT dr.quota FROM domain_resources dr
+		JOIN domain_services ds ON ds.id = dr.service_id
+		JOIN domains d ON d.id = ds.domain_id
+		WHERE d.name = ? AND ds.type = ? AND dr.name = ?`,
+		"germany", "unshared", "things").Scan(&actualQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actualQuota != 60 {
+		t.Error("domain quota was not updated in database")
+	}
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/requests",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"requests":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/requests?state=approved&state=rejected",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/request-list-berlin-decided.json",
+	}.Check(t, router)
+}
+
+func Test_ScheduledChangeOperations(t *testing.T) {
+	cluster, router := setupTest(t)
+
+	//check PostScheduledChange error cases
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("due_at must be in the future\ncannot schedule shared/unknown quota: no such resource\n"),
+		RequestJSON: object{
+			"scheduled_change": object{
+				"due_at": 0,
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "unknown", "quota": 20}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 422,
+		ExpectBody:       p2s("no quotas given\n"),
+		RequestJSON:      object{"scheduled_change": object{"due_at": 3600}},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such project: uuid-for-paris\n"),
+		RequestJSON: object{
+			"scheduled_change": object{
+				"project_id": "uuid-for-paris",
+				"due_at":     3600,
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 20}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+
+	//check PostScheduledChange happy path: the first project change is
+	//acceptable, the second one will exceed the domain quota when applied
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 201,
+		ExpectJSON:       "fixtures/scheduled-change-post-berlin.json",
+		RequestJSON: object{
+			"scheduled_change": object{
+				"project_id": "uuid-for-berlin",
+				"due_at":     3600,
+				"comment":    "capacity rollout",
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 20}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 201,
+		RequestJSON: object{
+			"scheduled_change": object{
+				"project_id": "uuid-for-berlin",
+				"due_at":     3600,
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 35}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	for _, dueAt := range []int64{7200, 3600} {
+		test.APIRequest{
+			Method:           "POST",
+			Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+			ExpectStatusCode: 201,
+			RequestJSON: object{
+				"scheduled_change": object{
+					"due_at": dueAt,
+					"services": []object{
+						{
+							"type":      "unshared",
+							"resources": []object{{"name": "things", "quota": 60}},
+						},
+					},
+				},
+			},
+		}.Check(t, router)
+	}
+
+	//check CancelScheduledChange
+	test.APIRequest{
+		Method:           "DELETE",
+		Path:             "/v1/domains/uuid-for-france/scheduled-changes/4",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such scheduled change\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "DELETE",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes/4",
+		ExpectStatusCode: 200,
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "DELETE",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes/4",
+		ExpectStatusCode: 409,
+		ExpectBody:       p2s("scheduled change 4 has already been cancelled\n"),
+	}.Check(t, router)
+
+	//check ListScheduledChanges
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/scheduled-change-list-pending.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-france/scheduled-changes",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"scheduled_changes":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes?state=unknown",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid value for state: unknown\n"),
+	}.Check(t, router)
+
+	//apply the changes that are due in one hour: the first project change is
+	//applied, the second one fails, the domain change is not due yet
+	expectNoErrors(t, applyScheduledChanges(cluster, time.Unix(3600, 0), ApplyScheduledChange))
+	var actualQuota uint64
+	err := db.DB.QueryRow(`
+		SELECT pr.quota FROM project_resources pr
+		JOIN project_services ps ON ps.id = pr.service_id
+		JOIN projects p ON p.id = ps.project_id
+		WHERE p.name = ? AND ps.type = ? AND pr.name = ?`,
+		"berlin", "shared", "things").Scan(&actualQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actualQuota != 20 {
+		t.Errorf("expected project quota to be 20, but got %d", actualQuota)
+	}
+	plugin := cluster.QuotaPlugins["shared"].(*test.Plugin)
+	if plugin.OverrideQuota["uuid-for-berlin"]["things"] != 20 {
+		t.Error("quota was not sent to backend")
+	}
+
+	//apply the remaining change
+	expectNoErrors(t, applyScheduledChanges(cluster, time.Unix(7200, 0), ApplyScheduledChange))
+	err = db.DB.QueryRow(`
+		SELECT dr.quota FROM domain_resources dr
+		JOIN domain_services ds ON ds.id = dr.service_id
+		JOIN domains d ON d.id = ds.domain_id
+		WHERE d.name = ? AND ds.type = ? AND dr.name = ?`,
+		"germany", "unshared", "things").Scan(&actualQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actualQuota != 60 {
+		t.Errorf("expected domain quota to be 60, but got %d", actualQuota)
+	}
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"scheduled_changes":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes?state=applied&state=failed&state=cancelled",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/scheduled-change-list-processed.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/audit?action=apply_change&action=fail_change",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/scheduled-change-audit.json",
+	}.Check(t, router)
+
+	//a change that cannot be processed at all is marked as failed, and does not
+	//block the changes that are due after it
+	for _, quota := range []uint64{15, 16} {
+		test.APIRequest{
+			Method:           "POST",
+			Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+			ExpectStatusCode: 201,
+			RequestJSON: object{
+				"scheduled_change": object{
+					"project_id": "uuid-for-berlin",
+					"due_at":     10800,
+					"services": []object{
+						{
+							"type":      "shared",
+							"resources": []object{{"name": "things", "quota": quota}},
+						},
+					},
+				},
+			},
+		}.Check(t, router)
+	}
+	brokenApply := func(cluster *limes.Cluster, changeID int64, now time.Time) error {
+		if changeID == 5 {
+			return errors.New("datacenter is on fire")
+		}
+		return ApplyScheduledChange(cluster, changeID, now)
+	}
+	errs := applyScheduledChanges(cluster, time.Unix(10800, 0), brokenApply)
+	expectedErrs := []string{"cannot apply scheduled change 5: datacenter is on fire"}
+	if !reflect.DeepEqual(errs, expectedErrs) {
+		t.Errorf("expected errors %#v, but got %#v", expectedErrs, errs)
+	}
+	expectScheduledChangeState(t, 5, db.ScheduledChangeFailed, "datacenter is on fire")
+	expectScheduledChangeState(t, 6, db.ScheduledChangeApplied, "")
+	expectProjectQuota(t, "berlin", "shared", "things", 16)
+
+	//a change that is cancelled after the collector has selected it is not
+	//applied anymore
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/v1/domains/uuid-for-germany/scheduled-changes",
+		ExpectStatusCode: 201,
+		RequestJSON: object{
+			"scheduled_change": object{
+				"project_id": "uuid-for-berlin",
+				"due_at":     14400,
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 17}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	cancellingApply := func(cluster *limes.Cluster, changeID int64, now time.Time) error {
+		test.APIRequest{
+			Method:           "DELETE",
+			Path:             fmt.Sprintf("/v1/domains/uuid-for-germany/scheduled-changes/%d", changeID),
+			ExpectStatusCode: 200,
+		}.Check(t, router)
+		return ApplyScheduledChange(cluster, changeID, now)
+	}
+	expectNoErrors(t, applyScheduledChanges(cluster, time.Unix(14400, 0), cancellingApply))
+	expectScheduledChangeState(t, 7, db.ScheduledChangeCancelled, "")
+	expectProjectQuota(t, "berlin", "shared", "things", 16)
+}
+
+//applyScheduledChanges runs the collector job for scheduled changes once,
+//and returns the errors logged by it.
+func applyScheduledChanges(cluster *limes.Cluster, now time.Time, apply collector.ScheduledChangeApplier) (errs []string) {
+	c := collector.NewCollector(cluster, nil, limes.CollectorConfiguration{})
+	c.Once = true
+	c.TimeNow = func() time.Time { return now }
+	c.LogError = func(msg string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(msg, args...))
+	}
+	c.ApplyScheduledChanges(apply)
+	return
+}
+
+func expectNoErrors(t *testing.T, errs []string) {
+	t.Helper()
+	for _, msg := range errs {
+		t.Error(msg)
+	}
+}
+
+func expectScheduledChangeState(t *testing.T, changeID int64, expectedState, expectedError string) {
+	t.Helper()
+	var change db.ScheduledChange
+	err := db.DB.SelectOne(&change, `SELECT * FROM scheduled_changes WHERE id = $1`, changeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.State != expectedState || change.ErrorMessage != expectedError {
+		t.Errorf("expected scheduled change %d to be %s with error %q, but it is %s with error %q",
+			changeID, expectedState, expectedError, change.State, change.ErrorMessage)
+	}
+}
+
+func Test_AuditOperations(t *testing.T) {
+	_, router := setupTest(t)
+
+	//generate some audit events
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/clusters/west",
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"cluster": object{
+				"services": []object{
+					{
+						"type":      "unshared",
+						"resources": []object{{"name": "capacity", "capacity": 100, "comment": "hand-counted"}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany",
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"domain": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 40}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"project": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "capacity", "quota": 12},
+							{"name": "things", "quota": 15},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+
+	//check ListAuditEvents
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/audit",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/audit-list.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/audit?project=uuid-for-berlin&resource=things",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/audit-list-filtered.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/audit?since=1&until=2",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/audit-list-timerange.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/audit?user=unknown",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"events":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/audit?since=yesterday",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid value for since: strconv.ParseInt: parsing \"yesterday\": invalid syntax\n"),
+	}.Check(t, router)
+
+	//check ListDomainAuditEvents and ListProjectAuditEvents
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-france/audit",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"events":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/audit?resource=things",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/audit-list-filtered.json",
+	}.Check(t, router)
+}
+
+func Test_HistoryOperations(t *testing.T) {
+	_, router := setupTest(t)
+
+	//check GetProjectHistory
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/history",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/history-get-berlin.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/history?resource=things&from=7200",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/history-get-berlin-filtered.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/history?to=3600",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"history":{"services":[]}}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin/history?from=now",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid value for from: strconv.ParseInt: parsing \"now\": invalid syntax\n"),
+	}.Check(t, router)
+
+	//check GetDomainHistory
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/history?service=shared&resource=things",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/history-get-germany.json",
+	}.Check(t, router)
+
+	//check GetClusterHistory
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/current/history?resource=things",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/history-get-west.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/north/history",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such cluster\n"),
+	}.Check(t, router)
+}
+
+func Test_ErrorFormat(t *testing.T) {
+	_, router := setupTest(t)
+	acceptJSON := map[string]string{"Accept": "application/json"}
+
+	//plain-text errors are reported in the JSON error format when the client
+	//prefers JSON
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-unknown",
+		RequestHeader:    acceptJSON,
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s(`{"error":{"status":404,"code":"not_found","message":"no such domain (if it was just created, try to POST /domains/discover)"}}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/unknown",
+		RequestHeader:    acceptJSON,
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s(`{"error":{"status":404,"code":"not_found","message":"404 page not found"}}`),
+	}.Check(t, router)
+
+	//validation errors contain structured data for each rejected resource
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		RequestHeader:    acceptJSON,
+		ExpectStatusCode: 422,
+		ExpectJSON:       "fixtures/error-put-project.json",
+		RequestJSON: object{
+			"project": object{
+				"services": []object{
+					{
+						"type": "shared",
+						"resources": []object{
+							{"name": "things", "quota": 35},
+							{"name": "capacity", "quota": 1},
+						},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+
+	//plain text stays the default, and is used when preferred by the client
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-unknown",
+		RequestHeader:    map[string]string{"Accept": "*/*"},
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such domain (if it was just created, try to POST /domains/discover)\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-unknown",
+		RequestHeader:    map[string]string{"Accept": "application/json;q=0.5, text/plain"},
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such domain (if it was just created, try to POST /domains/discover)\n"),
+	}.Check(t, router)
+
+	//successful responses are not affected
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		RequestHeader:    acceptJSON,
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/project-get-berlin.json",
+	}.Check(t, router)
+}
+
+func Test_ETags(t *testing.T) {
+	_, router := setupTest(t)
+
+	//GetProject and GetDomain report an ETag for the current quotas
+	projectETag1, err := projectETag(db.DB, &db.Project{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainETag1, err := domainETag(db.DB, &db.Domain{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		ExpectStatusCode: 200,
+		ExpectHeader:     map[string]string{"ETag": projectETag1},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany",
+		ExpectStatusCode: 200,
+		ExpectHeader:     map[string]string{"ETag": domainETag1},
+	}.Check(t, router)
+
+	//PutProject with a matching ETag succeeds and reports the new ETag
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		RequestHeader:    map[string]string{"If-Match": projectETag1},
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"project": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 15}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	projectETag2, err := projectETag(db.DB, &db.Project{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if projectETag2 == projectETag1 {
+		t.Error("expected project ETag to change after quota update")
+	}
+
+	//PutProject with a stale ETag fails
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin",
+		RequestHeader:    map[string]string{"If-Match": projectETag1},
+		ExpectStatusCode: 412,
+		ExpectBody:       p2s("quotas have been changed since they were last read (ETag mismatch)\n"),
+		RequestJSON: object{
+			"project": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 12}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+
+	//changing a project quota does not change the domain's ETag, so PutDomain
+	//with the ETag from before succeeds (and the wildcard matches anyway)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany",
+		RequestHeader:    map[string]string{"If-Match": `"something-else", ` + domainETag1},
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"domain": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 40}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany",
+		RequestHeader:    map[string]string{"If-Match": domainETag1},
+		ExpectStatusCode: 412,
+		ExpectBody:       p2s("quotas have been changed since they were last read (ETag mismatch)\n"),
+		RequestJSON: object{
+			"domain": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 50}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany",
+		RequestHeader:    map[string]string{"If-Match": "*"},
+		ExpectStatusCode: 200,
+		RequestJSON: object{
+			"domain": object{
+				"services": []object{
+					{
+						"type":      "shared",
+						"resources": []object{{"name": "things", "quota": 50}},
+					},
+				},
+			},
+		},
+	}.Check(t, router)
+
+	//bulk updates do not support If-Match since there is no single ETag for all projects
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-germany/projects",
+		RequestHeader:    map[string]string{"If-Match": projectETag1},
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("If-Match is not supported for bulk quota updates\n"),
+		RequestJSON:      object{"projects": []object{}},
+	}.Check(t, router)
+
+	//quota updates that were validated against an outdated quota value are not applied
+	var res db.DomainResource
+	err = db.DB.SelectOne(&res, `
+		SELECT dr.* FROM domain_resources dr
+		  JOIN domain_services ds ON ds.id = dr.service_id
+		  JOIN domains d ON d.id = ds.domain_id
+		 WHERE d.name = $1 AND ds.type = $2 AND dr.name = $3`,
+		"germany", "shared", "things")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.RollbackUnlessCommitted(tx)
+	res.Quota = 60
+	err = applyDomainQuotaUpdates(tx, []domainQuotaUpdate{{Resource: res, OldQuota: 40}})
+	if err != errConcurrentQuotaUpdate {
+		t.Errorf("expected update with outdated quota to fail with %q, but got %v", errConcurrentQuotaUpdate, err)
+	}
+}
+
+func Test_ListPagination(t *testing.T) {
+	_, router := setupTest(t)
+
+	//make dresden use more than its quota for shared/things
+	_, err := db.DB.Exec(`UPDATE project_resources SET usage = 12 WHERE service_id = 4 AND name = 'things'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//sorting and pagination for projects
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&sort=-usage&limit=1",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/project-list-page-dresden.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&sort=-usage&limit=1&marker=uuid-for-dresden",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/project-list-page-berlin.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&sort=-usage&limit=1&marker=uuid-for-berlin",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"projects":[]}`),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&limit=1&marker=uuid-for-berlin",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/project-list-page-dresden.json",
+	}.Check(t, router)
+
+	//usage predicates for projects
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&usage_ratio_gt=0.8",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/project-list-page-dresden.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&usage_gt_quota",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/project-list-page-dresden.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&quota_gt_usage=true&usage_ratio_lt=0.5",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/project-list-page-berlin.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&usage_ratio_gt=2",
+		ExpectStatusCode: 200,
+		ExpectBody:       p2s(`{"projects":[]}`),
+	}.Check(t, router)
+
+	//sorting, pagination and predicates for domains
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains?service=shared&resource=things&sort=-usage_ratio",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/domain-list-sorted.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains?service=shared&resource=things&sort=name&limit=1&marker=uuid-for-france",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/domain-list-page-germany.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains?service=shared&resource=things&usage_ratio_gt=0.4",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/domain-list-page-germany.json",
+	}.Check(t, router)
+
+	//malformed arguments
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?sort=quota",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("malformed value for sort: \"quota\" (expected \"name\", \"usage\" or \"usage_ratio\", optionally prefixed with \"-\")\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&sort=-usage",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("sorting by usage requires exactly one \"service\" and one \"resource\" filter\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains?limit=0",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("malformed value for limit: \"0\" (expected positive integer)\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?usage_ratio_gt=high",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("malformed value for usage_ratio_gt: \"high\" (expected number)\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?service=shared&resource=things&sort=usage&marker=uuid-for-paris",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid marker: no such project or domain\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?limit=1&marker=uuid-for-paris",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid marker: no such project or domain\n"),
+	}.Check(t, router)
+}
+
+func Test_CSVExport(t *testing.T) {
+	_, router := setupTest(t)
+
+	//load only one domain or project at a time to check that the batches are
+	//put together correctly
+	defer func(size int) { csvBatchSize = size }(csvBatchSize)
+	csvBatchSize = 1
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/current?format=csv",
+		ExpectStatusCode: 200,
+		ExpectHeader:     map[string]string{"Content-Type": "text/csv; charset=utf-8"},
+		ExpectFile:       "fixtures/cluster-get-west.csv",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains",
+		RequestHeader:    map[string]string{"Accept": "application/json;q=0.5, text/csv"},
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/domain-list.csv",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?format=csv&service=shared",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/project-list-filtered.csv",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?format=csv&service=shared&resource=things&sort=-usage",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/project-list-sorted.csv",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects?format=csv&service=shared&resource=things&sort=-usage&marker=uuid-for-paris",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid marker: no such project or domain\n"),
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin?format=csv",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/project-get-berlin.csv",
+	}.Check(t, router)
+
+	//JSON stays the default, and can be requested explicitly
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany?format=json",
+		RequestHeader:    map[string]string{"Accept": "text/csv"},
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/domain-get-germany.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany?format=xlsx",
+		ExpectStatusCode: 400,
+		ExpectBody:       p2s("invalid value for \"format\" (expected \"csv\" or \"json\")\n"),
+	}.Check(t, router)
+}
+
+//fakeTokenValidator validates every token except "invalid". Tokens expire
+//after 3 seconds if they start with "short", after 100 seconds otherwise.
+//If OnValidate is set, it is called during each validation.
+type fakeTokenValidator struct {
+	Calls      int
+	OnValidate func()
+}
+
+func (v *fakeTokenValidator) ValidateToken(token string) (policy.Context, limes.TokenMetadata, error) {
+	v.Calls++
+	if v.OnValidate != nil {
+		v.OnValidate()
+	}
+	if token == "invalid" {
+		return policy.Context{}, limes.TokenMetadata{}, errors.New("token is invalid")
+	}
+	context := policy.Context{Auth: map[string]string{"user_id": "user-" + token}}
+	meta := limes.TokenMetadata{ExpiresAt: time.Unix(100, 0), AuditIDs: []string{"audit-" + token}}
+	if strings.HasPrefix(token, "short") {
+		meta.ExpiresAt = time.Unix(3, 0)
+	}
+	return context, meta, nil
+}
+
+func (v *fakeTokenValidator) ListRevocationEvents(since time.Time) ([]limes.RevocationEvent, error) {
+	return nil, nil
+}
+
+func Test_TokenCache(t *testing.T) {
+	timeNow = test.TimeNow
+	test.ResetTime()
+	validator := &fakeTokenValidator{}
+	cache := newTokenCache("west", validator, limes.TokenCacheConfiguration{
+		MaxTTL:  5 * time.Second,
+		MaxSize: 2,
+	})
+
+	//each call to expectValidation advances the clock by one second
+	expectValidation := func(token string, expectedCalls int) {
+		t.Helper()
+		context, err := cache.ValidateToken(token)
+		if token == "invalid" {
+			if err == nil {
+				t.Errorf("expected validation of token %q to fail", token)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected error when validating token %q: %s", token, err.Error())
+		} else if context.Auth["user_id"] != "user-"+token {
+			t.Errorf("expected user_id %q, got %q", "user-"+token, context.Auth["user_id"])
+		}
+		if validator.Calls != expectedCalls {
+			t.Errorf("after validating token %q: expected %d calls to Keystone, got %d", token, expectedCalls, validator.Calls)
+		}
+	}
+
+	expectValidation("alice", 1) //t = 0
+	expectValidation("alice", 1) //t = 1 (cache hit)
+
+	//entries do not outlive the token's expiry...
+	expectValidation("short-bob", 2) //t = 2
+	expectValidation("short-bob", 3) //t = 3 (token has expired)
+	expectValidation("alice", 3)     //t = 4 (cache hit)
+
+	//...nor the maximum TTL
+	expectValidation("alice", 4) //t = 5
+
+	//failed validations are not cached
+	expectValidation("invalid", 5) //t = 6
+	expectValidation("invalid", 6) //t = 7
+
+	//when the cache is full, expired entries are evicted first, then the entry
+	//that expires first
+	expectValidation("carol", 7) //t = 8 (evicts short-bob)
+	expectValidation("alice", 7) //t = 9 (cache hit)
+	expectValidation("dave", 8)  //t = 10 (evicts alice)
+	expectValidation("carol", 8) //t = 11 (cache hit)
+	expectValidation("alice", 9) //t = 12 (evicts carol)
+
+	//revocation events evict matching entries
+	cache.ApplyRevocationEvents([]limes.RevocationEvent{{UserID: "user-dave"}})
+	expectValidation("alice", 9) //t = 13 (cache hit)
+	expectValidation("dave", 10) //t = 14
+	cache.ApplyRevocationEvents([]limes.RevocationEvent{{AuditChainID: "audit-alice"}})
+	expectValidation("dave", 10)  //t = 15 (cache hit)
+	expectValidation("alice", 11) //t = 16
+	cache.ApplyRevocationEvents([]limes.RevocationEvent{{RoleID: "something"}})
+	expectValidation("dave", 12)  //t = 17
+	expectValidation("alice", 13) //t = 18
+
+	//revocation events that arrive while a validation is in flight prevent its
+	//result from being cached
+	validator.OnValidate = func() {
+		cache.ApplyRevocationEvents([]limes.RevocationEvent{{UserID: "user-erin"}})
+	}
+	expectValidation("erin", 14) //t = 19
+	validator.OnValidate = nil
+	expectValidation("erin", 15) //t = 20 (was not cached)
+	expectValidation("erin", 15) //t = 21 (cache hit)
+
+	//with a zero TTL, nothing is cached
+	validator.Calls = 0
+	cache = newTokenCache("west", validator, limes.TokenCacheConfiguration{})
+	expectValidation("alice", 1)
+	expectValidation("alice", 2)
+}
+
+func Test_Reload(t *testing.T) {
+	cluster, router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/west",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/cluster-get-west.json",
+	}.Check(t, router)
+
+	//reload with a policy that forbids everything
+	enforcer, err := policy.NewEnforcer(map[string]string{"default": "!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config limes.Configuration
+	config.Clusters = map[string]*limes.Cluster{"west": cluster}
+	config.API.PolicyEnforcer = enforcer
+	router.(*V1Router).Reload(cluster, config)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/west",
+		ExpectStatusCode: 403,
+		ExpectBody:       p2s("Forbidden\n"),
+	}.Check(t, router)
+}
+
+func Test_ForeignClusterWrites(t *testing.T) {
+	cluster, router := setupTest(t)
+
+	domainQuotaRequest := object{
+		"domain": object{
+			"services": []object{
+				{
+					"type": "unshared",
+					"resources": []object{
+						{"name": "things", "quota": 12},
+					},
+				},
+			},
+		},
+	}
+
+	//domain "poland" is in a different cluster, so without the
+	//X-Limes-Cluster-Id header, it cannot be found
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-poland",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such domain (if it was just created, try to POST /domains/discover)\n"),
+		RequestJSON:      domainQuotaRequest,
+	}.Check(t, router)
+
+	//the foreign cluster can only be written to once it has been connected
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-poland",
+		RequestHeader:    map[string]string{"X-Limes-Cluster-Id": "east"},
+		ExpectStatusCode: 503,
+		ExpectBody:       p2s("cannot write to cluster east: not connected\n"),
+		RequestJSON:      domainQuotaRequest,
+	}.Check(t, router)
+
+	//simulate a successful Cluster.Connect() for the foreign cluster, and check
+	//that writing to it requires the "foreign:write" permission
+	eastCluster := *cluster
+	eastCluster.ID = "east"
+	eastCluster.Config = &limes.ClusterConfiguration{
+		Auth: &limes.AuthParameters{ProviderClient: &gophercloud.ProviderClient{}},
+	}
+	policyBytes, err := ioutil.ReadFile("../test/policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func(overrides map[string]string) {
+		rules := make(map[string]string)
+		err := json.Unmarshal(policyBytes, &rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range overrides {
+			rules[key] = value
+		}
+		enforcer, err := policy.NewEnforcer(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config limes.Configuration
+		config.Clusters = map[string]*limes.Cluster{"west": cluster, "east": &eastCluster}
+		config.API.PolicyEnforcer = enforcer
+		router.(*V1Router).Reload(cluster, config)
+	}
+
+	reload(map[string]string{"foreign:write": "!"})
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-poland",
+		RequestHeader:    map[string]string{"X-Limes-Cluster-Id": "east"},
+		ExpectStatusCode: 403,
+		ExpectBody:       p2s("Forbidden\n"),
+		RequestJSON:      domainQuotaRequest,
+	}.Check(t, router)
+
+	reload(nil)
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/domains/uuid-for-poland",
+		RequestHeader:    map[string]string{"X-Limes-Cluster-Id": "east"},
+		ExpectStatusCode: 200,
+		RequestJSON:      domainQuotaRequest,
+	}.Check(t, router)
+	expectDomainQuota(t, "poland", "unshared", "things", 12)
+
+	//audit events for the write are recorded for the foreign cluster
+	var count int
+	err = db.DB.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE cluster_id = $1`, "east").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Error("expected audit events for cluster east")
+	}
+}
+
+func Test_ScrapeErrors(t *testing.T) {
+	_, router := setupTest(t)
+
+	//no scrape errors in the initial test data
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/current/scrape-errors",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/scrape-errors-empty.json",
+	}.Check(t, router)
+
+	//simulate failed scrapes for berlin (in this cluster) and warsaw (in a different cluster)
+	_, err := db.DB.Exec(
+		`UPDATE project_services SET scrape_error_message = $1, scrape_error_at = $2, consecutive_scrape_failures = $3 WHERE id IN (1, 7)`,
+		"Scrape failed", time.Unix(99, 0).UTC(), 3,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/current/scrape-errors",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/scrape-errors-west.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/clusters/unknown/scrape-errors",
+		ExpectStatusCode: 404,
+		ExpectBody:       p2s("no such cluster\n"),
+	}.Check(t, router)
+
+	//scrape errors are also shown in the project report
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/domains/uuid-for-germany/projects/uuid-for-berlin?service=unshared",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "./fixtures/project-get-berlin-scrape-error.json",
+	}.Check(t, router)
 }
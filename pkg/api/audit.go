@@ -0,0 +1,124 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/reports"
+)
+
+//newAuditTrail prepares an audit trail for changes made by the given user in
+//the given cluster.
+func newAuditTrail(clusterID string, token *Token) db.AuditTrail {
+	return db.AuditTrail{
+		Time:      timeNow(),
+		ClusterID: clusterID,
+		UserUUID:  token.UserUUID,
+		UserName:  token.UserName,
+	}
+}
+
+//formatAuditValue formats an optional value for use in an audit log line.
+func formatAuditValue(value *uint64) string {
+	if value == nil {
+		return "none"
+	}
+	return strconv.FormatUint(*value, 10)
+}
+
+//ListAuditEvents handles GET /v1/audit.
+func (p *v1Provider) ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "audit:list") {
+		return
+	}
+	p.listAuditEvents(w, r, nil, nil)
+}
+
+//ListDomainAuditEvents handles GET /v1/domains/:domain_id/audit.
+func (p *v1Provider) ListDomainAuditEvents(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "audit:show") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	p.listAuditEvents(w, r, dbDomain, nil)
+}
+
+//ListProjectAuditEvents handles GET /v1/domains/:domain_id/projects/:project_id/audit.
+func (p *v1Provider) ListProjectAuditEvents(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "audit:show") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	dbProject := p.FindProjectFromRequest(w, r, dbDomain)
+	if dbProject == nil {
+		return
+	}
+	p.listAuditEvents(w, r, dbDomain, dbProject)
+}
+
+func (p *v1Provider) listAuditEvents(w http.ResponseWriter, r *http.Request, dbDomain *db.Domain, dbProject *db.Project) {
+	query := r.URL.Query()
+	filter := reports.AuditEventFilter{
+		DomainUUIDs:   query["domain"],
+		ProjectUUIDs:  query["project"],
+		ServiceTypes:  query["service"],
+		ResourceNames: query["resource"],
+		Actions:       query["action"],
+		Users:         query["user"],
+	}
+	//the domain and project from the URL path take precedence over the query
+	if dbDomain != nil {
+		filter.DomainUUIDs = []string{dbDomain.UUID}
+	}
+	if dbProject != nil {
+		filter.ProjectUUIDs = []string{dbProject.UUID}
+	}
+
+	var ok bool
+	filter.Since, ok = readTimestampParam(w, r, "since")
+	if !ok {
+		return
+	}
+	filter.Until, ok = readTimestampParam(w, r, "until")
+	if !ok {
+		return
+	}
+
+	events, err := reports.GetAuditEvents(p.Cluster, db.DB, filter)
+	if ReturnError(w, err) {
+		return
+	}
+	if events == nil {
+		events = []*reports.AuditEvent{}
+	}
+	ReturnJSON(w, 200, map[string]interface{}{"events": events})
+}
@@ -21,9 +21,7 @@ package api
 
 import (
 	"database/sql"
-	"fmt"
 	"net/http"
-	"strings"
 
 	gorp "gopkg.in/gorp.v2"
 
@@ -31,6 +29,7 @@ import (
 	"github.com/sapcc/limes/pkg/db"
 	"github.com/sapcc/limes/pkg/limes"
 	"github.com/sapcc/limes/pkg/reports"
+	"github.com/sapcc/limes/pkg/validation"
 )
 
 //ListClusters handles GET /v1/clusters.
@@ -45,13 +44,25 @@ func (p *v1Provider) ListClusters(w http.ResponseWriter, r *http.Request) {
 	}
 	result.CurrentCluster = p.Cluster.ID
 
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
+	useCSV, ok := checkCSVFormat(w, r)
+	if !ok {
+		return
+	}
 	var err error
 	_, localQuotaUsageOnly := r.URL.Query()["local"]
-	result.Clusters, err = reports.GetClusters(p.Config, nil, localQuotaUsageOnly, db.DB, reports.ReadFilter(r))
+	result.Clusters, err = reports.GetClusters(p.Config, nil, localQuotaUsageOnly, db.DB, filter)
 	if ReturnError(w, err) {
 		return
 	}
 
+	if useCSV {
+		returnClustersCSV(w, result.Clusters)
+		return
+	}
 	ReturnJSON(w, 200, result)
 }
 
@@ -65,8 +76,16 @@ func (p *v1Provider) GetCluster(w http.ResponseWriter, r *http.Request) {
 	if clusterID == "current" {
 		clusterID = p.Cluster.ID
 	}
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
+	useCSV, ok := checkCSVFormat(w, r)
+	if !ok {
+		return
+	}
 	_, localQuotaUsageOnly := r.URL.Query()["local"]
-	clusters, err := reports.GetClusters(p.Config, &clusterID, localQuotaUsageOnly, db.DB, reports.ReadFilter(r))
+	clusters, err := reports.GetClusters(p.Config, &clusterID, localQuotaUsageOnly, db.DB, filter)
 	if ReturnError(w, err) {
 		return
 	}
@@ -75,12 +94,39 @@ func (p *v1Provider) GetCluster(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if useCSV {
+		returnClustersCSV(w, clusters)
+		return
+	}
 	ReturnJSON(w, 200, map[string]interface{}{"cluster": clusters[0]})
 }
 
+//ListScrapeErrors handles GET /v1/clusters/:cluster_id/scrape-errors.
+func (p *v1Provider) ListScrapeErrors(w http.ResponseWriter, r *http.Request) {
+	if !p.CheckToken(r).Require(w, "cluster:show") {
+		return
+	}
+	clusterID := mux.Vars(r)["cluster_id"]
+	if clusterID == "current" {
+		clusterID = p.Cluster.ID
+	}
+	cluster, exists := p.Config.Clusters[clusterID]
+	if !exists {
+		http.Error(w, "no such cluster", 404)
+		return
+	}
+
+	scrapeErrors, err := reports.GetScrapeErrors(cluster, db.DB)
+	if ReturnError(w, err) {
+		return
+	}
+	ReturnJSON(w, 200, map[string]interface{}{"scrape_errors": scrapeErrors})
+}
+
 //PutCluster handles PUT /v1/clusters/:cluster_id.
 func (p *v1Provider) PutCluster(w http.ResponseWriter, r *http.Request) {
-	if !p.CheckToken(r).Require(w, "cluster:edit") {
+	token := p.CheckToken(r)
+	if !token.Require(w, "cluster:edit") {
 		return
 	}
 
@@ -94,6 +140,10 @@ func (p *v1Provider) PutCluster(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no such cluster", 404)
 		return
 	}
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
 
 	//parse request body
 	var parseTarget struct {
@@ -112,14 +162,18 @@ func (p *v1Provider) PutCluster(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.RollbackUnlessCommitted(tx)
 
-	var errors []string
+	var (
+		updates  []clusterResourceUpdate
+		verdicts ResourceVerdicts
+	)
+	auditTrail := newAuditTrail(clusterID, token)
 
 	for _, srv := range parseTarget.Cluster.Services {
 		//check that this service is configured for this cluster
 		if !cluster.HasService(srv.Type) {
 			for _, res := range srv.Resources {
-				errors = append(errors,
-					fmt.Sprintf("cannot set %s/%s capacity: no such service", srv.Type, res.Name),
+				verdicts.reject(srv.Type, res.Name,
+					validation.NewResourceError(validation.ReasonNoSuchService, "cannot set %s/%s capacity: no such service", srv.Type, res.Name),
 				)
 			}
 			continue
@@ -134,22 +188,20 @@ func (p *v1Provider) PutCluster(w http.ResponseWriter, r *http.Request) {
 			//maintain capacity for the new service before CheckConsistency() has run
 			//(which should happen immediately when `limes collect` starts)
 			for _, res := range srv.Resources {
-				errors = append(errors,
-					fmt.Sprintf("cannot set %s/%s capacity: no such service", srv.Type, res.Name),
+				verdicts.reject(srv.Type, res.Name,
+					validation.NewResourceError(validation.ReasonNoSuchService, "cannot set %s/%s capacity: no such service", srv.Type, res.Name),
 				)
 			}
 			continue
 		}
 
 		for _, res := range srv.Resources {
-			msg, err := writeClusterResource(tx, cluster, srv, service, res)
+			update, err := prepareClusterResourceUpdate(tx, cluster, srv, service, res, &auditTrail, &verdicts)
 			if ReturnError(w, err) {
 				return
 			}
-			if msg != "" {
-				errors = append(errors,
-					fmt.Sprintf("cannot set %s/%s capacity: %s", srv.Type, res.Name, msg),
-				)
+			if update != nil {
+				updates = append(updates, *update)
 			}
 		}
 
@@ -157,18 +209,52 @@ func (p *v1Provider) PutCluster(w http.ResponseWriter, r *http.Request) {
 		//cluster_services record, cleanup the cluster_services record, too
 	}
 
-	//if not legal, report errors to the user
+	//if not legal, report errors to the user (in dry-run mode, the errors are
+	//reported as part of the verdicts below)
+	dryRun := isDryRun(r)
+	errors := verdicts.Errors()
 	if len(errors) > 0 {
-		http.Error(w, strings.Join(errors, "\n"), 422)
+		if !dryRun {
+			returnVerdictErrors(w, r, "", verdicts)
+			return
+		}
+		updates = nil //nothing would be applied
+	}
+
+	//update the DB with the new capacities
+	for _, update := range updates {
+		err := update.Apply(tx)
+		if ReturnError(w, err) {
+			return
+		}
+	}
+
+	//in dry-run mode, report the resulting state and roll back the transaction
+	if dryRun {
+		clusters, err := reports.GetClusters(p.Config, &clusterID, false, tx, filter)
+		if ReturnError(w, err) {
+			return
+		}
+		if len(clusters) == 0 {
+			http.Error(w, "no resource data found for cluster", 500)
+			return
+		}
+		ReturnJSON(w, dryRunStatusCode(errors), map[string]interface{}{"cluster": clusters[0], "verdicts": verdicts})
+		return
+	}
+
+	err = auditTrail.Write(tx)
+	if ReturnError(w, err) {
 		return
 	}
 	err = tx.Commit()
 	if ReturnError(w, err) {
 		return
 	}
+	auditTrail.Commit()
 
 	//otherwise, report success
-	clusters, err := reports.GetClusters(p.Config, &clusterID, false, db.DB, reports.ReadFilter(r))
+	clusters, err := reports.GetClusters(p.Config, &clusterID, false, db.DB, filter)
 	if ReturnError(w, err) {
 		return
 	}
@@ -199,9 +285,41 @@ func findClusterService(tx *gorp.Transaction, srv ServiceCapacities, clusterID s
 	return service, nil
 }
 
-func writeClusterResource(tx *gorp.Transaction, cluster *limes.Cluster, srv ServiceCapacities, service *db.ClusterService, res ResourceCapacity) (validationError string, internalError error) {
+//clusterResourceUpdate describes a pending change to a cluster_resources
+//record, as prepared by prepareClusterResourceUpdate().
+type clusterResourceUpdate struct {
+	Resource *db.ClusterResource
+	IsNew    bool
+	IsDelete bool
+}
+
+//Apply writes the pending change into the database.
+func (u clusterResourceUpdate) Apply(tx *gorp.Transaction) error {
+	switch {
+	case u.IsNew:
+		return tx.Insert(u.Resource)
+	case u.IsDelete:
+		_, err := tx.Delete(u.Resource)
+		return err
+	default:
+		_, err := tx.Update(u.Resource)
+		return err
+	}
+}
+
+//prepareClusterResourceUpdate validates the requested capacity for a single
+//resource and records the verdict. If the capacity is acceptable and differs
+//from the current value, the necessary change to the DB is returned.
+func prepareClusterResourceUpdate(tx *gorp.Transaction, cluster *limes.Cluster, srv ServiceCapacities, service *db.ClusterService, res ResourceCapacity, auditTrail *db.AuditTrail, verdicts *ResourceVerdicts) (*clusterResourceUpdate, error) {
+	reject := func(code, msg string) (*clusterResourceUpdate, error) {
+		verdicts.reject(srv.Type, res.Name,
+			validation.NewResourceError(code, "cannot set %s/%s capacity: %s", srv.Type, res.Name, msg),
+		)
+		return nil, nil
+	}
+
 	if !cluster.HasResource(srv.Type, res.Name) {
-		return "no such resource", nil
+		return reject(validation.ReasonNoSuchResource, "no such resource")
 	}
 
 	//load existing resource record, if any
@@ -214,21 +332,26 @@ func writeClusterResource(tx *gorp.Transaction, cluster *limes.Cluster, srv Serv
 		if err == sql.ErrNoRows {
 			resource = nil
 		} else {
-			return "", err
+			return nil, err
 		}
 	}
 
 	//easiest case: if deletion is requested and the record is deleted, we're done
 	if resource == nil && res.Capacity < 0 {
-		return "", nil
+		*verdicts = append(*verdicts, ResourceVerdict{
+			ServiceType:  srv.Type,
+			ResourceName: res.Name,
+			Verdict:      verdictUnchanged,
+		})
+		return nil, nil
 	}
 
 	//validation
 	if resource != nil && resource.Comment == "" {
-		return "capacity for this resource is maintained automatically", nil
+		return reject(validation.ReasonCapacityAutomatic, "capacity for this resource is maintained automatically")
 	}
 	if res.Capacity >= 0 && res.Comment == "" {
-		return "comment is missing", nil
+		return reject(validation.ReasonCommentMissing, "comment is missing")
 	}
 
 	//convert to target unit if required
@@ -242,10 +365,35 @@ func writeClusterResource(tx *gorp.Transaction, cluster *limes.Cluster, srv Serv
 		inputValue := limes.ValueWithUnit{Value: uint64(res.Capacity), Unit: inputUnit}
 		newCapacity, err = inputValue.ConvertFor(cluster, srv.Type, res.Name)
 		if err != nil {
-			return err.Error(), nil
+			return reject(validation.ReasonInvalidValue, err.Error())
 		}
 	}
 
+	//nothing to do if neither capacity nor comment change
+	if resource != nil && res.Capacity >= 0 && resource.Capacity == newCapacity && resource.Comment == res.Comment {
+		verdicts.unchanged(srv.Type, res.Name, newCapacity)
+		return nil, nil
+	}
+
+	//record the change in the audit trail
+	event := db.AuditEvent{
+		ServiceType:  srv.Type,
+		ResourceName: res.Name,
+		Action:       db.AuditActionSetCapacity,
+	}
+	if resource != nil {
+		oldCapacity := resource.Capacity
+		event.OldValue = &oldCapacity
+	}
+	if res.Capacity >= 0 {
+		event.NewValue = &newCapacity
+	}
+	auditTrail.Add(event, "set capacity %s.%s = %s -> %s for cluster %s by user %s (%s)",
+		srv.Type, res.Name, formatAuditValue(event.OldValue), formatAuditValue(event.NewValue),
+		auditTrail.ClusterID, auditTrail.UserUUID, auditTrail.UserName,
+	)
+	verdicts.accept(srv.Type, res.Name, event.OldValue, event.NewValue)
+
 	switch {
 	case resource == nil:
 		//need to insert
@@ -255,16 +403,14 @@ func writeClusterResource(tx *gorp.Transaction, cluster *limes.Cluster, srv Serv
 			Capacity:  newCapacity,
 			Comment:   res.Comment,
 		}
-		return "", tx.Insert(resource)
+		return &clusterResourceUpdate{Resource: resource, IsNew: true}, nil
 	case res.Capacity < 0:
 		//need to delete
-		_, err := tx.Delete(resource)
-		return "", err
+		return &clusterResourceUpdate{Resource: resource, IsDelete: true}, nil
 	default:
 		//need to update
 		resource.Capacity = newCapacity
 		resource.Comment = res.Comment
-		_, err := tx.Update(resource)
-		return "", err
+		return &clusterResourceUpdate{Resource: resource}, nil
 	}
 }
@@ -25,10 +25,14 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sapcc/limes/pkg/db"
 	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/reports"
+	"github.com/sapcc/limes/pkg/util"
 )
 
 //VersionData is used by version advertisement handlers.
@@ -46,20 +50,62 @@ type VersionLinkData struct {
 	Type     string `json:"type,omitempty"`
 }
 
+//timeNow is replaced by unit tests to obtain reproducible timestamps.
+var timeNow = time.Now
+
 type v1Provider struct {
 	Cluster     *limes.Cluster
 	Config      limes.Configuration
 	VersionData VersionData
+	tokenCache  *tokenCache
+}
+
+//V1Router is the http.Handler that serves the Limes v1 API. Its
+//configuration can be replaced at runtime by calling Reload().
+type V1Router struct {
+	handler    atomic.Value //contains http.Handler
+	tokenCache *tokenCache
+	tokenCfg   limes.TokenCacheConfiguration
 }
 
 //NewV1Router creates a http.Handler that serves the Limes v1 API.
 //It also returns the VersionData for this API version which is needed for the
 //version advertisement on "GET /".
-func NewV1Router(cluster *limes.Cluster, config limes.Configuration) (http.Handler, VersionData) {
+func NewV1Router(cluster *limes.Cluster, config limes.Configuration) (*V1Router, VersionData) {
+	router := &V1Router{
+		tokenCache: newTokenCache(cluster.ID, cluster.Config.Auth, config.API.TokenCache),
+		tokenCfg:   config.API.TokenCache,
+	}
+	handler, versionData := router.buildHandler(cluster, config)
+	router.handler.Store(handler)
+	return router, versionData
+}
+
+//ServeHTTP implements the http.Handler interface.
+func (router *V1Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	router.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+//Reload atomically replaces the cluster and configuration used by this
+//router, including the policy enforcer. Requests that are already in
+//progress are completed with the previous configuration. The token cache
+//retains its contents; changes to its configuration only take effect after a
+//restart.
+func (router *V1Router) Reload(cluster *limes.Cluster, config limes.Configuration) {
+	if config.API.TokenCache != router.tokenCfg {
+		util.LogError("changes to api.token_cache will only take effect after a restart")
+	}
+	router.tokenCache.SetValidator(cluster.Config.Auth)
+	handler, _ := router.buildHandler(cluster, config)
+	router.handler.Store(handler)
+}
+
+func (router *V1Router) buildHandler(cluster *limes.Cluster, config limes.Configuration) (http.Handler, VersionData) {
 	r := mux.NewRouter()
 	p := &v1Provider{
-		Cluster: cluster,
-		Config:  config,
+		Cluster:    cluster,
+		Config:     config,
+		tokenCache: router.tokenCache,
 	}
 	p.VersionData = VersionData{
 		Status: "CURRENT",
@@ -84,19 +130,43 @@ func NewV1Router(cluster *limes.Cluster, config limes.Configuration) (http.Handl
 	r.Methods("GET").Path("/v1/clusters").HandlerFunc(p.ListClusters)
 	r.Methods("GET").Path("/v1/clusters/{cluster_id}").HandlerFunc(p.GetCluster)
 	r.Methods("PUT").Path("/v1/clusters/{cluster_id}").HandlerFunc(p.PutCluster)
+	r.Methods("GET").Path("/v1/clusters/{cluster_id}/history").HandlerFunc(p.GetClusterHistory)
+	r.Methods("GET").Path("/v1/clusters/{cluster_id}/scrape-errors").HandlerFunc(p.ListScrapeErrors)
 
 	r.Methods("GET").Path("/v1/domains").HandlerFunc(p.ListDomains)
 	r.Methods("GET").Path("/v1/domains/{domain_id}").HandlerFunc(p.GetDomain)
 	r.Methods("POST").Path("/v1/domains/discover").HandlerFunc(p.DiscoverDomains)
 	r.Methods("PUT").Path("/v1/domains/{domain_id}").HandlerFunc(p.PutDomain)
+	r.Methods("GET").Path("/v1/domains/{domain_id}/history").HandlerFunc(p.GetDomainHistory)
 
 	r.Methods("GET").Path("/v1/domains/{domain_id}/projects").HandlerFunc(p.ListProjects)
+	r.Methods("PUT").Path("/v1/domains/{domain_id}/projects").HandlerFunc(p.PutProjects)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/quota-transfers").HandlerFunc(p.PostQuotaTransfer)
 	r.Methods("GET").Path("/v1/domains/{domain_id}/projects/{project_id}").HandlerFunc(p.GetProject)
 	r.Methods("POST").Path("/v1/domains/{domain_id}/projects/discover").HandlerFunc(p.DiscoverProjects)
 	r.Methods("POST").Path("/v1/domains/{domain_id}/projects/{project_id}/sync").HandlerFunc(p.SyncProject)
 	r.Methods("PUT").Path("/v1/domains/{domain_id}/projects/{project_id}").HandlerFunc(p.PutProject)
+	r.Methods("GET").Path("/v1/domains/{domain_id}/projects/{project_id}/history").HandlerFunc(p.GetProjectHistory)
+
+	r.Methods("GET").Path("/v1/audit").HandlerFunc(p.ListAuditEvents)
+	r.Methods("GET").Path("/v1/domains/{domain_id}/audit").HandlerFunc(p.ListDomainAuditEvents)
+	r.Methods("GET").Path("/v1/domains/{domain_id}/projects/{project_id}/audit").HandlerFunc(p.ListProjectAuditEvents)
+
+	r.Methods("GET").Path("/v1/requests").HandlerFunc(p.ListQuotaRequests)
+	r.Methods("GET").Path("/v1/domains/{domain_id}/requests").HandlerFunc(p.ListDomainQuotaRequests)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/requests").HandlerFunc(p.PostDomainQuotaRequest)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/requests/{request_id}/approve").HandlerFunc(p.ApproveDomainQuotaRequest)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/requests/{request_id}/reject").HandlerFunc(p.RejectDomainQuotaRequest)
+	r.Methods("GET").Path("/v1/domains/{domain_id}/projects/{project_id}/requests").HandlerFunc(p.ListProjectQuotaRequests)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/projects/{project_id}/requests").HandlerFunc(p.PostProjectQuotaRequest)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/projects/{project_id}/requests/{request_id}/approve").HandlerFunc(p.ApproveProjectQuotaRequest)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/projects/{project_id}/requests/{request_id}/reject").HandlerFunc(p.RejectProjectQuotaRequest)
 
-	return r, p.VersionData
+	r.Methods("GET").Path("/v1/domains/{domain_id}/scheduled-changes").HandlerFunc(p.ListScheduledChanges)
+	r.Methods("POST").Path("/v1/domains/{domain_id}/scheduled-changes").HandlerFunc(p.PostScheduledChange)
+	r.Methods("DELETE").Path("/v1/domains/{domain_id}/scheduled-changes/{change_id}").HandlerFunc(p.CancelScheduledChange)
+
+	return errorFormatHandler{r}, p.VersionData
 }
 
 //ReturnJSON is a convenience function for HTTP handlers returning JSON data.
@@ -134,6 +204,17 @@ func RequireJSON(w http.ResponseWriter, r *http.Request, data interface{}) bool
 	return true
 }
 
+//readFilter parses the report filter from the request's query parameters, or
+//writes an error response if that fails.
+func readFilter(w http.ResponseWriter, r *http.Request) (reports.Filter, bool) {
+	filter, err := reports.ReadFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return filter, false
+	}
+	return filter, true
+}
+
 //Path constructs a full URL for a given URL path below the /v1/ endpoint.
 func (p *v1Provider) Path(elements ...string) string {
 	parts := []string{
@@ -149,14 +230,31 @@ func (p *v1Provider) Path(elements ...string) string {
 //no such header). Any errors will be written into the response immediately and
 //cause a nil return value.
 func (p *v1Provider) FindClusterFromRequest(w http.ResponseWriter, r *http.Request, token *Token) *limes.Cluster {
+	return p.findClusterFromRequest(w, r, token, "foreign:read")
+}
+
+//FindClusterFromRequestForWrite is like FindClusterFromRequest, but requires
+//the "foreign:write" permission for foreign clusters. It is used by handlers
+//that modify data in the target cluster, so the foreign cluster must also have
+//been connected to at startup.
+func (p *v1Provider) FindClusterFromRequestForWrite(w http.ResponseWriter, r *http.Request, token *Token) *limes.Cluster {
+	cluster := p.findClusterFromRequest(w, r, token, "foreign:write")
+	if cluster != nil && cluster != p.Cluster && cluster.ProviderClient() == nil {
+		http.Error(w, "cannot write to cluster "+cluster.ID+": not connected", 503)
+		return nil
+	}
+	return cluster
+}
+
+func (p *v1Provider) findClusterFromRequest(w http.ResponseWriter, r *http.Request, token *Token, rule string) *limes.Cluster {
 	//use current cluster if nothing else specified
 	clusterID := r.Header.Get("X-Limes-Cluster-Id")
 	if clusterID == "" || clusterID == p.Cluster.ID {
 		return p.Cluster
 	}
 
-	//if foreign cluster specified, user needs permission to read it
-	if !token.Require(w, "foreign:read") {
+	//if foreign cluster specified, user needs permission to access it
+	if !token.Require(w, rule) {
 		return nil
 	}
 
@@ -0,0 +1,273 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/reports"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//checkCSVFormat decides whether a report shall be rendered as CSV instead of
+//JSON. CSV is chosen when requested with "?format=csv", or when the Accept
+//header ranks text/csv higher than application/json. If the "format" query
+//parameter is invalid, an error response is written and false is returned.
+func checkCSVFormat(w http.ResponseWriter, r *http.Request) (useCSV bool, ok bool) {
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		return true, true
+	case "json":
+		return false, true
+	case "":
+		qualities := acceptQualities(r)
+		return qualities["text/csv"] > qualities["application/json"], true
+	default:
+		http.Error(w, `invalid value for "format" (expected "csv" or "json")`, 400)
+		return false, false
+	}
+}
+
+//how many domains or projects are loaded from the DB at once when rendering a
+//CSV report
+var csvBatchSize = 100
+
+//csvReportWriter streams a CSV report into an http.ResponseWriter. The report
+//is loaded from the DB in batches of csvBatchSize objects, and the output is
+//flushed to the client after each batch, so that large reports do not need to
+//be built up in memory.
+//
+//The response status and header row are only sent with the first row (or by
+//Finish()), so errors that occur while loading the first batch can still be
+//reported with a proper error response.
+type csvReportWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	header  []string
+	started bool
+	err     error
+}
+
+func newCSVReportWriter(w http.ResponseWriter, header ...string) *csvReportWriter {
+	return &csvReportWriter{w: w, csv: csv.NewWriter(w), header: header}
+}
+
+func (cw *csvReportWriter) start() {
+	if cw.started {
+		return
+	}
+	cw.started = true
+	cw.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw.w.WriteHeader(200)
+	cw.err = cw.csv.Write(cw.header)
+}
+
+//Write adds a single row to the report. Errors are deferred until Flush().
+func (cw *csvReportWriter) Write(fields ...string) {
+	cw.start()
+	if cw.err == nil {
+		cw.err = cw.csv.Write(fields)
+	}
+}
+
+//Flush sends all buffered rows to the client.
+func (cw *csvReportWriter) Flush() error {
+	cw.start()
+	cw.csv.Flush()
+	if cw.err == nil {
+		cw.err = cw.csv.Error()
+	}
+	if flusher, ok := cw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return cw.err
+}
+
+//Finish completes the report. The argument is the error (if any) that
+//occurred while loading the report. If no output has been sent yet, it is
+//reported as an error response. Otherwise, the status code cannot be changed
+//anymore, so the error is only logged and the report is cut short.
+func (cw *csvReportWriter) Finish(err error) {
+	if err == nil {
+		err = cw.Flush()
+		if err != nil {
+			util.LogError("could not write CSV report: %s", err.Error())
+		}
+		return
+	}
+	if cw.started {
+		util.LogError("could not complete CSV report: %s", err.Error())
+		return
+	}
+	if err == reports.ErrInvalidMarker {
+		http.Error(cw.w, err.Error(), 400)
+		return
+	}
+	ReturnError(cw.w, err)
+}
+
+//returnClustersCSV renders one row per (cluster, service, resource).
+func returnClustersCSV(w http.ResponseWriter, clusters []*reports.Cluster) {
+	cw := newCSVReportWriter(w,
+		"cluster_id", "service", "resource", "unit",
+		"capacity", "domains_quota", "usage", "min_scraped_at", "max_scraped_at",
+	)
+	for _, cluster := range clusters {
+		for _, serviceType := range sortedKeys(cluster.Services) {
+			service := cluster.Services[serviceType]
+			for _, resourceName := range sortedKeys(service.Resources) {
+				resource := service.Resources[resourceName]
+				capacity := ""
+				if resource.Capacity != nil {
+					capacity = formatUint(*resource.Capacity)
+				}
+				cw.Write(
+					cluster.ID, serviceType, resourceName, string(resource.Unit),
+					capacity, formatUint(resource.DomainsQuota), formatUint(resource.Usage),
+					formatTimestamp(service.MinScrapedAt), formatTimestamp(service.MaxScrapedAt),
+				)
+			}
+		}
+	}
+	cw.Finish(nil)
+}
+
+//returnDomainsCSV renders one row per (domain, service, resource). The domain
+//reports are obtained in batches from the given function (usually a closure
+//around reports.ForeachDomainBatch), and each batch is sent to the client
+//before the next one is loaded.
+func returnDomainsCSV(w http.ResponseWriter, foreachBatch func(func([]*reports.Domain) error) error) {
+	cw := newCSVReportWriter(w,
+		"domain_id", "domain_name", "service", "resource", "unit",
+		"quota", "projects_quota", "usage", "backend_quota", "min_scraped_at", "max_scraped_at",
+	)
+	cw.Finish(foreachBatch(func(domains []*reports.Domain) error {
+		writeDomainsCSV(cw, domains)
+		return cw.Flush()
+	}))
+}
+
+func writeDomainsCSV(cw *csvReportWriter, domains []*reports.Domain) {
+	for _, domain := range domains {
+		for _, serviceType := range sortedKeys(domain.Services) {
+			service := domain.Services[serviceType]
+			for _, resourceName := range sortedKeys(service.Resources) {
+				resource := service.Resources[resourceName]
+				backendQuota := formatUint(resource.AllProjectsQuota)
+				if resource.InfiniteBackendQuota != nil && *resource.InfiniteBackendQuota {
+					backendQuota = "-1"
+				} else if resource.BackendQuota != nil {
+					backendQuota = formatUint(*resource.BackendQuota)
+				}
+				cw.Write(
+					domain.UUID, domain.Name, serviceType, resourceName, string(resource.Unit),
+					formatUint(resource.DomainQuota), formatUint(resource.ProjectsQuota), formatUint(resource.Usage),
+					backendQuota, formatTimestamp(service.MinScrapedAt), formatTimestamp(service.MaxScrapedAt),
+				)
+			}
+		}
+	}
+}
+
+//returnProjectsCSV renders one row per (project, service, resource). The
+//project reports are obtained in batches from the given function (usually a
+//closure around reports.ForeachProjectBatch), and each batch is sent to the
+//client before the next one is loaded.
+func returnProjectsCSV(w http.ResponseWriter, domain *db.Domain, foreachBatch func(func([]*reports.Project) error) error) {
+	cw := newCSVReportWriter(w,
+		"domain_id", "domain_name", "project_id", "project_name", "service", "resource", "unit",
+		"quota", "usage", "backend_quota", "scraped_at",
+	)
+	cw.Finish(foreachBatch(func(projects []*reports.Project) error {
+		writeProjectsCSV(cw, domain, projects)
+		return cw.Flush()
+	}))
+}
+
+func writeProjectsCSV(cw *csvReportWriter, domain *db.Domain, projects []*reports.Project) {
+	for _, project := range projects {
+		for _, serviceType := range sortedKeys(project.Services) {
+			service := project.Services[serviceType]
+			for _, resourceName := range sortedKeys(service.Resources) {
+				resource := service.Resources[resourceName]
+				backendQuota := formatUint(resource.Quota)
+				if resource.BackendQuota != nil {
+					backendQuota = strconv.FormatInt(*resource.BackendQuota, 10)
+				}
+				cw.Write(
+					domain.UUID, domain.Name, project.UUID, project.Name, serviceType, resourceName, string(resource.Unit),
+					formatUint(resource.Quota), formatUint(resource.Usage), backendQuota, formatTimestamp(service.ScrapedAt),
+				)
+			}
+		}
+	}
+}
+
+//sortedKeys returns the keys of one of the Services or Resources maps from
+//package reports in a stable order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case reports.ClusterServices:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case reports.ClusterResources:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case reports.DomainServices:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case reports.DomainResources:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case reports.ProjectServices:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case reports.ProjectResources:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatUint(value uint64) string {
+	return strconv.FormatUint(value, 10)
+}
+
+//formatTimestamp renders a UNIX timestamp in a format that spreadsheet
+//applications understand. Zero timestamps (i.e. "never") become empty cells.
+func formatTimestamp(value int64) string {
+	if value == 0 {
+		return ""
+	}
+	return time.Unix(value, 0).UTC().Format(time.RFC3339)
+}
@@ -20,9 +20,8 @@
 package api
 
 import (
-	"fmt"
 	"net/http"
-	"strings"
+	"sort"
 
 	gorp "gopkg.in/gorp.v2"
 
@@ -31,6 +30,7 @@ import (
 	"github.com/sapcc/limes/pkg/limes"
 	"github.com/sapcc/limes/pkg/reports"
 	"github.com/sapcc/limes/pkg/util"
+	"github.com/sapcc/limes/pkg/validation"
 )
 
 //ListDomains handles GET /v1/domains.
@@ -44,11 +44,29 @@ func (p *v1Provider) ListDomains(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domains, err := reports.GetDomains(cluster, nil, db.DB, reports.ReadFilter(r))
-	if ReturnError(w, err) {
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
+	useCSV, ok := checkCSVFormat(w, r)
+	if !ok {
+		return
+	}
+	if useCSV {
+		returnDomainsCSV(w, func(callback func([]*reports.Domain) error) error {
+			return reports.ForeachDomainBatch(cluster, db.DB, filter, csvBatchSize, callback)
+		})
 		return
 	}
 
+	domains, err := reports.GetDomains(cluster, nil, db.DB, filter)
+	if err == reports.ErrInvalidMarker {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if ReturnError(w, err) {
+		return
+	}
 	ReturnJSON(w, 200, map[string]interface{}{"domains": domains})
 }
 
@@ -67,7 +85,15 @@ func (p *v1Provider) GetDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domains, err := reports.GetDomains(cluster, &dbDomain.ID, db.DB, reports.ReadFilter(r))
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
+	useCSV, ok := checkCSVFormat(w, r)
+	if !ok {
+		return
+	}
+	domains, err := reports.GetDomains(cluster, &dbDomain.ID, db.DB, filter)
 	if ReturnError(w, err) {
 		return
 	}
@@ -75,17 +101,33 @@ func (p *v1Provider) GetDomain(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no resource data found for domain", 500)
 		return
 	}
+	if useCSV {
+		returnDomainsCSV(w, func(callback func([]*reports.Domain) error) error {
+			return callback(domains)
+		})
+		return
+	}
+	etag, err := domainETag(db.DB, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
 
+	w.Header().Set("ETag", etag)
 	ReturnJSON(w, 200, map[string]interface{}{"domain": domains[0]})
 }
 
 //DiscoverDomains handles POST /v1/domains/discover.
 func (p *v1Provider) DiscoverDomains(w http.ResponseWriter, r *http.Request) {
-	if !p.CheckToken(r).Require(w, "domain:discover") {
+	token := p.CheckToken(r)
+	if !token.Require(w, "domain:discover") {
+		return
+	}
+	cluster := p.FindClusterFromRequestForWrite(w, r, token)
+	if cluster == nil {
 		return
 	}
 
-	newDomainUUIDs, err := collector.ScanDomains(p.Cluster, collector.ScanDomainsOpts{})
+	newDomainUUIDs, err := collector.ScanDomains(cluster, collector.ScanDomainsOpts{})
 	if ReturnError(w, err) {
 		return
 	}
@@ -106,11 +148,19 @@ func (p *v1Provider) PutDomain(w http.ResponseWriter, r *http.Request) {
 		token.Require(w, "domain:raise") //produce standard Unauthorized response
 		return
 	}
+	cluster := p.FindClusterFromRequestForWrite(w, r, token)
+	if cluster == nil {
+		return
+	}
 
-	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	dbDomain := p.FindDomainFromRequest(w, r, cluster)
 	if dbDomain == nil {
 		return
 	}
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
 
 	//parse request body
 	var parseTarget struct {
@@ -131,8 +181,23 @@ func (p *v1Provider) PutDomain(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.RollbackUnlessCommitted(tx)
 
+	//if the client sent an ETag, the quotas must not have changed since the
+	//client read them (the lock ensures that they also do not change until we
+	//have written the new quotas)
+	err = lockDomainQuotas(tx, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
+	etag, err := domainETag(tx, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
+	if !checkIfMatch(w, r, etag) {
+		return
+	}
+
 	//gather a report on the domain's quotas to decide whether a quota update is legal
-	domainReports, err := reports.GetDomains(p.Cluster, &dbDomain.ID, db.DB, reports.Filter{})
+	domainReports, err := reports.GetDomains(cluster, &dbDomain.ID, db.DB, reports.Filter{})
 	if ReturnError(w, err) {
 		return
 	}
@@ -143,17 +208,96 @@ func (p *v1Provider) PutDomain(w http.ResponseWriter, r *http.Request) {
 	domainReport := domainReports[0]
 
 	//check all services for resources to update
-	var services []db.DomainService
-	_, err = tx.Select(&services,
-		`SELECT * FROM domain_services WHERE domain_id = $1 ORDER BY type`, dbDomain.ID)
+	updates, verdicts, err := prepareDomainQuotaUpdates(tx, cluster, dbDomain, domainReport, serviceQuotas, canRaise, canLower)
+	if ReturnError(w, err) {
+		return
+	}
+
+	//if not legal, report errors to the user (in dry-run mode, the errors are
+	//reported as part of the verdicts below)
+	dryRun := isDryRun(r)
+	errors := verdicts.Errors()
+	if len(errors) > 0 {
+		if !dryRun {
+			returnVerdictErrors(w, r, "", verdicts)
+			return
+		}
+		updates = nil //nothing would be applied
+	}
+
+	//update the DB with the new quotas
+	auditTrail := newAuditTrail(cluster.ID, token)
+	addDomainQuotaUpdatesToAuditTrail(&auditTrail, dbDomain, updates)
+	err = applyDomainQuotaUpdates(tx, updates)
+	if returnQuotaUpdateError(w, err) {
+		return
+	}
+
+	//in dry-run mode, report the resulting state and roll back the transaction
+	if dryRun {
+		domains, err := reports.GetDomains(cluster, &dbDomain.ID, tx, filter)
+		if ReturnError(w, err) {
+			return
+		}
+		if len(domains) == 0 {
+			http.Error(w, "no resource data found for domain", 500)
+			return
+		}
+		ReturnJSON(w, dryRunStatusCode(errors), map[string]interface{}{"domain": domains[0], "verdicts": verdicts})
+		return
+	}
+
+	err = auditTrail.Write(tx)
+	if ReturnError(w, err) {
+		return
+	}
+	err = tx.Commit()
 	if ReturnError(w, err) {
 		return
 	}
-	var resourcesToUpdate []db.DomainResource
-	var resourcesToUpdateAsUntyped []interface{}
-	var errors []string
+	auditTrail.Commit()
+
+	//otherwise, report success
+	domains, err := reports.GetDomains(cluster, &dbDomain.ID, db.DB, filter)
+	if ReturnError(w, err) {
+		return
+	}
+	if len(domains) == 0 {
+		http.Error(w, "no resource data found for domain", 500)
+		return
+	}
+	etag, err = domainETag(db.DB, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	ReturnJSON(w, 200, map[string]interface{}{"domain": domains[0]})
+}
+
+//domainQuotaUpdate describes a single change to a domain resource's quota
+//that has been validated by prepareDomainQuotaUpdates(), but has not been
+//written into the DB yet.
+type domainQuotaUpdate struct {
+	Service  db.DomainService
+	Resource db.DomainResource //contains the new quota value
+	OldQuota uint64
+	//IsNew is true if the domain_resources record does not exist yet.
+	IsNew bool
+}
+
+//prepareDomainQuotaUpdates checks which of the requested quota values differ
+//from the current quotas of the given domain, and whether these changes are
+//legal. The outcome of the validation is returned as a list of verdicts; only
+//DB errors cause a non-nil error return.
+func prepareDomainQuotaUpdates(tx *gorp.Transaction, cluster *limes.Cluster, domain *db.Domain, domainReport *reports.Domain, serviceQuotas ServiceQuotas, canRaise, canLower bool) (updates []domainQuotaUpdate, verdicts ResourceVerdicts, err error) {
+	var services []db.DomainService
+	_, err = tx.Select(&services,
+		`SELECT * FROM domain_services WHERE domain_id = $1 ORDER BY type`, domain.ID)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var auditTrail util.AuditTrail
 	for _, srv := range services {
 		resourceQuotas, exists := serviceQuotas[srv.Type]
 		if !exists {
@@ -165,8 +309,8 @@ func (p *v1Provider) PutDomain(w http.ResponseWriter, r *http.Request) {
 		var resources []db.DomainResource
 		_, err = tx.Select(&resources,
 			`SELECT * FROM domain_resources WHERE service_id = $1 ORDER BY name`, srv.ID)
-		if ReturnError(w, err) {
-			return
+		if err != nil {
+			return nil, nil, err
 		}
 		for _, res := range resources {
 			isExistingResource[res.Name] = true
@@ -174,49 +318,56 @@ func (p *v1Provider) PutDomain(w http.ResponseWriter, r *http.Request) {
 			if !exists {
 				continue
 			}
-			newQuota, err := newQuotaInput.ConvertFor(p.Cluster, srv.Type, res.Name)
+			if newQuotaInput.ExpiresAt != nil {
+				verdicts.reject(srv.Type, res.Name, validation.NewResourceError(validation.ReasonExpiryNotSupported, "cannot change %s/%s quota: expiry is only supported for project quotas", srv.Type, res.Name))
+				continue
+			}
+			newQuota, err := newQuotaInput.ConvertFor(cluster, srv.Type, res.Name)
 			if err != nil {
-				errors = append(errors, fmt.Sprintf("cannot change %s/%s quota: %s", srv.Type, res.Name, err.Error()))
+				verdicts.reject(srv.Type, res.Name, validation.NewResourceError(validation.ReasonInvalidValue, "cannot change %s/%s quota: %s", srv.Type, res.Name, err.Error()))
 				continue
 			}
 			if res.Quota == newQuota {
+				verdicts.unchanged(srv.Type, res.Name, newQuota)
 				continue //nothing to do
 			}
 
 			err = checkDomainQuotaUpdate(srv, res, domainReport, newQuota, canRaise, canLower)
 			if err != nil {
-				errors = append(errors, err.Error())
+				verdicts.reject(srv.Type, res.Name, err)
 				continue
 			}
 
-			//take a copy of the loop variable (it will be updated by the loop, so if
-			//we didn't take a copy manually, the resourcesToUpdateAsUntyped list
-			//would contain only identical pointers)
-			res := res
-			auditTrail.Add("set quota %s.%s = %d -> %d for domain %s by user %s (%s)",
-				srv.Type, res.Name, res.Quota, newQuota,
-				dbDomain.UUID, token.UserUUID, token.UserName,
-			)
-			res.Quota = newQuota
-			resourcesToUpdate = append(resourcesToUpdate, res)
-			resourcesToUpdateAsUntyped = append(resourcesToUpdateAsUntyped, &res)
+			update := domainQuotaUpdate{Service: srv, Resource: res, OldQuota: res.Quota}
+			update.Resource.Quota = newQuota
+			updates = append(updates, update)
+			verdicts.accept(srv.Type, res.Name, &update.OldQuota, &update.Resource.Quota)
 		}
 
-		//check resources that need to be created
-		for resourceName, newQuotaInput := range resourceQuotas {
-			if isExistingResource[resourceName] {
-				continue
+		//check resources that need to be created (in a stable order to keep the
+		//error messages and the audit trail reproducible)
+		var resourceNames []string
+		for resourceName := range resourceQuotas {
+			if !isExistingResource[resourceName] {
+				resourceNames = append(resourceNames, resourceName)
 			}
-			if !p.Cluster.HasResource(srv.Type, resourceName) {
-				errors = append(errors,
-					fmt.Sprintf("cannot set %s/%s quota: no such resource", srv.Type, resourceName),
+		}
+		sort.Strings(resourceNames)
+		for _, resourceName := range resourceNames {
+			if !cluster.HasResource(srv.Type, resourceName) {
+				verdicts.reject(srv.Type, resourceName,
+					validation.NewResourceError(validation.ReasonNoSuchResource, "cannot set %s/%s quota: no such resource", srv.Type, resourceName),
 				)
 				continue
 			}
 
-			newQuota, err := newQuotaInput.ConvertFor(p.Cluster, srv.Type, resourceName)
+			if resourceQuotas[resourceName].ExpiresAt != nil {
+				verdicts.reject(srv.Type, resourceName, validation.NewResourceError(validation.ReasonExpiryNotSupported, "cannot set %s/%s quota: expiry is only supported for project quotas", srv.Type, resourceName))
+				continue
+			}
+			newQuota, err := resourceQuotas[resourceName].ConvertFor(cluster, srv.Type, resourceName)
 			if err != nil {
-				errors = append(errors, fmt.Sprintf("cannot change %s/%s quota: %s", srv.Type, resourceName, err.Error()))
+				verdicts.reject(srv.Type, resourceName, validation.NewResourceError(validation.ReasonInvalidValue, "cannot change %s/%s quota: %s", srv.Type, resourceName, err.Error()))
 				continue
 			}
 
@@ -227,53 +378,69 @@ func (p *v1Provider) PutDomain(w http.ResponseWriter, r *http.Request) {
 			}
 			err = checkDomainQuotaUpdate(srv, res, domainReport, newQuota, canRaise, canLower)
 			if err != nil {
-				errors = append(errors, err.Error())
+				verdicts.reject(srv.Type, resourceName, err)
 				continue
 			}
 
-			auditTrail.Add("set quota %s.%s = %d -> %d for domain %s by user %s (%s)",
-				srv.Type, res.Name, res.Quota, newQuota,
-				dbDomain.UUID, token.UserUUID, token.UserName,
-			)
-			res.Quota = newQuota
-			err = tx.Insert(&res)
-			if ReturnError(w, err) {
-				return
-			}
+			update := domainQuotaUpdate{Service: srv, Resource: res, OldQuota: 0, IsNew: true}
+			update.Resource.Quota = newQuota
+			updates = append(updates, update)
+			verdicts.accept(srv.Type, resourceName, &update.OldQuota, &update.Resource.Quota)
 		}
 	}
 
-	//if not legal, report errors to the user
-	if len(errors) > 0 {
-		http.Error(w, strings.Join(errors, "\n"), 422)
-		return
-	}
+	return updates, verdicts, nil
+}
 
-	//update the DB with the new quotas
-	onlyQuota := func(c *gorp.ColumnMap) bool {
-		return c.ColumnName == "quota"
-	}
-	_, err = tx.UpdateColumns(onlyQuota, resourcesToUpdateAsUntyped...)
-	if ReturnError(w, err) {
-		return
-	}
-	err = tx.Commit()
-	if ReturnError(w, err) {
-		return
+//addDomainQuotaUpdatesToAuditTrail records the given quota updates in the audit trail.
+func addDomainQuotaUpdatesToAuditTrail(auditTrail *db.AuditTrail, domain *db.Domain, updates []domainQuotaUpdate) {
+	for _, update := range updates {
+		oldQuota, newQuota := update.OldQuota, update.Resource.Quota
+		auditTrail.Add(db.AuditEvent{
+			DomainUUID:   domain.UUID,
+			ServiceType:  update.Service.Type,
+			ResourceName: update.Resource.Name,
+			Action:       db.AuditActionSetQuota,
+			OldValue:     &oldQuota,
+			NewValue:     &newQuota,
+		}, "set quota %s.%s = %d -> %d for domain %s by user %s (%s)",
+			update.Service.Type, update.Resource.Name, oldQuota, newQuota,
+			domain.UUID, auditTrail.UserUUID, auditTrail.UserName,
+		)
 	}
-	auditTrail.Commit()
+}
 
-	//otherwise, report success
-	domains, err := reports.GetDomains(p.Cluster, &dbDomain.ID, db.DB, reports.ReadFilter(r))
-	if ReturnError(w, err) {
-		return
-	}
-	if len(domains) == 0 {
-		http.Error(w, "no resource data found for domain", 500)
-		return
-	}
+var updateDomainQuotaQuery = `
+	UPDATE domain_resources SET quota = $1 WHERE service_id = $2 AND name = $3 AND quota = $4
+`
+
+//applyDomainQuotaUpdates writes the new quota values into the DB. Like
+//applyProjectQuotaUpdates, it returns errConcurrentQuotaUpdate if a quota was
+//changed after it was read for validation.
+func applyDomainQuotaUpdates(tx *gorp.Transaction, updates []domainQuotaUpdate) error {
+	for idx, update := range updates {
+		if update.IsNew {
+			err := tx.Insert(&updates[idx].Resource)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 
-	ReturnJSON(w, 200, map[string]interface{}{"domain": domains[0]})
+		result, err := tx.Exec(updateDomainQuotaQuery,
+			update.Resource.Quota, update.Resource.ServiceID, update.Resource.Name, update.OldQuota)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return errConcurrentQuotaUpdate
+		}
+	}
+	return nil
 }
 
 func checkDomainQuotaUpdate(srv db.DomainService, res db.DomainResource, domain *reports.Domain, newQuota uint64, canRaise, canLower bool) error {
@@ -284,13 +451,13 @@ func checkDomainQuotaUpdate(srv db.DomainService, res db.DomainResource, domain
 		if canRaise {
 			return nil
 		}
-		return fmt.Errorf("cannot change %s/%s quota: user is not allowed to raise quotas in this project", srv.Type, res.Name)
+		return validation.NewResourceError(validation.ReasonRaiseForbidden, "cannot change %s/%s quota: user is not allowed to raise quotas in this project", srv.Type, res.Name)
 	}
 
 	//if quota is being lowered, permission is required and the domain quota may
 	//not be less than the sum of quotas that the domain gives out to projects
 	if !canLower {
-		return fmt.Errorf("cannot change %s/%s quota: user is not allowed to lower quotas in this project", srv.Type, res.Name)
+		return validation.NewResourceError(validation.ReasonLowerForbidden, "cannot change %s/%s quota: user is not allowed to lower quotas in this project", srv.Type, res.Name)
 	}
 	projectsQuota := uint64(0)
 	var unit limes.Unit
@@ -301,11 +468,11 @@ func checkDomainQuotaUpdate(srv db.DomainService, res db.DomainResource, domain
 		}
 	}
 	if newQuota < projectsQuota {
-		return fmt.Errorf(
+		return validation.NewResourceError(validation.ReasonBelowProjectQuotas,
 			"cannot change %s/%s quota: domain quota may not be smaller than sum of project quotas in that domain (%s)",
 			srv.Type, res.Name,
 			unit.Format(projectsQuota),
-		)
+		).WithMinAcceptable(projectsQuota)
 	}
 
 	return nil
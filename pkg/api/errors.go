@@ -0,0 +1,186 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//ErrorResponse is the JSON error format. It is used instead of plain-text
+//error messages when the client prefers JSON (see errorFormatHandler).
+type ErrorResponse struct {
+	Status    int               `json:"status"`
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Resources []ResourceVerdict `json:"resources,omitempty"`
+}
+
+//errorCodes contains the error codes for the JSON error format. Status codes
+//not listed here get a code derived from their status text.
+var errorCodes = map[int]string{
+	//this is used when quotas have been changed, but could not be written into
+	//the backend services
+	http.StatusAccepted:            "backend_error",
+	http.StatusUnprocessableEntity: "validation_failed",
+}
+
+func errorCodeForStatus(status int) string {
+	if code, exists := errorCodes[status]; exists {
+		return code
+	}
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.Replace(text, " ", "_", -1))
+}
+
+//errorFormatHandler wraps the v1 API router. When the client prefers JSON
+//over plain text (as indicated by the Accept header), the plain-text error
+//messages written by http.Error() are converted into the JSON error format.
+//Otherwise, responses are passed through unchanged.
+type errorFormatHandler struct {
+	inner http.Handler
+}
+
+//ServeHTTP implements the http.Handler interface.
+func (h errorFormatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !prefersJSON(r) {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+	ew := &jsonErrorWriter{ResponseWriter: w}
+	h.inner.ServeHTTP(ew, r)
+	ew.Finish()
+}
+
+//prefersJSON checks whether the Accept header of the given request ranks
+//application/json at least as high as text/plain. Wildcards are not taken
+//into account, so that clients which do not ask for JSON explicitly keep
+//getting plain-text errors.
+func prefersJSON(r *http.Request) bool {
+	qualities := acceptQualities(r)
+	jsonQuality := qualities["application/json"]
+	return jsonQuality > 0 && jsonQuality >= qualities["text/plain"]
+}
+
+//acceptQualities parses the Accept header of the given request into a map of
+//media types and their quality values.
+func acceptQualities(r *http.Request) map[string]float64 {
+	result := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		quality := 1.0
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				value, err := strconv.ParseFloat(kv[1], 64)
+				if err == nil {
+					quality = value
+				}
+			}
+		}
+		result[strings.ToLower(strings.TrimSpace(fields[0]))] = quality
+	}
+	return result
+}
+
+//jsonErrorWriter is the http.ResponseWriter used by errorFormatHandler. It
+//holds back plain-text error responses until Finish() is called.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+//WriteHeader implements the http.ResponseWriter interface.
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	isError := status >= 400 || status == http.StatusAccepted
+	if isError && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+//Write implements the http.ResponseWriter interface.
+func (w *jsonErrorWriter) Write(buf []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(buf)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+//Flush implements the http.Flusher interface.
+func (w *jsonErrorWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Finish writes the JSON error response if a plain-text error response was
+//held back.
+func (w *jsonErrorWriter) Finish() {
+	if w.status == 0 {
+		return
+	}
+	w.Header().Del("X-Content-Type-Options")
+	returnJSONError(w.ResponseWriter, w.status, strings.TrimSuffix(w.body.String(), "\n"), nil)
+}
+
+//returnJSONError writes an error response in the JSON error format.
+func returnJSONError(w http.ResponseWriter, status int, message string, resources []ResourceVerdict) {
+	ReturnJSON(w, status, map[string]interface{}{
+		"error": ErrorResponse{
+			Status:    status,
+			Code:      errorCodeForStatus(status),
+			Message:   message,
+			Resources: resources,
+		},
+	})
+}
+
+//returnVerdictErrors produces a 422 response listing the reasons for all
+//rejected verdicts, prefixed by the given message (if any). If the client
+//prefers the JSON error format (see errorFormatHandler), the rejected verdicts
+//are included as structured data.
+func returnVerdictErrors(w http.ResponseWriter, r *http.Request, prefix string, verdicts ...ResourceVerdicts) {
+	var (
+		rejected []ResourceVerdict
+		errors   []string
+	)
+	for _, v := range verdicts {
+		for _, verdict := range v {
+			if verdict.Verdict == verdictRejected {
+				rejected = append(rejected, verdict)
+				errors = append(errors, verdict.Reason)
+			}
+		}
+	}
+	message := prefix + strings.Join(errors, "\n")
+	if prefersJSON(r) {
+		returnJSONError(w, 422, message, rejected)
+		return
+	}
+	http.Error(w, message, 422)
+}
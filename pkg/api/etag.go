@@ -0,0 +1,150 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	gorp "gopkg.in/gorp.v2"
+
+	"github.com/sapcc/limes/pkg/db"
+)
+
+var domainETagQuery = `
+	SELECT ds.type, dr.name, dr.quota
+	  FROM domain_services ds
+	  JOIN domain_resources dr ON dr.service_id = ds.id
+	 WHERE ds.domain_id = $1
+	 ORDER BY ds.type, dr.name
+`
+
+var projectETagQuery = `
+	SELECT ps.type, pr.name, pr.quota
+	  FROM project_services ps
+	  JOIN project_resources pr ON pr.service_id = ps.id
+	 WHERE ps.project_id = $1
+	 ORDER BY ps.type, pr.name
+`
+
+var lockDomainQuotasQuery = `
+	SELECT id FROM domain_services WHERE domain_id = $1 ORDER BY id FOR UPDATE
+`
+
+var lockProjectQuotasQuery = `
+	SELECT id FROM project_services WHERE project_id = $1 ORDER BY id FOR UPDATE
+`
+
+var lockAllProjectQuotasQuery = `
+	SELECT ps.id FROM project_services ps
+	  JOIN projects p ON p.id = ps.project_id
+	 WHERE p.domain_id = $1
+	 ORDER BY ps.id
+	   FOR UPDATE OF ps
+`
+
+//lockDomainQuotas locks the services of the given domain until the end of
+//the given transaction. PUT requests must do this before computing the ETag
+//for checkIfMatch(), so that two requests with the same If-Match header are
+//serialized and the second one sees the ETag produced by the first one.
+func lockDomainQuotas(tx *gorp.Transaction, domain *db.Domain) error {
+	_, err := tx.Exec(lockDomainQuotasQuery, domain.ID)
+	return err
+}
+
+//lockProjectQuotas is like lockDomainQuotas, but for a single project.
+func lockProjectQuotas(tx *gorp.Transaction, project *db.Project) error {
+	_, err := tx.Exec(lockProjectQuotasQuery, project.ID)
+	return err
+}
+
+//lockQuotasForProjectUpdate locks the quotas of the given domain, and then
+//those of the given project, until the end of the given transaction. Changes
+//to project quotas must do this before reading the domain report that they
+//are validated against, so that concurrent changes to projects in the same
+//domain see each other's results and cannot overcommit the domain quota.
+func lockQuotasForProjectUpdate(tx *gorp.Transaction, domain *db.Domain, project *db.Project) error {
+	err := lockDomainQuotas(tx, domain)
+	if err != nil {
+		return err
+	}
+	return lockProjectQuotas(tx, project)
+}
+
+//lockAllProjectQuotas is like lockProjectQuotas, but for all projects in the
+//given domain. Since all these locks are taken in the order of
+//project_services.id, this cannot deadlock with lockProjectQuotas.
+func lockAllProjectQuotas(tx *gorp.Transaction, domain *db.Domain) error {
+	_, err := tx.Exec(lockAllProjectQuotasQuery, domain.ID)
+	return err
+}
+
+//domainETag computes the ETag for the quotas of the given domain.
+func domainETag(dbi db.Interface, domain *db.Domain) (string, error) {
+	return quotaETag(dbi, domainETagQuery, domain.ID)
+}
+
+//projectETag computes the ETag for the quotas of the given project.
+func projectETag(dbi db.Interface, project *db.Project) (string, error) {
+	return quotaETag(dbi, projectETagQuery, project.ID)
+}
+
+//quotaETag computes an ETag from the quota values returned by the given
+//query. Since only quota values are taken into account, the ETag does not
+//change when usage data is scraped, but it does change when quotas are changed
+//through any means (including by `limes collect`, e.g. when quotas expire).
+func quotaETag(dbi db.Interface, query string, args ...interface{}) (string, error) {
+	hash := sha256.New()
+	err := db.ForeachRow(dbi, query, args, func(rows *sql.Rows) error {
+		var (
+			serviceType  string
+			resourceName string
+			quota        uint64
+		)
+		err := rows.Scan(&serviceType, &resourceName, &quota)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s/%s=%d\n", serviceType, resourceName, quota)
+		return nil
+	})
+	return fmt.Sprintf(`"%x"`, hash.Sum(nil)[:16]), err
+}
+
+//checkIfMatch checks the If-Match header of the given request (if any)
+//against the given current ETag. If the precondition fails, an error response
+//is written and false is returned.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, currentETag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag == "*" || etag == currentETag {
+			return true
+		}
+	}
+	http.Error(w, "quotas have been changed since they were last read (ETag mismatch)", http.StatusPreconditionFailed)
+	return false
+}
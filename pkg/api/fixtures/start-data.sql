@@ -89,3 +89,15 @@ INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, su
 
 INSERT INTO domain_resources (service_id, name, quota) VALUES (1, 'items', 1);
 INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'items', 2, 1, 2, '');
+
+-- project_resource_history has samples for two points in time (paris has an infinite backend quota, and dresden was
+-- not scraped in the second interval)
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'shared',   'things',   '1970-01-01 01:00:00+00:00', 10, 1, 10);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'shared',   'capacity', '1970-01-01 01:00:00+00:00', 10, 1, 10);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'shared',   'things',   '1970-01-01 02:00:00+00:00', 10, 2, 10);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'shared',   'capacity', '1970-01-01 02:00:00+00:00', 10, 2, 10);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (2, 'shared',   'things',   '1970-01-01 01:00:00+00:00', 10, 2, 10);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (3, 'unshared', 'things',   '1970-01-01 01:00:00+00:00', 10, 2, -1);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (3, 'unshared', 'things',   '1970-01-01 02:00:00+00:00', 10, 2, -1);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (4, 'unshared', 'things',   '1970-01-01 01:00:00+00:00', 10, 2, 10);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'weird',    'things',   '1970-01-01 01:00:00+00:00', 2, 1, 2);
@@ -0,0 +1,115 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/reports"
+)
+
+//GetProjectHistory handles GET /v1/domains/:domain_id/projects/:project_id/history.
+func (p *v1Provider) GetProjectHistory(w http.ResponseWriter, r *http.Request) {
+	if !p.CheckToken(r).Require(w, "project:show") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	dbProject := p.FindProjectFromRequest(w, r, dbDomain)
+	if dbProject == nil {
+		return
+	}
+	p.getHistory(w, r, p.Cluster, &dbDomain.ID, &dbProject.ID)
+}
+
+//GetDomainHistory handles GET /v1/domains/:domain_id/history.
+func (p *v1Provider) GetDomainHistory(w http.ResponseWriter, r *http.Request) {
+	if !p.CheckToken(r).Require(w, "domain:show") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	p.getHistory(w, r, p.Cluster, &dbDomain.ID, nil)
+}
+
+//GetClusterHistory handles GET /v1/clusters/:cluster_id/history.
+func (p *v1Provider) GetClusterHistory(w http.ResponseWriter, r *http.Request) {
+	if !p.CheckToken(r).Require(w, "cluster:show") {
+		return
+	}
+	clusterID := mux.Vars(r)["cluster_id"]
+	if clusterID == "current" {
+		clusterID = p.Cluster.ID
+	}
+	cluster, exists := p.Config.Clusters[clusterID]
+	if !exists {
+		http.Error(w, "no such cluster", 404)
+		return
+	}
+	p.getHistory(w, r, cluster, nil, nil)
+}
+
+func (p *v1Provider) getHistory(w http.ResponseWriter, r *http.Request, cluster *limes.Cluster, domainID, projectID *int64) {
+	from, ok := readTimestampParam(w, r, "from")
+	if !ok {
+		return
+	}
+	to, ok := readTimestampParam(w, r, "to")
+	if !ok {
+		return
+	}
+
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := reports.GetHistory(cluster, domainID, projectID, from, to, db.DB, filter)
+	if ReturnError(w, err) {
+		return
+	}
+	ReturnJSON(w, 200, map[string]interface{}{"history": history})
+}
+
+//readTimestampParam parses the given query parameter as a UNIX timestamp. If
+//the parameter is not given, nil is returned. If it is malformed, an error
+//response is written and false is returned.
+func readTimestampParam(w http.ResponseWriter, r *http.Request, param string) (*time.Time, bool) {
+	str := r.URL.Query().Get(param)
+	if str == "" {
+		return nil, true
+	}
+	timestamp, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid value for "+param+": "+err.Error(), 400)
+		return nil, false
+	}
+	t := time.Unix(timestamp, 0).UTC()
+	return &t, true
+}
@@ -21,6 +21,7 @@ package api
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/sapcc/limes/pkg/limes"
 )
@@ -33,16 +34,25 @@ type ServiceQuotas map[string]ResourceQuotas
 //ResourceQuotas contains new quota values for the resources in a single
 //service. The map key is the resource name. This type is used to unserialize
 //JSON request bodies in PUT requests.
-type ResourceQuotas map[string]limes.ValueWithUnit
+type ResourceQuotas map[string]ResourceQuota
+
+//ResourceQuota contains a new quota value for a single resource.
+type ResourceQuota struct {
+	limes.ValueWithUnit
+	//If not nil, the new quota is only granted until this point in time (only
+	//supported for project quotas).
+	ExpiresAt *time.Time
+}
 
 //UnmarshalJSON implements the json.Unmarshaler interface.
 func (sq *ServiceQuotas) UnmarshalJSON(input []byte) error {
 	var data []struct {
 		Type      string `json:"type"`
 		Resources []struct {
-			Name  string      `json:"name"`
-			Quota uint64      `json:"quota"`
-			Unit  *limes.Unit `json:"unit"`
+			Name      string      `json:"name"`
+			Quota     uint64      `json:"quota"`
+			Unit      *limes.Unit `json:"unit"`
+			ExpiresAt *int64      `json:"expires_at"`
 		} `json:"resources"`
 	}
 	err := json.Unmarshal(input, &data)
@@ -51,6 +61,9 @@ func (sq *ServiceQuotas) UnmarshalJSON(input []byte) error {
 	}
 
 	//remove existing content
+	if *sq == nil {
+		*sq = make(ServiceQuotas, len(data))
+	}
 	for key := range *sq {
 		delete(*sq, key)
 	}
@@ -63,9 +76,17 @@ func (sq *ServiceQuotas) UnmarshalJSON(input []byte) error {
 			if res.Unit != nil {
 				unit = *res.Unit
 			}
-			rq[res.Name] = limes.ValueWithUnit{
-				Value: res.Quota,
-				Unit:  unit,
+			var expiresAt *time.Time
+			if res.ExpiresAt != nil {
+				t := time.Unix(*res.ExpiresAt, 0).UTC()
+				expiresAt = &t
+			}
+			rq[res.Name] = ResourceQuota{
+				ValueWithUnit: limes.ValueWithUnit{
+					Value: res.Quota,
+					Unit:  unit,
+				},
+				ExpiresAt: expiresAt,
 			}
 		}
 		(*sq)[srv.Type] = rq
@@ -73,6 +94,23 @@ func (sq *ServiceQuotas) UnmarshalJSON(input []byte) error {
 	return nil
 }
 
+//AddTemplate adds the quota values from the given quota template for all
+//resources that do not have a quota value yet.
+func (sq ServiceQuotas) AddTemplate(template limes.QuotaTemplate) {
+	for serviceType, resourceQuotas := range template {
+		rq, exists := sq[serviceType]
+		if !exists {
+			rq = make(ResourceQuotas, len(resourceQuotas))
+			sq[serviceType] = rq
+		}
+		for resourceName, quota := range resourceQuotas {
+			if _, exists := rq[resourceName]; !exists {
+				rq[resourceName] = ResourceQuota{ValueWithUnit: limes.ValueWithUnit{Value: quota, Unit: limes.UnitUnspecified}}
+			}
+		}
+	}
+}
+
 //ServiceCapacities contains updated capacity values for some or all resources
 //in a single service.
 type ServiceCapacities struct {
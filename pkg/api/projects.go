@@ -20,9 +20,12 @@
 package api
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	gorp "gopkg.in/gorp.v2"
 
@@ -32,6 +35,7 @@ import (
 	"github.com/sapcc/limes/pkg/limes"
 	"github.com/sapcc/limes/pkg/reports"
 	"github.com/sapcc/limes/pkg/util"
+	"github.com/sapcc/limes/pkg/validation"
 )
 
 //ListProjects handles GET /v1/domains/:domain_id/projects.
@@ -50,11 +54,29 @@ func (p *v1Provider) ListProjects(w http.ResponseWriter, r *http.Request) {
 	}
 
 	_, withSubresources := r.URL.Query()["detail"]
-	projects, err := reports.GetProjects(cluster, dbDomain.ID, nil, db.DB, reports.ReadFilter(r), withSubresources)
-	if ReturnError(w, err) {
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
+	useCSV, ok := checkCSVFormat(w, r)
+	if !ok {
+		return
+	}
+	if useCSV {
+		returnProjectsCSV(w, dbDomain, func(callback func([]*reports.Project) error) error {
+			return reports.ForeachProjectBatch(cluster, dbDomain.ID, db.DB, filter, withSubresources, csvBatchSize, callback)
+		})
 		return
 	}
 
+	projects, err := reports.GetProjects(cluster, dbDomain.ID, nil, db.DB, filter, withSubresources)
+	if err == reports.ErrInvalidMarker {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if ReturnError(w, err) {
+		return
+	}
 	ReturnJSON(w, 200, map[string]interface{}{"projects": projects})
 }
 
@@ -78,7 +100,15 @@ func (p *v1Provider) GetProject(w http.ResponseWriter, r *http.Request) {
 	}
 
 	_, withSubresources := r.URL.Query()["detail"]
-	projects, err := reports.GetProjects(cluster, dbDomain.ID, &dbProject.ID, db.DB, reports.ReadFilter(r), withSubresources)
+	filter, ok := readFilter(w, r)
+	if !ok {
+		return
+	}
+	useCSV, ok := checkCSVFormat(w, r)
+	if !ok {
+		return
+	}
+	projects, err := reports.GetProjects(cluster, dbDomain.ID, &dbProject.ID, db.DB, filter, withSubresources)
 	if ReturnError(w, err) {
 		return
 	}
@@ -86,21 +116,37 @@ func (p *v1Provider) GetProject(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no resource data found for project", 500)
 		return
 	}
+	if useCSV {
+		returnProjectsCSV(w, dbDomain, func(callback func([]*reports.Project) error) error {
+			return callback(projects)
+		})
+		return
+	}
+	etag, err := projectETag(db.DB, dbProject)
+	if ReturnError(w, err) {
+		return
+	}
 
+	w.Header().Set("ETag", etag)
 	ReturnJSON(w, 200, map[string]interface{}{"project": projects[0]})
 }
 
 //DiscoverProjects handles POST /v1/domains/:domain_id/projects/discover.
 func (p *v1Provider) DiscoverProjects(w http.ResponseWriter, r *http.Request) {
-	if !p.CheckToken(r).Require(w, "project:discover") {
+	token := p.CheckToken(r)
+	if !token.Require(w, "project:discover") {
+		return
+	}
+	cluster := p.FindClusterFromRequestForWrite(w, r, token)
+	if cluster == nil {
 		return
 	}
-	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	dbDomain := p.FindDomainFromRequest(w, r, cluster)
 	if dbDomain == nil {
 		return
 	}
 
-	newProjectUUIDs, err := collector.ScanProjects(p.Cluster, dbDomain)
+	newProjectUUIDs, err := collector.ScanProjects(cluster, dbDomain)
 	if ReturnError(w, err) {
 		return
 	}
@@ -114,10 +160,15 @@ func (p *v1Provider) DiscoverProjects(w http.ResponseWriter, r *http.Request) {
 
 //SyncProject handles POST /v1/domains/:domain_id/projects/sync.
 func (p *v1Provider) SyncProject(w http.ResponseWriter, r *http.Request) {
-	if !p.CheckToken(r).Require(w, "project:show") {
+	token := p.CheckToken(r)
+	if !token.Require(w, "project:show") {
 		return
 	}
-	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	cluster := p.FindClusterFromRequestForWrite(w, r, token)
+	if cluster == nil {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, cluster)
 	if dbDomain == nil {
 		return
 	}
@@ -128,7 +179,7 @@ func (p *v1Provider) SyncProject(w http.ResponseWriter, r *http.Request) {
 
 	//check if project needs to be discovered
 	if dbProject == nil {
-		newProjectUUIDs, err := collector.ScanProjects(p.Cluster, dbDomain)
+		newProjectUUIDs, err := collector.ScanProjects(cluster, dbDomain)
 		if ReturnError(w, err) {
 			return
 		}
@@ -153,11 +204,20 @@ func (p *v1Provider) SyncProject(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//mark all project services as stale to force limes-collect to sync ASAP
-	_, err := db.DB.Exec(`UPDATE project_services SET stale = '1' WHERE project_id = $1`, dbProject.ID)
+	//(since the user explicitly asked for it, this also skips the backoff
+	//after failed scrapes)
+	_, err := db.DB.Exec(`UPDATE project_services SET stale = '1', scrape_backoff_until = NULL WHERE project_id = $1`, dbProject.ID)
 	if ReturnError(w, err) {
 		return
 	}
 
+	//wake up limes-collect if it's idle; this is not fatal since limes-collect
+	//will find the stale project services on its next poll anyway
+	err = collector.NotifySyncRequested(db.DB, cluster.ID, dbProject.ID)
+	if err != nil {
+		util.LogError("cannot notify limes-collect about sync request for project %s: %s", dbProject.UUID, err.Error())
+	}
+
 	w.WriteHeader(202)
 }
 
@@ -170,8 +230,12 @@ func (p *v1Provider) PutProject(w http.ResponseWriter, r *http.Request) {
 		token.Require(w, "project:raise") //produce standard Unauthorized response
 		return
 	}
+	cluster := p.FindClusterFromRequestForWrite(w, r, token)
+	if cluster == nil {
+		return
+	}
 
-	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	dbDomain := p.FindDomainFromRequest(w, r, cluster)
 	if dbDomain == nil {
 		return
 	}
@@ -183,6 +247,7 @@ func (p *v1Provider) PutProject(w http.ResponseWriter, r *http.Request) {
 	//parse request body
 	var parseTarget struct {
 		Project struct {
+			Template *string       `json:"template"`
 			Services ServiceQuotas `json:"services"`
 		} `json:"project"`
 	}
@@ -192,6 +257,18 @@ func (p *v1Provider) PutProject(w http.ResponseWriter, r *http.Request) {
 	}
 	serviceQuotas := parseTarget.Project.Services
 
+	//when a quota template is selected, its quotas apply to all resources that
+	//are not given explicitly in the request
+	newTemplate := parseTarget.Project.Template
+	if newTemplate != nil && *newTemplate != "" {
+		template := cluster.QuotaTemplate(*newTemplate)
+		if template == nil {
+			http.Error(w, "no such quota template: "+*newTemplate, 422)
+			return
+		}
+		serviceQuotas.AddTemplate(template)
+	}
+
 	//start a transaction for the quota updates
 	tx, err := db.DB.Begin()
 	if ReturnError(w, err) {
@@ -199,8 +276,25 @@ func (p *v1Provider) PutProject(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.RollbackUnlessCommitted(tx)
 
+	//if the client sent an ETag, the quotas must not have changed since the
+	//client read them (the lock ensures that they also do not change until we
+	//have written the new quotas; the domain quotas are locked as well, so that
+	//concurrent updates of other projects in this domain cannot invalidate the
+	//domain report below)
+	err = lockQuotasForProjectUpdate(tx, dbDomain, dbProject)
+	if ReturnError(w, err) {
+		return
+	}
+	etag, err := projectETag(tx, dbProject)
+	if ReturnError(w, err) {
+		return
+	}
+	if !checkIfMatch(w, r, etag) {
+		return
+	}
+
 	//gather a report on the domain's quotas to decide whether a quota update is legal
-	domainReports, err := reports.GetDomains(p.Cluster, &dbDomain.ID, db.DB, reports.Filter{})
+	domainReports, err := reports.GetDomains(cluster, &dbDomain.ID, tx, reports.Filter{})
 	if ReturnError(w, err) {
 		return
 	}
@@ -209,79 +303,63 @@ func (p *v1Provider) PutProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	domainReport := domainReports[0]
+	hierarchy, err := validation.LoadProjectHierarchy(tx, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
 
 	//check all services for resources to update
-	var services []db.ProjectService
-	_, err = tx.Select(&services,
-		`SELECT * FROM project_services WHERE project_id = $1 ORDER BY type`, dbProject.ID)
+	updates, verdicts, err := prepareProjectQuotaUpdates(tx, cluster, dbProject, domainReport, hierarchy, serviceQuotas, canRaise, canLower, false)
 	if ReturnError(w, err) {
 		return
 	}
-	var resourcesToUpdate []db.ProjectResource
-	var resourcesToUpdateAsUntyped []interface{}
-	servicesToUpdate := make(map[string]bool)
-	var errors []string
 
-	var auditTrail util.AuditTrail
-	for _, srv := range services {
-		resourceQuotas, exists := serviceQuotas[srv.Type]
-		if !exists {
-			continue
+	//if not legal, report errors to the user (in dry-run mode, the errors are
+	//reported as part of the verdicts below)
+	dryRun := isDryRun(r)
+	errors := verdicts.Errors()
+	if len(errors) > 0 {
+		if !dryRun {
+			returnVerdictErrors(w, r, "", verdicts)
+			return
 		}
+		updates = nil //nothing would be applied
+	}
 
-		//check all resources
-		var resources []db.ProjectResource
-		_, err = tx.Select(&resources,
-			`SELECT * FROM project_resources WHERE service_id = $1 ORDER BY name`, srv.ID)
+	//update the DB with the new quotas
+	auditTrail := newAuditTrail(cluster.ID, token)
+	addProjectQuotaUpdatesToAuditTrail(&auditTrail, dbDomain, dbProject, updates)
+	err = applyProjectQuotaUpdates(tx, updates)
+	if returnQuotaUpdateError(w, err) {
+		return
+	}
+	if newTemplate != nil && !dryRun {
+		dbProject.Template = *newTemplate
+		_, err = tx.Update(dbProject)
 		if ReturnError(w, err) {
 			return
 		}
-		for _, res := range resources {
-			newQuotaInput, exists := resourceQuotas[res.Name]
-			if !exists {
-				continue
-			}
-			newQuota, err := newQuotaInput.ConvertFor(p.Cluster, srv.Type, res.Name)
-			if err != nil {
-				errors = append(errors, fmt.Sprintf("cannot change %s/%s quota: %s", srv.Type, res.Name, err.Error()))
-				continue
-			}
-			if res.Quota == newQuota {
-				continue //nothing to do
-			}
-
-			err = checkProjectQuotaUpdate(srv, res, domainReport, newQuota, canRaise, canLower)
-			if err != nil {
-				errors = append(errors, err.Error())
-				continue
-			}
-
-			//take a copy of the loop variable (it will be updated by the loop, so if
-			//we didn't take a copy manually, the resourcesToUpdateAsUntyped list
-			//would contain only identical pointers)
-			res := res
-			auditTrail.Add("set quota %s.%s = %d -> %d for project %s by user %s (%s)",
-				srv.Type, res.Name, res.Quota, newQuota,
-				dbProject.UUID, token.UserUUID, token.UserName,
-			)
-			res.Quota = newQuota
-			resourcesToUpdate = append(resourcesToUpdate, res)
-			resourcesToUpdateAsUntyped = append(resourcesToUpdateAsUntyped, &res)
-			servicesToUpdate[srv.Type] = true
-		}
 	}
 
-	//if not legal, report errors to the user
-	if len(errors) > 0 {
-		http.Error(w, strings.Join(errors, "\n"), 422)
+	//in dry-run mode, report the resulting state and roll back the transaction
+	//(this also skips writing the quotas into the backend)
+	if dryRun {
+		projects, err := reports.GetProjects(cluster, dbDomain.ID, &dbProject.ID, tx, reports.Filter{}, false)
+		if ReturnError(w, err) {
+			return
+		}
+		if len(projects) == 0 {
+			http.Error(w, "no resource data found for project", 500)
+			return
+		}
+		if newTemplate != nil && len(errors) == 0 {
+			projects[0].Template = *newTemplate
+		}
+		ReturnJSON(w, dryRunStatusCode(errors), map[string]interface{}{"project": projects[0], "verdicts": verdicts})
 		return
 	}
 
-	//update the DB with the new quotas
-	onlyQuota := func(c *gorp.ColumnMap) bool {
-		return c.ColumnName == "quota"
-	}
-	_, err = tx.UpdateColumns(onlyQuota, resourcesToUpdateAsUntyped...)
+	err = auditTrail.Write(tx)
 	if ReturnError(w, err) {
 		return
 	}
@@ -291,117 +369,527 @@ func (p *v1Provider) PutProject(w http.ResponseWriter, r *http.Request) {
 	}
 	auditTrail.Commit()
 
+	//report the new ETag (the quotas in Limes are final at this point, even if
+	//writing them into the backend fails)
+	etag, err = projectETag(db.DB, dbProject)
+	if ReturnError(w, err) {
+		return
+	}
+	w.Header().Set("ETag", etag)
+
 	//attempt to write the quotas into the backend
 	//
 	//It is not a mistake that this happens after tx.Commit(). If this operation
 	//fails, then subsequent scraping tasks will try to apply the quota again
 	//until the operation succeeds. What's important is that the approved quota
 	//budget inside Limes is redistributed.
-	errors = nil
-	for _, srv := range services {
-		if !servicesToUpdate[srv.Type] {
-			continue
-		}
+	errors, err = collector.WriteProjectQuotasToBackend(cluster, dbDomain.UUID, dbProject.UUID, updatedProjectServices(updates))
+	if ReturnError(w, err) {
+		return
+	}
 
-		plugin := p.Cluster.QuotaPlugins[srv.Type]
-		if plugin == nil {
-			errors = append(errors, fmt.Sprintf("no quota plugin registered for service type %s", srv.Type))
-			continue
-		}
+	//report any backend errors to the user
+	if len(errors) > 0 {
+		msg := "quotas have been accepted, but some error(s) occurred while trying to write the quotas into the backend services:"
+		http.Error(w, msg+"\n"+strings.Join(errors, "\n"), 202)
+		return
+	}
 
-		//collect all resource quotas for this service (NOT only the ones that were
-		//updated just now; the QuotaPlugin.SetQuota method requires as input *all*
-		//quotas for that plugin's service)
-		quotaValues := make(map[string]uint64)
-		var resources []db.ProjectResource
-		_, err = db.DB.Select(&resources,
-			`SELECT * FROM project_resources WHERE service_id = $1`, srv.ID)
-		if ReturnError(w, err) {
+	//otherwise, report success
+	projects, err := reports.GetProjects(cluster, dbDomain.ID, &dbProject.ID, db.DB, reports.Filter{}, false)
+	if ReturnError(w, err) {
+		return
+	}
+	if len(projects) == 0 {
+		http.Error(w, "no resource data found for project", 500)
+		return
+	}
+
+	ReturnJSON(w, 200, map[string]interface{}{"project": projects[0]})
+}
+
+//PutProjects handles PUT /v1/domains/:domain_id/projects.
+func (p *v1Provider) PutProjects(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "project:list") {
+		return
+	}
+	cluster := p.FindClusterFromRequestForWrite(w, r, token)
+	if cluster == nil {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, cluster)
+	if dbDomain == nil {
+		return
+	}
+
+	//parse request body
+	var parseTarget struct {
+		Projects []struct {
+			UUID     string        `json:"id"`
+			Services ServiceQuotas `json:"services"`
+		} `json:"projects"`
+	}
+	//there is no single ETag for multiple projects
+	if r.Header.Get("If-Match") != "" {
+		http.Error(w, "If-Match is not supported for bulk quota updates", 400)
+		return
+	}
+	if !RequireJSON(w, r, &parseTarget) {
+		return
+	}
+
+	//start a transaction for the quota updates
+	tx, err := db.DB.Begin()
+	if ReturnError(w, err) {
+		return
+	}
+	defer db.RollbackUnlessCommitted(tx)
+	err = lockAllProjectQuotas(tx, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
+
+	//check all projects for resources to update (the domain quota and the
+	//quotas of parent projects are checked below for all projects at once)
+	var results []*bulkProjectResult
+	isSeen := make(map[string]bool)
+	for _, input := range parseTarget.Projects {
+		if isSeen[input.UUID] {
+			http.Error(w, fmt.Sprintf("project %s appears multiple times in the request", input.UUID), 400)
 			return
 		}
-		for _, res := range resources {
-			quotaValues[res.Name] = res.Quota
+		isSeen[input.UUID] = true
+
+		var dbProject db.Project
+		err := tx.SelectOne(&dbProject,
+			`SELECT * FROM projects WHERE domain_id = $1 AND uuid = $2`, dbDomain.ID, input.UUID)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("no such project: %s", input.UUID), 404)
+			return
 		}
-		err = plugin.SetQuota(p.Cluster.ProviderClientForService(srv.Type), dbDomain.UUID, dbProject.UUID, quotaValues)
-		if err != nil {
-			errors = append(errors, err.Error())
-			continue
+		if ReturnError(w, err) {
+			return
 		}
 
-		//on success, we now know that the backend has all the correct quotas
-		_, err = db.DB.Exec(
-			`UPDATE project_resources SET backend_quota = quota WHERE service_id = $1`,
-			srv.ID)
+		canRaise := token.CheckForProject("project:raise", &dbProject)
+		canLower := token.CheckForProject("project:lower", &dbProject)
+		updates, verdicts, err := prepareProjectQuotaUpdates(tx, cluster, &dbProject, nil, nil, input.Services, canRaise, canLower, false)
 		if ReturnError(w, err) {
 			return
 		}
+		results = append(results, &bulkProjectResult{
+			UUID:     dbProject.UUID,
+			Name:     dbProject.Name,
+			Verdicts: verdicts,
+			project:  &dbProject,
+			updates:  updates,
+		})
 	}
 
-	//report any backend errors to the user
-	if len(errors) > 0 {
-		msg := "quotas have been accepted, but some error(s) occurred while trying to write the quotas into the backend services:"
-		http.Error(w, msg+"\n"+strings.Join(errors, "\n"), 202)
+	//check the final state against the domain quotas
+	domainReports, err := reports.GetDomains(cluster, &dbDomain.ID, tx, reports.Filter{})
+	if ReturnError(w, err) {
 		return
 	}
+	if len(domainReports) == 0 {
+		http.Error(w, "no resource data found for domain", 500)
+		return
+	}
+	hierarchy, err := validation.LoadProjectHierarchy(tx, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
+	checkBulkProjectQuotaUpdates(cluster, domainReports[0], hierarchy, results)
 
-	//otherwise, report success
-	projects, err := reports.GetProjects(p.Cluster, dbDomain.ID, &dbProject.ID, db.DB, reports.Filter{}, false)
+	//if not legal, report errors to the user (in dry-run mode, stop here in any case)
+	statusCode := 200
+	for _, result := range results {
+		result.Status = result.computeStatus()
+		if result.Status == verdictRejected {
+			statusCode = 422
+		}
+	}
+	if statusCode != 200 || isDryRun(r) {
+		ReturnJSON(w, statusCode, map[string]interface{}{"projects": results})
+		return
+	}
+
+	//update the DB with the new quotas
+	auditTrail := newAuditTrail(cluster.ID, token)
+	for _, result := range results {
+		addProjectQuotaUpdatesToAuditTrail(&auditTrail, dbDomain, result.project, result.updates)
+		err = applyProjectQuotaUpdates(tx, result.updates)
+		if returnQuotaUpdateError(w, err) {
+			return
+		}
+	}
+	err = auditTrail.Write(tx)
 	if ReturnError(w, err) {
 		return
 	}
-	if len(projects) == 0 {
-		http.Error(w, "no resource data found for project", 500)
+	err = tx.Commit()
+	if ReturnError(w, err) {
 		return
 	}
+	auditTrail.Commit()
 
-	ReturnJSON(w, 200, map[string]interface{}{"project": projects[0]})
+	//attempt to write the quotas into the backend (see comment in PutProject
+	//for why this happens after tx.Commit())
+	for _, result := range results {
+		result.BackendErrors, err = collector.WriteProjectQuotasToBackend(cluster, dbDomain.UUID, result.project.UUID, updatedProjectServices(result.updates))
+		if ReturnError(w, err) {
+			return
+		}
+		if len(result.BackendErrors) > 0 {
+			statusCode = 202
+		}
+	}
+
+	ReturnJSON(w, statusCode, map[string]interface{}{"projects": results})
 }
 
-func checkProjectQuotaUpdate(srv db.ProjectService, res db.ProjectResource, domain *reports.Domain, newQuota uint64, canRaise, canLower bool) error {
-	//if quota is being reduced, permission is required and usage must fit into quota
-	//(note that both res.Quota and newQuota are uint64, so we do not need to
-	//cover the case of infinite quotas)
-	if res.Quota > newQuota {
-		if !canLower {
-			return fmt.Errorf("cannot change %s/%s quota: user is not allowed to lower quotas in this project", srv.Type, res.Name)
-		}
-		if res.Usage > newQuota {
-			return fmt.Errorf("cannot change %s/%s quota: quota may not be lower than current usage", srv.Type, res.Name)
-		}
-		return nil
-	}
-
-	//if quota is being raised, permission is required and also the domain quota may not be exceeded
-	if !canRaise {
-		return fmt.Errorf("cannot change %s/%s quota: user is not allowed to raise quotas in this project", srv.Type, res.Name)
-	}
-	domainQuota := uint64(0)
-	projectsQuota := uint64(0)
-	var unit limes.Unit
-	if domainService, exists := domain.Services[srv.Type]; exists {
-		if domainResource, exists := domainService.Resources[res.Name]; exists {
-			domainQuota = domainResource.DomainQuota
-			projectsQuota = domainResource.ProjectsQuota
-			unit = domainResource.Unit
-		}
-	}
-	//NOTE: It looks like an arithmetic overflow (or rather, underflow) is
-	//possible here, but it isn't. projectsQuota is the sum over all current
-	//project quotas, including res.Quota, and thus is always bigger (since these
-	//quotas are all unsigned). Also, we're doing everything in a transaction, so
-	//an overflow because of concurrent quota changes is also out of the
-	//question.
-	newProjectsQuota := projectsQuota - res.Quota + newQuota
-	if newProjectsQuota > domainQuota {
-		maxQuota := domainQuota - (projectsQuota - res.Quota)
-		if domainQuota < projectsQuota-res.Quota {
-			maxQuota = 0
-		}
-		return fmt.Errorf("cannot change %s/%s quota: domain quota exceeded (maximum acceptable project quota is %s)",
-			srv.Type, res.Name,
-			unit.Format(maxQuota),
+//bulkProjectResult appears in the response of PutProjects and describes the
+//outcome for a single project.
+type bulkProjectResult struct {
+	UUID          string           `json:"id"`
+	Name          string           `json:"name"`
+	Status        string           `json:"status"`
+	Verdicts      ResourceVerdicts `json:"verdicts"`
+	BackendErrors []string         `json:"backend_errors,omitempty"`
+	project       *db.Project
+	updates       []projectQuotaUpdate
+}
+
+//computeStatus summarizes the verdicts for this project: "rejected" if any
+//quota was rejected, "accepted" if any quota will be changed, or "unchanged"
+//otherwise.
+func (r bulkProjectResult) computeStatus() string {
+	if len(r.Verdicts.Errors()) > 0 {
+		return verdictRejected
+	}
+	if len(r.updates) > 0 {
+		return verdictAccepted
+	}
+	return verdictUnchanged
+}
+
+//checkBulkProjectQuotaUpdates checks whether the project quotas resulting from
+//PutProjects fit into the domain quota and the quotas of parent projects.
+//Since this is checked on the final state, the order of the updates within
+//the request does not matter. If the domain quota is exceeded for some
+//resource, all updates that raise quotas for that resource are rejected.
+func checkBulkProjectQuotaUpdates(cluster *limes.Cluster, domain *reports.Domain, hierarchy *validation.ProjectHierarchy, results []*bulkProjectResult) {
+	//check against parent project quotas
+	for _, result := range results {
+		for _, update := range result.updates {
+			hierarchy.Set(validation.ProjectResourceRef{ProjectUUID: result.UUID, ServiceType: update.Service.Type, ResourceName: update.Resource.Name}, update.Resource.Quota)
+		}
+	}
+	for _, result := range results {
+		for _, update := range result.updates {
+			ref := validation.ProjectResourceRef{ProjectUUID: result.UUID, ServiceType: update.Service.Type, ResourceName: update.Resource.Name}
+			unit := cluster.InfoForResource(ref.ServiceType, ref.ResourceName).Unit
+			err := hierarchy.Check(ref, update.OldQuota, update.Resource.Quota, unit)
+			if err != nil {
+				result.Verdicts.overrule(ref.ServiceType, ref.ResourceName, err)
+			}
+		}
+	}
+
+	//check against domain quota (only top-level projects count towards the
+	//domain quota; child projects sublease their quota from them)
+	type resourceRef struct {
+		ServiceType  string
+		ResourceName string
+	}
+	oldSums := make(map[resourceRef]uint64)
+	newSums := make(map[resourceRef]uint64)
+	for _, result := range results {
+		if hierarchy.IsChildProject(result.UUID) {
+			continue
+		}
+		for _, update := range result.updates {
+			ref := resourceRef{update.Service.Type, update.Resource.Name}
+			oldSums[ref] += update.OldQuota
+			newSums[ref] += update.Resource.Quota
+		}
+	}
+
+	for ref, newSum := range newSums {
+		oldSum := oldSums[ref]
+		if newSum <= oldSum {
+			continue //lowering the total quota is always okay
+		}
+
+		domainQuota := uint64(0)
+		projectsQuota := uint64(0)
+		var unit limes.Unit
+		if domainService, exists := domain.Services[ref.ServiceType]; exists {
+			if domainResource, exists := domainService.Resources[ref.ResourceName]; exists {
+				domainQuota = domainResource.DomainQuota
+				projectsQuota = domainResource.ProjectsQuota
+				unit = domainResource.Unit
+			}
+		}
+		//no underflow possible here for the same reasons as in validation.CheckProjectQuotaUpdate()
+		newProjectsQuota := projectsQuota - oldSum + newSum
+		if newProjectsQuota <= domainQuota {
+			continue
+		}
+
+		reason := validation.NewResourceError(validation.ReasonDomainQuotaExceeded, "cannot change %s/%s quota: domain quota exceeded (sum of project quotas would be %s, but domain quota is %s)",
+			ref.ServiceType, ref.ResourceName,
+			unit.Format(newProjectsQuota), unit.Format(domainQuota),
 		)
+		for _, result := range results {
+			if hierarchy.IsChildProject(result.UUID) {
+				continue
+			}
+			for _, update := range result.updates {
+				if update.Service.Type == ref.ServiceType && update.Resource.Name == ref.ResourceName && update.Resource.Quota > update.OldQuota {
+					result.Verdicts.overrule(ref.ServiceType, ref.ResourceName, reason)
+				}
+			}
+		}
+	}
+}
+
+//projectQuotaUpdate describes a single change to a project resource's quota
+//that has been validated by prepareProjectQuotaUpdates(), but has not been
+//written into the DB yet.
+type projectQuotaUpdate struct {
+	Service  db.ProjectService
+	Resource db.ProjectResource //contains the new quota value
+	OldQuota uint64
+	//If not nil, the new quota is only granted until Grant.ExpiresAt. Any
+	//existing grant for this resource is replaced by this one (or removed if
+	//Grant is nil, since the new quota is then granted permanently). When an
+	//existing grant is kept (see prepareProjectQuotaUpdates), this is a copy of
+	//it with an adjusted PreviousQuota.
+	Grant    *db.ProjectQuotaGrant
+	HadGrant bool
+}
+
+//prepareProjectQuotaUpdates checks which of the requested quota values differ
+//from the current quotas of the given project, and whether these changes are
+//legal. The outcome of the validation is returned as a list of verdicts; only
+//DB errors cause a non-nil error return.
+//
+//If domainReport or hierarchy is nil, the new quotas are not checked against
+//the domain quota or the quotas of parent and child projects, respectively.
+//The caller must do these checks instead (see PutProjects).
+//
+//When a quota is changed without an expiry time, an existing time-limited
+//grant for this resource is removed if keepGrants is false (i.e. the new quota
+//is granted permanently, as requested by an explicit PUT). If keepGrants is
+//true (for transfers, quota requests and scheduled changes), the grant is
+//kept, and the quota after expiry is moved along by the same amount as the
+//quota, so that the change also outlasts the grant.
+func prepareProjectQuotaUpdates(tx *gorp.Transaction, cluster *limes.Cluster, project *db.Project, domainReport *reports.Domain, hierarchy *validation.ProjectHierarchy, serviceQuotas ServiceQuotas, canRaise, canLower, keepGrants bool) (updates []projectQuotaUpdate, verdicts ResourceVerdicts, err error) {
+	var services []db.ProjectService
+	_, err = tx.Select(&services,
+		`SELECT * FROM project_services WHERE project_id = $1 ORDER BY type`, project.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//the quota of child projects is subleased from their top-level project, so
+	//it does not count towards the domain quota
+	if hierarchy != nil && hierarchy.IsChildProject(project.UUID) {
+		domainReport = nil
+	}
+
+	for _, srv := range services {
+		resourceQuotas, exists := serviceQuotas[srv.Type]
+		if !exists {
+			continue
+		}
+
+		//check all resources
+		var resources []db.ProjectResource
+		_, err = tx.Select(&resources,
+			`SELECT * FROM project_resources WHERE service_id = $1 ORDER BY name`, srv.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		var grants []db.ProjectQuotaGrant
+		_, err = tx.Select(&grants,
+			`SELECT * FROM project_quota_grants WHERE service_id = $1`, srv.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		grantsByName := make(map[string]db.ProjectQuotaGrant, len(grants))
+		for _, grant := range grants {
+			grantsByName[grant.ResourceName] = grant
+		}
+
+		for _, res := range resources {
+			newQuotaInput, exists := resourceQuotas[res.Name]
+			if !exists {
+				continue
+			}
+			newQuota, err := newQuotaInput.ConvertFor(cluster, srv.Type, res.Name)
+			if err != nil {
+				verdicts.reject(srv.Type, res.Name, validation.NewResourceError(validation.ReasonInvalidValue, "cannot change %s/%s quota: %s", srv.Type, res.Name, err.Error()))
+				continue
+			}
+			if res.Quota == newQuota && newQuotaInput.ExpiresAt == nil {
+				verdicts.unchanged(srv.Type, res.Name, newQuota)
+				continue //nothing to do
+			}
+
+			//a time-limited quota must be higher than the quota that is restored
+			//when it expires (when an existing grant is replaced, the quota from
+			//before the existing grant is restored)
+			existingGrant, hadGrant := grantsByName[res.Name]
+			var grant *db.ProjectQuotaGrant
+			if newQuotaInput.ExpiresAt != nil {
+				grant = &db.ProjectQuotaGrant{
+					ServiceID:     srv.ID,
+					ResourceName:  res.Name,
+					PreviousQuota: res.Quota,
+					ExpiresAt:     *newQuotaInput.ExpiresAt,
+				}
+				if hadGrant {
+					grant.PreviousQuota = existingGrant.PreviousQuota
+				}
+				if !grant.ExpiresAt.After(timeNow()) {
+					verdicts.reject(srv.Type, res.Name, validation.NewResourceError(validation.ReasonInvalidExpiry, "cannot change %s/%s quota: expiry time must be in the future", srv.Type, res.Name))
+					continue
+				}
+				if newQuota <= grant.PreviousQuota {
+					verdicts.reject(srv.Type, res.Name, validation.NewResourceError(validation.ReasonInvalidExpiry, "cannot change %s/%s quota: quota with expiry must be higher than the quota after expiry (%s)",
+						srv.Type, res.Name, cluster.InfoForResource(srv.Type, res.Name).Unit.Format(grant.PreviousQuota),
+					).WithMinAcceptable(grant.PreviousQuota+1))
+					continue
+				}
+			} else if hadGrant && keepGrants {
+				//(the grant only remains meaningful as long as some quota is left
+				//that can be reverted; a quota after expiry below zero is clamped)
+				previousQuota := int64(existingGrant.PreviousQuota) + int64(newQuota) - int64(res.Quota)
+				if previousQuota < 0 {
+					previousQuota = 0
+				}
+				if uint64(previousQuota) < newQuota {
+					keptGrant := existingGrant
+					keptGrant.PreviousQuota = uint64(previousQuota)
+					grant = &keptGrant
+				}
+			}
+
+			err = validation.CheckProjectQuotaUpdate(srv, res, domainReport, newQuota, canRaise, canLower)
+			if err == nil && hierarchy != nil {
+				ref := validation.ProjectResourceRef{ProjectUUID: project.UUID, ServiceType: srv.Type, ResourceName: res.Name}
+				err = hierarchy.Check(ref, res.Quota, newQuota, cluster.InfoForResource(srv.Type, res.Name).Unit)
+			}
+			if err != nil {
+				verdicts.reject(srv.Type, res.Name, err)
+				continue
+			}
+
+			update := projectQuotaUpdate{Service: srv, Resource: res, OldQuota: res.Quota, Grant: grant, HadGrant: hadGrant}
+			update.Resource.Quota = newQuota
+			updates = append(updates, update)
+			verdicts.accept(srv.Type, res.Name, &update.OldQuota, &update.Resource.Quota)
+		}
+	}
+
+	return updates, verdicts, nil
+}
+
+//addProjectQuotaUpdatesToAuditTrail records the given quota updates in the audit trail.
+func addProjectQuotaUpdatesToAuditTrail(auditTrail *db.AuditTrail, domain *db.Domain, project *db.Project, updates []projectQuotaUpdate) {
+	for _, update := range updates {
+		oldQuota, newQuota := update.OldQuota, update.Resource.Quota
+		var expiry string
+		if update.Grant != nil {
+			expiry = fmt.Sprintf(" until %s", update.Grant.ExpiresAt.UTC().Format(time.RFC3339))
+		}
+		auditTrail.Add(db.AuditEvent{
+			DomainUUID:   domain.UUID,
+			ProjectUUID:  project.UUID,
+			ServiceType:  update.Service.Type,
+			ResourceName: update.Resource.Name,
+			Action:       db.AuditActionSetQuota,
+			OldValue:     &oldQuota,
+			NewValue:     &newQuota,
+		}, "set quota %s.%s = %d -> %d%s for project %s by user %s (%s)",
+			update.Service.Type, update.Resource.Name, oldQuota, newQuota, expiry,
+			project.UUID, auditTrail.UserUUID, auditTrail.UserName,
+		)
+	}
+}
+
+//errConcurrentQuotaUpdate is returned by applyProjectQuotaUpdates and
+//applyDomainQuotaUpdates when a quota was changed by someone else after it was
+//read for validation.
+var errConcurrentQuotaUpdate = errors.New("quota was changed concurrently by another request, please retry")
+
+var updateProjectQuotaQuery = `
+	UPDATE project_resources SET quota = $1 WHERE service_id = $2 AND name = $3 AND quota = $4
+`
+
+//applyProjectQuotaUpdates writes the new quota values into the DB. Each write
+//only succeeds if the quota still has the value that the update was validated
+//against; otherwise errConcurrentQuotaUpdate is returned and the caller must
+//roll back the transaction.
+func applyProjectQuotaUpdates(tx *gorp.Transaction, updates []projectQuotaUpdate) error {
+	for _, update := range updates {
+		result, err := tx.Exec(updateProjectQuotaQuery,
+			update.Resource.Quota, update.Resource.ServiceID, update.Resource.Name, update.OldQuota)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return errConcurrentQuotaUpdate
+		}
 	}
 
+	//replace existing grants for time-limited quotas
+	for _, update := range updates {
+		if update.HadGrant {
+			_, err := tx.Exec(
+				`DELETE FROM project_quota_grants WHERE service_id = $1 AND resource_name = $2`,
+				update.Resource.ServiceID, update.Resource.Name)
+			if err != nil {
+				return err
+			}
+		}
+		if update.Grant != nil {
+			err := tx.Insert(update.Grant)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+//updatedProjectServices returns all project services that are affected by the
+//given updates (without duplicates).
+func updatedProjectServices(updates []projectQuotaUpdate) []db.ProjectService {
+	var result []db.ProjectService
+	isSeen := make(map[int64]bool)
+	for _, update := range updates {
+		if !isSeen[update.Service.ID] {
+			isSeen[update.Service.ID] = true
+			result = append(result, update.Service)
+		}
+	}
+	return result
+}
+
+//returnQuotaUpdateError is like ReturnError, but reports
+//errConcurrentQuotaUpdate with status 409 instead of 500.
+func returnQuotaUpdateError(w http.ResponseWriter, err error) bool {
+	if err == errConcurrentQuotaUpdate {
+		http.Error(w, err.Error(), 409)
+		return true
+	}
+	return ReturnError(w, err)
+}
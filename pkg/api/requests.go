@@ -0,0 +1,481 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/limes/pkg/collector"
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/reports"
+	"github.com/sapcc/limes/pkg/validation"
+)
+
+//ListQuotaRequests handles GET /v1/requests.
+func (p *v1Provider) ListQuotaRequests(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "cluster:show") {
+		return
+	}
+	p.listQuotaRequests(w, r, reports.QuotaRequestFilter{})
+}
+
+//ListDomainQuotaRequests handles GET /v1/domains/:domain_id/requests.
+func (p *v1Provider) ListDomainQuotaRequests(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "domain:show") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	p.listQuotaRequests(w, r, reports.QuotaRequestFilter{DomainID: &dbDomain.ID})
+}
+
+//ListProjectQuotaRequests handles GET /v1/domains/:domain_id/projects/:project_id/requests.
+func (p *v1Provider) ListProjectQuotaRequests(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "project:show") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	dbProject := p.FindProjectFromRequest(w, r, dbDomain)
+	if dbProject == nil {
+		return
+	}
+	p.listQuotaRequests(w, r, reports.QuotaRequestFilter{DomainID: &dbDomain.ID, ProjectID: &dbProject.ID})
+}
+
+func (p *v1Provider) listQuotaRequests(w http.ResponseWriter, r *http.Request, filter reports.QuotaRequestFilter) {
+	//only pending requests are shown unless the user asks for something else
+	filter.States = r.URL.Query()["state"]
+	if len(filter.States) == 0 {
+		filter.States = []string{db.QuotaRequestPending}
+	}
+	for _, state := range filter.States {
+		if !isValidQuotaRequestState(state) {
+			http.Error(w, "invalid value for state: "+state, 400)
+			return
+		}
+	}
+
+	requests, err := reports.GetQuotaRequests(p.Cluster, db.DB, filter)
+	if ReturnError(w, err) {
+		return
+	}
+	if requests == nil {
+		requests = []*reports.QuotaRequest{}
+	}
+	ReturnJSON(w, 200, map[string]interface{}{"requests": requests})
+}
+
+func isValidQuotaRequestState(state string) bool {
+	switch state {
+	case db.QuotaRequestPending, db.QuotaRequestApproved, db.QuotaRequestRejected:
+		return true
+	default:
+		return false
+	}
+}
+
+//PostDomainQuotaRequest handles POST /v1/domains/:domain_id/requests.
+func (p *v1Provider) PostDomainQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "domain:request") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	p.createQuotaRequest(w, r, token, dbDomain, nil)
+}
+
+//PostProjectQuotaRequest handles POST /v1/domains/:domain_id/projects/:project_id/requests.
+func (p *v1Provider) PostProjectQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "project:request") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	dbProject := p.FindProjectFromRequest(w, r, dbDomain)
+	if dbProject == nil {
+		return
+	}
+	p.createQuotaRequest(w, r, token, dbDomain, dbProject)
+}
+
+func (p *v1Provider) createQuotaRequest(w http.ResponseWriter, r *http.Request, token *Token, dbDomain *db.Domain, dbProject *db.Project) {
+	//parse request body
+	var parseTarget struct {
+		Request struct {
+			Comment  string        `json:"comment"`
+			Services ServiceQuotas `json:"services"`
+		} `json:"request"`
+	}
+	parseTarget.Request.Services = make(ServiceQuotas)
+	if !RequireJSON(w, r, &parseTarget) {
+		return
+	}
+
+	//validate requested quotas (whether they can be granted is only decided at
+	//approval time)
+	var (
+		resources []db.QuotaRequestResource
+		errors    []string
+	)
+	for serviceType, resourceQuotas := range parseTarget.Request.Services {
+		for resourceName, quotaInput := range resourceQuotas {
+			if !p.Cluster.HasResource(serviceType, resourceName) {
+				errors = append(errors, fmt.Sprintf("cannot request %s/%s quota: no such resource", serviceType, resourceName))
+				continue
+			}
+			quota, err := quotaInput.ConvertFor(p.Cluster, serviceType, resourceName)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("cannot request %s/%s quota: %s", serviceType, resourceName, err.Error()))
+				continue
+			}
+			resources = append(resources, db.QuotaRequestResource{
+				ServiceType: serviceType,
+				Name:        resourceName,
+				Quota:       quota,
+			})
+		}
+	}
+	if len(errors) == 0 && len(resources) == 0 {
+		errors = append(errors, "no quotas requested")
+	}
+	if len(errors) > 0 {
+		http.Error(w, strings.Join(errors, "\n"), 422)
+		return
+	}
+
+	//store the request
+	tx, err := db.DB.Begin()
+	if ReturnError(w, err) {
+		return
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	request := db.QuotaRequest{
+		DomainID:      dbDomain.ID,
+		State:         db.QuotaRequestPending,
+		Comment:       parseTarget.Request.Comment,
+		RequestedAt:   timeNow(),
+		RequesterUUID: token.UserUUID,
+		RequesterName: token.UserName,
+	}
+	if dbProject != nil {
+		request.ProjectID = &dbProject.ID
+	}
+	err = tx.Insert(&request)
+	if ReturnError(w, err) {
+		return
+	}
+	for _, res := range resources {
+		res.RequestID = request.ID
+		err = tx.Insert(&res)
+		if ReturnError(w, err) {
+			return
+		}
+	}
+
+	auditTrail := newAuditTrail(p.Cluster.ID, token)
+	auditTrail.Add(quotaRequestAuditEvent(dbDomain, dbProject, db.AuditActionFileRequest),
+		"filed quota request %d for %s by user %s (%s)",
+		request.ID, describeQuotaRequestTarget(dbDomain, dbProject), token.UserUUID, token.UserName,
+	)
+	err = auditTrail.Write(tx)
+	if ReturnError(w, err) {
+		return
+	}
+	err = tx.Commit()
+	if ReturnError(w, err) {
+		return
+	}
+	auditTrail.Commit()
+
+	p.returnQuotaRequest(w, 201, request.ID)
+}
+
+//ApproveDomainQuotaRequest handles POST /v1/domains/:domain_id/requests/:request_id/approve.
+func (p *v1Provider) ApproveDomainQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	p.decideDomainQuotaRequest(w, r, db.QuotaRequestApproved)
+}
+
+//RejectDomainQuotaRequest handles POST /v1/domains/:domain_id/requests/:request_id/reject.
+func (p *v1Provider) RejectDomainQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	p.decideDomainQuotaRequest(w, r, db.QuotaRequestRejected)
+}
+
+//ApproveProjectQuotaRequest handles POST /v1/domains/:domain_id/projects/:project_id/requests/:request_id/approve.
+func (p *v1Provider) ApproveProjectQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	p.decideProjectQuotaRequest(w, r, db.QuotaRequestApproved)
+}
+
+//RejectProjectQuotaRequest handles POST /v1/domains/:domain_id/projects/:project_id/requests/:request_id/reject.
+func (p *v1Provider) RejectProjectQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	p.decideProjectQuotaRequest(w, r, db.QuotaRequestRejected)
+}
+
+func (p *v1Provider) decideDomainQuotaRequest(w http.ResponseWriter, r *http.Request, newState string) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "domain:approve") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	p.decideQuotaRequest(w, r, token, dbDomain, nil, newState)
+}
+
+func (p *v1Provider) decideProjectQuotaRequest(w http.ResponseWriter, r *http.Request, newState string) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "project:approve") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	dbProject := p.FindProjectFromRequest(w, r, dbDomain)
+	if dbProject == nil {
+		return
+	}
+	p.decideQuotaRequest(w, r, token, dbDomain, dbProject, newState)
+}
+
+func (p *v1Provider) decideQuotaRequest(w http.ResponseWriter, r *http.Request, token *Token, dbDomain *db.Domain, dbProject *db.Project, newState string) {
+	requestID, err := strconv.ParseInt(mux.Vars(r)["request_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "no such quota request", 404)
+		return
+	}
+
+	//parse request body (optional, only contains a comment)
+	var parseTarget struct {
+		Request struct {
+			Comment string `json:"comment"`
+		} `json:"request"`
+	}
+	if r.ContentLength != 0 && !RequireJSON(w, r, &parseTarget) {
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if ReturnError(w, err) {
+		return
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	//find the request (it must belong to the domain or project from the URL)
+	var request db.QuotaRequest
+	if dbProject == nil {
+		err = tx.SelectOne(&request,
+			`SELECT * FROM quota_requests WHERE id = $1 AND domain_id = $2 AND project_id IS NULL`,
+			requestID, dbDomain.ID)
+	} else {
+		err = tx.SelectOne(&request,
+			`SELECT * FROM quota_requests WHERE id = $1 AND domain_id = $2 AND project_id = $3`,
+			requestID, dbDomain.ID, dbProject.ID)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such quota request", 404)
+		return
+	}
+	if ReturnError(w, err) {
+		return
+	}
+	if request.State != db.QuotaRequestPending {
+		http.Error(w, fmt.Sprintf("quota request %d has already been %s", request.ID, request.State), 409)
+		return
+	}
+
+	auditTrail := newAuditTrail(p.Cluster.ID, token)
+	var projectServices []db.ProjectService
+	if newState == db.QuotaRequestApproved {
+		//the quota values are checked again at approval time since the domain's
+		//quotas may have changed since the request was filed
+		var resources []db.QuotaRequestResource
+		_, err = tx.Select(&resources,
+			`SELECT * FROM quota_request_resources WHERE request_id = $1`, request.ID)
+		if ReturnError(w, err) {
+			return
+		}
+		serviceQuotas := make(ServiceQuotas)
+		for _, res := range resources {
+			if serviceQuotas[res.ServiceType] == nil {
+				serviceQuotas[res.ServiceType] = make(ResourceQuotas)
+			}
+			serviceQuotas[res.ServiceType][res.Name] = ResourceQuota{
+				ValueWithUnit: limes.ValueWithUnit{
+					Value: res.Quota,
+					Unit:  limes.UnitUnspecified,
+				},
+			}
+		}
+
+		//take the same locks as PutDomain/PutProject, so that the domain report
+		//cannot be outdated by concurrent quota changes before we have written
+		//ours
+		if dbProject == nil {
+			err = lockDomainQuotas(tx, dbDomain)
+		} else {
+			err = lockQuotasForProjectUpdate(tx, dbDomain, dbProject)
+		}
+		if ReturnError(w, err) {
+			return
+		}
+		domainReports, err := reports.GetDomains(p.Cluster, &dbDomain.ID, tx, reports.Filter{})
+		if ReturnError(w, err) {
+			return
+		}
+		if len(domainReports) == 0 {
+			http.Error(w, "no resource data found for domain", 500)
+			return
+		}
+		domainReport := domainReports[0]
+
+		var verdicts ResourceVerdicts
+		if dbProject == nil {
+			var updates []domainQuotaUpdate
+			updates, verdicts, err = prepareDomainQuotaUpdates(tx, p.Cluster, dbDomain, domainReport, serviceQuotas, true, true)
+			if ReturnError(w, err) {
+				return
+			}
+			if len(verdicts.Errors()) == 0 {
+				addDomainQuotaUpdatesToAuditTrail(&auditTrail, dbDomain, updates)
+				err = applyDomainQuotaUpdates(tx, updates)
+			}
+		} else {
+			var (
+				hierarchy *validation.ProjectHierarchy
+				updates   []projectQuotaUpdate
+			)
+			hierarchy, err = validation.LoadProjectHierarchy(tx, dbDomain)
+			if ReturnError(w, err) {
+				return
+			}
+			updates, verdicts, err = prepareProjectQuotaUpdates(tx, p.Cluster, dbProject, domainReport, hierarchy, serviceQuotas, true, true, true)
+			if ReturnError(w, err) {
+				return
+			}
+			if len(verdicts.Errors()) == 0 {
+				addProjectQuotaUpdatesToAuditTrail(&auditTrail, dbDomain, dbProject, updates)
+				err = applyProjectQuotaUpdates(tx, updates)
+				projectServices = updatedProjectServices(updates)
+			}
+		}
+		if returnQuotaUpdateError(w, err) {
+			return
+		}
+
+		//if not legal, report errors to the user (the request stays pending)
+		if len(verdicts.Errors()) > 0 {
+			returnVerdictErrors(w, r, "cannot approve quota request:\n", verdicts)
+			return
+		}
+	}
+
+	//record the decision
+	now := timeNow()
+	request.State = newState
+	request.DecidedAt = &now
+	request.DeciderUUID = token.UserUUID
+	request.DeciderName = token.UserName
+	request.DecisionComment = parseTarget.Request.Comment
+	_, err = tx.Update(&request)
+	if ReturnError(w, err) {
+		return
+	}
+	action := db.AuditActionApproveRequest
+	if newState == db.QuotaRequestRejected {
+		action = db.AuditActionRejectRequest
+	}
+	auditTrail.Add(quotaRequestAuditEvent(dbDomain, dbProject, action),
+		"%s quota request %d for %s by user %s (%s)",
+		newState, request.ID, describeQuotaRequestTarget(dbDomain, dbProject), token.UserUUID, token.UserName,
+	)
+	err = auditTrail.Write(tx)
+	if ReturnError(w, err) {
+		return
+	}
+	err = tx.Commit()
+	if ReturnError(w, err) {
+		return
+	}
+	auditTrail.Commit()
+
+	//attempt to write the quotas into the backend (see comment in PutProject)
+	if len(projectServices) > 0 {
+		errors, err := collector.WriteProjectQuotasToBackend(p.Cluster, dbDomain.UUID, dbProject.UUID, projectServices)
+		if ReturnError(w, err) {
+			return
+		}
+		if len(errors) > 0 {
+			msg := "quota request has been approved, but some error(s) occurred while trying to write the quotas into the backend services:"
+			http.Error(w, msg+"\n"+strings.Join(errors, "\n"), 202)
+			return
+		}
+	}
+
+	p.returnQuotaRequest(w, 200, request.ID)
+}
+
+func (p *v1Provider) returnQuotaRequest(w http.ResponseWriter, code int, requestID int64) {
+	requests, err := reports.GetQuotaRequests(p.Cluster, db.DB, reports.QuotaRequestFilter{RequestID: &requestID})
+	if ReturnError(w, err) {
+		return
+	}
+	if len(requests) == 0 {
+		http.Error(w, "quota request not found after it was stored", 500)
+		return
+	}
+	ReturnJSON(w, code, map[string]interface{}{"request": requests[0]})
+}
+
+func quotaRequestAuditEvent(dbDomain *db.Domain, dbProject *db.Project, action string) db.AuditEvent {
+	event := db.AuditEvent{DomainUUID: dbDomain.UUID, Action: action}
+	if dbProject != nil {
+		event.ProjectUUID = dbProject.UUID
+	}
+	return event
+}
+
+func describeQuotaRequestTarget(dbDomain *db.Domain, dbProject *db.Project) string {
+	if dbProject == nil {
+		return "domain " + dbDomain.UUID
+	}
+	return "project " + dbProject.UUID
+}
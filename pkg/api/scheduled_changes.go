@@ -0,0 +1,503 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/limes/pkg/collector"
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/reports"
+	"github.com/sapcc/limes/pkg/util"
+	"github.com/sapcc/limes/pkg/validation"
+	gorp "gopkg.in/gorp.v2"
+)
+
+//ListScheduledChanges handles GET /v1/domains/:domain_id/scheduled-changes.
+func (p *v1Provider) ListScheduledChanges(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	if !token.Require(w, "domain:show") {
+		return
+	}
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+
+	//only pending changes are shown unless the user asks for something else
+	filter := reports.ScheduledChangeFilter{DomainID: &dbDomain.ID}
+	filter.States = r.URL.Query()["state"]
+	if len(filter.States) == 0 {
+		filter.States = []string{db.ScheduledChangePending}
+	}
+	for _, state := range filter.States {
+		if !isValidScheduledChangeState(state) {
+			http.Error(w, "invalid value for state: "+state, 400)
+			return
+		}
+	}
+
+	changes, err := reports.GetScheduledChanges(p.Cluster, db.DB, filter)
+	if ReturnError(w, err) {
+		return
+	}
+	if changes == nil {
+		changes = []*reports.ScheduledChange{}
+	}
+	ReturnJSON(w, 200, map[string]interface{}{"scheduled_changes": changes})
+}
+
+func isValidScheduledChangeState(state string) bool {
+	switch state {
+	case db.ScheduledChangePending, db.ScheduledChangeApplied, db.ScheduledChangeFailed, db.ScheduledChangeCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+//PostScheduledChange handles POST /v1/domains/:domain_id/scheduled-changes.
+func (p *v1Provider) PostScheduledChange(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+
+	//parse request body
+	var parseTarget struct {
+		Change struct {
+			ProjectUUID string        `json:"project_id"`
+			DueAt       int64         `json:"due_at"`
+			Comment     string        `json:"comment"`
+			Services    ServiceQuotas `json:"services"`
+		} `json:"scheduled_change"`
+	}
+	parseTarget.Change.Services = make(ServiceQuotas)
+	if !RequireJSON(w, r, &parseTarget) {
+		return
+	}
+	input := parseTarget.Change
+
+	tx, err := db.DB.Begin()
+	if ReturnError(w, err) {
+		return
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	var dbProject *db.Project
+	if input.ProjectUUID != "" {
+		dbProject, err = findProjectInDomain(tx, dbDomain, input.ProjectUUID)
+		if ReturnError(w, err) {
+			return
+		}
+		if dbProject == nil {
+			http.Error(w, fmt.Sprintf("no such project: %s", input.ProjectUUID), 404)
+			return
+		}
+	}
+
+	//the user's permissions are recorded with the change, so that the change
+	//is validated in the same way as a PUT on the domain or project would be
+	canRaise, canLower, ok := checkScheduledChangePermissions(w, token, dbProject)
+	if !ok {
+		return
+	}
+
+	//validate the new quotas (whether they are acceptable is only decided when
+	//the change is applied)
+	var (
+		resources []db.ScheduledChangeResource
+		errors    []string
+	)
+	now := timeNow()
+	dueAt := time.Unix(input.DueAt, 0).UTC()
+	if !dueAt.After(now) {
+		errors = append(errors, "due_at must be in the future")
+	}
+	for serviceType, resourceQuotas := range input.Services {
+		for resourceName, quotaInput := range resourceQuotas {
+			if !p.Cluster.HasResource(serviceType, resourceName) {
+				errors = append(errors, fmt.Sprintf("cannot schedule %s/%s quota: no such resource", serviceType, resourceName))
+				continue
+			}
+			if quotaInput.ExpiresAt != nil {
+				errors = append(errors, fmt.Sprintf("cannot schedule %s/%s quota: expiry is not supported for scheduled changes", serviceType, resourceName))
+				continue
+			}
+			quota, err := quotaInput.ConvertFor(p.Cluster, serviceType, resourceName)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("cannot schedule %s/%s quota: %s", serviceType, resourceName, err.Error()))
+				continue
+			}
+			resources = append(resources, db.ScheduledChangeResource{
+				ServiceType: serviceType,
+				Name:        resourceName,
+				Quota:       quota,
+			})
+		}
+	}
+	if len(errors) == 0 && len(resources) == 0 {
+		errors = append(errors, "no quotas given")
+	}
+	if len(errors) > 0 {
+		http.Error(w, strings.Join(errors, "\n"), 422)
+		return
+	}
+
+	//store the change
+	change := db.ScheduledChange{
+		DomainID:    dbDomain.ID,
+		State:       db.ScheduledChangePending,
+		Comment:     input.Comment,
+		DueAt:       dueAt,
+		CreatedAt:   now,
+		CreatorUUID: token.UserUUID,
+		CreatorName: token.UserName,
+		CanRaise:    canRaise,
+		CanLower:    canLower,
+	}
+	if dbProject != nil {
+		change.ProjectID = &dbProject.ID
+	}
+	err = tx.Insert(&change)
+	if ReturnError(w, err) {
+		return
+	}
+	for _, res := range resources {
+		res.ChangeID = change.ID
+		err = tx.Insert(&res)
+		if ReturnError(w, err) {
+			return
+		}
+	}
+
+	auditTrail := newAuditTrail(p.Cluster.ID, token)
+	auditTrail.Add(quotaRequestAuditEvent(dbDomain, dbProject, db.AuditActionScheduleChange),
+		"scheduled change %d for %s at %s by user %s (%s)",
+		change.ID, describeQuotaRequestTarget(dbDomain, dbProject), dueAt.Format(time.RFC3339),
+		token.UserUUID, token.UserName,
+	)
+	err = auditTrail.Write(tx)
+	if ReturnError(w, err) {
+		return
+	}
+	err = tx.Commit()
+	if ReturnError(w, err) {
+		return
+	}
+	auditTrail.Commit()
+
+	p.returnScheduledChange(w, 201, change.ID)
+}
+
+//CancelScheduledChange handles DELETE /v1/domains/:domain_id/scheduled-changes/:change_id.
+func (p *v1Provider) CancelScheduledChange(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+	changeID, err := strconv.ParseInt(mux.Vars(r)["change_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "no such scheduled change", 404)
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if ReturnError(w, err) {
+		return
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	var change db.ScheduledChange
+	err = tx.SelectOne(&change,
+		`SELECT * FROM scheduled_changes WHERE id = $1 AND domain_id = $2 FOR UPDATE`,
+		changeID, dbDomain.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such scheduled change", 404)
+		return
+	}
+	if ReturnError(w, err) {
+		return
+	}
+	dbProject, err := findScheduledChangeProject(tx, change)
+	if ReturnError(w, err) {
+		return
+	}
+
+	//cancelling requires the same permissions as scheduling
+	_, _, ok := checkScheduledChangePermissions(w, token, dbProject)
+	if !ok {
+		return
+	}
+	if change.State != db.ScheduledChangePending {
+		http.Error(w, fmt.Sprintf("scheduled change %d has already been %s", change.ID, change.State), 409)
+		return
+	}
+
+	now := timeNow()
+	change.State = db.ScheduledChangeCancelled
+	change.ProcessedAt = &now
+	_, err = tx.Update(&change)
+	if ReturnError(w, err) {
+		return
+	}
+
+	auditTrail := newAuditTrail(p.Cluster.ID, token)
+	auditTrail.Add(quotaRequestAuditEvent(dbDomain, dbProject, db.AuditActionCancelChange),
+		"cancelled scheduled change %d for %s by user %s (%s)",
+		change.ID, describeQuotaRequestTarget(dbDomain, dbProject), token.UserUUID, token.UserName,
+	)
+	err = auditTrail.Write(tx)
+	if ReturnError(w, err) {
+		return
+	}
+	err = tx.Commit()
+	if ReturnError(w, err) {
+		return
+	}
+	auditTrail.Commit()
+
+	p.returnScheduledChange(w, 200, change.ID)
+}
+
+//checkScheduledChangePermissions checks whether the user may raise or lower
+//quotas on the domain from the request URL (if project is nil) or on the
+//given project. If the user may do neither, an error response is written and
+//ok is false.
+func checkScheduledChangePermissions(w http.ResponseWriter, token *Token, project *db.Project) (canRaise, canLower, ok bool) {
+	if project == nil {
+		canRaise = token.Check("domain:raise")
+		canLower = token.Check("domain:lower")
+		if !canRaise && !canLower {
+			token.Require(w, "domain:raise") //produce standard Unauthorized response
+			return false, false, false
+		}
+		return canRaise, canLower, true
+	}
+
+	canRaise = token.CheckForProject("project:raise", project)
+	canLower = token.CheckForProject("project:lower", project)
+	if !canRaise && !canLower {
+		token.RequireForProject(w, "project:raise", project) //produce standard Unauthorized response
+		return false, false, false
+	}
+	return canRaise, canLower, true
+}
+
+func (p *v1Provider) returnScheduledChange(w http.ResponseWriter, code int, changeID int64) {
+	changes, err := reports.GetScheduledChanges(p.Cluster, db.DB, reports.ScheduledChangeFilter{ChangeID: &changeID})
+	if ReturnError(w, err) {
+		return
+	}
+	if len(changes) == 0 {
+		http.Error(w, "scheduled change not found after it was stored", 500)
+		return
+	}
+	ReturnJSON(w, code, map[string]interface{}{"scheduled_change": changes[0]})
+}
+
+func findScheduledChangeProject(tx *gorp.Transaction, change db.ScheduledChange) (*db.Project, error) {
+	if change.ProjectID == nil {
+		return nil, nil
+	}
+	var project db.Project
+	err := tx.SelectOne(&project, `SELECT * FROM projects WHERE id = $1`, *change.ProjectID)
+	return &project, err
+}
+
+//ApplyScheduledChange applies the scheduled change with the given ID if it is
+//still pending. The new quotas are validated in the same way as for PUT
+//requests on the respective domain or project, using the permissions that the
+//creator of the change had when they scheduled it. If validation fails, the
+//change is marked as failed. This implements collector.ScheduledChangeApplier
+//and is called periodically by `limes collect`.
+func ApplyScheduledChange(cluster *limes.Cluster, changeID int64, now time.Time) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	//lock the change, so that it cannot be cancelled or applied concurrently
+	//(if it was cancelled or applied since the caller selected it, there is
+	//nothing to do)
+	var change db.ScheduledChange
+	err = tx.SelectOne(&change,
+		`SELECT * FROM scheduled_changes WHERE id = $1 AND state = $2 FOR UPDATE`,
+		changeID, db.ScheduledChangePending)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var dbDomain db.Domain
+	err = tx.SelectOne(&dbDomain, `SELECT * FROM domains WHERE id = $1`, change.DomainID)
+	if err != nil {
+		return err
+	}
+	dbProject, err := findScheduledChangeProject(tx, change)
+	if err != nil {
+		return err
+	}
+
+	var resources []db.ScheduledChangeResource
+	_, err = tx.Select(&resources,
+		`SELECT * FROM scheduled_change_resources WHERE change_id = $1`, change.ID)
+	if err != nil {
+		return err
+	}
+	serviceQuotas := make(ServiceQuotas)
+	for _, res := range resources {
+		if serviceQuotas[res.ServiceType] == nil {
+			serviceQuotas[res.ServiceType] = make(ResourceQuotas)
+		}
+		serviceQuotas[res.ServiceType][res.Name] = ResourceQuota{
+			ValueWithUnit: limes.ValueWithUnit{
+				Value: res.Quota,
+				Unit:  limes.UnitUnspecified,
+			},
+		}
+	}
+
+	//take the same locks as PutDomain/PutProject, so that the domain report
+	//cannot be outdated by concurrent quota changes before we have written
+	//ours
+	if dbProject == nil {
+		err = lockDomainQuotas(tx, &dbDomain)
+	} else {
+		err = lockQuotasForProjectUpdate(tx, &dbDomain, dbProject)
+	}
+	if err != nil {
+		return err
+	}
+	domainReports, err := reports.GetDomains(cluster, &dbDomain.ID, tx, reports.Filter{})
+	if err != nil {
+		return err
+	}
+	if len(domainReports) == 0 {
+		return fmt.Errorf("no resource data found for domain %s", dbDomain.UUID)
+	}
+	domainReport := domainReports[0]
+
+	//the changes are recorded in the audit trail under the name of the user who
+	//scheduled them
+	auditTrail := db.AuditTrail{
+		Time:      now,
+		ClusterID: cluster.ID,
+		UserUUID:  change.CreatorUUID,
+		UserName:  change.CreatorName,
+	}
+
+	//validate and apply the new quotas in the same way as PutDomain/PutProject
+	var (
+		verdicts        ResourceVerdicts
+		projectServices []db.ProjectService
+	)
+	if dbProject == nil {
+		var updates []domainQuotaUpdate
+		updates, verdicts, err = prepareDomainQuotaUpdates(tx, cluster, &dbDomain, domainReport, serviceQuotas, change.CanRaise, change.CanLower)
+		if err != nil {
+			return err
+		}
+		if len(verdicts.Errors()) == 0 {
+			addDomainQuotaUpdatesToAuditTrail(&auditTrail, &dbDomain, updates)
+			err = applyDomainQuotaUpdates(tx, updates)
+		}
+	} else {
+		var (
+			hierarchy *validation.ProjectHierarchy
+			updates   []projectQuotaUpdate
+		)
+		hierarchy, err = validation.LoadProjectHierarchy(tx, &dbDomain)
+		if err != nil {
+			return err
+		}
+		updates, verdicts, err = prepareProjectQuotaUpdates(tx, cluster, dbProject, domainReport, hierarchy, serviceQuotas, change.CanRaise, change.CanLower, true)
+		if err != nil {
+			return err
+		}
+		if len(verdicts.Errors()) == 0 {
+			addProjectQuotaUpdatesToAuditTrail(&auditTrail, &dbDomain, dbProject, updates)
+			err = applyProjectQuotaUpdates(tx, updates)
+			projectServices = updatedProjectServices(updates)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	//record the outcome (if not legal, the change is marked as failed and
+	//nothing is applied)
+	target := describeQuotaRequestTarget(&dbDomain, dbProject)
+	if errors := verdicts.Errors(); len(errors) > 0 {
+		change.State = db.ScheduledChangeFailed
+		change.ErrorMessage = strings.Join(errors, "\n")
+		auditTrail.Add(quotaRequestAuditEvent(&dbDomain, dbProject, db.AuditActionFailChange),
+			"could not apply scheduled change %d for %s (scheduled by user %s (%s)): %s",
+			change.ID, target, change.CreatorUUID, change.CreatorName, strings.Join(errors, "; "),
+		)
+		util.LogInfo("could not apply scheduled change %d for %s: %s", change.ID, target, strings.Join(errors, "; "))
+	} else {
+		change.State = db.ScheduledChangeApplied
+		auditTrail.Add(quotaRequestAuditEvent(&dbDomain, dbProject, db.AuditActionApplyChange),
+			"applied scheduled change %d for %s (scheduled by user %s (%s))",
+			change.ID, target, change.CreatorUUID, change.CreatorName,
+		)
+	}
+	change.ProcessedAt = &now
+	_, err = tx.Update(&change)
+	if err != nil {
+		return err
+	}
+	err = auditTrail.Write(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	auditTrail.Commit()
+
+	//attempt to write the quotas into the backend (see comment in PutProject;
+	//if this fails, the consistency check will retry later, so the change
+	//still counts as applied and no error is returned)
+	if len(projectServices) > 0 {
+		errors, err := collector.WriteProjectQuotasToBackend(cluster, dbDomain.UUID, dbProject.UUID, projectServices)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+		for _, msg := range errors {
+			util.LogError("scheduled change %d was applied, but writing the quotas into the backend failed: %s", change.ID, msg)
+		}
+	}
+	return nil
+}
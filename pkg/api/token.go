@@ -20,11 +20,13 @@
 package api
 
 import (
+	"database/sql"
 	"errors"
 	"net/http"
 
 	policy "github.com/databus23/goslo.policy"
 	"github.com/gorilla/mux"
+	"github.com/sapcc/limes/pkg/db"
 )
 
 //Token represents a user's token, as passed through the X-Auth-Token header of
@@ -38,9 +40,10 @@ type Token struct {
 	UserName string
 }
 
-//CheckToken checks the validity of the request's X-Auth-Token in Keystone, and
-//returns a Token instance for checking authorization. Any errors that occur
-//during this function are deferred until Require() is called.
+//CheckToken checks the validity of the request's X-Auth-Token in Keystone (or
+//in the token cache), and returns a Token instance for checking authorization.
+//Any errors that occur during this function are deferred until Require() is
+//called.
 func (p *v1Provider) CheckToken(r *http.Request) *Token {
 	str := r.Header.Get("X-Auth-Token")
 	if str == "" {
@@ -48,8 +51,16 @@ func (p *v1Provider) CheckToken(r *http.Request) *Token {
 	}
 
 	t := &Token{enforcer: p.Config.API.PolicyEnforcer}
-	t.context, t.err = p.Cluster.Config.Auth.ValidateToken(str)
+	t.context, t.err = p.tokenCache.ValidateToken(str)
 	t.context.Request = mux.Vars(r)
+	//the project is only loaded to find its parent project, so this query can
+	//be skipped unless the policy refers to the parent project
+	projectUUID := t.context.Request["project_id"]
+	if projectUUID != "" && t.err == nil && p.Config.API.PolicyUsesParentProject {
+		var project *db.Project
+		project, t.err = findProjectForPolicy(projectUUID)
+		t.context.Request = requestVarsForProject(t.context.Request, projectUUID, project)
+	}
 	t.UserUUID = t.context.Auth["user_id"]
 	t.UserName = t.context.Auth["user_name"]
 	return t
@@ -75,3 +86,65 @@ func (t *Token) Require(w http.ResponseWriter, rule string) bool {
 func (t *Token) Check(rule string) bool {
 	return t.err == nil && t.enforcer.Enforce(rule, t.context)
 }
+
+//CheckForProject is like Check, but evaluates the rule as if the request URL
+//referred to the given project. This is used by endpoints that act on
+//multiple projects at once. The caller has already loaded the project, so no
+//further DB queries are needed.
+func (t *Token) CheckForProject(rule string, project *db.Project) bool {
+	if t.err != nil {
+		return false
+	}
+	ctx := t.context
+	ctx.Request = requestVarsForProject(t.context.Request, project.UUID, project)
+	return t.enforcer.Enforce(rule, ctx)
+}
+
+//RequireForProject is like Require, but evaluates the rule as if the request
+//URL referred to the given project (see CheckForProject).
+func (t *Token) RequireForProject(w http.ResponseWriter, rule string, project *db.Project) bool {
+	if t.err != nil {
+		http.Error(w, t.err.Error(), 401)
+		return false
+	}
+
+	if !t.CheckForProject(rule, project) {
+		http.Error(w, "Forbidden", 403)
+		return false
+	}
+	return true
+}
+
+//findProjectForPolicy loads the project with the given UUID, or returns nil
+//if the project is not known yet.
+func findProjectForPolicy(projectUUID string) (*db.Project, error) {
+	var project db.Project
+	err := db.DB.SelectOne(&project, `SELECT * FROM projects WHERE uuid = $1`, projectUUID)
+	switch err {
+	case nil:
+		return &project, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+//requestVarsForProject returns a copy of the given request variables where
+//"project_id" refers to the given project. If the project has a parent
+//project, the parent's UUID is added as "parent_project_id". This allows for
+//policy rules that let admins of parent projects manage their child projects.
+//The project may be nil if it is not known yet.
+func requestVarsForProject(vars map[string]string, projectUUID string, project *db.Project) map[string]string {
+	result := make(map[string]string, len(vars)+2)
+	for key, value := range vars {
+		result[key] = value
+	}
+	result["project_id"] = projectUUID
+
+	//the parent of a top-level project is the domain
+	if project != nil && project.ParentUUID != "" && project.ParentUUID != vars["domain_id"] {
+		result["parent_project_id"] = project.ParentUUID
+	}
+	return result
+}
@@ -0,0 +1,260 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	policy "github.com/databus23/goslo.policy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+var tokenCacheHitCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "limes_token_cache_hits",
+		Help: "Counter for Keystone token validations that were answered from the token cache.",
+	},
+	[]string{"os_cluster"},
+)
+
+var tokenCacheMissCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "limes_token_cache_misses",
+		Help: "Counter for Keystone token validations that required a request to Keystone.",
+	},
+	[]string{"os_cluster"},
+)
+
+var tokenCacheSizeGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_token_cache_entries",
+		Help: "Number of validated Keystone tokens in the token cache.",
+	},
+	[]string{"os_cluster"},
+)
+
+func init() {
+	prometheus.MustRegister(tokenCacheHitCounter)
+	prometheus.MustRegister(tokenCacheMissCounter)
+	prometheus.MustRegister(tokenCacheSizeGauge)
+}
+
+//defaultTokenCacheSize is used when the token cache is enabled, but no
+//maximum size is configured.
+const defaultTokenCacheSize = 1000
+
+//tokenValidator is the interface of limes.AuthParameters that the tokenCache
+//uses. (This is an interface to allow for substitution in unit tests.)
+type tokenValidator interface {
+	ValidateToken(token string) (policy.Context, limes.TokenMetadata, error)
+	ListRevocationEvents(since time.Time) ([]limes.RevocationEvent, error)
+}
+
+//tokenCache remembers the results of successful token validations for up to
+//the configured maximum TTL, but never beyond the token's expiry. Failed
+//validations are not cached.
+type tokenCache struct {
+	clusterID string
+	validator tokenValidator
+	maxTTL    time.Duration
+	maxSize   int
+	mutex     sync.Mutex
+	entries   map[string]tokenCacheEntry //key = SHA-256 hash of token
+	//generation is incremented by each call to ApplyRevocationEvents, so that
+	//validations that were in flight during a revocation do not put revoked
+	//tokens back into the cache
+	generation uint64
+}
+
+type tokenCacheEntry struct {
+	context    policy.Context
+	meta       limes.TokenMetadata
+	validUntil time.Time
+}
+
+//newTokenCache creates a tokenCache according to the given configuration. If
+//cfg.MaxTTL is zero, caching is disabled and all validations are forwarded to
+//the validator. If cfg.RevocationPollInterval is non-zero, a goroutine is
+//started that polls Keystone for revocation events.
+func newTokenCache(clusterID string, validator tokenValidator, cfg limes.TokenCacheConfiguration) *tokenCache {
+	c := &tokenCache{
+		clusterID: clusterID,
+		validator: validator,
+		maxTTL:    cfg.MaxTTL,
+		maxSize:   cfg.MaxSize,
+		entries:   make(map[string]tokenCacheEntry),
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultTokenCacheSize
+	}
+	if c.maxTTL > 0 && cfg.RevocationPollInterval > 0 {
+		go c.pollRevocationEvents(cfg.RevocationPollInterval)
+	}
+	return c
+}
+
+//ValidateToken is like limes.AuthParameters.ValidateToken, but answers from
+//the cache when possible.
+func (c *tokenCache) ValidateToken(token string) (policy.Context, error) {
+	if c.maxTTL <= 0 {
+		context, _, err := c.getValidator().ValidateToken(token)
+		return context, err
+	}
+
+	hashBytes := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(hashBytes[:])
+	now := timeNow()
+
+	c.mutex.Lock()
+	entry, exists := c.entries[key]
+	generation := c.generation
+	c.mutex.Unlock()
+	if exists && now.Before(entry.validUntil) {
+		tokenCacheHitCounter.With(prometheus.Labels{"os_cluster": c.clusterID}).Inc()
+		return entry.context, nil
+	}
+
+	tokenCacheMissCounter.With(prometheus.Labels{"os_cluster": c.clusterID}).Inc()
+	context, meta, err := c.getValidator().ValidateToken(token)
+	if err != nil {
+		return context, err
+	}
+
+	entry = tokenCacheEntry{context, meta, now.Add(c.maxTTL)}
+	if !meta.ExpiresAt.IsZero() && meta.ExpiresAt.Before(entry.validUntil) {
+		entry.validUntil = meta.ExpiresAt
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.generation != generation {
+		//the token might have been revoked after Keystone validated it
+		return context, nil
+	}
+	if len(c.entries) >= c.maxSize {
+		c.evict(now)
+	}
+	c.entries[key] = entry
+	c.updateSizeGauge()
+	return context, nil
+}
+
+//evict makes room for a new entry by removing all expired entries or, if
+//there are none, the entry that would expire first. The caller must hold the
+//mutex.
+func (c *tokenCache) evict(now time.Time) {
+	var (
+		earliestKey   string
+		earliestEntry tokenCacheEntry
+	)
+	for key, entry := range c.entries {
+		if !now.Before(entry.validUntil) {
+			delete(c.entries, key)
+			continue
+		}
+		if earliestKey == "" || entry.validUntil.Before(earliestEntry.validUntil) {
+			earliestKey, earliestEntry = key, entry
+		}
+	}
+	if len(c.entries) >= c.maxSize {
+		delete(c.entries, earliestKey)
+	}
+}
+
+//ApplyRevocationEvents removes all entries from the cache that match any of
+//the given revocation events. Events that cannot be matched against the
+//cached data (e.g. those revoking a role or trust) flush the entire cache.
+func (c *tokenCache) ApplyRevocationEvents(events []limes.RevocationEvent) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.updateSizeGauge()
+	c.generation++
+
+	for _, event := range events {
+		if event.RoleID != "" || event.TrustID != "" {
+			c.entries = make(map[string]tokenCacheEntry)
+			return
+		}
+		for key, entry := range c.entries {
+			if entry.matches(event) {
+				delete(c.entries, key)
+			}
+		}
+	}
+}
+
+func (e tokenCacheEntry) matches(event limes.RevocationEvent) bool {
+	auth := e.context.Auth
+	switch {
+	case event.UserID != "" && event.UserID == auth["user_id"]:
+		return true
+	case event.ProjectID != "" && event.ProjectID == auth["project_id"]:
+		return true
+	case event.DomainID != "" && (event.DomainID == auth["domain_id"] || event.DomainID == auth["user_domain_id"] || event.DomainID == auth["project_domain_id"]):
+		return true
+	}
+	for _, auditID := range e.meta.AuditIDs {
+		if auditID != "" && (auditID == event.AuditID || auditID == event.AuditChainID) {
+			return true
+		}
+	}
+	//an event without any of the attributes above would revoke all tokens
+	return event.UserID == "" && event.ProjectID == "" && event.DomainID == "" &&
+		event.AuditID == "" && event.AuditChainID == ""
+}
+
+//SetValidator replaces the validator that is used for cache misses, e.g.
+//after the configuration has been reloaded. Cached entries are retained.
+func (c *tokenCache) SetValidator(validator tokenValidator) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.validator = validator
+}
+
+func (c *tokenCache) getValidator() tokenValidator {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.validator
+}
+
+func (c *tokenCache) updateSizeGauge() {
+	tokenCacheSizeGauge.With(prometheus.Labels{"os_cluster": c.clusterID}).Set(float64(len(c.entries)))
+}
+
+func (c *tokenCache) pollRevocationEvents(interval time.Duration) {
+	since := time.Now()
+	for {
+		time.Sleep(interval)
+		pollStartedAt := time.Now()
+		events, err := c.getValidator().ListRevocationEvents(since)
+		if err != nil {
+			util.LogError("cannot poll Keystone for token revocation events: %s", err.Error())
+			continue
+		}
+		//applying an event twice is harmless, so leave some overlap between polls
+		//in case our clock is ahead of Keystone's
+		since = pollStartedAt.Add(-time.Minute)
+		c.ApplyRevocationEvents(events)
+	}
+}
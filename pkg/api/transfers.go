@@ -0,0 +1,331 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	gorp "gopkg.in/gorp.v2"
+
+	"github.com/sapcc/limes/pkg/collector"
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/reports"
+	"github.com/sapcc/limes/pkg/validation"
+)
+
+//PostQuotaTransfer handles POST /v1/domains/:domain_id/quota-transfers.
+func (p *v1Provider) PostQuotaTransfer(w http.ResponseWriter, r *http.Request) {
+	token := p.CheckToken(r)
+
+	//parse request body
+	var parseTarget struct {
+		Transfer struct {
+			SourceProjectUUID string        `json:"source_project_id"`
+			TargetProjectUUID string        `json:"target_project_id"`
+			Services          ServiceQuotas `json:"services"`
+		} `json:"transfer"`
+	}
+	parseTarget.Transfer.Services = make(ServiceQuotas)
+	if !RequireJSON(w, r, &parseTarget) {
+		return
+	}
+	transfer := parseTarget.Transfer
+	if transfer.SourceProjectUUID == transfer.TargetProjectUUID {
+		http.Error(w, "source and target project must be different", 400)
+		return
+	}
+
+	dbDomain := p.FindDomainFromRequest(w, r, p.Cluster)
+	if dbDomain == nil {
+		return
+	}
+
+	//start a transaction for the quota updates
+	tx, err := db.DB.Begin()
+	if ReturnError(w, err) {
+		return
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	//find both projects
+	var projects [2]*db.Project
+	for idx, projectUUID := range []string{transfer.SourceProjectUUID, transfer.TargetProjectUUID} {
+		projects[idx], err = findProjectInDomain(tx, dbDomain, projectUUID)
+		if ReturnError(w, err) {
+			return
+		}
+		if projects[idx] == nil {
+			http.Error(w, fmt.Sprintf("no such project: %s", projectUUID), 404)
+			return
+		}
+	}
+	sourceProject, targetProject := projects[0], projects[1]
+
+	//check permissions on both projects
+	for _, project := range projects {
+		if !token.RequireForProject(w, "project:transfer", project) {
+			return
+		}
+	}
+
+	//lock the quotas of both projects until the end of the transaction, so that
+	//concurrent transfers out of the same project cannot both see the same
+	//source quota
+	_, err = tx.Exec(lockQuotaTransferQuery, sourceProject.ID, targetProject.ID)
+	if ReturnError(w, err) {
+		return
+	}
+
+	//compute the new quotas for both projects
+	sourceQuotas, targetQuotas, errors, err := prepareQuotaTransfer(tx, p.Cluster, sourceProject, targetProject, transfer.Services)
+	if ReturnError(w, err) {
+		return
+	}
+	if len(errors) > 0 {
+		http.Error(w, strings.Join(errors, "\n"), 422)
+		return
+	}
+
+	//validate the new quotas (the domain quota only needs to be checked when
+	//quota is transferred from a child project, whose quota does not count
+	//towards the domain quota, into a top-level project, which is the only
+	//case in which the sum of all top-level project quotas grows)
+	hierarchy, err := validation.LoadProjectHierarchy(tx, dbDomain)
+	if ReturnError(w, err) {
+		return
+	}
+	var domainReport *reports.Domain
+	if hierarchy.IsChildProject(sourceProject.UUID) && !hierarchy.IsChildProject(targetProject.UUID) {
+		domainReports, err := reports.GetDomains(p.Cluster, &dbDomain.ID, tx, reports.Filter{})
+		if ReturnError(w, err) {
+			return
+		}
+		if len(domainReports) == 0 {
+			http.Error(w, "no resource data found for domain", 500)
+			return
+		}
+		domainReport = domainReports[0]
+	}
+	//each project shall be checked against the final quotas of the other one
+	//(this matters if one is the parent of the other)
+	for _, item := range []struct {
+		Project *db.Project
+		Quotas  ServiceQuotas
+	}{{sourceProject, sourceQuotas}, {targetProject, targetQuotas}} {
+		for serviceType, resourceQuotas := range item.Quotas {
+			for resourceName, quota := range resourceQuotas {
+				hierarchy.Set(validation.ProjectResourceRef{ProjectUUID: item.Project.UUID, ServiceType: serviceType, ResourceName: resourceName}, quota.Value)
+			}
+		}
+	}
+	sourceUpdates, sourceVerdicts, err := prepareProjectQuotaUpdates(tx, p.Cluster, sourceProject, domainReport, hierarchy, sourceQuotas, true, true, true)
+	if ReturnError(w, err) {
+		return
+	}
+	targetUpdates, targetVerdicts, err := prepareProjectQuotaUpdates(tx, p.Cluster, targetProject, domainReport, hierarchy, targetQuotas, true, true, true)
+	if ReturnError(w, err) {
+		return
+	}
+	if len(sourceVerdicts.Errors())+len(targetVerdicts.Errors()) > 0 {
+		returnVerdictErrors(w, r, "", sourceVerdicts, targetVerdicts)
+		return
+	}
+
+	//update the DB with the new quotas
+	auditTrail := newAuditTrail(p.Cluster.ID, token)
+	addQuotaTransferToAuditTrail(&auditTrail, dbDomain, sourceProject, targetProject, sourceUpdates, targetUpdates)
+	err = applyProjectQuotaUpdates(tx, append(sourceUpdates, targetUpdates...))
+	if returnQuotaUpdateError(w, err) {
+		return
+	}
+	err = auditTrail.Write(tx)
+	if ReturnError(w, err) {
+		return
+	}
+	err = tx.Commit()
+	if ReturnError(w, err) {
+		return
+	}
+	auditTrail.Commit()
+
+	//attempt to write the quotas into the backend (see comment in PutProject
+	//for why this happens after tx.Commit())
+	errors, err = collector.WriteProjectQuotasToBackend(p.Cluster, dbDomain.UUID, sourceProject.UUID, updatedProjectServices(sourceUpdates))
+	if ReturnError(w, err) {
+		return
+	}
+	targetErrors, err := collector.WriteProjectQuotasToBackend(p.Cluster, dbDomain.UUID, targetProject.UUID, updatedProjectServices(targetUpdates))
+	if ReturnError(w, err) {
+		return
+	}
+	errors = append(errors, targetErrors...)
+
+	//report any backend errors to the user
+	if len(errors) > 0 {
+		msg := "quotas have been transferred, but some error(s) occurred while trying to write the quotas into the backend services:"
+		http.Error(w, msg+"\n"+strings.Join(errors, "\n"), 202)
+		return
+	}
+
+	//otherwise, report success
+	var result []*reports.Project
+	for _, project := range projects {
+		projectReports, err := reports.GetProjects(p.Cluster, dbDomain.ID, &project.ID, db.DB, reports.Filter{}, false)
+		if ReturnError(w, err) {
+			return
+		}
+		if len(projectReports) == 0 {
+			http.Error(w, "no resource data found for project", 500)
+			return
+		}
+		result = append(result, projectReports[0])
+	}
+	ReturnJSON(w, 200, map[string]interface{}{"projects": result})
+}
+
+//findProjectInDomain returns the project with the given UUID if it exists in
+//the given domain, or nil otherwise.
+func findProjectInDomain(tx *gorp.Transaction, domain *db.Domain, projectUUID string) (*db.Project, error) {
+	var project db.Project
+	err := tx.SelectOne(&project,
+		`SELECT * FROM projects WHERE domain_id = $1 AND uuid = $2`, domain.ID, projectUUID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &project, err
+}
+
+//The rows are locked in a fixed order (by project ID) to avoid deadlocks
+//between two transfers in opposite directions.
+var lockQuotaTransferQuery = `
+	SELECT pr.service_id FROM project_resources pr
+	  JOIN project_services ps ON ps.id = pr.service_id
+	 WHERE ps.project_id IN ($1, $2)
+	 ORDER BY ps.project_id, pr.service_id, pr.name
+	   FOR UPDATE OF pr
+`
+
+var quotaTransferQuery = `
+	SELECT pr.quota FROM project_resources pr
+	  JOIN project_services ps ON ps.id = pr.service_id
+	 WHERE ps.project_id = $1 AND ps.type = $2 AND pr.name = $3
+`
+
+//prepareQuotaTransfer computes the new quota values for the source and target
+//project of a quota transfer. The results can be passed into
+//prepareProjectQuotaUpdates() for further validation. Validation errors are
+//returned as a list of messages; only DB errors cause a non-nil error return.
+func prepareQuotaTransfer(tx *gorp.Transaction, cluster *limes.Cluster, source, target *db.Project, amounts ServiceQuotas) (sourceQuotas, targetQuotas ServiceQuotas, errors []string, err error) {
+	sourceQuotas = make(ServiceQuotas)
+	targetQuotas = make(ServiceQuotas)
+
+	//iterate in a stable order to get stable error messages
+	serviceTypes := make([]string, 0, len(amounts))
+	for serviceType := range amounts {
+		serviceTypes = append(serviceTypes, serviceType)
+	}
+	sort.Strings(serviceTypes)
+
+	for _, serviceType := range serviceTypes {
+		resourceNames := make([]string, 0, len(amounts[serviceType]))
+		for resourceName := range amounts[serviceType] {
+			resourceNames = append(resourceNames, resourceName)
+		}
+		sort.Strings(resourceNames)
+
+		for _, resourceName := range resourceNames {
+			if !cluster.HasResource(serviceType, resourceName) {
+				errors = append(errors, fmt.Sprintf("cannot transfer %s/%s quota: no such resource", serviceType, resourceName))
+				continue
+			}
+			amount, err := amounts[serviceType][resourceName].ConvertFor(cluster, serviceType, resourceName)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("cannot transfer %s/%s quota: %s", serviceType, resourceName, err.Error()))
+				continue
+			}
+
+			var sourceQuota, targetQuota uint64
+			err = tx.QueryRow(quotaTransferQuery, source.ID, serviceType, resourceName).Scan(&sourceQuota)
+			if err == nil {
+				err = tx.QueryRow(quotaTransferQuery, target.ID, serviceType, resourceName).Scan(&targetQuota)
+			}
+			if err == sql.ErrNoRows {
+				//this should only occur if one of the projects was not scraped yet
+				errors = append(errors, fmt.Sprintf("cannot transfer %s/%s quota: quota data is not available for both projects yet", serviceType, resourceName))
+				continue
+			}
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			if amount > sourceQuota {
+				unit := cluster.InfoForResource(serviceType, resourceName).Unit
+				errors = append(errors, fmt.Sprintf("cannot transfer %s/%s quota: source project only has a quota of %s",
+					serviceType, resourceName, unit.Format(sourceQuota)))
+				continue
+			}
+
+			if sourceQuotas[serviceType] == nil {
+				sourceQuotas[serviceType] = make(ResourceQuotas)
+				targetQuotas[serviceType] = make(ResourceQuotas)
+			}
+			sourceQuotas[serviceType][resourceName] = ResourceQuota{ValueWithUnit: limes.ValueWithUnit{Value: sourceQuota - amount, Unit: limes.UnitUnspecified}}
+			targetQuotas[serviceType][resourceName] = ResourceQuota{ValueWithUnit: limes.ValueWithUnit{Value: targetQuota + amount, Unit: limes.UnitUnspecified}}
+		}
+	}
+
+	if len(errors) == 0 && len(sourceQuotas) == 0 {
+		errors = append(errors, "no quotas to transfer")
+	}
+	return
+}
+
+//addQuotaTransferToAuditTrail records the quota changes from a quota transfer in the audit trail.
+func addQuotaTransferToAuditTrail(auditTrail *db.AuditTrail, domain *db.Domain, source, target *db.Project, sourceUpdates, targetUpdates []projectQuotaUpdate) {
+	for _, item := range []struct {
+		Project   *db.Project
+		Updates   []projectQuotaUpdate
+		Direction string
+	}{
+		{source, sourceUpdates, "to project " + target.UUID},
+		{target, targetUpdates, "from project " + source.UUID},
+	} {
+		for _, update := range item.Updates {
+			oldQuota, newQuota := update.OldQuota, update.Resource.Quota
+			auditTrail.Add(db.AuditEvent{
+				DomainUUID:   domain.UUID,
+				ProjectUUID:  item.Project.UUID,
+				ServiceType:  update.Service.Type,
+				ResourceName: update.Resource.Name,
+				Action:       db.AuditActionTransferQuota,
+				OldValue:     &oldQuota,
+				NewValue:     &newQuota,
+			}, "transfer quota %s.%s = %d -> %d for project %s (%s) by user %s (%s)",
+				update.Service.Type, update.Resource.Name, oldQuota, newQuota,
+				item.Project.UUID, item.Direction, auditTrail.UserUUID, auditTrail.UserName,
+			)
+		}
+	}
+}
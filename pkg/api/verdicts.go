@@ -0,0 +1,143 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sapcc/limes/pkg/validation"
+)
+
+//Acceptable values for ResourceVerdict.Verdict.
+const (
+	verdictAccepted  = "accepted"
+	verdictRejected  = "rejected"
+	verdictUnchanged = "unchanged"
+)
+
+//ResourceVerdict describes the outcome of validating a single quota or
+//capacity value in a PUT request. Verdicts are reported to the user when the
+//request is made in dry-run mode.
+type ResourceVerdict struct {
+	ServiceType  string `json:"service"`
+	ResourceName string `json:"resource"`
+	Verdict      string `json:"verdict"`
+	Reason       string `json:"reason,omitempty"`
+	ReasonCode   string `json:"reason_code,omitempty"`
+	//These are pointers to values to enable precise control over whether this field is rendered in output.
+	OldValue           *uint64 `json:"old_value,omitempty"`
+	NewValue           *uint64 `json:"new_value,omitempty"`
+	MinAcceptableValue *uint64 `json:"min_acceptable_value,omitempty"`
+	MaxAcceptableValue *uint64 `json:"max_acceptable_value,omitempty"`
+}
+
+//ResourceVerdicts is a list of ResourceVerdict that is filled while a PUT
+//request is being validated.
+type ResourceVerdicts []ResourceVerdict
+
+func (v *ResourceVerdicts) accept(serviceType, resourceName string, oldValue, newValue *uint64) {
+	*v = append(*v, ResourceVerdict{
+		ServiceType:  serviceType,
+		ResourceName: resourceName,
+		Verdict:      verdictAccepted,
+		OldValue:     oldValue,
+		NewValue:     newValue,
+	})
+}
+
+func (v *ResourceVerdicts) reject(serviceType, resourceName string, err error) {
+	*v = append(*v, rejectedVerdict(serviceType, resourceName, err))
+}
+
+//rejectedVerdict builds a rejected verdict. If the given error is a
+//validation.ResourceError, its reason code and acceptable values are included.
+func rejectedVerdict(serviceType, resourceName string, err error) ResourceVerdict {
+	verdict := ResourceVerdict{
+		ServiceType:  serviceType,
+		ResourceName: resourceName,
+		Verdict:      verdictRejected,
+		Reason:       err.Error(),
+		ReasonCode:   validation.ReasonInvalidValue,
+	}
+	if rerr, ok := err.(*validation.ResourceError); ok {
+		verdict.ReasonCode = rerr.Code
+		verdict.MinAcceptableValue = rerr.MinAcceptable
+		verdict.MaxAcceptableValue = rerr.MaxAcceptable
+	}
+	return verdict
+}
+
+func (v *ResourceVerdicts) unchanged(serviceType, resourceName string, value uint64) {
+	*v = append(*v, ResourceVerdict{
+		ServiceType:  serviceType,
+		ResourceName: resourceName,
+		Verdict:      verdictUnchanged,
+		OldValue:     &value,
+		NewValue:     &value,
+	})
+}
+
+//overrule turns a previous "accepted" verdict for the given resource into a
+//rejection. This is used when a value that was acceptable on its own turns out
+//to be unacceptable in combination with other values in the same request.
+func (v ResourceVerdicts) overrule(serviceType, resourceName string, err error) {
+	for idx, verdict := range v {
+		if verdict.ServiceType == serviceType && verdict.ResourceName == resourceName && verdict.Verdict == verdictAccepted {
+			v[idx] = rejectedVerdict(serviceType, resourceName, err)
+		}
+	}
+}
+
+//MarshalJSON implements the json.Marshaler interface.
+func (v ResourceVerdicts) MarshalJSON() ([]byte, error) {
+	//render an empty list instead of null
+	if v == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]ResourceVerdict(v))
+}
+
+//Errors returns the reasons for all rejected values, in the order in which
+//they were rejected.
+func (v ResourceVerdicts) Errors() []string {
+	var errors []string
+	for _, verdict := range v {
+		if verdict.Verdict == verdictRejected {
+			errors = append(errors, verdict.Reason)
+		}
+	}
+	return errors
+}
+
+//isDryRun checks whether the ?dry_run query parameter was given.
+func isDryRun(r *http.Request) bool {
+	_, dryRun := r.URL.Query()["dry_run"]
+	return dryRun
+}
+
+//dryRunStatusCode returns the status code for the response to a PUT request
+//in dry-run mode: 200 if the request would have been accepted, 422 otherwise.
+func dryRunStatusCode(errors []string) int {
+	if len(errors) > 0 {
+		return 422
+	}
+	return 200
+}
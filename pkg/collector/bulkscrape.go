@@ -0,0 +1,317 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//bulk scraping is only used when at least this fraction of all projects
+//needs scraping (when only a few projects need scraping, e.g. because of a
+//sync request, scraping them individually is much cheaper than listing the
+//data for all projects in the cluster)
+const bulkScrapeMinRatio = 0.5
+
+//how many project services are claimed or written in a single transaction
+//during bulk scraping
+var bulkScrapeBatchSize = 100
+
+//when ScrapeAll() fails, the next bulk scrape is only attempted after this
+//interval (until then, projects are scraped individually)
+var bulkScrapeRetryInterval = 10 * time.Minute
+
+//bulkScrapeRetryTimes holds the time after which the next bulk scrape may be
+//attempted for each service type. It is shared between all scraping workers
+//for the same service type, so that a failed ScrapeAll() makes all of them
+//fall back to individual scrapes, instead of each worker trying ScrapeAll()
+//against the broken backend on its own.
+type bulkScrapeRetryTimes struct {
+	mutex sync.Mutex
+	times map[string]time.Time
+}
+
+var bulkScrapeRetryAt = &bulkScrapeRetryTimes{times: make(map[string]time.Time)}
+
+//Get returns the retry time for the given service type.
+func (r *bulkScrapeRetryTimes) Get(serviceType string) time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.times[serviceType]
+}
+
+//Set sets the retry time for the given service type.
+func (r *bulkScrapeRetryTimes) Set(serviceType string, retryAt time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.times[serviceType] = retryAt
+}
+
+var countProjectsToScrapeQuery = `SELECT COUNT(*)` + projectsToScrapeClause
+
+var countProjectsQuery = `
+	SELECT COUNT(*) FROM project_services ps
+	  JOIN projects p ON p.id = ps.project_id
+	  JOIN domains d ON d.id = p.domain_id
+	 WHERE d.cluster_id = $1 AND ps.type = $2
+`
+
+//scrapeBulk is called by Scrape() for plugins that implement
+//limes.BulkQuotaPlugin. It claims all projects that need scraping, scrapes
+//them with a single ScrapeAll() call, and writes the results in batches.
+//Projects that are missing in the ScrapeAll() result are scraped individually.
+//
+//Returns false if no bulk scrape was done, either because too few projects
+//need scraping or because ScrapeAll() failed. In this case, Scrape() shall
+//proceed with a regular scrape.
+func (c *Collector) scrapeBulk(plugin limes.BulkQuotaPlugin, labels prometheus.Labels) bool {
+	serviceType := plugin.ServiceInfo().Type
+	now := c.TimeNow()
+	if now.Before(bulkScrapeRetryAt.Get(serviceType)) {
+		return false
+	}
+
+	//this is called before every regular scrape, so check with cheap queries
+	//whether enough projects need scraping before selecting all of them
+	queryArgs := []interface{}{c.Cluster.ID, serviceType, now.Add(-scrapeInterval), now}
+	var targetCount, projectCount int
+	err := db.DB.QueryRow(countProjectsToScrapeQuery, queryArgs...).Scan(&targetCount)
+	if err != nil {
+		c.LogError("cannot count projects for which to bulk scrape %s data: %s", serviceType, err.Error())
+		return false
+	}
+	if targetCount < 2 {
+		return false
+	}
+	err = db.DB.QueryRow(countProjectsQuery, c.Cluster.ID, serviceType).Scan(&projectCount)
+	if err != nil {
+		c.LogError("cannot count projects for bulk scraping %s data: %s", serviceType, err.Error())
+		return false
+	}
+	if float64(targetCount) < bulkScrapeMinRatio*float64(projectCount) {
+		return false
+	}
+
+	var targets []scrapeTarget
+	err = db.ForeachRow(db.DB, findProjectsQuery, queryArgs, func(rows *sql.Rows) error {
+		var target scrapeTarget
+		err := rows.Scan(&target.ServiceID, &target.ProjectName, &target.ProjectUUID, &target.DomainName, &target.DomainUUID, &target.FirstScrape)
+		targets = append(targets, target)
+		return err
+	})
+	if err != nil {
+		c.LogError("cannot select projects for which to bulk scrape %s data: %s", serviceType, err.Error())
+		return false
+	}
+
+	//claim all these projects (except for those that another worker has
+	//claimed in the meantime), and keep the claims alive until we're done, so
+	//that other workers do not pick up the same projects while ScrapeAll() is
+	//running
+	claimed, err := c.claimProjectServices(targets, now)
+	if err != nil {
+		c.LogError("cannot claim projects for bulk scraping %s data: %s", serviceType, err.Error())
+		return false
+	}
+	if len(claimed) == 0 {
+		return false
+	}
+	stopClaimRenewal := make(chan struct{})
+	go c.renewProjectServiceClaims(claimed, stopClaimRenewal)
+
+	util.LogDebug("bulk scraping %s for %d projects", serviceType, len(claimed))
+	results, err := plugin.ScrapeAll(c.Cluster.ProviderClientForService(serviceType))
+	if err != nil {
+		//this is not recorded as a scrape error for each project, since the
+		//projects will now be scraped individually (so we will find out which
+		//ones are actually broken)
+		close(stopClaimRenewal)
+		c.LogError("bulk scrape %s data failed (will scrape projects individually): %s", serviceType, err.Error())
+		bulkScrapeRetryAt.Set(serviceType, now.Add(bulkScrapeRetryInterval))
+		err = c.releaseProjectServices(claimed)
+		if err != nil {
+			c.LogError("release claims on %s data after failed bulk scrape failed: %s", serviceType, err.Error())
+		}
+		return false
+	}
+
+	//write results in batches, to avoid overly long transactions
+	var (
+		batch   []scrapeTarget
+		missing []scrapeTarget
+	)
+	for _, target := range claimed {
+		if _, exists := results[target.ProjectUUID]; !exists {
+			missing = append(missing, target)
+			continue
+		}
+		batch = append(batch, target)
+		if len(batch) >= bulkScrapeBatchSize {
+			c.writeBulkScrapeResults(batch, results, labels)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		c.writeBulkScrapeResults(batch, results, labels)
+	}
+
+	//projects that the backend did not report on need to be scraped individually
+	for _, target := range missing {
+		c.scrapeProject(target, labels)
+	}
+
+	close(stopClaimRenewal)
+	return true
+}
+
+func (c *Collector) writeBulkScrapeResults(targets []scrapeTarget, results map[string]map[string]limes.ResourceData, labels prometheus.Labels) {
+	err := c.writeScrapeResults(targets, results, c.TimeNow())
+	if err == nil {
+		scrapeSuccessCounter.With(labels).Add(float64(len(targets)))
+		return
+	}
+
+	serviceType := c.Plugin.ServiceInfo().Type
+	c.LogError("write %s backend data for %d projects failed: %s", serviceType, len(targets), err.Error())
+	scrapeFailedCounter.With(labels).Add(float64(len(targets)))
+	err = c.releaseProjectServices(targets)
+	if err != nil {
+		c.LogError("release claims on %s data for %d projects failed: %s", serviceType, len(targets), err.Error())
+	}
+}
+
+//claimProjectServices is like claimProjectService, but claims many project
+//services with a few queries. Returns the targets that were claimed
+//successfully.
+func (c *Collector) claimProjectServices(targets []scrapeTarget, now time.Time) (claimed []scrapeTarget, err error) {
+	err = forEachScrapeTargetBatch(targets, func(batch []scrapeTarget) error {
+		tx, err := db.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer db.RollbackUnlessCommitted(tx)
+
+		//lock the unclaimed project services, so that concurrent claims on the
+		//same project services wait for us and then see our claim
+		idsClause, args := scrapeTargetIDsClause(batch, 1)
+		isUnclaimed := make(map[int64]bool)
+		query := `SELECT id FROM project_services WHERE (scrape_claimed_until IS NULL OR scrape_claimed_until < $1) AND ` + idsClause + ` FOR UPDATE`
+		err = db.ForeachRow(tx, query, append([]interface{}{now}, args...), func(rows *sql.Rows) error {
+			var serviceID int64
+			err := rows.Scan(&serviceID)
+			isUnclaimed[serviceID] = true
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		var toClaim []scrapeTarget
+		for _, target := range batch {
+			if isUnclaimed[target.ServiceID] {
+				toClaim = append(toClaim, target)
+			}
+		}
+		if len(toClaim) == 0 {
+			return nil
+		}
+		idsClause, args = scrapeTargetIDsClause(toClaim, 1)
+		_, err = tx.Exec(`UPDATE project_services SET scrape_claimed_until = $1 WHERE `+idsClause,
+			append([]interface{}{now.Add(scrapeClaimDuration)}, args...)...)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err == nil {
+			claimed = append(claimed, toClaim...)
+		}
+		return err
+	})
+	return claimed, err
+}
+
+//renewProjectServiceClaims extends the claims on the given project services
+//periodically until the given channel is closed. Claims that have been
+//released in the meantime (e.g. because the scrape result was written) are
+//not renewed.
+func (c *Collector) renewProjectServiceClaims(targets []scrapeTarget, stop <-chan struct{}) {
+	ticker := time.NewTicker(scrapeClaimDuration / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			until := c.TimeNow().Add(scrapeClaimDuration)
+			err := forEachScrapeTargetBatch(targets, func(batch []scrapeTarget) error {
+				idsClause, args := scrapeTargetIDsClause(batch, 1)
+				_, err := db.DB.Exec(`UPDATE project_services SET scrape_claimed_until = $1 WHERE scrape_claimed_until IS NOT NULL AND `+idsClause,
+					append([]interface{}{until}, args...)...)
+				return err
+			})
+			if err != nil {
+				c.LogError("cannot renew claims for bulk scraping %s data: %s", c.Plugin.ServiceInfo().Type, err.Error())
+			}
+		}
+	}
+}
+
+//releaseProjectServices is like releaseProjectService, but for many project
+//services at once.
+func (c *Collector) releaseProjectServices(targets []scrapeTarget) error {
+	return forEachScrapeTargetBatch(targets, func(batch []scrapeTarget) error {
+		idsClause, args := scrapeTargetIDsClause(batch, 0)
+		_, err := db.DB.Exec(`UPDATE project_services SET scrape_claimed_until = NULL WHERE `+idsClause, args...)
+		return err
+	})
+}
+
+//forEachScrapeTargetBatch calls the given action for consecutive slices of at
+//most bulkScrapeBatchSize targets.
+func forEachScrapeTargetBatch(targets []scrapeTarget, action func([]scrapeTarget) error) error {
+	for len(targets) > 0 {
+		size := bulkScrapeBatchSize
+		if size > len(targets) {
+			size = len(targets)
+		}
+		err := action(targets[:size])
+		if err != nil {
+			return err
+		}
+		targets = targets[size:]
+	}
+	return nil
+}
+
+//scrapeTargetIDsClause returns a WHERE clause fragment that matches the
+//project services of the given targets.
+func scrapeTargetIDsClause(targets []scrapeTarget, parameterOffset int) (string, []interface{}) {
+	ids := make([]interface{}, len(targets))
+	for idx, target := range targets {
+		ids[idx] = target.ServiceID
+	}
+	return db.BuildSimpleWhereClause(map[string]interface{}{"id": ids}, parameterOffset)
+}
@@ -0,0 +1,144 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/test"
+)
+
+func Test_BulkScrape(t *testing.T) {
+	plugin := test.NewBulkPlugin("unittest", "uuid-for-berlin", "uuid-for-dresden")
+	cluster := prepareScrapeTest(t, plugin)
+	var errorCount int
+	c := Collector{
+		Cluster: cluster,
+		Plugin:  plugin,
+		LogError: func(msg string, args ...interface{}) {
+			errorCount++
+		},
+		TimeNow: test.TimeNow,
+		Once:    true,
+	}
+
+	//disable jitter to get reproducible backoff durations
+	defer func(f func(time.Duration) time.Duration) { addJitter = f }(addJitter)
+	addJitter = func(d time.Duration) time.Duration { return d }
+	//use small batches to check that multiple transactions work
+	defer func(size int) { bulkScrapeBatchSize = size }(bulkScrapeBatchSize)
+	bulkScrapeBatchSize = 1
+	//the retry time is shared between tests, so make sure that we start clean
+	bulkScrapeRetryAt.Set("unittest", time.Time{})
+	defer bulkScrapeRetryAt.Set("unittest", time.Time{})
+
+	//prepareScrapeTest() only creates one project, but we need several
+	discovery := cluster.DiscoveryPlugin.(*test.DiscoveryPlugin)
+	fullDiscovery := test.NewDiscoveryPlugin()
+	discovery.StaticDomains = fullDiscovery.StaticDomains
+	discovery.StaticProjects = fullDiscovery.StaticProjects
+	_, err := ScanDomains(cluster, ScanDomainsOpts{ScanAllProjects: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//first Scrape should scrape berlin and dresden with ScrapeAll(), and paris
+	//individually because ScrapeAll() does not report it
+	c.Scrape()
+	test.AssertDBContent(t, "fixtures/scrape-bulk1.sql")
+	expectBulkPluginCalls(t, plugin, 1, "uuid-for-paris")
+
+	//second Scrape should not do anything since all projects are up to date
+	c.Scrape()
+	test.AssertDBContent(t, "fixtures/scrape-bulk1.sql")
+	expectBulkPluginCalls(t, plugin, 0 /*, nothing */)
+
+	//when only one project needs scraping (e.g. after a sync request),
+	//Scrape() should be used instead of ScrapeAll()
+	_, err = db.DB.Exec(`UPDATE project_services SET stale = ? WHERE id = 1`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Scrape()
+	expectBulkPluginCalls(t, plugin, 0, "uuid-for-berlin")
+
+	//when ScrapeAll() fails, no errors should be recorded for the projects;
+	//instead, Scrape() should fall back to scraping projects individually
+	setProjectServicesStale(t)
+	plugin.ScrapeAllFails = true
+	c.Scrape()
+	test.AssertDBContent(t, "fixtures/scrape-bulk2.sql")
+	expectBulkPluginCalls(t, plugin, 1, "uuid-for-dresden")
+	if errorCount != 1 {
+		t.Errorf("expected 1 error to be logged, got %d", errorCount)
+	}
+
+	//ScrapeAll() should not be retried immediately, neither by this worker nor
+	//by any other worker for the same service
+	plugin.ScrapeAllFails = false
+	c2 := Collector{
+		Cluster: cluster,
+		Plugin:  plugin,
+		LogError: func(msg string, args ...interface{}) {
+			errorCount++
+		},
+		TimeNow: test.TimeNow,
+		Once:    true,
+	}
+	c2.Scrape()
+	expectBulkPluginCalls(t, plugin, 0, "uuid-for-paris")
+	setProjectServicesStale(t)
+	c.Scrape()
+	c2.Scrape()
+	expectBulkPluginCalls(t, plugin, 0, "uuid-for-berlin", "uuid-for-dresden")
+	c.Scrape()
+	expectBulkPluginCalls(t, plugin, 0, "uuid-for-paris")
+
+	//once the retry interval has passed, ScrapeAll() should be used again (but
+	//only if enough projects need scraping)
+	bulkScrapeRetryAt.Set("unittest", time.Time{})
+	_, err = db.DB.Exec(`UPDATE project_services SET stale = ? WHERE id = 1`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Scrape()
+	expectBulkPluginCalls(t, plugin, 0, "uuid-for-berlin")
+	setProjectServicesStale(t)
+	c.Scrape()
+	expectBulkPluginCalls(t, plugin, 1, "uuid-for-paris")
+	if errorCount != 1 {
+		t.Errorf("expected 1 error to be logged, got %d", errorCount)
+	}
+}
+
+func expectBulkPluginCalls(t *testing.T, plugin *test.BulkPlugin, scrapeAllCalls int, scrapedProjectUUIDs ...string) {
+	t.Helper()
+	if plugin.ScrapeAllCalls != scrapeAllCalls {
+		t.Errorf("expected %d calls to ScrapeAll(), got %d", scrapeAllCalls, plugin.ScrapeAllCalls)
+	}
+	if !reflect.DeepEqual(plugin.ScrapedProjectUUIDs, scrapedProjectUUIDs) {
+		t.Errorf("expected calls to Scrape() for %v, got %v", scrapedProjectUUIDs, plugin.ScrapedProjectUUIDs)
+	}
+	plugin.ScrapeAllCalls = 0
+	plugin.ScrapedProjectUUIDs = nil
+}
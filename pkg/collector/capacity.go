@@ -41,6 +41,7 @@ func (c *Collector) ScanCapacity() {
 	time.Sleep(scanInitialDelay)
 
 	for {
+		c.applyReload()
 		util.LogDebug("scanning capacity")
 		c.scanCapacity()
 
@@ -20,6 +20,7 @@
 package collector
 
 import (
+	"sync"
 	"time"
 
 	"github.com/sapcc/limes/pkg/limes"
@@ -41,15 +42,55 @@ type Collector struct {
 	//When set to true, suppresses the usual non-returning behavior of
 	//collector jobs.
 	Once bool
+	//How long samples are kept in project_resource_history. When zero,
+	//CleanupHistory does not delete anything.
+	HistoryRetention time.Duration
+	//Set by Reload(), and picked up by applyReload().
+	reloadMutex   sync.Mutex
+	reloadCluster *limes.Cluster
 }
 
 //NewCollector creates a Collector instance.
 func NewCollector(cluster *limes.Cluster, plugin limes.QuotaPlugin, cfg limes.CollectorConfiguration) *Collector {
 	return &Collector{
-		Cluster:  cluster,
-		Plugin:   plugin,
-		LogError: util.LogError,
-		TimeNow:  time.Now,
-		Once:     false,
+		Cluster:          cluster,
+		Plugin:           plugin,
+		LogError:         util.LogError,
+		TimeNow:          time.Now,
+		Once:             false,
+		HistoryRetention: cfg.HistoryRetentionPeriod(),
 	}
 }
+
+//Reload replaces the Cluster used by this Collector (and the Plugin, if any)
+//after the configuration has been reloaded. Since collector jobs run in their
+//own goroutines, the new Cluster is only picked up at the start of the next
+//iteration of the job.
+func (c *Collector) Reload(cluster *limes.Cluster) {
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+	c.reloadCluster = cluster
+}
+
+//applyReload is called by collector jobs at the start of each iteration to
+//pick up the Cluster given to Reload(), if any.
+func (c *Collector) applyReload() {
+	c.reloadMutex.Lock()
+	cluster := c.reloadCluster
+	c.reloadCluster = nil
+	c.reloadMutex.Unlock()
+	if cluster == nil {
+		return
+	}
+
+	if c.Plugin != nil {
+		serviceType := c.Plugin.ServiceInfo().Type
+		plugin, exists := cluster.QuotaPlugins[serviceType]
+		if !exists {
+			c.LogError("cannot apply reloaded configuration to %s collector: service is not configured anymore", serviceType)
+			return
+		}
+		c.Plugin = plugin
+	}
+	c.Cluster = cluster
+}
@@ -0,0 +1,70 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/test"
+)
+
+func Test_Reload(t *testing.T) {
+	cluster := keystoneTestCluster(t)
+	c := Collector{
+		Cluster:  cluster,
+		Plugin:   cluster.QuotaPlugins["shared"],
+		LogError: t.Errorf,
+		TimeNow:  test.TimeNow,
+		Once:     true,
+	}
+
+	//Reload() does not take effect until the next iteration of the job
+	newCluster := keystoneTestCluster(t)
+	newPlugin := test.NewPlugin("shared")
+	newCluster.QuotaPlugins["shared"] = newPlugin
+	c.Reload(newCluster)
+	if c.Cluster != cluster {
+		t.Error("expected Reload() to not replace the Cluster immediately")
+	}
+
+	c.applyReload()
+	if c.Cluster != newCluster {
+		t.Error("expected applyReload() to replace the Cluster")
+	}
+	if c.Plugin != newPlugin {
+		t.Error("expected applyReload() to replace the Plugin")
+	}
+
+	//when the collector's service disappears from the configuration, the
+	//reloaded configuration is not applied
+	var logged []string
+	c.LogError = func(msg string, args ...interface{}) {
+		logged = append(logged, msg)
+	}
+	c.Reload(&limes.Cluster{ID: "west", QuotaPlugins: map[string]limes.QuotaPlugin{}})
+	c.applyReload()
+	if c.Cluster != newCluster || c.Plugin != newPlugin {
+		t.Error("expected applyReload() to keep the previous Cluster when the service was removed")
+	}
+	if len(logged) != 1 {
+		t.Errorf("expected 1 error to be logged, got %d", len(logged))
+	}
+}
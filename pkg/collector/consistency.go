@@ -32,6 +32,7 @@ var consistencyCheckInterval = 1 * time.Hour
 //have a service entry for this plugin's service type.
 func (c *Collector) CheckConsistency() {
 	for {
+		c.applyReload()
 		c.checkConsistencyCluster()
 
 		if c.Once {
@@ -9,11 +9,11 @@ INSERT INTO domain_services (id, domain_id, type) VALUES (2, 1, 'shared');
 INSERT INTO domain_services (id, domain_id, type) VALUES (4, 2, 'shared');
 INSERT INTO domain_services (id, domain_id, type) VALUES (5, 1, 'whatever');
 
-INSERT INTO projects (id, domain_id, name, uuid, parent_uuid) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany');
-INSERT INTO projects (id, domain_id, name, uuid, parent_uuid) VALUES (2, 1, 'dresden', 'uuid-for-dresden', 'uuid-for-berlin');
-INSERT INTO projects (id, domain_id, name, uuid, parent_uuid) VALUES (3, 2, 'paris', 'uuid-for-paris', 'uuid-for-france');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany', '');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (2, 1, 'dresden', 'uuid-for-dresden', 'uuid-for-berlin', '');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (3, 2, 'paris', 'uuid-for-paris', 'uuid-for-france', '');
 
-INSERT INTO project_services (id, project_id, type, scraped_at, stale) VALUES (1, 1, 'unshared', NULL, FALSE);
-INSERT INTO project_services (id, project_id, type, scraped_at, stale) VALUES (3, 2, 'unshared', NULL, FALSE);
-INSERT INTO project_services (id, project_id, type, scraped_at, stale) VALUES (5, 3, 'unshared', NULL, FALSE);
-INSERT INTO project_services (id, project_id, type, scraped_at, stale) VALUES (6, 1, 'whatever', NULL, FALSE);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (1, 1, 'unshared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (3, 2, 'unshared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (5, 3, 'unshared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (6, 1, 'whatever', NULL, FALSE, '', NULL, 0, NULL, NULL);
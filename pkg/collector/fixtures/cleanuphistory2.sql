@@ -0,0 +1,13 @@
+INSERT INTO domains (id, cluster_id, name, uuid) VALUES (1, 'west', 'germany', 'uuid-for-germany');
+
+INSERT INTO domain_services (id, domain_id, type) VALUES (1, 1, 'unittest');
+
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany', '');
+
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (1, 1, 'unittest', 1, FALSE, '', NULL, 0, NULL, NULL);
+
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'capacity', 0, 0, 100, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'things', 0, 2, 42, '[{"index":0},{"index":1}]');
+
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'unittest', 'capacity', 7200, 0, 1, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'unittest', 'things', 7200, 0, 3, 42);
@@ -0,0 +1,17 @@
+INSERT INTO domains (id, cluster_id, name, uuid) VALUES (1, 'west', 'germany', 'uuid-for-germany');
+
+INSERT INTO domain_services (id, domain_id, type) VALUES (1, 1, 'unittest');
+
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany', '');
+
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (1, 1, 'unittest', 1, FALSE, '', NULL, 0, NULL, NULL);
+
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'capacity', 5, 0, 5, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'things', 10, 2, 10, '[{"index":0},{"index":1}]');
+
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (1, 7200, 'west', 'uuid-for-germany', 'uuid-for-berlin', 'unittest', 'capacity', 'expire_quota', 20, 5, '', '', 'set quota unittest.capacity = 20 -> 5 for project uuid-for-berlin through expiry of quota grant');
+
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'unittest', 'capacity', 0, 0, 0, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'unittest', 'things', 0, 0, 2, 42);
+
+INSERT INTO project_quota_grants (service_id, resource_name, previous_quota, expires_at) VALUES (1, 'things', 1, 3600);
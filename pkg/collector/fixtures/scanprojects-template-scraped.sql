@@ -0,0 +1,53 @@
+INSERT INTO domains (id, cluster_id, name, uuid) VALUES (1, 'west', 'germany', 'uuid-for-germany');
+INSERT INTO domains (id, cluster_id, name, uuid) VALUES (2, 'west', 'france', 'uuid-for-france');
+
+INSERT INTO domain_services (id, domain_id, type) VALUES (1, 1, 'unshared');
+INSERT INTO domain_services (id, domain_id, type) VALUES (2, 1, 'shared');
+INSERT INTO domain_services (id, domain_id, type) VALUES (3, 2, 'unshared');
+INSERT INTO domain_services (id, domain_id, type) VALUES (4, 2, 'shared');
+
+INSERT INTO domain_resources (service_id, name, quota) VALUES (1, 'things', 5);
+INSERT INTO domain_resources (service_id, name, quota) VALUES (1, 'capacity', 100);
+INSERT INTO domain_resources (service_id, name, quota) VALUES (2, 'capacity', 10);
+
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany', 'small');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (2, 1, 'dresden', 'uuid-for-dresden', 'uuid-for-berlin', 'small');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (3, 2, 'paris', 'uuid-for-paris', 'uuid-for-france', '');
+
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (1, 1, 'unshared', 8, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (2, 1, 'shared', 14, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (3, 2, 'unshared', 6, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (4, 2, 'shared', 12, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (5, 3, 'unshared', 4, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (6, 3, 'shared', 10, FALSE, '', NULL, 0, NULL, NULL);
+
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'capacity', 20, 0, 20, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (2, 'capacity', 5, 0, 5, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (3, 'capacity', 20, 0, 20, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (4, 'capacity', 5, 0, 5, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (5, 'capacity', 0, 0, 100, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (5, 'things', 0, 2, 42, '[{"index":0},{"index":1}]');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (3, 'things', 0, 2, 42, '[{"index":0},{"index":1}]');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'things', 0, 2, 42, '[{"index":0},{"index":1}]');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (6, 'capacity', 0, 0, 100, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (6, 'things', 0, 2, 42, '[{"index":0},{"index":1}]');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (4, 'things', 0, 2, 42, '[{"index":0},{"index":1}]');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (2, 'things', 0, 2, 42, '[{"index":0},{"index":1}]');
+
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (1, 0, 'west', 'uuid-for-germany', 'uuid-for-berlin', 'unshared', 'capacity', 'set_quota', 0, 20, '', '', 'set quota unshared.capacity = 0 -> 20 for project uuid-for-berlin through quota template small');
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (2, 0, 'west', 'uuid-for-germany', 'uuid-for-berlin', 'shared', 'capacity', 'set_quota', 0, 5, '', '', 'set quota shared.capacity = 0 -> 5 for project uuid-for-berlin through quota template small');
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (3, 1, 'west', 'uuid-for-germany', 'uuid-for-dresden', 'unshared', 'capacity', 'set_quota', 0, 20, '', '', 'set quota unshared.capacity = 0 -> 20 for project uuid-for-dresden through quota template small');
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (4, 1, 'west', 'uuid-for-germany', 'uuid-for-dresden', 'shared', 'capacity', 'set_quota', 0, 5, '', '', 'set quota shared.capacity = 0 -> 5 for project uuid-for-dresden through quota template small');
+
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (3, 'unshared', 'capacity', 0, 0, 0, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (3, 'unshared', 'things', 0, 0, 2, 42);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (2, 'unshared', 'capacity', 0, 20, 0, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (2, 'unshared', 'things', 0, 0, 2, 42);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'unshared', 'capacity', 0, 20, 0, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'unshared', 'things', 0, 0, 2, 42);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (3, 'shared', 'capacity', 0, 0, 0, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (3, 'shared', 'things', 0, 0, 2, 42);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (2, 'shared', 'capacity', 0, 5, 0, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (2, 'shared', 'things', 0, 0, 2, 42);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'shared', 'capacity', 0, 5, 0, 100);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'shared', 'things', 0, 0, 2, 42);
@@ -0,0 +1,32 @@
+INSERT INTO domains (id, cluster_id, name, uuid) VALUES (1, 'west', 'germany', 'uuid-for-germany');
+INSERT INTO domains (id, cluster_id, name, uuid) VALUES (2, 'west', 'france', 'uuid-for-france');
+
+INSERT INTO domain_services (id, domain_id, type) VALUES (1, 1, 'unshared');
+INSERT INTO domain_services (id, domain_id, type) VALUES (2, 1, 'shared');
+INSERT INTO domain_services (id, domain_id, type) VALUES (3, 2, 'unshared');
+INSERT INTO domain_services (id, domain_id, type) VALUES (4, 2, 'shared');
+
+INSERT INTO domain_resources (service_id, name, quota) VALUES (1, 'things', 5);
+INSERT INTO domain_resources (service_id, name, quota) VALUES (1, 'capacity', 100);
+INSERT INTO domain_resources (service_id, name, quota) VALUES (2, 'capacity', 10);
+
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany', 'small');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (2, 1, 'dresden', 'uuid-for-dresden', 'uuid-for-berlin', 'small');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (3, 2, 'paris', 'uuid-for-paris', 'uuid-for-france', '');
+
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (1, 1, 'unshared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (2, 1, 'shared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (3, 2, 'unshared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (4, 2, 'shared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (5, 3, 'unshared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (6, 3, 'shared', NULL, FALSE, '', NULL, 0, NULL, NULL);
+
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'capacity', 20, 0, 0, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (2, 'capacity', 5, 0, 0, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (3, 'capacity', 20, 0, 0, '');
+INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (4, 'capacity', 5, 0, 0, '');
+
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (1, 0, 'west', 'uuid-for-germany', 'uuid-for-berlin', 'unshared', 'capacity', 'set_quota', 0, 20, '', '', 'set quota unshared.capacity = 0 -> 20 for project uuid-for-berlin through quota template small');
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (2, 0, 'west', 'uuid-for-germany', 'uuid-for-berlin', 'shared', 'capacity', 'set_quota', 0, 5, '', '', 'set quota shared.capacity = 0 -> 5 for project uuid-for-berlin through quota template small');
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (3, 1, 'west', 'uuid-for-germany', 'uuid-for-dresden', 'unshared', 'capacity', 'set_quota', 0, 20, '', '', 'set quota unshared.capacity = 0 -> 20 for project uuid-for-dresden through quota template small');
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (4, 1, 'west', 'uuid-for-germany', 'uuid-for-dresden', 'shared', 'capacity', 'set_quota', 0, 5, '', '', 'set quota shared.capacity = 0 -> 5 for project uuid-for-dresden through quota template small');
@@ -2,9 +2,14 @@ INSERT INTO domains (id, cluster_id, name, uuid) VALUES (1, 'west', 'germany', '
 
 INSERT INTO domain_services (id, domain_id, type) VALUES (1, 1, 'autoapprovaltest');
 
-INSERT INTO projects (id, domain_id, name, uuid, parent_uuid) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany');
+INSERT INTO projects (id, domain_id, name, uuid, parent_uuid, template) VALUES (1, 1, 'berlin', 'uuid-for-berlin', 'uuid-for-germany', '');
 
-INSERT INTO project_services (id, project_id, type, scraped_at, stale) VALUES (1, 1, 'autoapprovaltest', 1, FALSE);
+INSERT INTO project_services (id, project_id, type, scraped_at, stale, scrape_error_message, scrape_error_at, consecutive_scrape_failures, scrape_claimed_until, scrape_backoff_until) VALUES (1, 1, 'autoapprovaltest', 1, FALSE, '', NULL, 0, NULL, NULL);
 
 INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'approve', 10, 0, 10, '');
 INSERT INTO project_resources (service_id, name, quota, usage, backend_quota, subresources) VALUES (1, 'noapprove', 0, 0, 20, '');
+
+INSERT INTO audit_events (id, time, cluster_id, domain_uuid, project_uuid, service_type, resource_name, action, old_value, new_value, user_uuid, user_name, message) VALUES (1, 1, 'west', 'uuid-for-germany', 'uuid-for-berlin', 'autoapprovaltest', 'approve', 'set_quota', 0, 10, '', '', 'set quota autoapprovaltest.approve = 0 -> 10 for project uuid-for-berlin through auto-approval');
+
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'autoapprovaltest', 'approve', 0, 10, 0, 10);
+INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota) VALUES (1, 'autoapprovaltest', 'noapprove', 0, 0, 0, 20);
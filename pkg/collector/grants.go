@@ -0,0 +1,188 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//how often to check for expired quota grants
+var grantExpiryInterval = 1 * time.Minute
+
+//(for top-level projects, the quota sum of all projects in their subtree is
+//selected as well, since their quota is subleased from the top-level project)
+var expiredGrantsQuery = db.ProjectSubtreesQuery + `
+	SELECT d.uuid, p.uuid, ps.id, ps.type, pr.name, pr.quota, pr.usage, g.previous_quota, (
+	       SELECT COALESCE(SUM(cpr.quota), 0)
+	         FROM project_subtrees s
+	         JOIN project_services cps ON cps.project_id = s.project_id
+	         JOIN project_resources cpr ON cpr.service_id = cps.id
+	        WHERE s.root_id = p.id AND cps.type = ps.type AND cpr.name = pr.name
+	       )
+	  FROM project_quota_grants g
+	  JOIN project_resources pr ON pr.service_id = g.service_id AND pr.name = g.resource_name
+	  JOIN project_services ps ON ps.id = pr.service_id
+	  JOIN projects p ON p.id = ps.project_id
+	  JOIN domains d ON d.id = p.domain_id
+	 WHERE d.cluster_id = $1 AND g.expires_at <= $2
+	 ORDER BY ps.id, pr.name
+`
+
+type expiredGrant struct {
+	DomainUUID    string
+	ProjectUUID   string
+	ServiceID     int64
+	ServiceType   string
+	ResourceName  string
+	Quota         uint64
+	Usage         uint64
+	PreviousQuota uint64
+	ChildrenQuota uint64
+}
+
+//ExpireQuotaGrants checks the database periodically for time-limited quota
+//grants that have expired, and reverts the respective project quotas to the
+//value from before the grant. When the usage (or the quota of child projects)
+//does not fit into that value, the grant is kept and reported in the
+//limes_unrevertable_quota_grants metric instead, until the usage has been
+//reduced.
+//
+//Errors are logged instead of returned. The function will not return unless
+//startup fails.
+func (c *Collector) ExpireQuotaGrants() {
+	for {
+		c.applyReload()
+		c.expireQuotaGrants()
+
+		if c.Once {
+			return
+		}
+		time.Sleep(grantExpiryInterval)
+	}
+}
+
+func (c *Collector) expireQuotaGrants() {
+	var grants []expiredGrant
+	queryArgs := []interface{}{c.Cluster.ID, c.TimeNow()}
+	err := db.ForeachRow(db.DB, expiredGrantsQuery, queryArgs, func(rows *sql.Rows) error {
+		var g expiredGrant
+		err := rows.Scan(
+			&g.DomainUUID, &g.ProjectUUID, &g.ServiceID, &g.ServiceType, &g.ResourceName,
+			&g.Quota, &g.Usage, &g.PreviousQuota, &g.ChildrenQuota,
+		)
+		grants = append(grants, g)
+		return err
+	})
+	if err != nil {
+		c.LogError("cannot select expired quota grants: %s", err.Error())
+		return
+	}
+
+	unrevertableGrantsGauge.Reset()
+	revertedServices := make(map[int64]expiredGrant)
+	for _, g := range grants {
+		if g.Usage > g.PreviousQuota || g.ChildrenQuota > g.PreviousQuota {
+			util.LogInfo("cannot revert expired quota grant for %s/%s in project %s: usage = %d, children quota = %d, but quota after expiry would be %d",
+				g.ServiceType, g.ResourceName, g.ProjectUUID, g.Usage, g.ChildrenQuota, g.PreviousQuota,
+			)
+			unrevertableGrantsGauge.With(prometheus.Labels{
+				"os_cluster": c.Cluster.ID,
+				"service":    g.ServiceType,
+				"resource":   g.ResourceName,
+			}).Inc()
+			continue
+		}
+
+		err := c.revertExpiredGrant(g)
+		if err != nil {
+			c.LogError("cannot revert expired quota grant for %s/%s in project %s: %s",
+				g.ServiceType, g.ResourceName, g.ProjectUUID, err.Error(),
+			)
+			continue
+		}
+		revertedServices[g.ServiceID] = g
+	}
+
+	//write the reverted quotas into the backend (an error at this point is
+	//non-fatal: in authoritative clusters, the scraper will try again to write
+	//the quota into the backend)
+	for serviceID, g := range revertedServices {
+		services := []db.ProjectService{{ID: serviceID, Type: g.ServiceType}}
+		errors, err := WriteProjectQuotasToBackend(c.Cluster, g.DomainUUID, g.ProjectUUID, services)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+		for _, msg := range errors {
+			util.LogError("could not write %s quotas into backend for project %s after expiry of quota grant: %s",
+				g.ServiceType, g.ProjectUUID, msg,
+			)
+		}
+	}
+}
+
+func (c *Collector) revertExpiredGrant(g expiredGrant) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	_, err = tx.Exec(
+		`UPDATE project_resources SET quota = $1 WHERE service_id = $2 AND name = $3`,
+		g.PreviousQuota, g.ServiceID, g.ResourceName)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`DELETE FROM project_quota_grants WHERE service_id = $1 AND resource_name = $2`,
+		g.ServiceID, g.ResourceName)
+	if err != nil {
+		return err
+	}
+
+	auditTrail := db.AuditTrail{Time: c.TimeNow(), ClusterID: c.Cluster.ID}
+	oldQuota, newQuota := g.Quota, g.PreviousQuota
+	auditTrail.Add(db.AuditEvent{
+		DomainUUID:   g.DomainUUID,
+		ProjectUUID:  g.ProjectUUID,
+		ServiceType:  g.ServiceType,
+		ResourceName: g.ResourceName,
+		Action:       db.AuditActionExpireQuota,
+		OldValue:     &oldQuota,
+		NewValue:     &newQuota,
+	}, "set quota %s.%s = %d -> %d for project %s through expiry of quota grant",
+		g.ServiceType, g.ResourceName, oldQuota, newQuota, g.ProjectUUID,
+	)
+	err = auditTrail.Write(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	auditTrail.Commit()
+	return nil
+}
@@ -0,0 +1,86 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/test"
+)
+
+func Test_ExpireQuotaGrants(t *testing.T) {
+	plugin := test.NewPlugin("unittest")
+	cluster := prepareScrapeTest(t, plugin)
+	c := Collector{
+		Cluster:  cluster,
+		Plugin:   plugin,
+		LogError: t.Errorf,
+		TimeNow:  test.TimeNow,
+		Once:     true,
+	}
+
+	//scrape once to create the project_resources, then grant some time-limited
+	//quotas ("things" cannot be reverted because usage = 2 exceeds the previous quota)
+	c.Scrape()
+	_, err := db.DB.Exec(`UPDATE project_resources SET quota = ? WHERE name = ?`, 20, "capacity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB.Exec(`UPDATE project_resources SET quota = ? WHERE name = ?`, 10, "things")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DB.Insert(
+		&db.ProjectQuotaGrant{ServiceID: 1, ResourceName: "capacity", PreviousQuota: 5, ExpiresAt: time.Unix(3600, 0)},
+		&db.ProjectQuotaGrant{ServiceID: 1, ResourceName: "things", PreviousQuota: 1, ExpiresAt: time.Unix(3600, 0)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//nothing has expired yet
+	c.ExpireQuotaGrants()
+	test.AssertDBContent(t, "fixtures/expiregrants1.sql")
+
+	//after the expiry time, the "capacity" quota shall be reverted and written
+	//into the backend, but the "things" grant shall remain in place
+	c.TimeNow = func() time.Time { return time.Unix(7200, 0) }
+	c.ExpireQuotaGrants()
+	test.AssertDBContent(t, "fixtures/expiregrants2.sql")
+	test.AssertDeepEqual(t, "backend quota", plugin.OverrideQuota["uuid-for-berlin"], map[string]uint64{
+		"capacity": 5,
+		"things":   10,
+	})
+
+	//check that the remaining grant is reported in the metrics
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(unrevertableGrantsGauge)
+	registry.MustRegister(&DataMetricsCollector{Cluster: cluster})
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/metrics",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/expiregrants_metrics.prom",
+	}.Check(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
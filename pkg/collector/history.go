@@ -0,0 +1,72 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//how often to check for samples in project_resource_history that have
+//exceeded the retention period
+var historyCleanupInterval = historyInterval
+
+var cleanupHistoryQuery = `
+	DELETE FROM project_resource_history
+	 WHERE time < $1 AND project_id IN (
+	   SELECT p.id FROM projects p JOIN domains d ON d.id = p.domain_id WHERE d.cluster_id = $2
+	 )
+`
+
+//CleanupHistory periodically deletes samples from the
+//project_resource_history table that are older than c.HistoryRetention, so
+//that the table does not grow without bound.
+//
+//Errors are logged instead of returned. The function will not return unless
+//startup fails.
+func (c *Collector) CleanupHistory() {
+	for {
+		c.applyReload()
+		c.cleanupHistory()
+
+		if c.Once {
+			return
+		}
+		time.Sleep(historyCleanupInterval)
+	}
+}
+
+func (c *Collector) cleanupHistory() {
+	if c.HistoryRetention <= 0 {
+		return
+	}
+	cutoff := c.TimeNow().Add(-c.HistoryRetention)
+	result, err := db.DB.Exec(cleanupHistoryQuery, cutoff, c.Cluster.ID)
+	if err != nil {
+		c.LogError("cannot clean up project_resource_history: %s", err.Error())
+		return
+	}
+	count, err := result.RowsAffected()
+	if err == nil && count > 0 {
+		util.LogDebug("deleted %d samples older than %s from project_resource_history", count, cutoff.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,60 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/test"
+)
+
+func Test_CleanupHistory(t *testing.T) {
+	plugin := test.NewPlugin("unittest")
+	cluster := prepareScrapeTest(t, plugin)
+	c := Collector{
+		Cluster:  cluster,
+		Plugin:   plugin,
+		LogError: t.Errorf,
+		TimeNow:  test.TimeNow,
+		Once:     true,
+	}
+
+	//scrape once to create some history samples, then add samples for a later hour
+	c.Scrape()
+	_, err := db.DB.Exec(`
+		INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota)
+		SELECT project_id, service_type, resource_name, ?, quota, usage + 1, backend_quota FROM project_resource_history
+	`, time.Unix(7200, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//without a retention period, nothing is deleted
+	c.TimeNow = func() time.Time { return time.Unix(7300, 0) }
+	c.CleanupHistory()
+	test.AssertDBContent(t, "fixtures/cleanuphistory1.sql")
+
+	//only samples older than the retention period are deleted
+	c.HistoryRetention = time.Hour
+	c.CleanupHistory()
+	test.AssertDBContent(t, "fixtures/cleanuphistory2.sql")
+}
@@ -20,11 +20,21 @@
 package collector
 
 import (
+	"fmt"
+	"time"
+
+	gorp "gopkg.in/gorp.v2"
+
 	"github.com/sapcc/limes/pkg/db"
 	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/reports"
 	"github.com/sapcc/limes/pkg/util"
+	"github.com/sapcc/limes/pkg/validation"
 )
 
+//Usually time.Now, but can be changed inside unit tests.
+var timeNow = time.Now
+
 //ScanDomainsOpts contains additional options for ScanDomains().
 type ScanDomainsOpts struct {
 	//Recurse into ScanProjects for all domains in the selected cluster,
@@ -247,7 +257,9 @@ func ScanProjects(cluster *limes.Cluster, domain *db.Domain) ([]string, error) {
 }
 
 //Initialize all the database records for a project (in both `projects` and
-//`project_services`).
+//`project_services`). If a quota template applies to the project's domain,
+//the template's quotas are approved. They are written into the backend after
+//the first scrape of the project (see writeScrapeResult).
 func initProject(cluster *limes.Cluster, domain *db.Domain, project limes.KeystoneProject) error {
 	//do this in a transaction to avoid half-initialized projects
 	tx, err := db.DB.Begin()
@@ -262,6 +274,7 @@ func initProject(cluster *limes.Cluster, domain *db.Domain, project limes.Keysto
 		Name:       project.Name,
 		UUID:       project.UUID,
 		ParentUUID: project.ParentUUID,
+		Template:   cluster.QuotaTemplateForDomain(domain.Name),
 	}
 	err = db.DB.Insert(dbProject)
 	if err != nil {
@@ -271,12 +284,126 @@ func initProject(cluster *limes.Cluster, domain *db.Domain, project limes.Keysto
 	//add records for all cluster services to the `project_services` table, with
 	//default `scraped_at = NULL` to force the scraping jobs to scrape the
 	//project resources
-	for _, serviceType := range cluster.ServiceTypes {
-		err := tx.Insert(&db.ProjectService{ProjectID: dbProject.ID, Type: serviceType})
+	services := make([]db.ProjectService, len(cluster.ServiceTypes))
+	for idx, serviceType := range cluster.ServiceTypes {
+		services[idx] = db.ProjectService{ProjectID: dbProject.ID, Type: serviceType}
+		err := tx.Insert(&services[idx])
 		if err != nil {
 			return err
 		}
 	}
 
-	return tx.Commit()
+	//apply the quota template (if any)
+	auditTrail := db.AuditTrail{Time: timeNow(), ClusterID: cluster.ID}
+	if dbProject.Template != "" {
+		err = applyQuotaTemplate(tx, cluster, domain, dbProject, services, &auditTrail)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = auditTrail.Write(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	auditTrail.Commit()
+	return nil
+}
+
+//applyQuotaTemplate creates the `project_resources` records for the resources
+//of a new project that are named in the project's quota template. Template
+//quotas go through the same validation as quota updates via the API, and are
+//skipped if they do not fit into the domain quota (or into the quota of the
+//parent project, if any). All other resources are left to the scraper, so
+//that they can be auto-approved as usual.
+func applyQuotaTemplate(tx *gorp.Transaction, cluster *limes.Cluster, domain *db.Domain, project *db.Project, services []db.ProjectService, auditTrail *db.AuditTrail) error {
+	template := cluster.QuotaTemplate(project.Template)
+	if template == nil {
+		util.LogError("cannot apply quota template %s to project %s/%s: no such quota template", project.Template, domain.Name, project.Name)
+		return nil
+	}
+
+	domainReports, err := reports.GetDomains(cluster, &domain.ID, tx, reports.Filter{})
+	if err != nil {
+		return err
+	}
+	if len(domainReports) == 0 {
+		return fmt.Errorf("no report for domain %s", domain.UUID)
+	}
+	hierarchy, err := validation.LoadProjectHierarchy(tx, domain)
+	if err != nil {
+		return err
+	}
+
+	//the quota of child projects is subleased from their top-level project, so
+	//it does not count towards the domain quota
+	domainReport := domainReports[0]
+	if hierarchy.IsChildProject(project.UUID) {
+		domainReport = nil
+	}
+
+	for _, srv := range services {
+		resourceQuotas, exists := template[srv.Type]
+		if !exists {
+			continue
+		}
+
+		for _, resInfo := range cluster.QuotaPlugins[srv.Type].Resources() {
+			quota, exists := resourceQuotas[resInfo.Name]
+			if !exists {
+				continue
+			}
+			res := db.ProjectResource{
+				ServiceID: srv.ID,
+				Name:      resInfo.Name,
+			}
+			ref := validation.ProjectResourceRef{
+				ProjectUUID:  project.UUID,
+				ServiceType:  srv.Type,
+				ResourceName: resInfo.Name,
+			}
+			var err error
+			if quota > 0 {
+				err = validation.CheckProjectQuotaUpdate(srv, res, domainReport, quota, true, true)
+				if err == nil {
+					err = hierarchy.Check(ref, 0, quota, resInfo.Unit)
+				}
+			}
+			if err != nil {
+				if _, ok := err.(*validation.ResourceError); !ok {
+					return err
+				}
+				util.LogInfo("not applying %s/%s quota from template %s to project %s/%s: %s",
+					srv.Type, resInfo.Name, project.Template, domain.Name, project.Name, err.Error(),
+				)
+				continue
+			}
+
+			res.Quota = quota
+			err = tx.Insert(&res)
+			if err != nil {
+				return err
+			}
+			hierarchy.Set(ref, quota)
+
+			oldQuota, newQuota := uint64(0), quota
+			auditTrail.Add(db.AuditEvent{
+				DomainUUID:   domain.UUID,
+				ProjectUUID:  project.UUID,
+				ServiceType:  srv.Type,
+				ResourceName: resInfo.Name,
+				Action:       db.AuditActionSetQuota,
+				OldValue:     &oldQuota,
+				NewValue:     &newQuota,
+			}, "set quota %s.%s = 0 -> %d for project %s through quota template %s",
+				srv.Type, resInfo.Name, quota, project.UUID, project.Template,
+			)
+		}
+	}
+
+	return nil
 }
@@ -24,7 +24,9 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/sapcc/limes/pkg/db"
 	"github.com/sapcc/limes/pkg/limes"
 	"github.com/sapcc/limes/pkg/test"
 
@@ -144,6 +146,97 @@ func Test_ScanDomains(t *testing.T) {
 	test.AssertDBContent(t, "fixtures/scandomains4.sql")
 }
 
+func Test_ScanProjectsWithQuotaTemplate(t *testing.T) {
+	test.ResetTime()
+	timeNow = test.TimeNow
+	defer func() { timeNow = time.Now }()
+	cluster := keystoneTestCluster(t)
+	cluster.Config.QuotaTemplates = limes.QuotaTemplateConfiguration{
+		Default: "small",
+		Domains: map[string]string{"france": ""},
+		Templates: map[string]limes.QuotaTemplate{
+			"small": {"unshared": {"things": 10, "capacity": 20}, "shared": {"capacity": 5}},
+		},
+	}
+	discovery := cluster.DiscoveryPlugin.(*test.DiscoveryPlugin)
+
+	//discover the domains without their projects first, so that we can
+	//approve domain quota before the projects get discovered
+	allProjects := discovery.StaticProjects
+	discovery.StaticProjects = map[string][]limes.KeystoneProject{}
+	_, err := ScanDomains(cluster, ScanDomainsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB.Exec(`INSERT INTO domain_resources (service_id, name, quota) VALUES (1, 'things', 5), (1, 'capacity', 100), (2, 'capacity', 10)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//berlin does not get "things" because the domain quota is too low, so
+	//dresden does not get it either since its parent project berlin has no
+	//"things" quota to sublease; both get "capacity" (the quota of dresden is
+	//subleased from berlin, so it does not count towards the domain quota);
+	//paris does not get a template at all because the template is disabled for
+	//its domain; resources that are not named in the template (shared/things)
+	//are not touched
+	discovery.StaticProjects = allProjects
+	_, err = ScanDomains(cluster, ScanDomainsOpts{ScanAllProjects: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertDBContent(t, "fixtures/scanprojects-template.sql")
+
+	//nothing is written into the backend before the first scrape
+	unsharedPlugin := cluster.QuotaPlugins["unshared"].(*test.Plugin)
+	sharedPlugin := cluster.QuotaPlugins["shared"].(*test.Plugin)
+	test.AssertDeepEqual(t, "unshared backend quotas", unsharedPlugin.OverrideQuota, map[string]map[string]uint64{})
+	test.AssertDeepEqual(t, "shared backend quotas", sharedPlugin.OverrideQuota, map[string]map[string]uint64{})
+
+	//the first scrape writes the template quotas into the backend, while the
+	//resources outside the template keep their backend quota (the cluster is
+	//not authoritative, so paris is not touched at all)
+	for _, serviceType := range cluster.ServiceTypes {
+		c := Collector{
+			Cluster:  cluster,
+			Plugin:   cluster.QuotaPlugins[serviceType],
+			LogError: t.Errorf,
+			TimeNow:  test.TimeNow,
+			Once:     true,
+		}
+		for idx := 0; idx < 3; idx++ {
+			c.Scrape()
+		}
+	}
+	test.AssertDBContent(t, "fixtures/scanprojects-template-scraped.sql")
+	test.AssertDeepEqual(t, "unshared backend quotas", unsharedPlugin.OverrideQuota, map[string]map[string]uint64{
+		"uuid-for-berlin":  {"things": 42, "capacity": 20},
+		"uuid-for-dresden": {"things": 42, "capacity": 20},
+	})
+	test.AssertDeepEqual(t, "shared backend quotas", sharedPlugin.OverrideQuota, map[string]map[string]uint64{
+		"uuid-for-berlin":  {"things": 42, "capacity": 5},
+		"uuid-for-dresden": {"things": 42, "capacity": 5},
+	})
+
+	//subsequent scrapes do not touch the backend again
+	unsharedPlugin.OverrideQuota["uuid-for-dresden"] = map[string]uint64{"things": 23, "capacity": 20}
+	_, err = db.DB.Exec(`UPDATE project_services SET stale = TRUE`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Collector{
+		Cluster:  cluster,
+		Plugin:   unsharedPlugin,
+		LogError: t.Errorf,
+		TimeNow:  test.TimeNow,
+		Once:     true,
+	}
+	for idx := 0; idx < 3; idx++ {
+		c.Scrape()
+	}
+	test.AssertDeepEqual(t, "unshared backend quotas", unsharedPlugin.OverrideQuota["uuid-for-dresden"], map[string]uint64{"things": 23, "capacity": 20})
+}
+
 func Test_listDomainsFiltered(t *testing.T) {
 	cluster := &limes.Cluster{
 		DiscoveryPlugin: &test.DiscoveryPlugin{
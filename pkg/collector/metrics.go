@@ -21,6 +21,8 @@ package collector
 
 import (
 	"database/sql"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/limes/pkg/db"
@@ -47,9 +49,45 @@ var scrapeFailedCounter = prometheus.NewCounterVec(
 	[]string{"os_cluster", "service", "service_name"},
 )
 
+var scrapeQueueDepthGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_scrape_queue_depth",
+		Help: "Number of Keystone projects that are waiting to be scraped.",
+	},
+	[]string{"os_cluster", "service"},
+)
+
+var scrapeInProgressGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_scrape_in_progress",
+		Help: "Number of Keystone projects that are currently being scraped.",
+	},
+	[]string{"os_cluster", "service"},
+)
+
+var scrapeInBackoffGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_scrape_in_backoff",
+		Help: "Number of Keystone projects that are not scraped until their backoff after a failed scrape expires.",
+	},
+	[]string{"os_cluster", "service"},
+)
+
+var unrevertableGrantsGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_unrevertable_quota_grants",
+		Help: "Number of expired time-limited quota grants that cannot be reverted because the usage exceeds the quota after expiry.",
+	},
+	[]string{"os_cluster", "service", "resource"},
+)
+
 func init() {
 	prometheus.MustRegister(scrapeSuccessCounter)
 	prometheus.MustRegister(scrapeFailedCounter)
+	prometheus.MustRegister(scrapeQueueDepthGauge)
+	prometheus.MustRegister(scrapeInProgressGauge)
+	prometheus.MustRegister(scrapeInBackoffGauge)
+	prometheus.MustRegister(unrevertableGrantsGauge)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -95,10 +133,36 @@ var projectBackendQuotaGauge = prometheus.NewGaugeVec(
 	[]string{"os_cluster", "domain", "domain_id", "project", "project_id", "service", "resource"},
 )
 
+var projectQuotaExpiresAtGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_project_quota_expires_at",
+		Help: "Expiry time (as UNIX timestamp) of a time-limited quota of a Limes resource for an OpenStack project.",
+	},
+	[]string{"os_cluster", "domain", "domain_id", "project", "project_id", "service", "resource"},
+)
+
+var projectQuotaAfterExpiryGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_project_quota_after_expiry",
+		Help: "Quota of a Limes resource for an OpenStack project after its time-limited quota expires.",
+	},
+	[]string{"os_cluster", "domain", "domain_id", "project", "project_id", "service", "resource"},
+)
+
 //DataMetricsCollector is a prometheus.Collector that submits
 //quota/usage/backend quota from an OpenStack cluster as Prometheus metrics.
 type DataMetricsCollector struct {
-	Cluster *limes.Cluster
+	Cluster     *limes.Cluster
+	reloadMutex sync.Mutex
+}
+
+//Reload replaces the Cluster used by this DataMetricsCollector after the
+//configuration has been reloaded. The new Cluster is used from the next call
+//to Collect() onwards.
+func (c *DataMetricsCollector) Reload(cluster *limes.Cluster) {
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+	c.Cluster = cluster
 }
 
 //Describe implements the prometheus.Collector interface.
@@ -108,6 +172,8 @@ func (c *DataMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
 	projectQuotaGauge.Describe(ch)
 	projectUsageGauge.Describe(ch)
 	projectBackendQuotaGauge.Describe(ch)
+	projectQuotaExpiresAtGauge.Describe(ch)
+	projectQuotaAfterExpiryGauge.Describe(ch)
 }
 
 var clusterMetricsQuery = `
@@ -134,6 +200,15 @@ var projectMetricsQuery = `
 	 WHERE d.cluster_id = $1
 `
 
+var projectGrantMetricsQuery = `
+	SELECT d.name, d.uuid, p.name, p.uuid, ps.type, g.resource_name, g.expires_at, g.previous_quota
+	  FROM domains d
+	  JOIN projects p ON p.domain_id = d.id
+	  JOIN project_services ps ON ps.project_id = p.id
+	  JOIN project_quota_grants g ON g.service_id = ps.id
+	 WHERE d.cluster_id = $1
+`
+
 //Collect implements the prometheus.Collector interface.
 func (c *DataMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 	//NOTE: I use NewConstMetric() instead of storing the values in the GaugeVec
@@ -143,6 +218,10 @@ func (c *DataMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 	//2. because this automatically handles deleted projects/domains correctly.
 	//   (Their metrics just disappear when Prometheus scrapes next time.)
 
+	c.reloadMutex.Lock()
+	cluster := c.Cluster
+	c.reloadMutex.Unlock()
+
 	//fetch Descs for all metrics
 	descCh := make(chan *prometheus.Desc, 1)
 	clusterCapacityGauge.Describe(descCh)
@@ -155,9 +234,13 @@ func (c *DataMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 	projectUsageDesc := <-descCh
 	projectBackendQuotaGauge.Describe(descCh)
 	projectBackendQuotaDesc := <-descCh
+	projectQuotaExpiresAtGauge.Describe(descCh)
+	projectQuotaExpiresAtDesc := <-descCh
+	projectQuotaAfterExpiryGauge.Describe(descCh)
+	projectQuotaAfterExpiryDesc := <-descCh
 
 	//fetch values for cluster level
-	queryArgs := []interface{}{c.Cluster.ID}
+	queryArgs := []interface{}{cluster.ID}
 	err := db.ForeachRow(db.DB, clusterMetricsQuery, queryArgs, func(rows *sql.Rows) error {
 		var (
 			clusterID    string
@@ -172,7 +255,7 @@ func (c *DataMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 		var sharedString string
 		if clusterID == "shared" {
 			sharedString = "true"
-			if !c.Cluster.IsServiceShared[serviceType] {
+			if !cluster.IsServiceShared[serviceType] {
 				return nil //continue with next row
 			}
 		} else {
@@ -182,7 +265,7 @@ func (c *DataMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(
 			clusterCapacityDesc,
 			prometheus.GaugeValue, float64(capacity),
-			c.Cluster.ID, sharedString, serviceType, resourceName,
+			cluster.ID, sharedString, serviceType, resourceName,
 		)
 		return nil
 	})
@@ -206,7 +289,7 @@ func (c *DataMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(
 			domainQuotaDesc,
 			prometheus.GaugeValue, float64(quota),
-			c.Cluster.ID, domainName, domainUUID, serviceType, resourceName,
+			cluster.ID, domainName, domainUUID, serviceType, resourceName,
 		)
 		return nil
 	})
@@ -235,21 +318,53 @@ func (c *DataMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(
 			projectQuotaDesc,
 			prometheus.GaugeValue, float64(quota),
-			c.Cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
+			cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
 		)
 		ch <- prometheus.MustNewConstMetric(
 			projectUsageDesc,
 			prometheus.GaugeValue, float64(usage),
-			c.Cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
+			cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
 		)
 		ch <- prometheus.MustNewConstMetric(
 			projectBackendQuotaDesc,
 			prometheus.GaugeValue, float64(backendQuota),
-			c.Cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
+			cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
 		)
 		return nil
 	})
 	if err != nil {
 		util.LogError("collect project metrics failed: " + err.Error())
 	}
+	//fetch values for time-limited project quotas
+	err = db.ForeachRow(db.DB, projectGrantMetricsQuery, queryArgs, func(rows *sql.Rows) error {
+		var (
+			domainName    string
+			domainUUID    string
+			projectName   string
+			projectUUID   string
+			serviceType   string
+			resourceName  string
+			expiresAt     util.Time
+			previousQuota uint64
+		)
+		err := rows.Scan(&domainName, &domainUUID, &projectName, &projectUUID, &serviceType, &resourceName, &expiresAt, &previousQuota)
+		if err != nil {
+			return err
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			projectQuotaExpiresAtDesc,
+			prometheus.GaugeValue, float64(time.Time(expiresAt).Unix()),
+			cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			projectQuotaAfterExpiryDesc,
+			prometheus.GaugeValue, float64(previousQuota),
+			cluster.ID, domainName, domainUUID, projectName, projectUUID, serviceType, resourceName,
+		)
+		return nil
+	})
+	if err != nil {
+		util.LogError("collect project grant metrics failed: " + err.Error())
+	}
 }
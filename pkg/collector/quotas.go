@@ -0,0 +1,72 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"fmt"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+)
+
+//WriteProjectQuotasToBackend writes the approved quotas of the given project
+//services into the backend services. Backend errors are returned as a list of
+//messages; only DB errors cause a non-nil error return.
+//
+//This is used by the API after quota changes, as well as by the collector
+//when it changes quotas on its own (e.g. when a quota grant expires).
+func WriteProjectQuotasToBackend(cluster *limes.Cluster, domainUUID, projectUUID string, services []db.ProjectService) (errors []string, err error) {
+	for _, srv := range services {
+		plugin := cluster.QuotaPlugins[srv.Type]
+		if plugin == nil {
+			errors = append(errors, fmt.Sprintf("no quota plugin registered for service type %s", srv.Type))
+			continue
+		}
+
+		//collect all resource quotas for this service (NOT only the ones that were
+		//updated just now; the QuotaPlugin.SetQuota method requires as input *all*
+		//quotas for that plugin's service)
+		quotaValues := make(map[string]uint64)
+		var resources []db.ProjectResource
+		_, err = db.DB.Select(&resources,
+			`SELECT * FROM project_resources WHERE service_id = $1`, srv.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range resources {
+			quotaValues[res.Name] = res.Quota
+		}
+		err = plugin.SetQuota(cluster.ProviderClientForService(srv.Type), domainUUID, projectUUID, quotaValues)
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+
+		//on success, we now know that the backend has all the correct quotas
+		_, err = db.DB.Exec(
+			`UPDATE project_resources SET backend_quota = quota WHERE service_id = $1`,
+			srv.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return errors, nil
+}
@@ -0,0 +1,152 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//how often to check for due scheduled changes
+var scheduledChangesInterval = 1 * time.Minute
+
+var dueScheduledChangesQuery = `
+	SELECT c.* FROM scheduled_changes c
+	  JOIN domains d ON d.id = c.domain_id
+	 WHERE d.cluster_id = $1 AND c.state = $2 AND c.due_at <= $3
+	 ORDER BY c.due_at, c.id
+`
+
+var failScheduledChangeQuery = `
+	UPDATE scheduled_changes SET state = $1, error_message = $2, processed_at = $3
+	 WHERE id = $4 AND state = $5
+`
+
+//ScheduledChangeApplier validates and applies a single pending scheduled
+//change. It must do nothing if the change is not pending anymore when it gets
+//to it (e.g. because it was cancelled in the meantime). Validation failures
+//are recorded on the change by the applier itself; a non-nil error return
+//means that the change could not be processed at all.
+//
+//The implementation lives in pkg/api (see api.ApplyScheduledChange) since the
+//quotas must be validated in the same way as for PUT requests.
+type ScheduledChangeApplier func(cluster *limes.Cluster, changeID int64, now time.Time) error
+
+//ApplyScheduledChanges checks the database periodically for scheduled changes
+//that are due, and applies them using the given applier. When a change cannot
+//be processed at all, it is marked as failed, so that it does not block the
+//changes that are due after it.
+//
+//Errors are logged instead of returned. The function will not return unless
+//startup fails.
+func (c *Collector) ApplyScheduledChanges(apply ScheduledChangeApplier) {
+	for {
+		c.applyReload()
+		c.applyScheduledChanges(apply)
+
+		if c.Once {
+			return
+		}
+		time.Sleep(scheduledChangesInterval)
+	}
+}
+
+func (c *Collector) applyScheduledChanges(apply ScheduledChangeApplier) {
+	now := c.TimeNow()
+	var changes []db.ScheduledChange
+	_, err := db.DB.Select(&changes, dueScheduledChangesQuery,
+		c.Cluster.ID, db.ScheduledChangePending, now)
+	if err != nil {
+		c.LogError("cannot select due scheduled changes: %s", err.Error())
+		return
+	}
+
+	for _, change := range changes {
+		err := apply(c.Cluster, change.ID, now)
+		if err == nil {
+			continue
+		}
+		c.LogError("cannot apply scheduled change %d: %s", change.ID, err.Error())
+		err = c.failScheduledChange(change, err, now)
+		if err != nil {
+			c.LogError("cannot mark scheduled change %d as failed: %s", change.ID, err.Error())
+		}
+	}
+}
+
+func (c *Collector) failScheduledChange(change db.ScheduledChange, applyErr error, now time.Time) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer db.RollbackUnlessCommitted(tx)
+
+	result, err := tx.Exec(failScheduledChangeQuery,
+		db.ScheduledChangeFailed, applyErr.Error(), now, change.ID, db.ScheduledChangePending)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return nil //change was processed by someone else in the meantime
+	}
+
+	//record the failure in the same way as pkg/api does for changes that fail validation
+	event := db.AuditEvent{Action: db.AuditActionFailChange}
+	err = tx.QueryRow(`SELECT uuid FROM domains WHERE id = $1`, change.DomainID).Scan(&event.DomainUUID)
+	if err != nil {
+		return err
+	}
+	target := "domain " + event.DomainUUID
+	if change.ProjectID != nil {
+		err = tx.QueryRow(`SELECT uuid FROM projects WHERE id = $1`, *change.ProjectID).Scan(&event.ProjectUUID)
+		if err != nil {
+			return err
+		}
+		target = "project " + event.ProjectUUID
+	}
+	auditTrail := db.AuditTrail{
+		Time:      now,
+		ClusterID: c.Cluster.ID,
+		UserUUID:  change.CreatorUUID,
+		UserName:  change.CreatorName,
+	}
+	auditTrail.Add(event,
+		"could not apply scheduled change %d for %s (scheduled by user %s (%s)): %s",
+		change.ID, target, change.CreatorUUID, change.CreatorName, applyErr.Error(),
+	)
+	err = auditTrail.Write(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	auditTrail.Commit()
+	util.LogInfo("marked scheduled change %d for %s as failed", change.ID, target)
+	return nil
+}
@@ -23,8 +23,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"time"
 
+	gorp "gopkg.in/gorp.v2"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/limes/pkg/db"
 	"github.com/sapcc/limes/pkg/limes"
@@ -37,9 +40,25 @@ var idleInterval = 10 * time.Second
 //how long to wait before scraping the same project and service again
 var scrapeInterval = 30 * time.Minute
 
-//query that finds the next project that needs to be scraped
-var findProjectQuery = `
-	SELECT ps.id, p.name, p.uuid, d.name, d.uuid
+//how long to wait before scraping a project again after its first failed
+//scrape (this is doubled after each further failure, up to scrapeBackoffMax)
+var scrapeBackoffMin = 1 * time.Minute
+var scrapeBackoffMax = 2 * time.Hour
+
+//addJitter randomizes backoff durations, so that projects which failed at the
+//same time (e.g. during a backend outage) are not retried all at once. Unit
+//tests replace this to get reproducible results.
+var addJitter = func(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+//how long a worker may take to scrape a project before other workers may
+//claim the same project (this only matters when a worker dies during a scrape)
+var scrapeClaimDuration = 10 * time.Minute
+
+//the part of findProjectsQuery that selects the projects that need to be
+//scraped (this is shared with countProjectsToScrapeQuery)
+var projectsToScrapeClause = `
 	FROM project_services ps
 	JOIN projects p ON p.id = ps.project_id
 	JOIN domains d ON d.id = p.domain_id
@@ -47,16 +66,60 @@ var findProjectQuery = `
 	WHERE d.cluster_id = $1 AND ps.type = $2
 	-- filter by need to be updated (because of user request, because of missing data, or because of outdated data)
 	AND (ps.stale OR ps.scraped_at IS NULL OR ps.scraped_at < $3)
+	-- filter projects that are currently being scraped by another worker
+	AND (ps.scrape_claimed_until IS NULL OR ps.scrape_claimed_until < $4)
+	-- filter projects whose scrape failed recently
+	AND (ps.scrape_backoff_until IS NULL OR ps.scrape_backoff_until < $4)
+`
+
+//query that finds all projects that need to be scraped
+var findProjectsQuery = `
+	SELECT ps.id, p.name, p.uuid, d.name, d.uuid, ps.scraped_at IS NULL` + projectsToScrapeClause + `
 	-- order by update priority (in the same way: first user-requested, then new projects, then outdated projects)
 	ORDER BY ps.stale DESC, COALESCE(ps.scraped_at, to_timestamp(0)) ASC
+`
+
+//query that finds the next project that needs to be scraped
+var findProjectQuery = findProjectsQuery + `
 	-- find only one project to scrape per iteration
 	LIMIT 1
 `
 
+//scrapeTarget identifies a project service that needs to be scraped.
+type scrapeTarget struct {
+	ServiceID   int64
+	ProjectName string
+	ProjectUUID string
+	DomainName  string
+	DomainUUID  string
+	//whether this project service has never been scraped before
+	FirstScrape bool
+}
+
+//query that claims a project for scraping; if another worker was faster, no
+//rows will be affected
+var claimProjectQuery = `
+	UPDATE project_services SET scrape_claimed_until = $1
+	 WHERE id = $2 AND (scrape_claimed_until IS NULL OR scrape_claimed_until < $3)
+`
+
 //Scrape checks the database periodically for outdated or missing resource
 //records for the given cluster and the given service type, and updates them by
 //querying the backend service.
 //
+//Idle phases are cut short when the API announces a sync request for this
+//service type (see NotifySyncRequested).
+//
+//When scraping a project fails, the next attempt is delayed with exponential
+//backoff, so that a broken project does not block the other projects.
+//
+//If the plugin implements limes.BulkQuotaPlugin, multiple projects that need
+//scraping are scraped at once (see scrapeBulk).
+//
+//Multiple Scrape() jobs may run concurrently for the same service type (even
+//in different processes). Each project is claimed by one job before it is
+//scraped, so no project is scraped twice at once.
+//
 //Errors are logged instead of returned. The function will not return unless
 //startup fails.
 func (c *Collector) Scrape() {
@@ -72,16 +135,36 @@ func (c *Collector) Scrape() {
 	scrapeSuccessCounter.With(labels).Add(0)
 	scrapeFailedCounter.With(labels).Add(0)
 
+	//sync requests from the API can cut our idle phases short
+	wakeup := scrapeWakeups.Subscribe(serviceType)
+	defer scrapeWakeups.Unsubscribe(serviceType, wakeup)
+
 	for {
-		var (
-			serviceID   int64
-			projectName string
-			projectUUID string
-			domainName  string
-			domainUUID  string
-		)
-		err := db.DB.QueryRow(findProjectQuery, c.Cluster.ID, serviceType, c.TimeNow().Add(-scrapeInterval)).
-			Scan(&serviceID, &projectName, &projectUUID, &domainName, &domainUUID)
+		c.applyReload()
+
+		//if the plugin supports it, scrape all projects at once when multiple
+		//projects need scraping
+		if bulkPlugin, ok := c.Plugin.(limes.BulkQuotaPlugin); ok {
+			if c.scrapeBulk(bulkPlugin, labels) {
+				if c.Once {
+					return
+				}
+				continue
+			}
+		}
+
+		var target scrapeTarget
+		now := c.TimeNow()
+		err := db.DB.QueryRow(findProjectQuery, c.Cluster.ID, serviceType, now.Add(-scrapeInterval), now).
+			Scan(&target.ServiceID, &target.ProjectName, &target.ProjectUUID, &target.DomainName, &target.DomainUUID, &target.FirstScrape)
+		if err == nil {
+			var claimed bool
+			claimed, err = c.claimProjectService(target.ServiceID, now)
+			if err == nil && !claimed {
+				//another worker was faster -> look for the next project immediately
+				continue
+			}
+		}
 		if err != nil {
 			//ErrNoRows is okay; it just means that needs scraping right now
 			if err != sql.ErrNoRows {
@@ -89,39 +172,23 @@ func (c *Collector) Scrape() {
 				//(such as "the DB has burst into flames"); maybe a separate thread that
 				//just pings the DB every now and then and does os.Exit(1) if it fails);
 				//check if database/sql has something like that built-in
-				c.LogError("cannot select next project for which to scrape %s data: %s", serviceType, err.Error())
+				c.LogError("cannot claim next project for which to scrape %s data: %s", serviceType, err.Error())
 			}
 			if c.Once {
 				return
 			}
-			time.Sleep(idleInterval)
+			sleepUnlessWoken(idleInterval, wakeup)
 			continue
 		}
 
-		util.LogDebug("scraping %s for %s/%s", serviceType, domainName, projectName)
-		resourceData, err := c.Plugin.Scrape(c.Cluster.ProviderClientForService(serviceType), domainUUID, projectUUID)
-		if err != nil {
-			c.LogError("scrape %s data for %s/%s failed: %s", serviceType, domainName, projectName, err.Error())
-			scrapeFailedCounter.With(labels).Inc()
+		if !c.scrapeProject(target, labels) {
 			if c.Once {
 				return
 			}
-			time.Sleep(idleInterval)
+			sleepUnlessWoken(idleInterval, wakeup)
 			continue
 		}
 
-		err = c.writeScrapeResult(domainUUID, projectUUID, serviceType, serviceID, resourceData, c.TimeNow())
-		if err != nil {
-			c.LogError("write %s backend data for %s/%s failed: %s", serviceType, domainName, projectName, err.Error())
-			scrapeFailedCounter.With(labels).Inc()
-			if c.Once {
-				return
-			}
-			time.Sleep(idleInterval)
-			continue
-		}
-
-		scrapeSuccessCounter.With(labels).Inc()
 		if c.Once {
 			break
 		}
@@ -131,21 +198,253 @@ func (c *Collector) Scrape() {
 	}
 }
 
-func (c *Collector) writeScrapeResult(domainUUID, projectUUID, serviceType string, serviceID int64, resourceData map[string]limes.ResourceData, scrapedAt time.Time) error {
+//scrapeProject scrapes a single project service that was claimed by this job,
+//and writes the result (or the error) into the database. Returns whether the
+//scrape was successful.
+func (c *Collector) scrapeProject(target scrapeTarget, labels prometheus.Labels) bool {
+	serviceType := c.Plugin.ServiceInfo().Type
+
+	util.LogDebug("scraping %s for %s/%s", serviceType, target.DomainName, target.ProjectName)
+	resourceData, err := c.Plugin.Scrape(c.Cluster.ProviderClientForService(serviceType), target.DomainUUID, target.ProjectUUID)
+	if err != nil {
+		c.LogError("scrape %s data for %s/%s failed: %s", serviceType, target.DomainName, target.ProjectName, err.Error())
+		scrapeFailedCounter.With(labels).Inc()
+		err = c.writeScrapeError(target.ServiceID, err, c.TimeNow())
+		if err != nil {
+			c.LogError("write %s scrape error for %s/%s failed: %s", serviceType, target.DomainName, target.ProjectName, err.Error())
+		}
+		return false
+	}
+
+	results := map[string]map[string]limes.ResourceData{target.ProjectUUID: resourceData}
+	err = c.writeScrapeResults([]scrapeTarget{target}, results, c.TimeNow())
+	if err != nil {
+		c.LogError("write %s backend data for %s/%s failed: %s", serviceType, target.DomainName, target.ProjectName, err.Error())
+		scrapeFailedCounter.With(labels).Inc()
+		err = c.releaseProjectService(target.ServiceID)
+		if err != nil {
+			c.LogError("release claim on %s data for %s/%s failed: %s", serviceType, target.DomainName, target.ProjectName, err.Error())
+		}
+		return false
+	}
+
+	scrapeSuccessCounter.With(labels).Inc()
+	return true
+}
+
+//how often MeasureScrapeQueues updates its metrics
+var scrapeQueueMeasureInterval = 1 * time.Minute
+
+//query that counts the projects that are waiting to be scraped, those that
+//are currently being scraped, and those that are in backoff after a failed
+//scrape (see findProjectQuery for the conditions)
+var measureScrapeQueuesQuery = `
+	SELECT ps.type,
+	       SUM(CASE WHEN (ps.scrape_claimed_until IS NULL OR ps.scrape_claimed_until < $1)
+	                 AND (ps.scrape_backoff_until IS NULL OR ps.scrape_backoff_until < $1)
+	                 AND (ps.stale OR ps.scraped_at IS NULL OR ps.scraped_at < $2) THEN 1 ELSE 0 END),
+	       SUM(CASE WHEN ps.scrape_claimed_until >= $1 THEN 1 ELSE 0 END),
+	       SUM(CASE WHEN ps.scrape_backoff_until >= $1 THEN 1 ELSE 0 END)
+	  FROM project_services ps
+	  JOIN projects p ON p.id = ps.project_id
+	  JOIN domains d ON d.id = p.domain_id
+	 WHERE d.cluster_id = $3
+	 GROUP BY ps.type
+`
+
+//MeasureScrapeQueues periodically reports how many projects are waiting to be
+//scraped, how many are currently being scraped, and how many are in backoff
+//after a failed scrape, for each service type.
+//These metrics can be used to choose the number of scraping workers per
+//service type.
+//
+//Errors are logged instead of returned. The function will not return unless
+//startup fails.
+func (c *Collector) MeasureScrapeQueues() {
+	for {
+		c.applyReload()
+		err := c.measureScrapeQueues()
+		if err != nil {
+			c.LogError("cannot measure scrape queues: %s", err.Error())
+		}
+
+		if c.Once {
+			return
+		}
+		time.Sleep(scrapeQueueMeasureInterval)
+	}
+}
+
+func (c *Collector) measureScrapeQueues() error {
+	queueDepth := make(map[string]uint64)
+	inProgress := make(map[string]uint64)
+	inBackoff := make(map[string]uint64)
+	now := c.TimeNow()
+	err := db.ForeachRow(db.DB, measureScrapeQueuesQuery, []interface{}{now, now.Add(-scrapeInterval), c.Cluster.ID}, func(rows *sql.Rows) error {
+		var (
+			serviceType string
+			waiting     uint64
+			claimed     uint64
+			backingOff  uint64
+		)
+		err := rows.Scan(&serviceType, &waiting, &claimed, &backingOff)
+		queueDepth[serviceType] = waiting
+		inProgress[serviceType] = claimed
+		inBackoff[serviceType] = backingOff
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	//report zero for services without any projects, too
+	for _, serviceType := range c.Cluster.ServiceTypes {
+		labels := prometheus.Labels{"os_cluster": c.Cluster.ID, "service": serviceType}
+		scrapeQueueDepthGauge.With(labels).Set(float64(queueDepth[serviceType]))
+		scrapeInProgressGauge.With(labels).Set(float64(inProgress[serviceType]))
+		scrapeInBackoffGauge.With(labels).Set(float64(inBackoff[serviceType]))
+	}
+	return nil
+}
+
+//claimProjectService marks the given project service as being scraped by
+//this worker. It returns false if another worker claimed it first.
+func (c *Collector) claimProjectService(serviceID int64, now time.Time) (bool, error) {
+	result, err := db.DB.Exec(claimProjectQuery, now.Add(scrapeClaimDuration), serviceID, now)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+//releaseProjectService removes the claim set by claimProjectService. This is
+//only needed when a scrape could not be recorded, since writeScrapeError and
+//writeScrapeResult release the claim themselves.
+func (c *Collector) releaseProjectService(serviceID int64) error {
+	_, err := db.DB.Exec(`UPDATE project_services SET scrape_claimed_until = NULL WHERE id = $1`, serviceID)
+	return err
+}
+
+//writeScrapeError records a failed scrape in the project_services table, so
+//that it can be shown in the API, and puts the project service into backoff.
+func (c *Collector) writeScrapeError(serviceID int64, scrapeErr error, failedAt time.Time) error {
+	var failures uint64
+	err := db.DB.QueryRow(`SELECT consecutive_scrape_failures FROM project_services WHERE id = $1`, serviceID).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	failures++
+
+	_, err = db.DB.Exec(
+		`UPDATE project_services SET scrape_error_message = $1, scrape_error_at = $2, consecutive_scrape_failures = $3, scrape_backoff_until = $4, scrape_claimed_until = NULL WHERE id = $5`,
+		scrapeErr.Error(), failedAt, failures, failedAt.Add(scrapeBackoff(failures)), serviceID,
+	)
+	return err
+}
+
+//scrapeBackoff returns how long to wait before scraping a project service
+//again after the given number of consecutive failed scrapes.
+func scrapeBackoff(failures uint64) time.Duration {
+	backoff := scrapeBackoffMin
+	for idx := uint64(1); idx < failures && backoff < scrapeBackoffMax; idx++ {
+		backoff *= 2
+	}
+	if backoff > scrapeBackoffMax {
+		backoff = scrapeBackoffMax
+	}
+	return addJitter(backoff)
+}
+
+//writeScrapeResults writes the scraped data for the given project services
+//into the database in a single transaction. The results are keyed by project
+//UUID and must contain an entry for each of the given project services.
+func (c *Collector) writeScrapeResults(targets []scrapeTarget, results map[string]map[string]limes.ResourceData, scrapedAt time.Time) error {
+	serviceType := c.Plugin.ServiceInfo().Type
 	tx, err := db.DB.Begin()
 	if err != nil {
 		return err
 	}
 	defer db.RollbackUnlessCommitted(tx)
 
+	auditTrail := db.AuditTrail{Time: scrapedAt, ClusterID: c.Cluster.ID}
+	quotaValuesToSet := make(map[int64]map[string]uint64) //key = service ID
+	for _, target := range targets {
+		quotaValues, needToSetQuota, err := c.writeScrapeResult(tx, &auditTrail, target, results[target.ProjectUUID], scrapedAt)
+		if err != nil {
+			return err
+		}
+		if needToSetQuota {
+			quotaValuesToSet[target.ServiceID] = quotaValues
+		}
+	}
+
+	err = auditTrail.Write(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	auditTrail.Commit()
+
+	//if a mismatch between frontend and backend quota was detected, try to
+	//rectify it (but an error at this point is non-fatal: we don't want scraping
+	//to get stuck because some project has backend_quota > usage > quota, for
+	//example)
+	for _, target := range targets {
+		quotaValues, exists := quotaValuesToSet[target.ServiceID]
+		if !exists {
+			continue
+		}
+		err := c.Plugin.SetQuota(c.Cluster.ProviderClientForService(serviceType), target.DomainUUID, target.ProjectUUID, quotaValues)
+		if err != nil {
+			util.LogError("could not rectify frontend/backend quota mismatch for service %s in project %s: %s",
+				serviceType, target.ProjectUUID, err.Error(),
+			)
+			continue
+		}
+		//backend quota rectified successfully
+		for resourceName, quota := range quotaValues {
+			_, err = db.DB.Exec(
+				`UPDATE project_resources SET backend_quota = $1 WHERE service_id = $2 AND name = $3`,
+				quota, target.ServiceID, resourceName,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//writeScrapeResult writes the scraped data for a single project service
+//within the given transaction. Returns the quota values of this project
+//service, and whether they need to be set in the backend.
+//
+//In authoritative clusters, the backend quotas are aligned with the approved
+//quotas whenever they differ. Otherwise, the backend is only written after
+//the first scrape of a project whose quota template was applied: The
+//template quotas are set, and all other resources keep their backend quota.
+func (c *Collector) writeScrapeResult(tx *gorp.Transaction, auditTrail *db.AuditTrail, target scrapeTarget, resourceData map[string]limes.ResourceData, scrapedAt time.Time) (map[string]uint64, bool, error) {
+	serviceType := c.Plugin.ServiceInfo().Type
+	serviceID := target.ServiceID
+	domainUUID := target.DomainUUID
+	projectUUID := target.ProjectUUID
+
 	//update existing project_resources entries
 	quotaValues := make(map[string]uint64)
 	needToSetQuota := false
 	var resources []db.ProjectResource
-	_, err = tx.Select(&resources, `SELECT * FROM project_resources WHERE service_id = $1`, serviceID)
+	_, err := tx.Select(&resources, `SELECT * FROM project_resources WHERE service_id = $1`, serviceID)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
+	//before the first scrape, only the resources from the quota template exist
+	pushTemplate := !c.Cluster.Authoritative && target.FirstScrape && len(resources) > 0
+	keepBackendQuota := false
 	for _, res := range resources {
 		quotaValues[res.Name] = res.Quota
 
@@ -166,7 +465,7 @@ func (c *Collector) writeScrapeResult(domainUUID, projectUUID, serviceType strin
 				}
 				bytes, err := json.Marshal(data.Subresources)
 				if err != nil {
-					return fmt.Errorf("failed to convert subresources to JSON: %s", err.Error())
+					return nil, false, fmt.Errorf("failed to convert subresources to JSON: %s", err.Error())
 				}
 				res.SubresourcesJSON = string(bytes)
 			}
@@ -174,7 +473,7 @@ func (c *Collector) writeScrapeResult(domainUUID, projectUUID, serviceType strin
 			//TODO: Update() only if required
 			_, err := tx.Update(&res)
 			if err != nil {
-				return err
+				return nil, false, err
 			}
 			if res.BackendQuota < 0 || res.Quota != uint64(res.BackendQuota) {
 				needToSetQuota = true
@@ -188,7 +487,6 @@ func (c *Collector) writeScrapeResult(domainUUID, projectUUID, serviceType strin
 	}
 
 	//insert missing project_resources entries
-	var auditTrail util.AuditTrail
 	for _, resMetadata := range c.Plugin.Resources() {
 		if _, exists := quotaValues[resMetadata.Name]; exists {
 			continue
@@ -204,69 +502,97 @@ func (c *Collector) writeScrapeResult(domainUUID, projectUUID, serviceType strin
 		}
 		if data.Quota > 0 && uint64(data.Quota) == resMetadata.AutoApproveInitialQuota {
 			res.Quota = resMetadata.AutoApproveInitialQuota
-			auditTrail.Add("set quota %s.%s = 0 -> %d for project %s through auto-approval",
+			oldQuota, newQuota := uint64(0), res.Quota
+			auditTrail.Add(db.AuditEvent{
+				DomainUUID:   domainUUID,
+				ProjectUUID:  projectUUID,
+				ServiceType:  serviceType,
+				ResourceName: resMetadata.Name,
+				Action:       db.AuditActionSetQuota,
+				OldValue:     &oldQuota,
+				NewValue:     &newQuota,
+			}, "set quota %s.%s = 0 -> %d for project %s through auto-approval",
 				serviceType, resMetadata.Name, res.Quota, projectUUID,
 			)
 		}
 		if len(data.Subresources) != 0 {
 			bytes, err := json.Marshal(data.Subresources)
 			if err != nil {
-				return fmt.Errorf("failed to convert subresources to JSON: %s", err.Error())
+				return nil, false, fmt.Errorf("failed to convert subresources to JSON: %s", err.Error())
 			}
 			res.SubresourcesJSON = string(bytes)
 		}
 
 		err = tx.Insert(res)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		quotaValues[res.Name] = res.Quota
-		if res.BackendQuota < 0 || res.Quota != uint64(res.BackendQuota) {
+		if pushTemplate {
+			//resources outside the quota template keep their backend quota
+			if res.BackendQuota < 0 {
+				keepBackendQuota = true
+			} else {
+				quotaValues[res.Name] = uint64(res.BackendQuota)
+			}
+		} else if res.BackendQuota < 0 || res.Quota != uint64(res.BackendQuota) {
 			needToSetQuota = true
 		}
 	}
 
+	if !c.Cluster.Authoritative {
+		needToSetQuota = needToSetQuota && pushTemplate
+		if needToSetQuota && keepBackendQuota {
+			util.LogInfo("not writing quota template into backend for project %s, service %s: cannot preserve infinite backend quotas of other resources",
+				projectUUID, serviceType,
+			)
+			needToSetQuota = false
+		}
+	}
+
 	//update scraped_at timestamp and reset the stale flag on this service so
-	//that we don't scrape it again immediately afterwards
+	//that we don't scrape it again immediately afterwards; also clear the
+	//previous scrape error, if any, and release this worker's claim
 	_, err = tx.Exec(
-		`UPDATE project_services SET scraped_at = $1, stale = $2 WHERE id = $3`,
+		`UPDATE project_services SET scraped_at = $1, stale = $2, scrape_error_message = '', scrape_error_at = NULL, consecutive_scrape_failures = 0, scrape_backoff_until = NULL, scrape_claimed_until = NULL WHERE id = $3`,
 		scrapedAt, false, serviceID,
 	)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-	auditTrail.Commit()
+	//record a sample of the new values in the history
+	err = writeHistorySample(tx, serviceID, scrapedAt)
+	return quotaValues, needToSetQuota, err
+}
 
-	//feature gate for automatic quota alignment
-	if !c.Cluster.Authoritative {
-		return nil
-	}
+//resolution of the project_resource_history table (when a project service is
+//scraped multiple times within the same interval, only the last sample is kept)
+var historyInterval = time.Hour
 
-	//if a mismatch between frontend and backend quota was detected, try to
-	//rectify it (but an error at this point is non-fatal: we don't want scraping
-	//to get stuck because some project has backend_quota > usage > quota, for
-	//example)
-	if needToSetQuota {
-		err := c.Plugin.SetQuota(c.Cluster.ProviderClientForService(serviceType), domainUUID, projectUUID, quotaValues)
-		if err != nil {
-			serviceType := c.Plugin.ServiceInfo().Type
-			util.LogError("could not rectify frontend/backend quota mismatch for service %s in project %s: %s",
-				serviceType, projectUUID, err.Error(),
-			)
-		} else {
-			//backend quota rectified successfully
-			_, err = db.DB.Exec(
-				`UPDATE project_resources SET backend_quota = quota WHERE service_id = $1`,
-				serviceID,
-			)
-			return err
-		}
-	}
+var deleteHistorySampleQuery = `
+	DELETE FROM project_resource_history
+	 WHERE time = $1
+	   AND project_id = (SELECT project_id FROM project_services WHERE id = $2)
+	   AND service_type = (SELECT type FROM project_services WHERE id = $2)
+`
 
-	return nil
+var insertHistorySampleQuery = `
+	INSERT INTO project_resource_history (project_id, service_type, resource_name, time, quota, usage, backend_quota)
+	SELECT ps.project_id, ps.type, pr.name, $1, pr.quota, pr.usage, pr.backend_quota
+	  FROM project_services ps
+	  JOIN project_resources pr ON pr.service_id = ps.id
+	 WHERE ps.id = $2
+`
+
+//writeHistorySample copies the current quota and usage values of the given
+//project service into the project_resource_history table.
+func writeHistorySample(tx *gorp.Transaction, serviceID int64, scrapedAt time.Time) error {
+	sampleTime := scrapedAt.Truncate(historyInterval)
+	_, err := tx.Exec(deleteHistorySampleQuery, sampleTime, serviceID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertHistorySampleQuery, sampleTime, serviceID)
+	return err
 }
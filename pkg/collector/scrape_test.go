@@ -23,6 +23,7 @@ import (
 	"errors"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/prometheus/client_golang/prometheus"
@@ -137,6 +138,19 @@ func Test_Scrape(t *testing.T) {
 		ExpectStatusCode: 200,
 		ExpectFile:       "fixtures/scrape_metrics.json",
 	}.Check(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	//after a config reload, data metrics are reported for the new cluster
+	_, err = db.DB.Exec(`UPDATE domains SET cluster_id = ?`, "north")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmc.Reload(&limes.Cluster{ID: "north", IsServiceShared: cluster.IsServiceShared})
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/metrics",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/scrape_metrics_reloaded.json",
+	}.Check(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 }
 
 func setProjectServicesStale(t *testing.T) {
@@ -164,11 +178,11 @@ func (p *autoApprovalTestPlugin) Resources() []limes.ResourceInfo {
 	//one resource can auto-approve, one cannot because BackendQuota != AutoApproveInitialQuota
 	return []limes.ResourceInfo{
 		{
-			Name: "approve",
+			Name:                    "approve",
 			AutoApproveInitialQuota: p.StaticBackendQuota,
 		},
 		{
-			Name: "noapprove",
+			Name:                    "noapprove",
 			AutoApproveInitialQuota: p.StaticBackendQuota,
 		},
 	}
@@ -209,3 +223,134 @@ func Test_AutoApproveInitialQuota(t *testing.T) {
 	c.Scrape()
 	test.AssertDBContent(t, "fixtures/scrape-autoapprove2.sql")
 }
+
+func Test_ScrapeFailure(t *testing.T) {
+	plugin := test.NewPlugin("unittest")
+	cluster := prepareScrapeTest(t, plugin)
+	var errorCount int
+	c := Collector{
+		Cluster: cluster,
+		Plugin:  plugin,
+		LogError: func(msg string, args ...interface{}) {
+			errorCount++
+		},
+		TimeNow: test.TimeNow,
+		Once:    true,
+	}
+
+	//disable jitter to get reproducible backoff durations
+	defer func(f func(time.Duration) time.Duration) { addJitter = f }(addJitter)
+	addJitter = func(d time.Duration) time.Duration { return d }
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(scrapeQueueDepthGauge)
+	registry.MustRegister(scrapeInBackoffGauge)
+
+	//failed scrapes should be recorded in project_services, and the project
+	//should not be scraped again until its backoff expires
+	plugin.ScrapeFails = true
+	c.Scrape()
+	c.Scrape()
+	if errorCount != 1 {
+		t.Errorf("expected 1 error to be logged, got %d", errorCount)
+	}
+	c.MeasureScrapeQueues()
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/metrics",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/scrape-failure-metrics.prom",
+	}.Check(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	//when the backoff has expired, the next failure should increase the number
+	//of consecutive failures and double the backoff
+	expireScrapeBackoff(t)
+	c.Scrape()
+	test.AssertDBContent(t, "fixtures/scrape-failure1.sql")
+	if errorCount != 2 {
+		t.Errorf("expected 2 errors to be logged, got %d", errorCount)
+	}
+
+	//a successful scrape should clear the error and the backoff again
+	plugin.ScrapeFails = false
+	expireScrapeBackoff(t)
+	c.Scrape()
+	test.AssertDBContent(t, "fixtures/scrape-failure2.sql")
+}
+
+func expireScrapeBackoff(t *testing.T) {
+	_, err := db.DB.Exec(`UPDATE project_services SET scrape_backoff_until = ? WHERE scrape_backoff_until IS NOT NULL`, time.Unix(0, 0).UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ScrapeBackoff(t *testing.T) {
+	defer func(f func(time.Duration) time.Duration) { addJitter = f }(addJitter)
+	addJitter = func(d time.Duration) time.Duration { return d }
+
+	expected := []time.Duration{
+		1 * time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute,
+		16 * time.Minute, 32 * time.Minute, 64 * time.Minute, 2 * time.Hour, 2 * time.Hour,
+	}
+	for idx, backoff := range expected {
+		actual := scrapeBackoff(uint64(idx + 1))
+		if actual != backoff {
+			t.Errorf("expected backoff %s after %d failures, got %s", backoff, idx+1, actual)
+		}
+	}
+	if actual := scrapeBackoff(1000); actual != 2*time.Hour {
+		t.Errorf("expected backoff %s after %d failures, got %s", 2*time.Hour, 1000, actual)
+	}
+}
+
+func Test_ScrapeClaims(t *testing.T) {
+	plugin := test.NewPlugin("unittest")
+	cluster := prepareScrapeTest(t, plugin)
+	c := Collector{
+		Cluster:  cluster,
+		Plugin:   plugin,
+		LogError: t.Errorf,
+		TimeNow:  test.TimeNow,
+		Once:     true,
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(scrapeQueueDepthGauge)
+	registry.MustRegister(scrapeInProgressGauge)
+
+	//simulate another worker that is currently scraping the only project
+	_, err := db.DB.Exec(`UPDATE project_services SET scrape_claimed_until = ?`, time.Unix(3600, 0).UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MeasureScrapeQueues()
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/metrics",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/scrape-claims-metrics1.prom",
+	}.Check(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	//Scrape should not touch the claimed project
+	c.Scrape()
+	test.AssertDBContent(t, "fixtures/scrape-claims1.sql")
+
+	//when the claim expires (e.g. because the other worker died), the project
+	//is up for scraping again
+	_, err = db.DB.Exec(`UPDATE project_services SET scrape_claimed_until = ?`, time.Unix(0, 0).UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MeasureScrapeQueues()
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/metrics",
+		ExpectStatusCode: 200,
+		ExpectFile:       "fixtures/scrape-claims-metrics2.prom",
+	}.Check(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	//Scrape should scrape the project and release the claim afterwards
+	c.Scrape()
+	test.AssertDBContent(t, "fixtures/scrape-claims2.sql")
+}
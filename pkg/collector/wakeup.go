@@ -0,0 +1,167 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//the Postgres notification channel on which the API announces sync requests;
+//the payload is a JSON-encoded syncRequest
+const syncRequestChannel = "limes_sync_project_service"
+
+//syncRequest is the payload of a notification on syncRequestChannel. Since all
+//clusters share the same database (and thus the same channel), the cluster ID
+//is included so that each collector only reacts to its own sync requests.
+type syncRequest struct {
+	ClusterID string `json:"cluster_id"`
+	ServiceID int64  `json:"service_id"`
+}
+
+//NotifySyncRequested wakes up the scraping jobs for all services of the given
+//project (identified by its ID in the database), after the API has marked
+//them as stale. When the database does not support notifications, this does
+//nothing, and the scraping jobs will find the stale project services on their
+//next poll instead.
+func NotifySyncRequested(dbi db.Interface, clusterID string, projectID int64) error {
+	if !db.SupportsNotifications() {
+		return nil
+	}
+	var serviceIDs []int64
+	err := db.ForeachRow(dbi, `SELECT id FROM project_services WHERE project_id = $1`, []interface{}{projectID}, func(rows *sql.Rows) error {
+		var serviceID int64
+		err := rows.Scan(&serviceID)
+		serviceIDs = append(serviceIDs, serviceID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, serviceID := range serviceIDs {
+		payload, err := json.Marshal(syncRequest{ClusterID: clusterID, ServiceID: serviceID})
+		if err != nil {
+			return err
+		}
+		err = db.Notify(dbi, syncRequestChannel, string(payload))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ListenForSyncRequests makes the scraping jobs in this process wake up
+//immediately when the API announces a sync request for the given cluster
+//through NotifySyncRequested. When the database does not support
+//notifications, the scraping jobs will only poll the database for stale
+//project services.
+func ListenForSyncRequests(cfg db.Configuration, clusterID string) error {
+	if !db.SupportsNotifications() {
+		util.LogInfo("database does not support notifications; sync requests will be picked up by polling")
+		return nil
+	}
+	return db.Listen(cfg, syncRequestChannel, func(payload string) {
+		handleSyncRequest(clusterID, payload)
+	})
+}
+
+func handleSyncRequest(clusterID, payload string) {
+	var req syncRequest
+	err := json.Unmarshal([]byte(payload), &req)
+	if err != nil {
+		util.LogError("received malformed sync request %q: %s", payload, err.Error())
+		return
+	}
+	if req.ClusterID != clusterID {
+		//sync request is for a different cluster's collector
+		return
+	}
+	var serviceType string
+	err = db.DB.QueryRow(`SELECT type FROM project_services WHERE id = $1`, req.ServiceID).Scan(&serviceType)
+	if err != nil {
+		//ErrNoRows is okay; the project might have been deleted in the meantime
+		if err != sql.ErrNoRows {
+			util.LogError("cannot find project service %d for sync request: %s", req.ServiceID, err.Error())
+		}
+		return
+	}
+	util.LogDebug("waking up %s scraping jobs for project service %d", serviceType, req.ServiceID)
+	scrapeWakeups.Wake(serviceType)
+}
+
+//wakeupHub dispatches wakeup signals to the scraping jobs of each service type.
+type wakeupHub struct {
+	mutex    sync.Mutex
+	channels map[string][]chan struct{}
+}
+
+var scrapeWakeups = &wakeupHub{channels: make(map[string][]chan struct{})}
+
+//Subscribe returns a channel that receives a value whenever the scraping jobs
+//for the given service type shall wake up.
+func (h *wakeupHub) Subscribe(serviceType string) chan struct{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	//the buffer ensures that a wakeup is not lost while the job is busy
+	channel := make(chan struct{}, 1)
+	h.channels[serviceType] = append(h.channels[serviceType], channel)
+	return channel
+}
+
+//Unsubscribe reverses Subscribe.
+func (h *wakeupHub) Unsubscribe(serviceType string, channel chan struct{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	channels := h.channels[serviceType]
+	for idx, c := range channels {
+		if c == channel {
+			h.channels[serviceType] = append(channels[:idx], channels[idx+1:]...)
+			return
+		}
+	}
+}
+
+//Wake wakes up all scraping jobs for the given service type.
+func (h *wakeupHub) Wake(serviceType string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, channel := range h.channels[serviceType] {
+		select {
+		case channel <- struct{}{}:
+		default:
+			//a wakeup is already pending for this job
+		}
+	}
+}
+
+//sleepUnlessWoken sleeps for the given duration, or until a value is received
+//on the given wakeup channel, whichever comes first.
+func sleepUnlessWoken(d time.Duration, wakeup <-chan struct{}) {
+	select {
+	case <-wakeup:
+	case <-time.After(d):
+	}
+}
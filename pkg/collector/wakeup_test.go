@@ -0,0 +1,86 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/test"
+)
+
+func Test_SyncRequestWakeup(t *testing.T) {
+	plugin := test.NewPlugin("unittest")
+	prepareScrapeTest(t, plugin)
+
+	wakeup := scrapeWakeups.Subscribe("unittest")
+	defer scrapeWakeups.Unsubscribe("unittest", wakeup)
+	otherWakeup := scrapeWakeups.Subscribe("other")
+	defer scrapeWakeups.Unsubscribe("other", otherWakeup)
+
+	//SQLite does not support notifications, so this should do nothing
+	err := NotifySyncRequested(db.DB, "west", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	expectWakeup(t, wakeup, false)
+
+	//a sync request should only wake up the jobs for the respective service type
+	handleSyncRequest("west", `{"cluster_id":"west","service_id":1}`)
+	expectWakeup(t, wakeup, true)
+	expectWakeup(t, otherWakeup, false)
+
+	//sync requests for other clusters, for nonexistent project services, or
+	//malformed ones are ignored
+	handleSyncRequest("west", `{"cluster_id":"east","service_id":1}`)
+	handleSyncRequest("west", `{"cluster_id":"west","service_id":42}`)
+	handleSyncRequest("west", "1")
+	handleSyncRequest("west", "foo")
+	expectWakeup(t, wakeup, false)
+
+	//multiple wakeups while a job is busy are coalesced into one
+	scrapeWakeups.Wake("unittest")
+	scrapeWakeups.Wake("unittest")
+	expectWakeup(t, wakeup, true)
+	expectWakeup(t, wakeup, false)
+
+	//a pending wakeup cuts the sleep short
+	scrapeWakeups.Wake("unittest")
+	start := time.Now()
+	sleepUnlessWoken(time.Minute, wakeup)
+	if time.Since(start) > 10*time.Second {
+		t.Error("expected sleepUnlessWoken() to be cut short by wakeup")
+	}
+}
+
+func expectWakeup(t *testing.T, wakeup chan struct{}, expected bool) {
+	t.Helper()
+	select {
+	case <-wakeup:
+		if !expected {
+			t.Error("expected no wakeup, but got one")
+		}
+	default:
+		if expected {
+			t.Error("expected wakeup, but got none")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"fmt"
+	"time"
+
+	gorp "gopkg.in/gorp.v2"
+
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//AuditTrail collects audit events while a transaction is in progress. The
+//events are written into the `audit_events` table by Write() as part of the
+//transaction, and sent into the log with log level AUDIT by Commit() once the
+//transaction has been committed.
+type AuditTrail struct {
+	//These fields are copied into each event that is added to the trail.
+	Time      time.Time
+	ClusterID string
+	UserUUID  string
+	UserName  string
+
+	events []AuditEvent
+}
+
+//Add adds an event to the audit trail. The given message is formatted like
+//with fmt.Sprintf, and will be used as the event's log line.
+func (t *AuditTrail) Add(event AuditEvent, msg string, args ...interface{}) {
+	event.Time = t.Time
+	event.ClusterID = t.ClusterID
+	event.UserUUID = t.UserUUID
+	event.UserName = t.UserName
+	event.Message = fmt.Sprintf(msg, args...)
+	t.events = append(t.events, event)
+}
+
+//Write inserts all events in this audit trail into the `audit_events` table.
+//Call this before tx.Commit().
+func (t *AuditTrail) Write(dbi gorp.SqlExecutor) error {
+	for idx := range t.events {
+		err := dbi.Insert(&t.events[idx])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Commit sends the whole audit trail into the log. Call this after tx.Commit().
+func (t *AuditTrail) Commit() {
+	var logTrail util.AuditTrail
+	for _, event := range t.events {
+		logTrail.Add("%s", event.Message)
+	}
+	logTrail.Commit()
+	t.events = nil //do not log these events again
+}
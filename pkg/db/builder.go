@@ -88,3 +88,20 @@ func ForeachRow(dbi Interface, query string, args []interface{}, action func(*sq
 	}
 	return rows.Close()
 }
+
+//ProjectSubtreesQuery is a common table expression that can be prepended to
+//queries that aggregate over project subtrees. The table `project_subtrees`
+//maps each child project (`project_id`) to the top-level project of its
+//subtree (`root_id`), i.e. to its ancestor whose parent is the domain.
+var ProjectSubtreesQuery = `
+	WITH RECURSIVE project_subtrees (root_id, project_id, project_uuid, domain_id) AS (
+		SELECT r.id, c.id, c.uuid, c.domain_id
+		  FROM projects r
+		  JOIN projects c ON c.parent_uuid = r.uuid AND c.domain_id = r.domain_id
+		 WHERE NOT EXISTS (SELECT 1 FROM projects rp WHERE rp.uuid = r.parent_uuid AND rp.domain_id = r.domain_id)
+		UNION ALL
+		SELECT s.root_id, c.id, c.uuid, c.domain_id
+		  FROM project_subtrees s
+		  JOIN projects c ON c.parent_uuid = s.project_uuid AND c.domain_id = s.domain_id
+	)
+`
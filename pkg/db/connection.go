@@ -54,6 +54,8 @@ func init() {
 			//Postgres is okay with a no-op "WHERE TRUE" clause, but SQLite does not know the TRUE literal
 			query = regexp.MustCompile(`\bWHERE TRUE\s*(GROUP|LIMIT|ORDER|$)`).ReplaceAllString(query, "$1")
 			query = regexp.MustCompile(`\bWHERE TRUE AND\b`).ReplaceAllString(query, "WHERE")
+			//SQLite does not have row-level locks (it locks the whole database on write anyway)
+			query = regexp.MustCompile(`\bFOR UPDATE( OF \w+)?`).ReplaceAllString(query, "")
 			// traceQuery(query, []interface{}{"PREPARE"})
 			return query, nil
 		},
@@ -63,8 +65,8 @@ func init() {
 //Configuration is the section of the global configuration file that
 //contains the data about
 type Configuration struct {
-	Location       string `yaml:"location"`
-	MigrationsPath string `yaml:"migrations"`
+	Location       util.Secret `yaml:"location"`
+	MigrationsPath string      `yaml:"migrations"`
 }
 
 //Init initializes the connection to the database.
@@ -75,7 +77,7 @@ func Init(cfg Configuration) error {
 		sqlDriver += "-debug"
 	}
 
-	db, err := sql.Open(sqlDriver, cfg.Location)
+	db, err := sql.Open(sqlDriver, cfg.Location.Value)
 	if err != nil {
 		return err
 	}
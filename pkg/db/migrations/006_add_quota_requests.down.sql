@@ -0,0 +1,2 @@
+DROP TABLE quota_request_resources;
+DROP TABLE quota_requests;
@@ -0,0 +1,23 @@
+CREATE TABLE quota_requests (
+  id               BIGSERIAL NOT NULL PRIMARY KEY,
+  domain_id        BIGINT    NOT NULL REFERENCES domains ON DELETE CASCADE,
+  project_id       BIGINT    REFERENCES projects ON DELETE CASCADE, -- NULL for requests concerning domain quota
+  state            TEXT      NOT NULL,
+  comment          TEXT      NOT NULL DEFAULT '',
+  requested_at     TIMESTAMP NOT NULL,
+  requester_uuid   TEXT      NOT NULL,
+  requester_name   TEXT      NOT NULL,
+  decided_at       TIMESTAMP, -- defaults to NULL while the request is pending
+  decider_uuid     TEXT      NOT NULL DEFAULT '',
+  decider_name     TEXT      NOT NULL DEFAULT '',
+  decision_comment TEXT      NOT NULL DEFAULT ''
+);
+CREATE INDEX quota_requests_state_idx ON quota_requests (state);
+
+CREATE TABLE quota_request_resources (
+  request_id   BIGINT NOT NULL REFERENCES quota_requests ON DELETE CASCADE,
+  service_type TEXT   NOT NULL,
+  name         TEXT   NOT NULL,
+  quota        BIGINT NOT NULL,
+  PRIMARY KEY (request_id, service_type, name)
+);
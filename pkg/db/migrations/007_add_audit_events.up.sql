@@ -0,0 +1,17 @@
+CREATE TABLE audit_events (
+  id            BIGSERIAL NOT NULL PRIMARY KEY,
+  time          TIMESTAMP NOT NULL,
+  cluster_id    TEXT      NOT NULL,
+  domain_uuid   TEXT      NOT NULL DEFAULT '',
+  project_uuid  TEXT      NOT NULL DEFAULT '',
+  service_type  TEXT      NOT NULL DEFAULT '',
+  resource_name TEXT      NOT NULL DEFAULT '',
+  action        TEXT      NOT NULL,
+  old_value     BIGINT    DEFAULT NULL,
+  new_value     BIGINT    DEFAULT NULL,
+  user_uuid     TEXT      NOT NULL DEFAULT '',
+  user_name     TEXT      NOT NULL DEFAULT '',
+  message       TEXT      NOT NULL
+);
+CREATE INDEX audit_events_time_idx ON audit_events (cluster_id, time);
+CREATE INDEX audit_events_project_idx ON audit_events (domain_uuid, project_uuid);
@@ -0,0 +1,10 @@
+CREATE TABLE project_resource_history (
+  project_id    BIGINT    NOT NULL REFERENCES projects ON DELETE CASCADE,
+  service_type  TEXT      NOT NULL,
+  resource_name TEXT      NOT NULL,
+  time          TIMESTAMP NOT NULL, -- start of the hour in which the sample was taken
+  quota         BIGINT    NOT NULL,
+  usage         BIGINT    NOT NULL,
+  backend_quota BIGINT    NOT NULL,
+  PRIMARY KEY (project_id, service_type, resource_name, time)
+);
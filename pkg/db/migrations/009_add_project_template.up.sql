@@ -0,0 +1 @@
+ALTER TABLE projects ADD COLUMN template TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+CREATE TABLE project_quota_grants (
+  service_id     BIGINT    NOT NULL,
+  resource_name  TEXT      NOT NULL,
+  previous_quota BIGINT    NOT NULL, -- the quota that is restored when the grant expires
+  expires_at     TIMESTAMP NOT NULL,
+  PRIMARY KEY (service_id, resource_name),
+  FOREIGN KEY (service_id, resource_name) REFERENCES project_resources (service_id, name) ON DELETE CASCADE
+);
+CREATE INDEX project_quota_grants_expires_at_idx ON project_quota_grants (expires_at);
@@ -0,0 +1,2 @@
+DROP TABLE scheduled_change_resources;
+DROP TABLE scheduled_changes;
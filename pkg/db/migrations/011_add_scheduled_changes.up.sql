@@ -0,0 +1,24 @@
+CREATE TABLE scheduled_changes (
+  id            BIGSERIAL NOT NULL PRIMARY KEY,
+  domain_id     BIGINT    NOT NULL REFERENCES domains ON DELETE CASCADE,
+  project_id    BIGINT    REFERENCES projects ON DELETE CASCADE, -- NULL for changes concerning domain quota
+  state         TEXT      NOT NULL,
+  comment       TEXT      NOT NULL DEFAULT '',
+  due_at        TIMESTAMP NOT NULL,
+  created_at    TIMESTAMP NOT NULL,
+  creator_uuid  TEXT      NOT NULL,
+  creator_name  TEXT      NOT NULL,
+  can_raise     BOOLEAN   NOT NULL, -- permissions of the creator, checked again when the change is applied
+  can_lower     BOOLEAN   NOT NULL,
+  processed_at  TIMESTAMP, -- defaults to NULL while the change is pending
+  error_message TEXT      NOT NULL DEFAULT ''
+);
+CREATE INDEX scheduled_changes_state_due_at_idx ON scheduled_changes (state, due_at);
+
+CREATE TABLE scheduled_change_resources (
+  change_id    BIGINT NOT NULL REFERENCES scheduled_changes ON DELETE CASCADE,
+  service_type TEXT   NOT NULL,
+  name         TEXT   NOT NULL,
+  quota        BIGINT NOT NULL,
+  PRIMARY KEY (change_id, service_type, name)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE project_services DROP COLUMN scrape_error_message;
+ALTER TABLE project_services DROP COLUMN scrape_error_at;
+ALTER TABLE project_services DROP COLUMN consecutive_scrape_failures;
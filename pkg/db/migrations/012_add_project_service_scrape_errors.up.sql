@@ -0,0 +1,3 @@
+ALTER TABLE project_services ADD COLUMN scrape_error_message TEXT NOT NULL DEFAULT '';
+ALTER TABLE project_services ADD COLUMN scrape_error_at TIMESTAMP DEFAULT NULL;
+ALTER TABLE project_services ADD COLUMN consecutive_scrape_failures BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE project_services DROP COLUMN scrape_claimed_until;
@@ -0,0 +1 @@
+ALTER TABLE project_services ADD COLUMN scrape_claimed_until TIMESTAMP DEFAULT NULL;
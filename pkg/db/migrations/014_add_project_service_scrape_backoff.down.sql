@@ -0,0 +1 @@
+ALTER TABLE project_services DROP COLUMN scrape_backoff_until;
@@ -0,0 +1 @@
+DROP INDEX project_resource_history_time_idx;
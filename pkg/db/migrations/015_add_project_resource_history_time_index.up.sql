@@ -0,0 +1 @@
+CREATE INDEX project_resource_history_time_idx ON project_resource_history (time);
@@ -66,6 +66,7 @@ type Project struct {
 	Name       string `db:"name"`
 	UUID       string `db:"uuid"`
 	ParentUUID string `db:"parent_uuid"`
+	Template   string `db:"template"`
 }
 
 //ProjectService contains a record from the `project_services` table.
@@ -75,6 +76,15 @@ type ProjectService struct {
 	Type      string     `db:"type"`
 	ScrapedAt *time.Time `db:"scraped_at"` //pointer type to allow for NULL value
 	Stale     bool       `db:"stale"`
+	//These fields describe the most recent failed scrape. They are reset when
+	//a scrape succeeds.
+	ScrapeErrorMessage        string     `db:"scrape_error_message"`
+	ScrapeErrorAt             *time.Time `db:"scrape_error_at"`
+	ConsecutiveScrapeFailures uint64     `db:"consecutive_scrape_failures"`
+	ScrapeBackoffUntil        *time.Time `db:"scrape_backoff_until"`
+	//While a collector worker is scraping this service, this field is set to
+	//prevent other workers from scraping it at the same time.
+	ScrapeClaimedUntil *time.Time `db:"scrape_claimed_until"`
 }
 
 //ProjectResource contains a record from the `project_resources` table.
@@ -87,6 +97,110 @@ type ProjectResource struct {
 	SubresourcesJSON string `db:"subresources"`
 }
 
+//ProjectQuotaGrant contains a record from the `project_quota_grants` table.
+type ProjectQuotaGrant struct {
+	ServiceID     int64     `db:"service_id"`
+	ResourceName  string    `db:"resource_name"`
+	PreviousQuota uint64    `db:"previous_quota"`
+	ExpiresAt     time.Time `db:"expires_at"`
+}
+
+//QuotaRequest contains a record from the `quota_requests` table.
+type QuotaRequest struct {
+	ID              int64      `db:"id"`
+	DomainID        int64      `db:"domain_id"`
+	ProjectID       *int64     `db:"project_id"` //pointer type to allow for NULL value (for domain quota requests)
+	State           string     `db:"state"`
+	Comment         string     `db:"comment"`
+	RequestedAt     time.Time  `db:"requested_at"`
+	RequesterUUID   string     `db:"requester_uuid"`
+	RequesterName   string     `db:"requester_name"`
+	DecidedAt       *time.Time `db:"decided_at"` //pointer type to allow for NULL value
+	DeciderUUID     string     `db:"decider_uuid"`
+	DeciderName     string     `db:"decider_name"`
+	DecisionComment string     `db:"decision_comment"`
+}
+
+//Acceptable values for QuotaRequest.State.
+const (
+	QuotaRequestPending  = "pending"
+	QuotaRequestApproved = "approved"
+	QuotaRequestRejected = "rejected"
+)
+
+//QuotaRequestResource contains a record from the `quota_request_resources` table.
+type QuotaRequestResource struct {
+	RequestID   int64  `db:"request_id"`
+	ServiceType string `db:"service_type"`
+	Name        string `db:"name"`
+	Quota       uint64 `db:"quota"`
+}
+
+//ScheduledChange contains a record from the `scheduled_changes` table.
+type ScheduledChange struct {
+	ID           int64      `db:"id"`
+	DomainID     int64      `db:"domain_id"`
+	ProjectID    *int64     `db:"project_id"` //pointer type to allow for NULL value (for domain quota changes)
+	State        string     `db:"state"`
+	Comment      string     `db:"comment"`
+	DueAt        time.Time  `db:"due_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+	CreatorUUID  string     `db:"creator_uuid"`
+	CreatorName  string     `db:"creator_name"`
+	CanRaise     bool       `db:"can_raise"`
+	CanLower     bool       `db:"can_lower"`
+	ProcessedAt  *time.Time `db:"processed_at"` //pointer type to allow for NULL value
+	ErrorMessage string     `db:"error_message"`
+}
+
+//Acceptable values for ScheduledChange.State.
+const (
+	ScheduledChangePending   = "pending"
+	ScheduledChangeApplied   = "applied"
+	ScheduledChangeFailed    = "failed"
+	ScheduledChangeCancelled = "cancelled"
+)
+
+//ScheduledChangeResource contains a record from the `scheduled_change_resources` table.
+type ScheduledChangeResource struct {
+	ChangeID    int64  `db:"change_id"`
+	ServiceType string `db:"service_type"`
+	Name        string `db:"name"`
+	Quota       uint64 `db:"quota"`
+}
+
+//AuditEvent contains a record from the `audit_events` table.
+type AuditEvent struct {
+	ID           int64     `db:"id"`
+	Time         time.Time `db:"time"`
+	ClusterID    string    `db:"cluster_id"`
+	DomainUUID   string    `db:"domain_uuid"`
+	ProjectUUID  string    `db:"project_uuid"`
+	ServiceType  string    `db:"service_type"`
+	ResourceName string    `db:"resource_name"`
+	Action       string    `db:"action"`
+	OldValue     *uint64   `db:"old_value"` //pointer type to allow for NULL value
+	NewValue     *uint64   `db:"new_value"` //pointer type to allow for NULL value
+	UserUUID     string    `db:"user_uuid"`
+	UserName     string    `db:"user_name"`
+	Message      string    `db:"message"`
+}
+
+//Acceptable values for AuditEvent.Action.
+const (
+	AuditActionSetQuota       = "set_quota"
+	AuditActionSetCapacity    = "set_capacity"
+	AuditActionFileRequest    = "file_request"
+	AuditActionApproveRequest = "approve_request"
+	AuditActionRejectRequest  = "reject_request"
+	AuditActionTransferQuota  = "transfer_quota"
+	AuditActionExpireQuota    = "expire_quota"
+	AuditActionScheduleChange = "schedule_change"
+	AuditActionCancelChange   = "cancel_change"
+	AuditActionApplyChange    = "apply_change"
+	AuditActionFailChange     = "fail_change"
+)
+
 //InitGorp is used by Init() to setup the ORM part of the database connection.
 //It's available as an exported function because the unit tests need to call
 //this while bypassing the normal Init() logic.
@@ -99,4 +213,10 @@ func InitGorp() {
 	DB.AddTableWithName(Project{}, "projects").SetKeys(true, "id")
 	DB.AddTableWithName(ProjectService{}, "project_services").SetKeys(true, "id")
 	DB.AddTableWithName(ProjectResource{}, "project_resources").SetKeys(false, "service_id", "name")
+	DB.AddTableWithName(ProjectQuotaGrant{}, "project_quota_grants").SetKeys(false, "service_id", "resource_name")
+	DB.AddTableWithName(QuotaRequest{}, "quota_requests").SetKeys(true, "id")
+	DB.AddTableWithName(QuotaRequestResource{}, "quota_request_resources").SetKeys(false, "request_id", "service_type", "name")
+	DB.AddTableWithName(ScheduledChange{}, "scheduled_changes").SetKeys(true, "id")
+	DB.AddTableWithName(ScheduledChangeResource{}, "scheduled_change_resources").SetKeys(false, "change_id", "service_type", "name")
+	DB.AddTableWithName(AuditEvent{}, "audit_events").SetKeys(true, "id")
 }
@@ -0,0 +1,74 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"time"
+
+	gorp "gopkg.in/gorp.v2"
+
+	"github.com/lib/pq"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//SupportsNotifications returns whether the database supports LISTEN/NOTIFY.
+//This is only the case for Postgres (i.e. not for the SQLite database used in
+//unit tests). Callers shall fall back to polling when this returns false.
+func SupportsNotifications() bool {
+	_, ok := DB.Dialect.(gorp.PostgresDialect)
+	return ok
+}
+
+//Notify sends a notification with the given payload on the given channel.
+//Notifications are only delivered when the surrounding transaction (if any)
+//is committed.
+func Notify(dbi Interface, channel, payload string) error {
+	_, err := dbi.Exec(`SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+//Listen opens a separate database connection that listens on the given
+//channel, and calls the given callback for each notification received on it.
+//Notifications may be lost while the connection is being re-established, so
+//callers must not rely on receiving all notifications.
+func Listen(cfg Configuration, channel string, callback func(payload string)) error {
+	listener := pq.NewListener(cfg.Location.Value, 10*time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				util.LogError("lost connection for LISTEN %s: %s", channel, err.Error())
+			}
+		},
+	)
+	err := listener.Listen(channel)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		for notification := range listener.Notify {
+			//a nil notification is sent after reconnecting
+			if notification != nil {
+				callback(notification.Extra)
+			}
+		}
+	}()
+	return nil
+}
@@ -22,7 +22,9 @@ package limes
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
+	"time"
 
 	policy "github.com/databus23/goslo.policy"
 	"github.com/gophercloud/gophercloud"
@@ -33,19 +35,50 @@ import (
 
 //AuthParameters contains credentials for authenticating with Keystone (i.e.
 //everything that's needed to set up a gophercloud.ProviderClient instance).
+//
+//Three authentication methods are supported: password (with UserName,
+//UserDomainName and Password), application credential (with
+//ApplicationCredentialID or ApplicationCredentialName, and
+//ApplicationCredentialSecret) and pre-issued token (with Token). For the
+//password and token methods, ProjectName and ProjectDomainName select the
+//scope of the token. Application credentials are always scoped to the project
+//where they were created.
 type AuthParameters struct {
-	AuthURL           string      `yaml:"auth_url"`
-	UserName          string      `yaml:"user_name"`
-	UserDomainName    string      `yaml:"user_domain_name"`
-	ProjectName       string      `yaml:"project_name"`
-	ProjectDomainName string      `yaml:"project_domain_name"`
-	Password          string      `yaml:"password"`
-	RegionName        string      `yaml:"region_name"`
-	tokenRenewalMutex *sync.Mutex `yaml:"-"`
+	AuthURL                     string      `yaml:"auth_url"`
+	UserName                    string      `yaml:"user_name"`
+	UserDomainName              string      `yaml:"user_domain_name"`
+	ProjectName                 string      `yaml:"project_name"`
+	ProjectDomainName           string      `yaml:"project_domain_name"`
+	Password                    util.Secret `yaml:"password"`
+	ApplicationCredentialID     string      `yaml:"application_credential_id"`
+	ApplicationCredentialName   string      `yaml:"application_credential_name"`
+	ApplicationCredentialSecret util.Secret `yaml:"application_credential_secret"`
+	Token                       util.Secret `yaml:"token"`
+	RegionName                  string      `yaml:"region_name"`
+	tokenRenewalMutex           *sync.Mutex `yaml:"-"`
 	//ProviderClient is only valid after calling Connect().
 	ProviderClient *gophercloud.ProviderClient `yaml:"-"`
 }
 
+type authMethod int
+
+const (
+	authMethodPassword authMethod = iota
+	authMethodApplicationCredential
+	authMethodToken
+)
+
+func (auth AuthParameters) method() authMethod {
+	switch {
+	case auth.ApplicationCredentialSecret.IsSet():
+		return authMethodApplicationCredential
+	case auth.Token.IsSet():
+		return authMethodToken
+	default:
+		return authMethodPassword
+	}
+}
+
 //CanReauth implements the
 //gophercloud/openstack/identity/v3/tokens.AuthOptionsBuilder interface.
 func (auth AuthParameters) CanReauth() bool {
@@ -55,18 +88,53 @@ func (auth AuthParameters) CanReauth() bool {
 //ToTokenV3CreateMap implements the
 //gophercloud/openstack/identity/v3/tokens.AuthOptionsBuilder interface.
 func (auth AuthParameters) ToTokenV3CreateMap(scope map[string]interface{}) (map[string]interface{}, error) {
-	gophercloudAuthOpts := gophercloud.AuthOptions{
-		Username:    auth.UserName,
-		Password:    auth.Password,
-		DomainName:  auth.UserDomainName,
-		AllowReauth: true,
+	switch auth.method() {
+	case authMethodApplicationCredential:
+		//our version of gophercloud does not know about application credentials yet
+		appCred := map[string]interface{}{"secret": auth.ApplicationCredentialSecret.Value}
+		if auth.ApplicationCredentialID != "" {
+			appCred["id"] = auth.ApplicationCredentialID
+		} else {
+			appCred["name"] = auth.ApplicationCredentialName
+			appCred["user"] = map[string]interface{}{
+				"name":   auth.UserName,
+				"domain": map[string]interface{}{"name": auth.UserDomainName},
+			}
+		}
+		return map[string]interface{}{
+			"auth": map[string]interface{}{
+				"identity": map[string]interface{}{
+					"methods":                []string{"application_credential"},
+					"application_credential": appCred,
+				},
+			},
+		}, nil
+
+	case authMethodToken:
+		gophercloudAuthOpts := gophercloud.AuthOptions{
+			TokenID:     auth.Token.Value,
+			AllowReauth: true,
+		}
+		return gophercloudAuthOpts.ToTokenV3CreateMap(scope)
+
+	default:
+		gophercloudAuthOpts := gophercloud.AuthOptions{
+			Username:    auth.UserName,
+			Password:    auth.Password.Value,
+			DomainName:  auth.UserDomainName,
+			AllowReauth: true,
+		}
+		return gophercloudAuthOpts.ToTokenV3CreateMap(scope)
 	}
-	return gophercloudAuthOpts.ToTokenV3CreateMap(scope)
 }
 
 //ToTokenV3ScopeMap implements the
 //gophercloud/openstack/identity/v3/tokens.AuthOptionsBuilder interface.
 func (auth AuthParameters) ToTokenV3ScopeMap() (map[string]interface{}, error) {
+	if auth.method() == authMethodApplicationCredential {
+		//Keystone rejects explicit scopes for application credentials
+		return nil, nil
+	}
 	return map[string]interface{}{
 		"project": map[string]interface{}{
 			"name":   auth.ProjectName,
@@ -141,41 +209,87 @@ func (auth *AuthParameters) refreshToken() error {
 	return nil
 }
 
+//TokenMetadata contains those attributes of a validated Keystone token that
+//are not part of its policy context, but are needed for caching validation
+//results.
+type TokenMetadata struct {
+	ExpiresAt time.Time
+	AuditIDs  []string
+}
+
 //ValidateToken validates the given Keystone token and returns a policy context for
 //checking authorization.
-func (auth *AuthParameters) ValidateToken(token string) (policy.Context, error) {
+func (auth *AuthParameters) ValidateToken(token string) (policy.Context, TokenMetadata, error) {
 	//special case for unit tests
 	if auth.AuthURL == "" {
-		return policy.Context{}, nil
+		return policy.Context{}, TokenMetadata{}, nil
 	}
 
 	client, err := openstack.NewIdentityV3(auth.ProviderClient,
 		gophercloud.EndpointOpts{Availability: gophercloud.AvailabilityPublic},
 	)
 	if err != nil {
-		return policy.Context{}, err
+		return policy.Context{}, TokenMetadata{}, err
 	}
 
 	response := tokens.Get(client, token)
 	if response.Err != nil {
 		//this includes 4xx responses, so after this point, we can be sure that the token is valid
-		return policy.Context{}, response.Err
+		return policy.Context{}, TokenMetadata{}, response.Err
 	}
 
 	//use a custom token struct instead of tokens.Token which is way incomplete
 	var tokenData keystoneToken
 	err = response.ExtractInto(&tokenData)
 	if err != nil {
-		return policy.Context{}, err
+		return policy.Context{}, TokenMetadata{}, err
+	}
+	meta := TokenMetadata{
+		ExpiresAt: time.Time(tokenData.ExpiresAt),
+		AuditIDs:  tokenData.AuditIDs,
+	}
+	return tokenData.ToContext(), meta, nil
+}
+
+//RevocationEvent is an event from Keystone's OS-REVOKE API, which indicates
+//that all tokens matching the given attributes have been revoked. Attributes
+//that are not set are empty.
+type RevocationEvent struct {
+	UserID       string                       `json:"user_id"`
+	ProjectID    string                       `json:"project_id"`
+	DomainID     string                       `json:"domain_id"`
+	RoleID       string                       `json:"role_id"`
+	TrustID      string                       `json:"trust_id"`
+	AuditID      string                       `json:"audit_id"`
+	AuditChainID string                       `json:"audit_chain_id"`
+	IssuedBefore gophercloud.JSONRFC3339Milli `json:"issued_before"`
+}
+
+//ListRevocationEvents lists all token revocation events that occurred since
+//the given time.
+func (auth *AuthParameters) ListRevocationEvents(since time.Time) ([]RevocationEvent, error) {
+	client, err := openstack.NewIdentityV3(auth.ProviderClient,
+		gophercloud.EndpointOpts{Availability: gophercloud.AvailabilityPublic},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"since": {since.UTC().Format(time.RFC3339)}}
+	var data struct {
+		Events []RevocationEvent `json:"events"`
 	}
-	return tokenData.ToContext(), nil
+	_, err = client.Get(client.ServiceURL("OS-REVOKE", "events")+"?"+query.Encode(), &data, nil)
+	return data.Events, err
 }
 
 type keystoneToken struct {
-	DomainScope  keystoneTokenThing         `json:"domain"`
-	ProjectScope keystoneTokenThingInDomain `json:"project"`
-	Roles        []keystoneTokenThing       `json:"roles"`
-	User         keystoneTokenThingInDomain `json:"user"`
+	DomainScope  keystoneTokenThing           `json:"domain"`
+	ProjectScope keystoneTokenThingInDomain   `json:"project"`
+	Roles        []keystoneTokenThing         `json:"roles"`
+	User         keystoneTokenThingInDomain   `json:"user"`
+	ExpiresAt    gophercloud.JSONRFC3339Milli `json:"expires_at"`
+	AuditIDs     []string                     `json:"audit_ids"`
 }
 
 type keystoneTokenThing struct {
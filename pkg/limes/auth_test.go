@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package limes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sapcc/limes/pkg/util"
+)
+
+func assertAuthRequest(t *testing.T, auth AuthParameters, expected string) {
+	scope, err := auth.ToTokenV3ScopeMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := auth.ToTokenV3CreateMap(scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expected {
+		t.Errorf("unexpected token request for %#v", auth)
+		t.Logf("  expected: %s", expected)
+		t.Logf("    actual: %s", actual)
+	}
+}
+
+func Test_AuthParameters_ToTokenV3CreateMap(t *testing.T) {
+	assertAuthRequest(t,
+		AuthParameters{UserName: "limes", UserDomainName: "Default", Password: util.Secret{Value: "swordfish"}, ProjectName: "service", ProjectDomainName: "Default"},
+		`{"auth":{"identity":{"methods":["password"],"password":{"user":{"domain":{"name":"Default"},"name":"limes","password":"swordfish"}}},"scope":{"project":{"domain":{"name":"Default"},"name":"service"}}}}`,
+	)
+	assertAuthRequest(t,
+		AuthParameters{ApplicationCredentialID: "appcred1", ApplicationCredentialSecret: util.Secret{Value: "swordfish"}},
+		`{"auth":{"identity":{"application_credential":{"id":"appcred1","secret":"swordfish"},"methods":["application_credential"]}}}`,
+	)
+	assertAuthRequest(t,
+		AuthParameters{ApplicationCredentialName: "limes-appcred", ApplicationCredentialSecret: util.Secret{Value: "swordfish"}, UserName: "limes", UserDomainName: "Default"},
+		`{"auth":{"identity":{"application_credential":{"name":"limes-appcred","secret":"swordfish","user":{"domain":{"name":"Default"},"name":"limes"}},"methods":["application_credential"]}}}`,
+	)
+	assertAuthRequest(t,
+		AuthParameters{Token: util.Secret{Value: "gAAAAAB"}, ProjectName: "service", ProjectDomainName: "Default"},
+		`{"auth":{"identity":{"methods":["token"],"token":{"id":"gAAAAAB"}},"scope":{"project":{"domain":{"name":"Default"},"name":"service"}}}}`,
+	)
+}
+
+func Test_AuthParameters_validate(t *testing.T) {
+	os.Setenv("LIMES_TEST_SECRET", "swordfish")
+	defer os.Unsetenv("LIMES_TEST_SECRET")
+	os.Unsetenv("LIMES_TEST_MISSING")
+
+	dir, err := ioutil.TempDir("", "limes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretPath := filepath.Join(dir, "secret")
+	err = ioutil.WriteFile(secretPath, []byte("swordfish\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Auth          AuthParameters
+		ExpectSuccess bool
+	}{
+		{AuthParameters{UserName: "limes", UserDomainName: "Default", Password: util.Secret{Value: "swordfish"}, ProjectName: "service", ProjectDomainName: "Default"}, true},
+		{AuthParameters{UserName: "limes", UserDomainName: "Default", ProjectName: "service", ProjectDomainName: "Default"}, false},
+		{AuthParameters{ApplicationCredentialID: "appcred1", ApplicationCredentialSecret: util.Secret{Value: "swordfish"}}, true},
+		{AuthParameters{ApplicationCredentialID: "appcred1"}, false},
+		{AuthParameters{ApplicationCredentialID: "appcred1", ApplicationCredentialSecret: util.Secret{Value: "swordfish"}, ProjectName: "service"}, false},
+		{AuthParameters{ApplicationCredentialName: "limes-appcred", ApplicationCredentialSecret: util.Secret{Value: "swordfish"}, UserName: "limes", UserDomainName: "Default"}, true},
+		{AuthParameters{ApplicationCredentialName: "limes-appcred", ApplicationCredentialSecret: util.Secret{Value: "swordfish"}}, false},
+		{AuthParameters{Token: util.Secret{Value: "gAAAAAB"}, ProjectName: "service", ProjectDomainName: "Default"}, true},
+		{AuthParameters{Token: util.Secret{Value: "gAAAAAB"}}, false},
+		//secrets from environment variables and files
+		{AuthParameters{ApplicationCredentialID: "appcred1", ApplicationCredentialSecret: util.Secret{FromEnv: "LIMES_TEST_SECRET"}}, true},
+		{AuthParameters{ApplicationCredentialID: "appcred1", ApplicationCredentialSecret: util.Secret{FromEnv: "LIMES_TEST_MISSING"}}, false},
+		{AuthParameters{ApplicationCredentialID: "appcred1", ApplicationCredentialSecret: util.Secret{FromFile: secretPath}}, true},
+		{AuthParameters{ApplicationCredentialID: "appcred1", ApplicationCredentialSecret: util.Secret{FromFile: secretPath + ".missing"}}, false},
+	}
+
+	for idx, tc := range testCases {
+		tc.Auth.AuthURL = "https://keystone.example.com/v3"
+		if tc.Auth.validate("auth", true) != tc.ExpectSuccess {
+			t.Errorf("test case %d: expected validation success = %t for %#v", idx, tc.ExpectSuccess, tc.Auth)
+		}
+		if tc.ExpectSuccess && tc.Auth.ApplicationCredentialSecret.FromEnv+tc.Auth.ApplicationCredentialSecret.FromFile != "" {
+			if tc.Auth.ApplicationCredentialSecret.Value != "swordfish" {
+				t.Errorf("test case %d: expected secret to resolve to \"swordfish\", got %q", idx, tc.Auth.ApplicationCredentialSecret.Value)
+			}
+		}
+	}
+}
@@ -44,25 +44,39 @@ type Cluster struct {
 //configuration, and also initializes all quota and capacity plugins. Errors
 //will be logged when some of the requested plugins cannot be found.
 func NewCluster(id string, config *ClusterConfiguration) *Cluster {
-	factory, exists := discoveryPluginFactories[config.Discovery.Method]
-	if !exists {
-		util.LogFatal("setup for cluster %s failed: no suitable discovery plugin found", id)
+	c, _ := newCluster(id, config)
+	return c
+}
+
+//newCluster is the implementation of NewCluster. It also returns whether the
+//Cluster could be set up without logging any errors.
+func newCluster(id string, config *ClusterConfiguration) (c *Cluster, success bool) {
+	success = true //until proven otherwise
+	logError := func(msg string, args ...interface{}) {
+		util.LogError(msg, args...)
+		success = false
 	}
 
-	c := &Cluster{
+	c = &Cluster{
 		ID:              id,
 		Config:          config,
 		IsServiceShared: make(map[string]bool),
-		DiscoveryPlugin: factory(config.Discovery),
 		QuotaPlugins:    make(map[string]QuotaPlugin),
 		CapacityPlugins: make(map[string]CapacityPlugin),
 		Authoritative:   config.Authoritative,
 	}
 
+	//NOTE: LoadConfiguration() has already validated that the discovery method exists
+	if factory, exists := discoveryPluginFactories[config.Discovery.Method]; exists {
+		c.DiscoveryPlugin = factory(config.Discovery)
+	} else {
+		logError("setup for cluster %s failed: no suitable discovery plugin found", id)
+	}
+
 	for _, srv := range config.Services {
 		factory, exists := quotaPluginFactories[srv.Type]
 		if !exists {
-			util.LogError("skipping service %s: no suitable collector plugin found", srv.Type)
+			logError("skipping service %s: no suitable collector plugin found", srv.Type)
 			continue
 		}
 
@@ -73,10 +87,20 @@ func NewCluster(id string, config *ClusterConfiguration) *Cluster {
 
 		plugin := factory(srv, scrapeSubresources)
 		if plugin == nil || plugin.ServiceInfo().Type != srv.Type {
-			util.LogError("skipping service %s: failed to initialize collector plugin", srv.Type)
+			logError("skipping service %s: failed to initialize collector plugin", srv.Type)
 			continue
 		}
 
+		isResource := make(map[string]bool)
+		for _, res := range plugin.Resources() {
+			isResource[res.Name] = true
+		}
+		for _, resName := range config.Subresources[srv.Type] {
+			if !isResource[resName] {
+				logError("cannot scrape subresources for %s/%s: no such resource", srv.Type, resName)
+			}
+		}
+
 		c.ServiceTypes = append(c.ServiceTypes, srv.Type)
 		c.QuotaPlugins[srv.Type] = plugin
 		c.IsServiceShared[srv.Type] = srv.Shared
@@ -85,20 +109,37 @@ func NewCluster(id string, config *ClusterConfiguration) *Cluster {
 	for _, capa := range config.Capacitors {
 		factory, exists := capacityPluginFactories[capa.ID]
 		if !exists {
-			util.LogError("skipping capacitor %s: no suitable collector plugin found", capa.ID)
+			logError("skipping capacitor %s: no suitable collector plugin found", capa.ID)
 			continue
 		}
 		plugin := factory(capa)
 		if plugin == nil || plugin.ID() != capa.ID {
-			util.LogError("skipping capacitor %s: failed to initialize collector plugin", capa.ID)
+			logError("skipping capacitor %s: failed to initialize collector plugin", capa.ID)
 			continue
 		}
 		c.CapacityPlugins[capa.ID] = plugin
 	}
 
+	for templateName, template := range config.QuotaTemplates.Templates {
+		for serviceType, resourceQuotas := range template {
+			for resourceName := range resourceQuotas {
+				if !c.HasResource(serviceType, resourceName) {
+					logError("ignoring resource %s/%s in quota template %s: no such resource", serviceType, resourceName, templateName)
+					delete(resourceQuotas, resourceName)
+				}
+			}
+		}
+	}
+
+	for serviceType := range config.Subresources {
+		if _, exists := c.QuotaPlugins[serviceType]; !exists {
+			logError("cannot scrape subresources for %s: no such service", serviceType)
+		}
+	}
+
 	sort.Strings(c.ServiceTypes) //determinism is useful for unit tests
 
-	return c
+	return c, success
 }
 
 //Connect calls Connect() on all AuthParameters for this Cluster, thus ensuring
@@ -187,3 +228,19 @@ func (c *Cluster) InfoForService(serviceType string) ServiceInfo {
 	}
 	return plugin.ServiceInfo()
 }
+
+//QuotaTemplateForDomain returns the name of the quota template that applies
+//to new projects in the given domain, or "" if no template applies.
+func (c *Cluster) QuotaTemplateForDomain(domainName string) string {
+	templates := c.Config.QuotaTemplates
+	if templateName, exists := templates.Domains[domainName]; exists {
+		return templateName
+	}
+	return templates.Default
+}
+
+//QuotaTemplate returns the quota template with the given name, or nil if no
+//such template is configured.
+func (c *Cluster) QuotaTemplate(templateName string) QuotaTemplate {
+	return c.Config.QuotaTemplates.Templates[templateName]
+}
@@ -20,12 +20,16 @@
 package limes
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	policy "github.com/databus23/goslo.policy"
 	"github.com/sapcc/limes/pkg/db"
@@ -40,6 +44,9 @@ type Configuration struct {
 	Clusters  map[string]*Cluster    `yaml:"-"`
 	API       APIConfiguration       `yaml:"api"`
 	Collector CollectorConfiguration `yaml:"collector"`
+	//Hash is the SHA-256 hash of the configuration file (in hex encoding). It
+	//is used to identify the active configuration in metrics.
+	Hash string `yaml:"-"`
 }
 
 type configurationInFile struct {
@@ -59,10 +66,26 @@ type ClusterConfiguration struct {
 	Services   []ServiceConfiguration   `yaml:"services"`
 	Capacitors []CapacitorConfiguration `yaml:"capacitors"`
 	//^ Sorry for the stupid pun. Not.
-	Subresources  map[string][]string `yaml:"subresources"`
-	Authoritative bool                `yaml:"authoritative"`
+	Subresources   map[string][]string        `yaml:"subresources"`
+	Authoritative  bool                       `yaml:"authoritative"`
+	QuotaTemplates QuotaTemplateConfiguration `yaml:"quota_templates"`
 }
 
+//QuotaTemplateConfiguration describes the quota templates that are applied to
+//newly discovered projects.
+type QuotaTemplateConfiguration struct {
+	//name of the template that is applied to projects in all domains not listed in Domains
+	Default string `yaml:"default"`
+	//domain name -> template name
+	Domains   map[string]string        `yaml:"domains"`
+	Templates map[string]QuotaTemplate `yaml:"templates"`
+}
+
+//QuotaTemplate contains the initial quota values for a new project. The outer
+//map key is the service type, the inner map key is the resource name. Values
+//are given in the base unit of the respective resource.
+type QuotaTemplate map[string]map[string]uint64
+
 //DiscoveryConfiguration describes the method of discovering Keystone domains
 //and projects.
 type DiscoveryConfiguration struct {
@@ -101,8 +124,8 @@ type CapacitorConfiguration struct {
 		ExtraSpecs           map[string]string `yaml:"extra_specs"`
 	} `yaml:"nova"`
 	Swift struct {
-		PrometheusAPIURL string  `yaml:"prometheus_api_url"`
-		AdjustmentFactor float64 `yaml:"adjustment_factor"`
+		PrometheusAPIURL util.Secret `yaml:"prometheus_api_url"`
+		AdjustmentFactor float64     `yaml:"adjustment_factor"`
 	} `yaml:"swift"`
 	Cinder struct {
 		VolumeBackendName string `yaml:"volume_backend_name"`
@@ -112,34 +135,77 @@ type CapacitorConfiguration struct {
 
 //APIConfiguration contains configuration parameters for limes-serve.
 type APIConfiguration struct {
-	ListenAddress  string           `yaml:"listen"`
-	PolicyFilePath string           `yaml:"policy"`
-	PolicyEnforcer *policy.Enforcer `yaml:"-"`
+	ListenAddress  string                  `yaml:"listen"`
+	PolicyFilePath string                  `yaml:"policy"`
+	PolicyEnforcer *policy.Enforcer        `yaml:"-"`
+	TokenCache     TokenCacheConfiguration `yaml:"token_cache"`
+	//PolicyUsesParentProject is true if any policy rule refers to
+	//%(parent_project_id)s. Only then does the API need to look up the parent
+	//project when checking a token.
+	PolicyUsesParentProject bool `yaml:"-"`
+}
+
+//TokenCacheConfiguration contains configuration parameters for the cache of
+//Keystone token validation results in limes-serve.
+type TokenCacheConfiguration struct {
+	MaxTTL                 time.Duration `yaml:"max_ttl"`
+	MaxSize                int           `yaml:"max_size"`
+	RevocationPollInterval time.Duration `yaml:"revocation_poll_interval"`
 }
 
 //CollectorConfiguration contains configuration parameters for limes-collect.
 type CollectorConfiguration struct {
 	MetricsListenAddress string `yaml:"metrics"`
 	ExposeDataMetrics    bool   `yaml:"data_metrics"`
+	//service type -> number of concurrent scraping jobs (default 1)
+	ScrapeWorkers map[string]uint `yaml:"scrape_workers"`
+	//how long samples are kept in project_resource_history (default 90 days)
+	HistoryRetention time.Duration `yaml:"history_retention"`
+}
+
+//ScrapeWorkersFor returns the number of concurrent scraping jobs for the
+//given service type.
+func (cfg CollectorConfiguration) ScrapeWorkersFor(serviceType string) uint {
+	count, exists := cfg.ScrapeWorkers[serviceType]
+	if !exists {
+		return 1
+	}
+	return count
+}
+
+//HistoryRetentionPeriod returns how long samples of quota and usage values
+//shall be kept in the project_resource_history table.
+func (cfg CollectorConfiguration) HistoryRetentionPeriod() time.Duration {
+	if cfg.HistoryRetention == 0 {
+		return 90 * 24 * time.Hour
+	}
+	return cfg.HistoryRetention
 }
 
 //NewConfiguration reads and validates the given configuration file.
 //Errors are logged and will result in
 //program termination, causing the function to not return.
-func NewConfiguration(path string) (cfg Configuration) {
-	//read config file
-	configBytes, err := ioutil.ReadFile(path)
+func NewConfiguration(path string) Configuration {
+	cfg, err := LoadConfiguration(path)
 	if err != nil {
-		util.LogFatal("read configuration file: %s", err.Error())
+		util.LogFatal(err.Error())
 	}
-	var cfgFile configurationInFile
-	err = yaml.Unmarshal(configBytes, &cfgFile)
+	return cfg
+}
+
+//LoadConfiguration is like NewConfiguration, but returns an error instead of
+//terminating the program when the configuration file cannot be loaded. This
+//is used when reloading the configuration at runtime. Validation errors are
+//logged individually before the error is returned.
+func LoadConfiguration(path string) (cfg Configuration, err error) {
+	cfgFile, configBytes, err := readConfigurationFile(path)
 	if err != nil {
-		util.LogFatal("parse configuration: %s", err.Error())
+		return cfg, err
 	}
-	if !cfgFile.validate() {
-		os.Exit(1)
+	if !cfgFile.validate(true) {
+		return cfg, errors.New("configuration is invalid (see errors above)")
 	}
+	hashBytes := sha256.Sum256(configBytes)
 
 	//inflate the ClusterConfiguration instances into Cluster, thereby validating
 	//the existence of the requested quota and capacity plugins and initializing
@@ -149,25 +215,76 @@ func NewConfiguration(path string) (cfg Configuration) {
 		Clusters:  make(map[string]*Cluster),
 		API:       cfgFile.API,
 		Collector: cfgFile.Collector,
+		Hash:      hex.EncodeToString(hashBytes[:]),
 	}
 	for clusterID, config := range cfgFile.Clusters {
-		if config.Discovery.Method == "" {
-			//choose default discovery method
-			config.Discovery.Method = "list"
-		}
 		cfg.Clusters[clusterID] = NewCluster(clusterID, config)
 	}
 
 	//load the policy file
-	cfg.API.PolicyEnforcer, err = loadPolicyFile(cfg.API.PolicyFilePath)
+	cfg.API.PolicyEnforcer, cfg.API.PolicyUsesParentProject, err = loadPolicyFile(cfg.API.PolicyFilePath)
 	if err != nil {
-		util.LogFatal(err.Error())
+		return cfg, fmt.Errorf("load policy file: %s", err.Error())
 	}
 
-	return
+	return cfg, nil
 }
 
-func (cfg configurationInFile) validate() (success bool) {
+//CheckConfiguration performs all the checks that LoadConfiguration performs
+//on the given configuration file, without connecting to the database or to
+//Keystone. In contrast to LoadConfiguration, it does not stop after
+//validation errors, and it treats problems with plugins (which are otherwise
+//skipped with an error message) as errors. All problems are logged, and the
+//return value indicates whether any were found.
+//
+//If resolveSecrets is false, secrets that refer to environment variables or
+//files are only checked for presence, but not read. This is useful for
+//checking the configuration on a machine that does not have the secrets.
+func CheckConfiguration(path string, resolveSecrets bool) (success bool) {
+	cfgFile, _, err := readConfigurationFile(path)
+	if err != nil {
+		util.LogError(err.Error())
+		return false
+	}
+	success = cfgFile.validate(resolveSecrets)
+
+	clusterIDs := make([]string, 0, len(cfgFile.Clusters))
+	for clusterID := range cfgFile.Clusters {
+		clusterIDs = append(clusterIDs, clusterID)
+	}
+	sort.Strings(clusterIDs)
+	for _, clusterID := range clusterIDs {
+		_, ok := newCluster(clusterID, cfgFile.Clusters[clusterID])
+		if !ok {
+			success = false
+		}
+	}
+
+	//a missing api.policy has already been reported by validate()
+	if cfgFile.API.PolicyFilePath != "" {
+		_, _, err = loadPolicyFile(cfgFile.API.PolicyFilePath)
+		if err != nil {
+			util.LogError("load policy file: %s", err.Error())
+			success = false
+		}
+	}
+
+	return success
+}
+
+func readConfigurationFile(path string) (cfgFile configurationInFile, configBytes []byte, err error) {
+	configBytes, err = ioutil.ReadFile(path)
+	if err != nil {
+		return cfgFile, nil, fmt.Errorf("read configuration file: %s", err.Error())
+	}
+	err = yaml.Unmarshal(configBytes, &cfgFile)
+	if err != nil {
+		return cfgFile, nil, fmt.Errorf("parse configuration: %s", err.Error())
+	}
+	return cfgFile, configBytes, nil
+}
+
+func (cfg *configurationInFile) validate(resolveSecrets bool) (success bool) {
 	//do not fail on first error; keep going and report all errors at once
 	success = true //until proven otherwise
 
@@ -175,7 +292,9 @@ func (cfg configurationInFile) validate() (success bool) {
 		util.LogError("missing %s configuration value", key)
 		success = false
 	}
-	if cfg.Database.Location == "" {
+	if resolveSecrets && !resolveSecret(&cfg.Database.Location, "database.location") {
+		success = false
+	} else if !cfg.Database.Location.IsSet() {
 		missing("database.location")
 	}
 	if cfg.Database.MigrationsPath == "" {
@@ -215,36 +334,8 @@ func (cfg configurationInFile) validate() (success bool) {
 			//Avoid nil pointer access if section cluster.auth not provided but still alert on the missing values
 			cluster.Auth = new(AuthParameters)
 		}
-		//gophercloud is very strict about requiring a trailing slash here
-		if cluster.Auth.AuthURL != "" && !strings.HasSuffix(cluster.Auth.AuthURL, "/") {
-			cluster.Auth.AuthURL += "/"
-		}
-
-		switch {
-		case cluster.Auth.AuthURL == "":
-			missing("auth.auth_url")
-		case !strings.HasPrefix(cluster.Auth.AuthURL, "http://") && !strings.HasPrefix(cluster.Auth.AuthURL, "https://"):
-			util.LogError("clusters[%s].auth.auth_url does not look like a HTTP URL", clusterID)
+		if !cluster.Auth.validate(fmt.Sprintf("clusters[%s].auth", clusterID), resolveSecrets) {
 			success = false
-		case !strings.HasSuffix(cluster.Auth.AuthURL, "/v3/"):
-			util.LogError("clusters[%s].auth.auth_url does not end with \"/v3/\"", clusterID)
-			success = false
-		}
-
-		if cluster.Auth.UserName == "" {
-			missing("auth.user_name")
-		}
-		if cluster.Auth.UserDomainName == "" {
-			missing("auth.user_domain_name")
-		}
-		if cluster.Auth.ProjectName == "" {
-			missing("auth.project_name")
-		}
-		if cluster.Auth.ProjectDomainName == "" {
-			missing("auth.project_domain_name")
-		}
-		if cluster.Auth.Password == "" {
-			missing("auth.password")
 		}
 		//NOTE: cluster.RegionName is optional
 		if len(cluster.Services) == 0 {
@@ -256,15 +347,58 @@ func (cfg configurationInFile) validate() (success bool) {
 			if srv.Type == "" {
 				missing(fmt.Sprintf("services[%d].type", idx))
 			}
+			if srv.Auth != nil && !srv.Auth.validate(fmt.Sprintf("clusters[%s].services[%d].auth", clusterID, idx), resolveSecrets) {
+				success = false
+			}
 		}
 		for idx, capa := range cluster.Capacitors {
 			if capa.ID == "" {
 				missing(fmt.Sprintf("capacitors[%d].id", idx))
 			}
+			path := fmt.Sprintf("clusters[%s].capacitors[%d].swift.prometheus_api_url", clusterID, idx)
+			if resolveSecrets && !resolveSecret(&cluster.Capacitors[idx].Swift.PrometheusAPIURL, path) {
+				success = false
+			}
+		}
+
+		isServiceType := make(map[string]bool)
+		for _, srv := range cluster.Services {
+			isServiceType[srv.Type] = true
+		}
+		templates := cluster.QuotaTemplates
+		if templates.Default != "" && templates.Templates[templates.Default] == nil {
+			util.LogError("clusters[%s].quota_templates.default refers to unknown quota template %q", clusterID, templates.Default)
+			success = false
+		}
+		for domainName, templateName := range templates.Domains {
+			if templateName != "" && templates.Templates[templateName] == nil {
+				util.LogError("clusters[%s].quota_templates.domains[%s] refers to unknown quota template %q", clusterID, domainName, templateName)
+				success = false
+			}
+		}
+		for templateName, template := range templates.Templates {
+			for serviceType := range template {
+				if !isServiceType[serviceType] {
+					util.LogError("clusters[%s].quota_templates.templates[%s] refers to unknown service %q", clusterID, templateName, serviceType)
+					success = false
+				}
+			}
 		}
 
 		cluster.Discovery.IncludeDomainRx = compileOptionalRx(cluster.Discovery.IncludeDomainPattern)
 		cluster.Discovery.ExcludeDomainRx = compileOptionalRx(cluster.Discovery.ExcludeDomainPattern)
+
+		if cluster.Discovery.Method == "" {
+			//choose default discovery method
+			cluster.Discovery.Method = "list"
+		}
+		if _, exists := discoveryPluginFactories[cluster.Discovery.Method]; !exists {
+			util.LogError("clusters[%s].discovery.method: no suitable discovery plugin found for %q", clusterID, cluster.Discovery.Method)
+			success = false
+		}
+		if cluster.Discovery.Method == "role-assignment" && cluster.Discovery.RoleAssignment.RoleName == "" {
+			missing("discovery.role-assignment.role")
+		}
 	}
 
 	if cfg.API.ListenAddress == "" {
@@ -277,19 +411,163 @@ func (cfg configurationInFile) validate() (success bool) {
 	if cfg.Collector.MetricsListenAddress == "" {
 		missing("collector.metrics")
 	}
+	for serviceType, count := range cfg.Collector.ScrapeWorkers {
+		if count == 0 {
+			util.LogError("invalid value for collector.scrape_workers.%s: must be at least 1", serviceType)
+			success = false
+		}
+	}
+	if cfg.Collector.HistoryRetention < 0 {
+		util.LogError("invalid value for collector.history_retention: must not be negative")
+		success = false
+	}
 
 	return
 }
 
-func loadPolicyFile(path string) (*policy.Enforcer, error) {
+func loadPolicyFile(path string) (enforcer *policy.Enforcer, usesParentProject bool, err error) {
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	var rules map[string]string
 	err = json.Unmarshal(bytes, &rules)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	enforcer, err = policy.NewEnforcer(rules)
+	return enforcer, policyUsesParentProject(rules), err
+}
+
+func policyUsesParentProject(rules map[string]string) bool {
+	for _, rule := range rules {
+		if strings.Contains(rule, "%(parent_project_id)s") {
+			return true
+		}
+	}
+	return false
+}
+
+//validate checks the given AuthParameters for completeness and consistency.
+//The path argument is used in error messages to locate these AuthParameters
+//in the configuration file. If resolveSecrets is false, secrets are not read
+//from environment variables or files.
+func (auth *AuthParameters) validate(path string, resolveSecrets bool) (success bool) {
+	success = true //until proven otherwise
+	missing := func(key string) {
+		util.LogError("missing %s.%s configuration value", path, key)
+		success = false
+	}
+	conflicting := func(key, otherKey string) {
+		util.LogError("%s.%s cannot be combined with %s.%s", path, key, path, otherKey)
+		success = false
+	}
+
+	//NOTE: This is a slice instead of a map to report errors in a stable order.
+	secrets := []struct {
+		Key    string
+		Secret *util.Secret
+	}{
+		{"password", &auth.Password},
+		{"application_credential_secret", &auth.ApplicationCredentialSecret},
+		{"token", &auth.Token},
+	}
+	for _, entry := range secrets {
+		if resolveSecrets && !resolveSecret(entry.Secret, path+"."+entry.Key) {
+			success = false
+		}
+	}
+
+	//gophercloud is very strict about requiring a trailing slash here
+	if auth.AuthURL != "" && !strings.HasSuffix(auth.AuthURL, "/") {
+		auth.AuthURL += "/"
+	}
+
+	switch {
+	case auth.AuthURL == "":
+		missing("auth_url")
+	case !strings.HasPrefix(auth.AuthURL, "http://") && !strings.HasPrefix(auth.AuthURL, "https://"):
+		util.LogError("%s.auth_url does not look like a HTTP URL", path)
+		success = false
+	case !strings.HasSuffix(auth.AuthURL, "/v3/"):
+		util.LogError("%s.auth_url does not end with \"/v3/\"", path)
+		success = false
+	}
+
+	switch auth.method() {
+	case authMethodApplicationCredential:
+		//application credentials are always scoped to the project where they were created
+		if auth.ProjectName != "" {
+			conflicting("application_credential_secret", "project_name")
+		}
+		if auth.ProjectDomainName != "" {
+			conflicting("application_credential_secret", "project_domain_name")
+		}
+		if auth.Password.IsSet() {
+			conflicting("application_credential_secret", "password")
+		}
+		if auth.Token.IsSet() {
+			conflicting("application_credential_secret", "token")
+		}
+		switch {
+		case auth.ApplicationCredentialID != "":
+			if auth.ApplicationCredentialName != "" {
+				conflicting("application_credential_id", "application_credential_name")
+			}
+		case auth.ApplicationCredentialName != "":
+			//application credentials can only be found by name within the scope of their user
+			if auth.UserName == "" {
+				missing("user_name")
+			}
+			if auth.UserDomainName == "" {
+				missing("user_domain_name")
+			}
+		default:
+			missing("application_credential_id")
+		}
+
+	case authMethodToken:
+		if auth.Password.IsSet() {
+			conflicting("token", "password")
+		}
+		if auth.ProjectName == "" {
+			missing("project_name")
+		}
+		if auth.ProjectDomainName == "" {
+			missing("project_domain_name")
+		}
+
+	default:
+		if auth.ApplicationCredentialID != "" || auth.ApplicationCredentialName != "" {
+			missing("application_credential_secret")
+		}
+		if auth.UserName == "" {
+			missing("user_name")
+		}
+		if auth.UserDomainName == "" {
+			missing("user_domain_name")
+		}
+		if auth.ProjectName == "" {
+			missing("project_name")
+		}
+		if auth.ProjectDomainName == "" {
+			missing("project_domain_name")
+		}
+		if !auth.Password.IsSet() {
+			missing("password")
+		}
+	}
+
+	return
+}
+
+//resolveSecret calls secret.Resolve() and logs an error if that fails. The
+//path argument locates the secret in the configuration file.
+func resolveSecret(secret *util.Secret, path string) bool {
+	err := secret.Resolve()
+	if err != nil {
+		util.LogError("cannot resolve %s: %s", path, err.Error())
+		return false
 	}
-	return policy.NewEnforcer(rules)
+	return true
 }
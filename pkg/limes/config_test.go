@@ -0,0 +1,177 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package limes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+type staticDiscoveryPlugin struct{}
+
+func (staticDiscoveryPlugin) Method() string {
+	return "static"
+}
+
+func (staticDiscoveryPlugin) ListDomains(client *gophercloud.ProviderClient) ([]KeystoneDomain, error) {
+	return nil, nil
+}
+
+func (staticDiscoveryPlugin) ListProjects(client *gophercloud.ProviderClient, domainUUID string) ([]KeystoneProject, error) {
+	return nil, nil
+}
+
+type staticQuotaPlugin struct{}
+
+func (staticQuotaPlugin) ServiceInfo() ServiceInfo {
+	return ServiceInfo{Type: "shared", ProductName: "shared", Area: "shared"}
+}
+
+func (staticQuotaPlugin) Resources() []ResourceInfo {
+	return []ResourceInfo{{Name: "things"}}
+}
+
+func (staticQuotaPlugin) Scrape(client *gophercloud.ProviderClient, domainUUID, projectUUID string) (map[string]ResourceData, error) {
+	return nil, nil
+}
+
+func (staticQuotaPlugin) SetQuota(client *gophercloud.ProviderClient, domainUUID, projectUUID string, quotas map[string]uint64) error {
+	return nil
+}
+
+func init() {
+	RegisterDiscoveryPlugin(func(DiscoveryConfiguration) DiscoveryPlugin {
+		return staticDiscoveryPlugin{}
+	})
+	RegisterQuotaPlugin(func(ServiceConfiguration, map[string]bool) QuotaPlugin {
+		return staticQuotaPlugin{}
+	})
+}
+
+var testConfig = `
+database:
+  location: postgres://postgres@localhost/limes
+  migrations: /usr/share/limes/migrations
+api:
+  listen: ":8080"
+  policy: ../test/policy.json
+collector:
+  metrics: ":8081"
+clusters:
+  west:
+    auth:
+      auth_url: https://keystone.example.com/v3
+      application_credential_id: appcred1
+      application_credential_secret: swordfish
+    discovery:
+      method: static
+    services:
+      - type: shared
+`
+
+func Test_CheckConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "limes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limes.yaml")
+
+	writeFile(t, path, testConfig)
+	if !CheckConfiguration(path, true) {
+		t.Error("expected check of valid configuration to succeed")
+	}
+	writeFile(t, path, testConfig+"    subresources:\n      shared: [ things ]\n")
+	if !CheckConfiguration(path, true) {
+		t.Error("expected check of valid configuration with subresources to succeed")
+	}
+
+	//problems that LoadConfiguration() tolerates are errors for CheckConfiguration()
+	writeFile(t, path, testConfig+"      - type: unknown\n")
+	if CheckConfiguration(path, true) {
+		t.Error("expected check to fail for service without plugin")
+	}
+	writeFile(t, path, testConfig+"    subresources:\n      shared: [ unknown ]\n")
+	if CheckConfiguration(path, true) {
+		t.Error("expected check to fail for subresources of unknown resource")
+	}
+	writeFile(t, path, testConfig+"    subresources:\n      unknown: [ things ]\n")
+	if CheckConfiguration(path, true) {
+		t.Error("expected check to fail for subresources of unknown service")
+	}
+
+	//validation errors and unreadable policy files are errors
+	writeFile(t, path, strings.Replace(testConfig, "method: static", "method: unknown", 1))
+	if CheckConfiguration(path, true) {
+		t.Error("expected check to fail for unknown discovery method")
+	}
+	writeFile(t, path, strings.Replace(testConfig, `metrics: ":8081"`, "metrics: \":8081\"\n  scrape_workers: { shared: 0 }", 1))
+	if CheckConfiguration(path, true) {
+		t.Error("expected check to fail for zero scrape workers")
+	}
+	writeFile(t, path, strings.Replace(testConfig, "../test/policy.json", "../test/nonexistent.json", 1))
+	if CheckConfiguration(path, true) {
+		t.Error("expected check to fail for missing policy file")
+	}
+	if CheckConfiguration(filepath.Join(dir, "nonexistent.yaml"), true) {
+		t.Error("expected check to fail for missing configuration file")
+	}
+
+	//in syntax-only mode, secrets are not resolved, but must still be present
+	os.Unsetenv("LIMES_TEST_MISSING")
+	writeFile(t, path, strings.Replace(testConfig, "application_credential_secret: swordfish", "application_credential_secret: { fromEnv: LIMES_TEST_MISSING }", 1))
+	if CheckConfiguration(path, true) {
+		t.Error("expected check to fail for unresolvable secret")
+	}
+	if !CheckConfiguration(path, false) {
+		t.Error("expected syntax-only check to succeed for unresolvable secret")
+	}
+	writeFile(t, path, strings.Replace(testConfig, "      application_credential_secret: swordfish\n", "", 1))
+	if CheckConfiguration(path, false) {
+		t.Error("expected syntax-only check to fail for missing secret")
+	}
+}
+
+func Test_PolicyUsesParentProject(t *testing.T) {
+	rules := map[string]string{
+		"project_scope": "project_domain_id:%(domain_id)s and project_id:%(project_id)s",
+		"project:show":  "rule:project_scope",
+	}
+	if policyUsesParentProject(rules) {
+		t.Error("expected policy without parent_project_id to not use the parent project")
+	}
+
+	rules["parent_project_scope"] = "project_domain_id:%(domain_id)s and project_id:%(parent_project_id)s"
+	if !policyUsesParentProject(rules) {
+		t.Error("expected policy with parent_project_id to use the parent project")
+	}
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -79,6 +79,21 @@ type QuotaPlugin interface {
 	SetQuota(client *gophercloud.ProviderClient, domainUUID, projectUUID string, quotas map[string]uint64) error
 }
 
+//BulkQuotaPlugin is an optional interface that can be implemented by a
+//QuotaPlugin if the backend service can report quota and usage data for all
+//projects at once (e.g. through an admin listing). When a large part of all
+//projects needs to be scraped at the same time, the collector will then call
+//ScrapeAll() once instead of calling Scrape() for each project. If ScrapeAll()
+//fails, the collector falls back to Scrape() for a while.
+type BulkQuotaPlugin interface {
+	QuotaPlugin
+	//ScrapeAll is like Scrape, but returns the data for all projects at once.
+	//The keys of the outer map are project UUIDs, the inner maps have the same
+	//format as the result of Scrape(). Projects that are missing in the result
+	//will be scraped individually with Scrape().
+	ScrapeAll(client *gophercloud.ProviderClient) (map[string]map[string]ResourceData, error)
+}
+
 //CapacityPlugin is the interface that all capacity collector plugins must
 //implement.
 //
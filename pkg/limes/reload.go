@@ -0,0 +1,106 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package limes
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+var configReloadCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "limes_config_reloads",
+		Help: "Counter for configuration reloads triggered by SIGHUP.",
+	},
+	[]string{"os_cluster", "result"},
+)
+
+var configHashGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "limes_config_hash",
+		Help: "Has the value 1 for the SHA-256 hash of the currently active configuration file.",
+	},
+	[]string{"os_cluster", "hash"},
+)
+
+func init() {
+	prometheus.MustRegister(configReloadCounter)
+	prometheus.MustRegister(configHashGauge)
+}
+
+//WatchForReload starts a goroutine that reloads the configuration file at the
+//given path whenever the process receives SIGHUP. Each successfully loaded
+//configuration is handed to the apply callback, which may reject it by
+//returning an error (e.g. when the cluster cannot be connected to). When
+//loading or applying the new configuration fails, the errors are logged and
+//the previous configuration stays active.
+//
+//The given configuration is the one that is active initially.
+func WatchForReload(path, clusterID string, initial Configuration, apply func(Configuration) error) {
+	setActiveConfigHash(clusterID, initial.Hash)
+	for _, result := range []string{"success", "failure"} {
+		configReloadCounter.With(prometheus.Labels{"os_cluster": clusterID, "result": result}).Add(0)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			ReloadConfiguration(path, clusterID, apply)
+		}
+	}()
+}
+
+//ReloadConfiguration performs a single reload of the configuration file at the
+//given path, as described for WatchForReload. It returns whether the new
+//configuration was applied.
+func ReloadConfiguration(path, clusterID string, apply func(Configuration) error) bool {
+	util.LogInfo("reloading configuration from %s", path)
+	cfg, err := LoadConfiguration(path)
+	if err == nil {
+		if _, exists := cfg.Clusters[clusterID]; !exists {
+			err = fmt.Errorf("no such cluster configured: %s", clusterID)
+		}
+	}
+	if err == nil {
+		err = apply(cfg)
+	}
+
+	if err != nil {
+		util.LogError("configuration reload failed, keeping previous configuration: %s", err.Error())
+		configReloadCounter.With(prometheus.Labels{"os_cluster": clusterID, "result": "failure"}).Inc()
+		return false
+	}
+
+	util.LogInfo("configuration reloaded successfully")
+	configReloadCounter.With(prometheus.Labels{"os_cluster": clusterID, "result": "success"}).Inc()
+	setActiveConfigHash(clusterID, cfg.Hash)
+	return true
+}
+
+func setActiveConfigHash(clusterID, hash string) {
+	configHashGauge.Reset()
+	configHashGauge.With(prometheus.Labels{"os_cluster": clusterID, "hash": hash}).Set(1)
+}
@@ -0,0 +1,82 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package limes
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ReloadConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "limes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limes.yaml")
+
+	var applied []Configuration
+	apply := func(cfg Configuration) error {
+		applied = append(applied, cfg)
+		return nil
+	}
+	reject := func(cfg Configuration) error {
+		return errors.New("rejected")
+	}
+
+	//invalid configuration is not applied
+	writeFile(t, path, "database: {}\n")
+	if ReloadConfiguration(path, "west", apply) {
+		t.Error("expected reload of invalid configuration to fail")
+	}
+
+	//valid configuration is applied
+	writeFile(t, path, testConfig)
+	if !ReloadConfiguration(path, "west", apply) {
+		t.Error("expected reload of valid configuration to succeed")
+	}
+	if len(applied) != 1 {
+		t.Fatalf("expected 1 configuration to be applied, got %d", len(applied))
+	}
+	if applied[0].Clusters["west"] == nil {
+		t.Error("expected cluster \"west\" in reloaded configuration")
+	}
+	if applied[0].API.PolicyEnforcer == nil {
+		t.Error("expected policy enforcer in reloaded configuration")
+	}
+	if len(applied[0].Hash) != 64 {
+		t.Errorf("expected SHA-256 hash in reloaded configuration, got %q", applied[0].Hash)
+	}
+
+	//valid configuration can still be rejected by the callback, or when the
+	//cluster is missing from it
+	if ReloadConfiguration(path, "west", reject) {
+		t.Error("expected reload to fail when the callback rejects the configuration")
+	}
+	if ReloadConfiguration(path, "east", apply) {
+		t.Error("expected reload to fail for a cluster that is not configured")
+	}
+	if len(applied) != 1 {
+		t.Errorf("expected no further configurations to be applied, got %d", len(applied))
+	}
+}
@@ -67,8 +67,8 @@ func (p *capacitySwiftHealthStatsdPlugin) Scrape(provider *gophercloud.ProviderC
 
 	var prometheusQuery = "min(swift_cluster_storage_capacity_bytes_gauge < inf)"
 	var prometheusAPIURL = "https://localhost:9090"
-	if p.cfg.Swift.PrometheusAPIURL != "" {
-		prometheusAPIURL = p.cfg.Swift.PrometheusAPIURL
+	if p.cfg.Swift.PrometheusAPIURL.Value != "" {
+		prometheusAPIURL = p.cfg.Swift.PrometheusAPIURL.Value
 	}
 
 	client, err := Client(prometheusAPIURL)
@@ -0,0 +1,144 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package reports
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//AuditEvent contains all data about a single audit event.
+type AuditEvent struct {
+	ID           int64      `json:"id"`
+	Time         int64      `json:"time"`
+	DomainUUID   string     `json:"domain_id,omitempty"`
+	ProjectUUID  string     `json:"project_id,omitempty"`
+	ServiceType  string     `json:"service,omitempty"`
+	ResourceName string     `json:"resource,omitempty"`
+	Action       string     `json:"action"`
+	OldValue     *uint64    `json:"old_value,omitempty"`
+	NewValue     *uint64    `json:"new_value,omitempty"`
+	User         *AuditUser `json:"user,omitempty"`
+	Message      string     `json:"message"`
+}
+
+//AuditUser is a substructure of AuditEvent identifying the user who caused
+//the event. Events caused by Limes itself (e.g. auto-approval) do not have a
+//user.
+type AuditUser struct {
+	UUID string `json:"id"`
+	Name string `json:"name"`
+}
+
+//AuditEventFilter selects the audit events returned by GetAuditEvents. Fields
+//that are empty or nil do not restrict the result. Each list field matches
+//events that have any of the values in the list.
+type AuditEventFilter struct {
+	DomainUUIDs   []string
+	ProjectUUIDs  []string
+	ServiceTypes  []string
+	ResourceNames []string
+	Actions       []string
+	//Users matches either the user UUID or the user name.
+	Users []string
+	//Since and Until restrict the event time to the half-open interval [Since, Until).
+	Since *time.Time
+	Until *time.Time
+}
+
+var auditEventReportQuery = `
+	SELECT id, time, domain_uuid, project_uuid, service_type, resource_name,
+	       action, old_value, new_value, user_uuid, user_name, message
+	  FROM audit_events
+	 WHERE %s
+	 ORDER BY time, id
+`
+
+//GetAuditEvents returns AuditEvent reports for all audit events in the given
+//cluster that match the given filter, in chronological order.
+func GetAuditEvents(cluster *limes.Cluster, dbi db.Interface, filter AuditEventFilter) ([]*AuditEvent, error) {
+	fields := map[string]interface{}{"cluster_id": cluster.ID}
+	if len(filter.DomainUUIDs) > 0 {
+		fields["domain_uuid"] = filter.DomainUUIDs
+	}
+	if len(filter.ProjectUUIDs) > 0 {
+		fields["project_uuid"] = filter.ProjectUUIDs
+	}
+	if len(filter.ServiceTypes) > 0 {
+		fields["service_type"] = filter.ServiceTypes
+	}
+	if len(filter.ResourceNames) > 0 {
+		fields["resource_name"] = filter.ResourceNames
+	}
+	if len(filter.Actions) > 0 {
+		fields["action"] = filter.Actions
+	}
+	whereStr, args := db.BuildSimpleWhereClause(fields, 0)
+
+	//the remaining conditions do not fit into BuildSimpleWhereClause
+	conditions := []string{whereStr}
+	if len(filter.Users) > 0 {
+		uuidStr, uuidArgs := db.BuildSimpleWhereClause(map[string]interface{}{"user_uuid": filter.Users}, len(args))
+		args = append(args, uuidArgs...)
+		nameStr, nameArgs := db.BuildSimpleWhereClause(map[string]interface{}{"user_name": filter.Users}, len(args))
+		args = append(args, nameArgs...)
+		conditions = append(conditions, fmt.Sprintf("(%s OR %s)", uuidStr, nameStr))
+	}
+	if filter.Since != nil {
+		args = append(args, *filter.Since)
+		conditions = append(conditions, fmt.Sprintf("time >= $%d", len(args)))
+	}
+	if filter.Until != nil {
+		args = append(args, *filter.Until)
+		conditions = append(conditions, fmt.Sprintf("time < $%d", len(args)))
+	}
+
+	var events []*AuditEvent
+	queryStr := fmt.Sprintf(auditEventReportQuery, strings.Join(conditions, " AND "))
+	err := db.ForeachRow(dbi, queryStr, args, func(rows *sql.Rows) error {
+		var (
+			event     AuditEvent
+			eventTime util.Time
+			userUUID  string
+			userName  string
+		)
+		err := rows.Scan(
+			&event.ID, &eventTime, &event.DomainUUID, &event.ProjectUUID,
+			&event.ServiceType, &event.ResourceName, &event.Action,
+			&event.OldValue, &event.NewValue, &userUUID, &userName, &event.Message,
+		)
+		if err != nil {
+			return err
+		}
+		event.Time = time.Time(eventTime).Unix()
+		if userUUID != "" || userName != "" {
+			event.User = &AuditUser{UUID: userUUID, Name: userName}
+		}
+		events = append(events, &event)
+		return nil
+	})
+	return events, err
+}
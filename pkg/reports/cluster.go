@@ -146,7 +146,7 @@ func GetClusters(config limes.Configuration, clusterID *string, localQuotaUsageO
 	clusters := make(clusters)
 	queryStr, joinArgs := filter.PrepareQuery(clusterReportQuery1)
 	whereStr, whereArgs := db.BuildSimpleWhereClause(makeClusterFilter("d", clusterID), len(joinArgs))
-	err := db.ForeachRow(db.DB, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
+	err := db.ForeachRow(dbi, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
 		var (
 			clusterID    string
 			serviceType  *string
@@ -183,7 +183,7 @@ func GetClusters(config limes.Configuration, clusterID *string, localQuotaUsageO
 	//second query: collect domain quota data in these clusters
 	queryStr, joinArgs = filter.PrepareQuery(clusterReportQuery2)
 	whereStr, whereArgs = db.BuildSimpleWhereClause(makeClusterFilter("d", clusterID), len(joinArgs))
-	err = db.ForeachRow(db.DB, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
+	err = db.ForeachRow(dbi, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
 		var (
 			clusterID    string
 			serviceType  *string
@@ -210,7 +210,7 @@ func GetClusters(config limes.Configuration, clusterID *string, localQuotaUsageO
 	//third query: collect capacity data for these clusters
 	queryStr, joinArgs = filter.PrepareQuery(clusterReportQuery3)
 	whereStr, whereArgs = db.BuildSimpleWhereClause(makeClusterFilter("cs", clusterID), len(joinArgs))
-	err = db.ForeachRow(db.DB, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
+	err = db.ForeachRow(dbi, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
 		var (
 			clusterID    string
 			serviceType  string
@@ -274,7 +274,7 @@ func GetClusters(config limes.Configuration, clusterID *string, localQuotaUsageO
 				sharedServiceTypes = append(sharedServiceTypes, serviceType)
 			}
 			whereStr, queryArgs := db.BuildSimpleWhereClause(map[string]interface{}{"ds.type": sharedServiceTypes}, 0)
-			err = db.ForeachRow(db.DB, fmt.Sprintf(clusterReportQuery4, whereStr), queryArgs, func(rows *sql.Rows) error {
+			err = db.ForeachRow(dbi, fmt.Sprintf(clusterReportQuery4, whereStr), queryArgs, func(rows *sql.Rows) error {
 				var (
 					serviceType  string
 					resourceName string
@@ -298,7 +298,7 @@ func GetClusters(config limes.Configuration, clusterID *string, localQuotaUsageO
 			//fifth query: aggregate project quota for shared services
 			whereStr, queryArgs = db.BuildSimpleWhereClause(map[string]interface{}{"ps.type": sharedServiceTypes}, 0)
 			sharedUsageSums := make(map[string]map[string]uint64)
-			err = db.ForeachRow(db.DB, fmt.Sprintf(clusterReportQuery5, whereStr), queryArgs, func(rows *sql.Rows) error {
+			err = db.ForeachRow(dbi, fmt.Sprintf(clusterReportQuery5, whereStr), queryArgs, func(rows *sql.Rows) error {
 				var (
 					serviceType  string
 					resourceName string
@@ -350,7 +350,7 @@ func GetClusters(config limes.Configuration, clusterID *string, localQuotaUsageO
 		queryStr, joinArgs = filter.PrepareQuery(clusterReportQuery3)
 		filter := map[string]interface{}{"cs.cluster_id": "shared"}
 		whereStr, whereArgs = db.BuildSimpleWhereClause(filter, len(joinArgs))
-		err = db.ForeachRow(db.DB, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
+		err = db.ForeachRow(dbi, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
 			var (
 				sharedClusterID string
 				serviceType     string
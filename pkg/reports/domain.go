@@ -54,6 +54,9 @@ type DomainResource struct {
 	DomainQuota   uint64 `json:"quota,keepempty"`
 	ProjectsQuota uint64 `json:"projects_quota,keepempty"`
 	Usage         uint64 `json:"usage,keepempty"`
+	//Quota sum of all projects including child projects (which are not
+	//included in ProjectsQuota). This is what the backend quotas are compared to.
+	AllProjectsQuota uint64 `json:"-"`
 	//These are pointers to values to enable precise control over whether this field is rendered in output.
 	BackendQuota         *uint64 `json:"backend_quota,omitempty"`
 	InfiniteBackendQuota *bool   `json:"infinite_backend_quota,omitempty"`
@@ -97,11 +100,16 @@ func (r DomainResources) MarshalJSON() ([]byte, error) {
 	return json.Marshal(list)
 }
 
+//The quota of child projects is subleased from their top-level project (see
+//validation.ProjectHierarchy), so only top-level projects count towards
+//projects_quota. The sum over all projects is only used to detect mismatches
+//with the backend quotas.
 var domainReportQuery1 = `
-	SELECT d.uuid, d.name, ps.type, pr.name, SUM(pr.quota), SUM(pr.usage),
+	SELECT d.uuid, d.name, ps.type, pr.name, SUM(CASE WHEN parent.id IS NULL THEN pr.quota ELSE 0 END), SUM(pr.quota), SUM(pr.usage),
 	       SUM(GREATEST(pr.backend_quota, 0)), MIN(pr.backend_quota) < 0, MIN(ps.scraped_at), MAX(ps.scraped_at)
 	  FROM domains d
 	  JOIN projects p ON p.domain_id = d.id
+	  LEFT OUTER JOIN projects parent ON parent.uuid = p.parent_uuid AND parent.domain_id = p.domain_id
 	  LEFT OUTER JOIN project_services ps ON ps.project_id = p.id {{AND ps.type = $service_type}}
 	  LEFT OUTER JOIN project_resources pr ON pr.service_id = ps.id {{AND pr.name = $resource_name}}
 	 WHERE %s GROUP BY d.uuid, d.name, ps.type, pr.name
@@ -123,17 +131,67 @@ func GetDomains(cluster *limes.Cluster, domainID *int64, dbi db.Interface, filte
 		fields["d.id"] = *domainID
 	}
 
+	//when listing, find the requested page of domains first
+	var pageUUIDs []string
+	if domainID == nil && filter.isPaginated() {
+		var err error
+		pageUUIDs, err = domainListQuery.FindPage(dbi, filter, map[string]interface{}{"o.cluster_id": cluster.ID})
+		if err != nil {
+			return nil, err
+		}
+		if len(pageUUIDs) == 0 {
+			return []*Domain{}, nil
+		}
+		fields["d.uuid"] = pageUUIDs
+	}
+
+	return getDomains(cluster, fields, pageUUIDs, dbi, filter)
+}
+
+//ForeachDomainBatch is like GetDomains for all domains in the given cluster,
+//but instead of returning all Domain reports at once, it loads them in batches
+//of the given size and calls the callback for each batch (in the order in
+//which GetDomains would return them). This is used to stream large reports to
+//the client without building them up in memory.
+func ForeachDomainBatch(cluster *limes.Cluster, dbi db.Interface, filter Filter, batchSize int, callback func([]*Domain) error) error {
+	var (
+		uuids []string
+		err   error
+	)
+	if filter.isPaginated() {
+		uuids, err = domainListQuery.FindPage(dbi, filter, map[string]interface{}{"o.cluster_id": cluster.ID})
+	} else {
+		uuids, err = findUUIDs(dbi, `SELECT uuid FROM domains WHERE cluster_id = $1 ORDER BY uuid`, cluster.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return foreachBatch(uuids, batchSize, func(batch []string) error {
+		fields := map[string]interface{}{"d.cluster_id": cluster.ID, "d.uuid": batch}
+		domains, err := getDomains(cluster, fields, batch, dbi, filter)
+		if err != nil {
+			return err
+		}
+		return callback(domains)
+	})
+}
+
+//getDomains is the implementation of GetDomains and ForeachDomainBatch. If
+//pageUUIDs is not nil, the result is ordered accordingly.
+func getDomains(cluster *limes.Cluster, fields map[string]interface{}, pageUUIDs []string, dbi db.Interface, filter Filter) ([]*Domain, error) {
 	//first query: data for projects in this domain
 	domains := make(domains)
 	queryStr, joinArgs := filter.PrepareQuery(domainReportQuery1)
 	whereStr, whereArgs := db.BuildSimpleWhereClause(fields, len(joinArgs))
-	err := db.ForeachRow(db.DB, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
+	err := db.ForeachRow(dbi, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
 		var (
 			domainUUID           string
 			domainName           string
 			serviceType          *string
 			resourceName         *string
 			projectsQuota        *uint64
+			allProjectsQuota     *uint64
 			usage                *uint64
 			backendQuota         *uint64
 			infiniteBackendQuota *bool
@@ -142,7 +200,7 @@ func GetDomains(cluster *limes.Cluster, domainID *int64, dbi db.Interface, filte
 		)
 		err := rows.Scan(
 			&domainUUID, &domainName, &serviceType, &resourceName,
-			&projectsQuota, &usage, &backendQuota, &infiniteBackendQuota,
+			&projectsQuota, &allProjectsQuota, &usage, &backendQuota, &infiniteBackendQuota,
 			&minScrapedAt, &maxScrapedAt,
 		)
 		if err != nil {
@@ -168,7 +226,10 @@ func GetDomains(cluster *limes.Cluster, domainID *int64, dbi db.Interface, filte
 			}
 			if projectsQuota != nil {
 				resource.ProjectsQuota = *projectsQuota
-				if backendQuota != nil && *projectsQuota != *backendQuota {
+			}
+			if allProjectsQuota != nil {
+				resource.AllProjectsQuota = *allProjectsQuota
+				if backendQuota != nil && *allProjectsQuota != *backendQuota {
 					resource.BackendQuota = backendQuota
 				}
 			}
@@ -186,7 +247,7 @@ func GetDomains(cluster *limes.Cluster, domainID *int64, dbi db.Interface, filte
 	//second query: add domain quotas
 	queryStr, joinArgs = filter.PrepareQuery(domainReportQuery2)
 	whereStr, whereArgs = db.BuildSimpleWhereClause(fields, len(joinArgs))
-	err = db.ForeachRow(db.DB, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
+	err = db.ForeachRow(dbi, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
 		var (
 			domainUUID   string
 			domainName   string
@@ -215,15 +276,22 @@ func GetDomains(cluster *limes.Cluster, domainID *int64, dbi db.Interface, filte
 		return nil, err
 	}
 
-	//flatten result (with stable order to keep the tests happy)
-	uuids := make([]string, 0, len(domains))
-	for uuid := range domains {
-		uuids = append(uuids, uuid)
+	//flatten result (in the order of the requested page, or with stable order
+	//to keep the tests happy)
+	uuids := pageUUIDs
+	if uuids == nil {
+		uuids = make([]string, 0, len(domains))
+		for uuid := range domains {
+			uuids = append(uuids, uuid)
+		}
+		sort.Strings(uuids)
 	}
-	sort.Strings(uuids)
-	result := make([]*Domain, len(domains))
-	for idx, uuid := range uuids {
-		result[idx] = domains[uuid]
+	result := make([]*Domain, 0, len(domains))
+	for _, uuid := range uuids {
+		//(domains on the requested page might have been deleted in the meantime)
+		if domain, exists := domains[uuid]; exists {
+			result = append(result, domain)
+		}
 	}
 
 	return result, nil
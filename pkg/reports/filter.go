@@ -20,8 +20,13 @@
 package reports
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/sapcc/limes/pkg/db"
 	"github.com/sapcc/limes/pkg/limes"
@@ -32,10 +37,31 @@ import (
 type Filter struct {
 	serviceTypes  []string
 	resourceNames []string
+
+	//The following fields are only used when listing projects or domains.
+	limit        uint64
+	marker       string
+	sortKey      string
+	sortDesc     bool
+	usageRatioGt *float64
+	usageRatioLt *float64
+	quotaGtUsage bool
+	usageGtQuota bool
+}
+
+//ErrInvalidMarker is returned by GetProjects and GetDomains when the marker
+//given in the Filter does not refer to an existing project or domain.
+var ErrInvalidMarker = errors.New("invalid marker: no such project or domain")
+
+var isValidSortKey = map[string]bool{
+	"name":        true,
+	"usage":       true,
+	"usage_ratio": true,
 }
 
-//ReadFilter extracts a Filter from the given Request.
-func ReadFilter(r *http.Request) Filter {
+//ReadFilter extracts a Filter from the given Request. An error is returned if
+//any of the query parameters is malformed.
+func ReadFilter(r *http.Request) (Filter, error) {
 	var (
 		f  Filter
 		ok bool
@@ -79,17 +105,84 @@ func ReadFilter(r *http.Request) Filter {
 		}
 	}
 
-	return f
+	if limitStr := queryValues.Get("limit"); limitStr != "" {
+		limit, err := strconv.ParseUint(limitStr, 10, 64)
+		if err != nil || limit == 0 {
+			return f, fmt.Errorf("malformed value for limit: %q (expected positive integer)", limitStr)
+		}
+		f.limit = limit
+	}
+	f.marker = queryValues.Get("marker")
+
+	if sortStr := queryValues.Get("sort"); sortStr != "" {
+		f.sortKey = strings.TrimPrefix(sortStr, "-")
+		f.sortDesc = f.sortKey != sortStr
+		if !isValidSortKey[f.sortKey] {
+			return f, fmt.Errorf("malformed value for sort: %q (expected \"name\", \"usage\" or \"usage_ratio\", optionally prefixed with \"-\")", sortStr)
+		}
+		//usage values of different resources can have different units, so they
+		//cannot be summed up into a meaningful sort value
+		if f.sortKey == "usage" && (len(f.serviceTypes) != 1 || len(f.resourceNames) != 1) {
+			return f, errors.New(`sorting by usage requires exactly one "service" and one "resource" filter`)
+		}
+	}
+
+	var err error
+	f.usageRatioGt, err = readFloatParam(queryValues.Get("usage_ratio_gt"), "usage_ratio_gt")
+	if err != nil {
+		return f, err
+	}
+	f.usageRatioLt, err = readFloatParam(queryValues.Get("usage_ratio_lt"), "usage_ratio_lt")
+	if err != nil {
+		return f, err
+	}
+	f.quotaGtUsage, err = readFlagParam(queryValues, "quota_gt_usage")
+	if err != nil {
+		return f, err
+	}
+	f.usageGtQuota, err = readFlagParam(queryValues, "usage_gt_quota")
+	return f, err
+}
+
+func readFloatParam(str, param string) (*float64, error) {
+	if str == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed value for %s: %q (expected number)", param, str)
+	}
+	return &value, nil
+}
+
+//readFlagParam treats a query parameter without value (e.g. "?quota_gt_usage")
+//as true.
+func readFlagParam(queryValues url.Values, param string) (bool, error) {
+	values, exists := queryValues[param]
+	if !exists || values[0] == "" {
+		return exists, nil
+	}
+	value, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, fmt.Errorf("malformed value for %s: %q (expected boolean)", param, values[0])
+	}
+	return value, nil
 }
 
-var filterPrepareRx = regexp.MustCompile(`{{AND ([a-z.]+) = \$(service_type|resource_name)}}`)
+var filterPrepareRx = regexp.MustCompile(`{{AND ([a-z._]+) = \$(service_type|resource_name)}}`)
 
 //PrepareQuery takes a SQL query string, and replaces the following
 //placeholders with the values in this Filter:
 //
-//    {{AND some_table.some_field = $service_type}}
-//    {{AND some_table.some_field = $resource_name}}
+//	{{AND some_table.some_field = $service_type}}
+//	{{AND some_table.some_field = $resource_name}}
 func (f Filter) PrepareQuery(query string) (preparedQuery string, args []interface{}) {
+	return f.prepareQueryWithOffset(query, 0)
+}
+
+//prepareQueryWithOffset is like PrepareQuery, but starts counting
+//placeholders ("$1", "$2", etc.) after the given offset.
+func (f Filter) prepareQueryWithOffset(query string, parameterOffset int) (preparedQuery string, args []interface{}) {
 	preparedQuery = filterPrepareRx.ReplaceAllStringFunc(query, func(matchStr string) string {
 		match := filterPrepareRx.FindStringSubmatch(matchStr)
 		values := f.serviceTypes
@@ -101,7 +194,7 @@ func (f Filter) PrepareQuery(query string) (preparedQuery string, args []interfa
 			return ""
 		}
 
-		whereStr, queryArgs := db.BuildSimpleWhereClause(map[string]interface{}{match[1]: values}, len(args))
+		whereStr, queryArgs := db.BuildSimpleWhereClause(map[string]interface{}{match[1]: values}, parameterOffset+len(args))
 		args = append(args, queryArgs...)
 		return "AND " + whereStr
 	})
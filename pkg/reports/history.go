@@ -0,0 +1,196 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package reports
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//History contains time series of quota and usage values for a project, or
+//aggregated over all projects in a domain or cluster.
+type History struct {
+	Services HistoryServices `json:"services,keepempty"`
+}
+
+//HistoryService is a substructure of History containing data for a single
+//backend service.
+type HistoryService struct {
+	limes.ServiceInfo
+	Resources HistoryResources `json:"resources,keepempty"`
+}
+
+//HistoryResource is a substructure of History containing data for a single
+//resource.
+type HistoryResource struct {
+	limes.ResourceInfo
+	Samples []HistorySample `json:"samples,keepempty"`
+}
+
+//HistorySample is a substructure of History containing the values of a single
+//resource at a certain point in time.
+type HistorySample struct {
+	Time         int64  `json:"time"`
+	Quota        uint64 `json:"quota,keepempty"`
+	Usage        uint64 `json:"usage,keepempty"`
+	BackendQuota uint64 `json:"backend_quota,keepempty"`
+	//This is a pointer to a value to enable precise control over whether this field is rendered in output.
+	InfiniteBackendQuota *bool `json:"infinite_backend_quota,omitempty"`
+}
+
+//HistoryServices provides fast lookup of services using a map, but serializes
+//to JSON as a list.
+type HistoryServices map[string]*HistoryService
+
+//MarshalJSON implements the json.Marshaler interface.
+func (s HistoryServices) MarshalJSON() ([]byte, error) {
+	//serialize with ordered keys to ensure testcase stability
+	types := make([]string, 0, len(s))
+	for typeStr := range s {
+		types = append(types, typeStr)
+	}
+	sort.Strings(types)
+	list := make([]*HistoryService, len(s))
+	for idx, typeStr := range types {
+		list[idx] = s[typeStr]
+	}
+	return json.Marshal(list)
+}
+
+//HistoryResources provides fast lookup of resources using a map, but
+//serializes to JSON as a list.
+type HistoryResources map[string]*HistoryResource
+
+//MarshalJSON implements the json.Marshaler interface.
+func (r HistoryResources) MarshalJSON() ([]byte, error) {
+	//serialize with ordered keys to ensure testcase stability
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*HistoryResource, len(r))
+	for idx, name := range names {
+		list[idx] = r[name]
+	}
+	return json.Marshal(list)
+}
+
+var historyReportQuery = `
+	SELECT h.service_type, h.resource_name, h.time,
+	       SUM(h.quota), SUM(h.usage),
+	       SUM(CASE WHEN h.backend_quota < 0 THEN 0 ELSE h.backend_quota END),
+	       MIN(h.backend_quota)
+	  FROM project_resource_history h
+	  JOIN projects p ON p.id = h.project_id
+	  JOIN domains d ON d.id = p.domain_id
+	 WHERE %s {{AND h.service_type = $service_type}} {{AND h.resource_name = $resource_name}}
+	 GROUP BY h.service_type, h.resource_name, h.time
+	 ORDER BY h.time
+`
+
+//GetHistory returns the History report for the given project or, if
+//projectID is nil, aggregated over the given domain or, if domainID is also
+//nil, aggregated over the whole cluster. If given, `from` and `to` restrict
+//the samples to the half-open interval [from, to).
+func GetHistory(cluster *limes.Cluster, domainID, projectID *int64, from, to *time.Time, dbi db.Interface, filter Filter) (*History, error) {
+	fields := map[string]interface{}{"d.cluster_id": cluster.ID}
+	if domainID != nil {
+		fields["d.id"] = *domainID
+	}
+	if projectID != nil {
+		fields["p.id"] = *projectID
+	}
+
+	//NOTE: SQLite numbers placeholders in order of appearance, so the WHERE
+	//clause needs to be built first since it appears first in the query
+	whereStr, args := db.BuildSimpleWhereClause(fields, 0)
+	conditions := []string{whereStr}
+	if from != nil {
+		args = append(args, *from)
+		conditions = append(conditions, fmt.Sprintf("h.time >= $%d", len(args)))
+	}
+	if to != nil {
+		args = append(args, *to)
+		conditions = append(conditions, fmt.Sprintf("h.time < $%d", len(args)))
+	}
+	queryStr := fmt.Sprintf(historyReportQuery, strings.Join(conditions, " AND "))
+	queryStr, filterArgs := filter.prepareQueryWithOffset(queryStr, len(args))
+	args = append(args, filterArgs...)
+
+	history := &History{Services: make(HistoryServices)}
+	err := db.ForeachRow(dbi, queryStr, args, func(rows *sql.Rows) error {
+		var (
+			serviceType     string
+			resourceName    string
+			sampleTime      util.Time
+			quota           uint64
+			usage           uint64
+			backendQuota    uint64
+			minBackendQuota int64
+		)
+		err := rows.Scan(&serviceType, &resourceName, &sampleTime, &quota, &usage, &backendQuota, &minBackendQuota)
+		if err != nil {
+			return err
+		}
+		if !cluster.HasResource(serviceType, resourceName) {
+			return nil
+		}
+
+		service, exists := history.Services[serviceType]
+		if !exists {
+			service = &HistoryService{
+				ServiceInfo: cluster.InfoForService(serviceType),
+				Resources:   make(HistoryResources),
+			}
+			history.Services[serviceType] = service
+		}
+		resource, exists := service.Resources[resourceName]
+		if !exists {
+			resource = &HistoryResource{
+				ResourceInfo: cluster.InfoForResource(serviceType, resourceName),
+				Samples:      []HistorySample{},
+			}
+			service.Resources[resourceName] = resource
+		}
+
+		sample := HistorySample{
+			Time:         time.Time(sampleTime).Unix(),
+			Quota:        quota,
+			Usage:        usage,
+			BackendQuota: backendQuota,
+		}
+		if minBackendQuota < 0 {
+			infinite := true
+			sample.InfiniteBackendQuota = &infinite
+		}
+		resource.Samples = append(resource.Samples, sample)
+		return nil
+	})
+	return history, err
+}
@@ -0,0 +1,243 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package reports
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/sapcc/limes/pkg/db"
+)
+
+//listQuery describes how the pagination, sorting and predicates from a Filter
+//are applied to a list of projects or domains.
+type listQuery struct {
+	//Table containing the listed objects (must have columns id, uuid, name).
+	Table string
+	//Query yielding one row with the columns owner_id, quota, usage for each
+	//resource of each listed object. May contain the Filter's placeholders.
+	ResourcesQuery string
+}
+
+var projectListQuery = listQuery{
+	Table: "projects",
+	ResourcesQuery: `
+		SELECT ps.project_id AS owner_id, pr.quota AS quota, pr.usage AS usage
+		  FROM project_services ps
+		  JOIN project_resources pr ON pr.service_id = ps.id {{AND ps.type = $service_type}} {{AND pr.name = $resource_name}}
+	`,
+}
+
+var domainListQuery = listQuery{
+	Table: "domains",
+	ResourcesQuery: `
+		SELECT ds.domain_id AS owner_id, dr.quota AS quota, COALESCE(SUM(pr.usage), 0) AS usage
+		  FROM domain_services ds
+		  JOIN domain_resources dr ON dr.service_id = ds.id {{AND ds.type = $service_type}} {{AND dr.name = $resource_name}}
+		  LEFT OUTER JOIN projects p ON p.domain_id = ds.domain_id
+		  LEFT OUTER JOIN project_services ps ON ps.project_id = p.id AND ps.type = ds.type
+		  LEFT OUTER JOIN project_resources pr ON pr.service_id = ps.id AND pr.name = dr.name
+		 GROUP BY ds.domain_id, ds.type, dr.name, dr.quota
+	`,
+}
+
+//This aggregates the resources of each object into the values that can be
+//sorted by. (ReadFilter ensures that "usage" is only sorted by when a single
+//resource is selected, so the SUM() does not mix different units.)
+var listQueryStatsQuery = `
+	SELECT owner_id, SUM(usage) AS usage,
+	       MAX(CASE WHEN quota > 0 THEN CAST(usage AS DOUBLE PRECISION) / quota ELSE NULL END) AS usage_ratio
+	  FROM (%s) r GROUP BY owner_id
+`
+
+var listQuerySortExpressions = map[string]string{
+	"":            "o.uuid",
+	"name":        "o.name",
+	"usage":       "CAST(COALESCE(s.usage, 0) AS DOUBLE PRECISION)",
+	"usage_ratio": "COALESCE(s.usage_ratio, 0)",
+}
+
+//isPaginated returns whether any of the list-only options in this Filter is
+//set. If not, listing does not need to go through listQuery.
+func (f Filter) isPaginated() bool {
+	return f.limit > 0 || f.marker != "" || f.sortKey != "" ||
+		f.usageRatioGt != nil || f.usageRatioLt != nil || f.quotaGtUsage || f.usageGtQuota
+}
+
+//queryBuilder assembles a SQL query from multiple fragments while keeping
+//track of the placeholders used in them.
+type queryBuilder struct {
+	args []interface{}
+}
+
+func (b *queryBuilder) addFiltered(f Filter, query string) string {
+	query, args := f.prepareQueryWithOffset(query, len(b.args))
+	b.args = append(b.args, args...)
+	return query
+}
+
+func (b *queryBuilder) addWhere(fields map[string]interface{}) string {
+	whereStr, args := db.BuildSimpleWhereClause(fields, len(b.args))
+	b.args = append(b.args, args...)
+	return whereStr
+}
+
+func (b *queryBuilder) addArg(value interface{}) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+//FindPage returns the UUIDs of the objects that match the given fields as well
+//as the predicates in the Filter, in the order requested by the Filter, and
+//restricted to the page designated by the Filter's limit and marker.
+func (q listQuery) FindPage(dbi db.Interface, f Filter, fields map[string]interface{}) ([]string, error) {
+	sortExpr := listQuerySortExpressions[f.sortKey]
+	direction := "ASC"
+	comparison := ">"
+	if f.sortDesc {
+		direction = "DESC"
+		comparison = "<"
+	}
+
+	var b queryBuilder
+	query := fmt.Sprintf("SELECT o.uuid FROM %s o LEFT OUTER JOIN (%s) s ON s.owner_id = o.id WHERE %s",
+		q.Table,
+		fmt.Sprintf(listQueryStatsQuery, b.addFiltered(f, q.ResourcesQuery)),
+		b.addWhere(fields),
+	)
+
+	//predicates: at least one resource must satisfy all of them
+	if f.usageRatioGt != nil || f.usageRatioLt != nil || f.quotaGtUsage || f.usageGtQuota {
+		//NOTE: The resources subquery must be added before the predicates to
+		//keep the placeholders in the order in which they appear in the query.
+		query += fmt.Sprintf(" AND EXISTS (SELECT 1 FROM (%s) r WHERE r.owner_id = o.id", b.addFiltered(f, q.ResourcesQuery))
+		if f.usageRatioGt != nil {
+			query += " AND r.quota > 0 AND r.usage > r.quota * CAST(" + b.addArg(*f.usageRatioGt) + " AS DOUBLE PRECISION)"
+		}
+		if f.usageRatioLt != nil {
+			query += " AND r.quota > 0 AND r.usage < r.quota * CAST(" + b.addArg(*f.usageRatioLt) + " AS DOUBLE PRECISION)"
+		}
+		if f.quotaGtUsage {
+			query += " AND r.quota > r.usage"
+		}
+		if f.usageGtQuota {
+			query += " AND r.usage > r.quota"
+		}
+		query += ")"
+	}
+
+	//marker: continue after the object with the given UUID (the marker is
+	//looked up even when sorting by UUID, so that unknown markers are reported
+	//as ErrInvalidMarker regardless of the sort order)
+	if f.marker != "" {
+		markerValue, err := q.findSortValue(dbi, f, fields, sortExpr)
+		if err != nil {
+			return nil, err
+		}
+		if f.sortKey == "" {
+			query += fmt.Sprintf(" AND o.uuid %s %s", comparison, b.addArg(f.marker))
+		} else {
+			valueStr := b.addArg(markerValue)
+			query += fmt.Sprintf(" AND (%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND o.uuid %[2]s %[4]s))",
+				sortExpr, comparison, valueStr, b.addArg(f.marker),
+			)
+		}
+	}
+
+	query += fmt.Sprintf(" ORDER BY %s %s", sortExpr, direction)
+	if f.sortKey != "" {
+		query += ", o.uuid " + direction
+	}
+	if f.limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", f.limit)
+	}
+
+	var uuids []string
+	err := db.ForeachRow(dbi, query, b.args, func(rows *sql.Rows) error {
+		var uuid string
+		err := rows.Scan(&uuid)
+		uuids = append(uuids, uuid)
+		return err
+	})
+	return uuids, err
+}
+
+//findUUIDs returns the UUIDs selected by the given query.
+func findUUIDs(dbi db.Interface, query string, args ...interface{}) ([]string, error) {
+	var uuids []string
+	err := db.ForeachRow(dbi, query, args, func(rows *sql.Rows) error {
+		var uuid string
+		err := rows.Scan(&uuid)
+		uuids = append(uuids, uuid)
+		return err
+	})
+	return uuids, err
+}
+
+//foreachBatch splits the given list of UUIDs into batches of at most the given
+//size, and calls the callback for each batch.
+func foreachBatch(uuids []string, batchSize int, callback func([]string) error) error {
+	for len(uuids) > 0 {
+		batch := uuids
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		uuids = uuids[len(batch):]
+		err := callback(batch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//findSortValue returns the value of the sort expression for the object
+//designated by the marker, or ErrInvalidMarker if there is no such object.
+func (q listQuery) findSortValue(dbi db.Interface, f Filter, fields map[string]interface{}, sortExpr string) (interface{}, error) {
+	var b queryBuilder
+	query := fmt.Sprintf("SELECT %s FROM %s o LEFT OUTER JOIN (%s) s ON s.owner_id = o.id WHERE %s AND o.uuid = ",
+		sortExpr, q.Table,
+		fmt.Sprintf(listQueryStatsQuery, b.addFiltered(f, q.ResourcesQuery)),
+		b.addWhere(fields),
+	)
+	query += b.addArg(f.marker)
+
+	var (
+		err         error
+		stringValue string
+		floatValue  float64
+	)
+	isString := f.sortKey == "" || f.sortKey == "name"
+	if isString {
+		err = dbi.QueryRow(query, b.args...).Scan(&stringValue)
+	} else {
+		err = dbi.QueryRow(query, b.args...).Scan(&floatValue)
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrInvalidMarker
+	case err != nil:
+		return nil, err
+	case isString:
+		return stringValue, nil
+	default:
+		return floatValue, nil
+	}
+}
@@ -20,6 +20,7 @@
 package reports
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"sort"
@@ -36,6 +37,7 @@ type Project struct {
 	UUID       string          `json:"id"`
 	Name       string          `json:"name"`
 	ParentUUID string          `json:"parent_id"`
+	Template   string          `json:"template,omitempty"`
 	Services   ProjectServices `json:"services,keepempty"`
 }
 
@@ -43,8 +45,34 @@ type Project struct {
 //a single backend service.
 type ProjectService struct {
 	limes.ServiceInfo
-	Resources ProjectResources `json:"resources,keepempty"`
-	ScrapedAt int64            `json:"scraped_at,omitempty"`
+	Resources   ProjectResources `json:"resources,keepempty"`
+	ScrapedAt   int64            `json:"scraped_at,omitempty"`
+	ScrapeError *ScrapeError     `json:"scrape_error,omitempty"`
+}
+
+//ScrapeError is a substructure of ProjectService containing the most recent
+//error that occurred while scraping this service, if no scrape has succeeded
+//since then.
+type ScrapeError struct {
+	Message             string `json:"message"`
+	FailedAt            int64  `json:"failed_at"`
+	ConsecutiveFailures uint64 `json:"consecutive_failures"`
+}
+
+//newScrapeError builds a ScrapeError from the respective columns of the
+//project_services table, or returns nil if there was no scrape error.
+func newScrapeError(message *string, failedAt *util.Time, consecutiveFailures *uint64) *ScrapeError {
+	if consecutiveFailures == nil || *consecutiveFailures == 0 {
+		return nil
+	}
+	result := &ScrapeError{ConsecutiveFailures: *consecutiveFailures}
+	if message != nil {
+		result.Message = *message
+	}
+	if failedAt != nil {
+		result.FailedAt = time.Time(*failedAt).Unix()
+	}
+	return result
 }
 
 //ProjectResource is a substructure of Project containing data for
@@ -53,9 +81,12 @@ type ProjectResource struct {
 	limes.ResourceInfo
 	Quota uint64 `json:"quota,keepempty"`
 	Usage uint64 `json:"usage,keepempty"`
-	//This is a pointer to a value to enable precise control over whether this field is rendered in output.
-	BackendQuota *int64          `json:"backend_quota,omitempty"`
-	Subresources util.JSONString `json:"subresources,omitempty"`
+	//These are pointers to values to enable precise control over whether this field is rendered in output.
+	ChildrenQuota    *uint64         `json:"children_quota,omitempty"`
+	BackendQuota     *int64          `json:"backend_quota,omitempty"`
+	QuotaExpiresAt   *int64          `json:"quota_expires_at,omitempty"`
+	QuotaAfterExpiry *uint64         `json:"quota_after_expiry,omitempty"`
+	Subresources     util.JSONString `json:"subresources,omitempty"`
 }
 
 //ProjectServices provides fast lookup of services using a map, but serializes
@@ -97,11 +128,23 @@ func (r ProjectResources) MarshalJSON() ([]byte, error) {
 }
 
 var projectReportQuery = `
-	SELECT p.uuid, p.name, COALESCE(p.parent_uuid, ''), ps.type, ps.scraped_at, pr.name, pr.quota, pr.usage, pr.backend_quota, pr.subresources
+	SELECT p.uuid, p.name, COALESCE(p.parent_uuid, ''), p.template, ps.type, ps.scraped_at,
+	       ps.scrape_error_message, ps.scrape_error_at, ps.consecutive_scrape_failures, pr.name, pr.quota, pr.usage, pr.backend_quota, g.expires_at, g.previous_quota, pr.subresources
 	  FROM projects p
 	  LEFT OUTER JOIN project_services ps ON ps.project_id = p.id {{AND ps.type = $service_type}}
 	  LEFT OUTER JOIN project_resources pr ON pr.service_id = ps.id {{AND pr.name = $resource_name}}
+	  LEFT OUTER JOIN project_quota_grants g ON g.service_id = pr.service_id AND g.resource_name = pr.name
+	 WHERE %s
+`
+
+var projectReportChildrenQuery = db.ProjectSubtreesQuery + `
+	SELECT p.uuid, ps.type, pr.name, SUM(pr.quota)
+	  FROM projects p
+	  JOIN project_subtrees s ON s.root_id = p.id
+	  JOIN project_services ps ON ps.project_id = s.project_id {{AND ps.type = $service_type}}
+	  JOIN project_resources pr ON pr.service_id = ps.id {{AND pr.name = $resource_name}}
 	 WHERE %s
+	 GROUP BY p.uuid, ps.type, pr.name
 `
 
 //GetProjects returns Project reports for all projects in the given domain or,
@@ -112,6 +155,55 @@ func GetProjects(cluster *limes.Cluster, domainID int64, projectID *int64, dbi d
 		fields["p.id"] = *projectID
 	}
 
+	//when listing, find the requested page of projects first
+	var pageUUIDs []string
+	if projectID == nil && filter.isPaginated() {
+		var err error
+		pageUUIDs, err = projectListQuery.FindPage(dbi, filter, map[string]interface{}{"o.domain_id": domainID})
+		if err != nil {
+			return nil, err
+		}
+		if len(pageUUIDs) == 0 {
+			return []*Project{}, nil
+		}
+		fields["p.uuid"] = pageUUIDs
+	}
+
+	return getProjects(cluster, fields, pageUUIDs, dbi, filter, withSubresources)
+}
+
+//ForeachProjectBatch is like GetProjects for all projects in the given domain,
+//but instead of returning all Project reports at once, it loads them in
+//batches of the given size and calls the callback for each batch (in the
+//order in which GetProjects would return them). This is used to stream large
+//reports to the client without building them up in memory.
+func ForeachProjectBatch(cluster *limes.Cluster, domainID int64, dbi db.Interface, filter Filter, withSubresources bool, batchSize int, callback func([]*Project) error) error {
+	var (
+		uuids []string
+		err   error
+	)
+	if filter.isPaginated() {
+		uuids, err = projectListQuery.FindPage(dbi, filter, map[string]interface{}{"o.domain_id": domainID})
+	} else {
+		uuids, err = findUUIDs(dbi, `SELECT uuid FROM projects WHERE domain_id = $1 ORDER BY uuid`, domainID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return foreachBatch(uuids, batchSize, func(batch []string) error {
+		fields := map[string]interface{}{"p.domain_id": domainID, "p.uuid": batch}
+		projects, err := getProjects(cluster, fields, batch, dbi, filter, withSubresources)
+		if err != nil {
+			return err
+		}
+		return callback(projects)
+	})
+}
+
+//getProjects is the implementation of GetProjects and ForeachProjectBatch.
+//If pageUUIDs is not nil, the result is ordered accordingly.
+func getProjects(cluster *limes.Cluster, fields map[string]interface{}, pageUUIDs []string, dbi db.Interface, filter Filter, withSubresources bool) ([]*Project, error) {
 	//avoid collecting the potentially large subresources strings when possible
 	queryStr := projectReportQuery
 	if !withSubresources {
@@ -131,18 +223,24 @@ func GetProjects(cluster *limes.Cluster, domainID int64, projectID *int64, dbi d
 			projectUUID       string
 			projectName       string
 			projectParentUUID string
+			projectTemplate   string
 			serviceType       *string
 			scrapedAt         *util.Time
+			scrapeErrorMsg    *string
+			scrapeErrorAt     *util.Time
+			scrapeFailures    *uint64
 			resourceName      *string
 			quota             *uint64
 			usage             *uint64
 			backendQuota      *int64
+			quotaExpiresAt    *util.Time
+			quotaAfterExpiry  *uint64
 			subresources      string
 		)
 		err := rows.Scan(
-			&projectUUID, &projectName, &projectParentUUID,
-			&serviceType, &scrapedAt, &resourceName,
-			&quota, &usage, &backendQuota, &subresources,
+			&projectUUID, &projectName, &projectParentUUID, &projectTemplate,
+			&serviceType, &scrapedAt, &scrapeErrorMsg, &scrapeErrorAt, &scrapeFailures, &resourceName,
+			&quota, &usage, &backendQuota, &quotaExpiresAt, &quotaAfterExpiry, &subresources,
 		)
 		if err != nil {
 			rows.Close()
@@ -155,6 +253,7 @@ func GetProjects(cluster *limes.Cluster, domainID int64, projectID *int64, dbi d
 				UUID:       projectUUID,
 				Name:       projectName,
 				ParentUUID: projectParentUUID,
+				Template:   projectTemplate,
 				Services:   make(ProjectServices),
 			}
 			projects[projectUUID] = project
@@ -176,6 +275,7 @@ func GetProjects(cluster *limes.Cluster, domainID int64, projectID *int64, dbi d
 			if scrapedAt != nil {
 				service.ScrapedAt = time.Time(*scrapedAt).Unix()
 			}
+			service.ScrapeError = newScrapeError(scrapeErrorMsg, scrapeErrorAt, scrapeFailures)
 			project.Services[*serviceType] = service
 		}
 
@@ -201,6 +301,11 @@ func GetProjects(cluster *limes.Cluster, domainID int64, projectID *int64, dbi d
 				resource.BackendQuota = backendQuota
 			}
 		}
+		if quotaExpiresAt != nil {
+			expiresAt := time.Time(*quotaExpiresAt).Unix()
+			resource.QuotaExpiresAt = &expiresAt
+			resource.QuotaAfterExpiry = quotaAfterExpiry
+		}
 		service.Resources[*resourceName] = resource
 	}
 	err = rows.Err()
@@ -213,15 +318,56 @@ func GetProjects(cluster *limes.Cluster, domainID int64, projectID *int64, dbi d
 		return nil, err
 	}
 
-	//flatten result (with stable order to keep the tests happy)
-	uuids := make([]string, 0, len(projects))
-	for uuid := range projects {
-		uuids = append(uuids, uuid)
+	//second query: add the quota sums of all projects in their subtree for all
+	//top-level projects
+	queryStr, joinArgs = filter.PrepareQuery(projectReportChildrenQuery)
+	whereStr, whereArgs = db.BuildSimpleWhereClause(fields, len(joinArgs))
+	err = db.ForeachRow(dbi, fmt.Sprintf(queryStr, whereStr), append(joinArgs, whereArgs...), func(rows *sql.Rows) error {
+		var (
+			projectUUID   string
+			serviceType   string
+			resourceName  string
+			childrenQuota uint64
+		)
+		err := rows.Scan(&projectUUID, &serviceType, &resourceName, &childrenQuota)
+		if err != nil {
+			return err
+		}
+
+		project, exists := projects[projectUUID]
+		if !exists {
+			return nil
+		}
+		service, exists := project.Services[serviceType]
+		if !exists {
+			return nil
+		}
+		resource, exists := service.Resources[resourceName]
+		if exists {
+			resource.ChildrenQuota = &childrenQuota
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//flatten result (in the order of the requested page, or with stable order
+	//to keep the tests happy)
+	uuids := pageUUIDs
+	if uuids == nil {
+		uuids = make([]string, 0, len(projects))
+		for uuid := range projects {
+			uuids = append(uuids, uuid)
+		}
+		sort.Strings(uuids)
 	}
-	sort.Strings(uuids)
-	result := make([]*Project, len(projects))
-	for idx, uuid := range uuids {
-		result[idx] = projects[uuid]
+	result := make([]*Project, 0, len(projects))
+	for _, uuid := range uuids {
+		//(projects on the requested page might have been deleted in the meantime)
+		if project, exists := projects[uuid]; exists {
+			result = append(result, project)
+		}
 	}
 
 	return result, nil
@@ -0,0 +1,222 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package reports
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//QuotaRequest contains all data about a quota request for a project or domain.
+type QuotaRequest struct {
+	ID              int64                `json:"id"`
+	DomainUUID      string               `json:"domain_id"`
+	ProjectUUID     string               `json:"project_id,omitempty"`
+	State           string               `json:"state"`
+	Comment         string               `json:"comment,omitempty"`
+	RequestedAt     int64                `json:"requested_at"`
+	Requester       QuotaRequestUser     `json:"requester"`
+	DecidedAt       int64                `json:"decided_at,omitempty"`
+	Decider         *QuotaRequestUser    `json:"decider,omitempty"`
+	DecisionComment string               `json:"decision_comment,omitempty"`
+	Services        QuotaRequestServices `json:"services,keepempty"`
+}
+
+//QuotaRequestUser is a substructure of QuotaRequest identifying the user who
+//filed or decided the request.
+type QuotaRequestUser struct {
+	UUID string `json:"id"`
+	Name string `json:"name"`
+}
+
+//QuotaRequestService is a substructure of QuotaRequest containing the
+//requested quotas for a single backend service.
+type QuotaRequestService struct {
+	Type      string                `json:"type"`
+	Resources QuotaRequestResources `json:"resources,keepempty"`
+}
+
+//QuotaRequestResource is a substructure of QuotaRequest containing the
+//requested quota for a single resource.
+type QuotaRequestResource struct {
+	limes.ResourceInfo
+	Quota uint64 `json:"quota,keepempty"`
+}
+
+//QuotaRequestServices provides fast lookup of services using a map, but
+//serializes to JSON as a list.
+type QuotaRequestServices map[string]*QuotaRequestService
+
+//MarshalJSON implements the json.Marshaler interface.
+func (s QuotaRequestServices) MarshalJSON() ([]byte, error) {
+	//serialize with ordered keys to ensure testcase stability
+	types := make([]string, 0, len(s))
+	for typeStr := range s {
+		types = append(types, typeStr)
+	}
+	sort.Strings(types)
+	list := make([]*QuotaRequestService, len(s))
+	for idx, typeStr := range types {
+		list[idx] = s[typeStr]
+	}
+	return json.Marshal(list)
+}
+
+//QuotaRequestResources provides fast lookup of resources using a map, but
+//serializes to JSON as a list.
+type QuotaRequestResources map[string]*QuotaRequestResource
+
+//MarshalJSON implements the json.Marshaler interface.
+func (r QuotaRequestResources) MarshalJSON() ([]byte, error) {
+	//serialize with ordered keys to ensure testcase stability
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*QuotaRequestResource, len(r))
+	for idx, name := range names {
+		list[idx] = r[name]
+	}
+	return json.Marshal(list)
+}
+
+//QuotaRequestFilter selects the quota requests returned by GetQuotaRequests.
+//Fields that are nil or empty do not restrict the result.
+type QuotaRequestFilter struct {
+	DomainID  *int64
+	ProjectID *int64
+	RequestID *int64
+	States    []string
+}
+
+var quotaRequestReportQuery = `
+	SELECT r.id, d.uuid, COALESCE(p.uuid, ''), r.state, r.comment,
+	       r.requested_at, r.requester_uuid, r.requester_name,
+	       r.decided_at, r.decider_uuid, r.decider_name, r.decision_comment,
+	       rr.service_type, rr.name, rr.quota
+	  FROM quota_requests r
+	  JOIN domains d ON d.id = r.domain_id
+	  LEFT OUTER JOIN projects p ON p.id = r.project_id
+	  LEFT OUTER JOIN quota_request_resources rr ON rr.request_id = r.id
+	 WHERE %s
+	 ORDER BY r.id
+`
+
+//GetQuotaRequests returns QuotaRequest reports for all quota requests in the
+//given cluster that match the given filter, ordered by ID.
+func GetQuotaRequests(cluster *limes.Cluster, dbi db.Interface, filter QuotaRequestFilter) ([]*QuotaRequest, error) {
+	fields := map[string]interface{}{"d.cluster_id": cluster.ID}
+	if filter.DomainID != nil {
+		fields["r.domain_id"] = *filter.DomainID
+	}
+	if filter.ProjectID != nil {
+		fields["r.project_id"] = *filter.ProjectID
+	}
+	if filter.RequestID != nil {
+		fields["r.id"] = *filter.RequestID
+	}
+	if len(filter.States) > 0 {
+		fields["r.state"] = filter.States
+	}
+
+	var (
+		requests []*QuotaRequest
+		byID     = make(map[int64]*QuotaRequest)
+	)
+	whereStr, whereArgs := db.BuildSimpleWhereClause(fields, 0)
+	err := db.ForeachRow(dbi, fmt.Sprintf(quotaRequestReportQuery, whereStr), whereArgs, func(rows *sql.Rows) error {
+		var (
+			dbRequest    db.QuotaRequest
+			domainUUID   string
+			projectUUID  string
+			requestedAt  util.Time
+			decidedAt    *util.Time
+			serviceType  *string
+			resourceName *string
+			quota        *uint64
+		)
+		err := rows.Scan(
+			&dbRequest.ID, &domainUUID, &projectUUID, &dbRequest.State, &dbRequest.Comment,
+			&requestedAt, &dbRequest.RequesterUUID, &dbRequest.RequesterName,
+			&decidedAt, &dbRequest.DeciderUUID, &dbRequest.DeciderName, &dbRequest.DecisionComment,
+			&serviceType, &resourceName, &quota,
+		)
+		if err != nil {
+			return err
+		}
+
+		request, exists := byID[dbRequest.ID]
+		if !exists {
+			request = &QuotaRequest{
+				ID:          dbRequest.ID,
+				DomainUUID:  domainUUID,
+				ProjectUUID: projectUUID,
+				State:       dbRequest.State,
+				Comment:     dbRequest.Comment,
+				RequestedAt: time.Time(requestedAt).Unix(),
+				Requester: QuotaRequestUser{
+					UUID: dbRequest.RequesterUUID,
+					Name: dbRequest.RequesterName,
+				},
+				DecisionComment: dbRequest.DecisionComment,
+				Services:        make(QuotaRequestServices),
+			}
+			if decidedAt != nil {
+				request.DecidedAt = time.Time(*decidedAt).Unix()
+				request.Decider = &QuotaRequestUser{
+					UUID: dbRequest.DeciderUUID,
+					Name: dbRequest.DeciderName,
+				}
+			}
+			byID[dbRequest.ID] = request
+			requests = append(requests, request)
+		}
+
+		if serviceType == nil || resourceName == nil || quota == nil {
+			return nil
+		}
+		if !cluster.HasResource(*serviceType, *resourceName) {
+			return nil
+		}
+
+		service, exists := request.Services[*serviceType]
+		if !exists {
+			service = &QuotaRequestService{
+				Type:      *serviceType,
+				Resources: make(QuotaRequestResources),
+			}
+			request.Services[*serviceType] = service
+		}
+		service.Resources[*resourceName] = &QuotaRequestResource{
+			ResourceInfo: cluster.InfoForResource(*serviceType, *resourceName),
+			Quota:        *quota,
+		}
+		return nil
+	})
+	return requests, err
+}
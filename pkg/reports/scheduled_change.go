@@ -0,0 +1,157 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package reports
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//ScheduledChange contains all data about a scheduled quota change for a
+//project or domain. The structure of the requested quotas is shared with
+//QuotaRequest.
+type ScheduledChange struct {
+	ID           int64                `json:"id"`
+	DomainUUID   string               `json:"domain_id"`
+	ProjectUUID  string               `json:"project_id,omitempty"`
+	State        string               `json:"state"`
+	Comment      string               `json:"comment,omitempty"`
+	DueAt        int64                `json:"due_at"`
+	CreatedAt    int64                `json:"created_at"`
+	Creator      QuotaRequestUser     `json:"creator"`
+	ProcessedAt  int64                `json:"processed_at,omitempty"`
+	ErrorMessage string               `json:"error,omitempty"`
+	Services     QuotaRequestServices `json:"services,keepempty"`
+}
+
+//ScheduledChangeFilter selects the scheduled changes returned by
+//GetScheduledChanges. Fields that are nil or empty do not restrict the result.
+type ScheduledChangeFilter struct {
+	DomainID *int64
+	ChangeID *int64
+	States   []string
+}
+
+var scheduledChangeReportQuery = `
+	SELECT c.id, d.uuid, COALESCE(p.uuid, ''), c.state, c.comment,
+	       c.due_at, c.created_at, c.creator_uuid, c.creator_name,
+	       c.processed_at, c.error_message,
+	       cr.service_type, cr.name, cr.quota
+	  FROM scheduled_changes c
+	  JOIN domains d ON d.id = c.domain_id
+	  LEFT OUTER JOIN projects p ON p.id = c.project_id
+	  LEFT OUTER JOIN scheduled_change_resources cr ON cr.change_id = c.id
+	 WHERE %s
+	 ORDER BY c.due_at, c.id
+`
+
+//GetScheduledChanges returns ScheduledChange reports for all scheduled changes
+//in the given cluster that match the given filter, ordered by due date.
+func GetScheduledChanges(cluster *limes.Cluster, dbi db.Interface, filter ScheduledChangeFilter) ([]*ScheduledChange, error) {
+	fields := map[string]interface{}{"d.cluster_id": cluster.ID}
+	if filter.DomainID != nil {
+		fields["c.domain_id"] = *filter.DomainID
+	}
+	if filter.ChangeID != nil {
+		fields["c.id"] = *filter.ChangeID
+	}
+	if len(filter.States) > 0 {
+		fields["c.state"] = filter.States
+	}
+
+	var (
+		changes []*ScheduledChange
+		byID    = make(map[int64]*ScheduledChange)
+	)
+	whereStr, whereArgs := db.BuildSimpleWhereClause(fields, 0)
+	err := db.ForeachRow(dbi, fmt.Sprintf(scheduledChangeReportQuery, whereStr), whereArgs, func(rows *sql.Rows) error {
+		var (
+			dbChange     db.ScheduledChange
+			domainUUID   string
+			projectUUID  string
+			dueAt        util.Time
+			createdAt    util.Time
+			processedAt  *util.Time
+			serviceType  *string
+			resourceName *string
+			quota        *uint64
+		)
+		err := rows.Scan(
+			&dbChange.ID, &domainUUID, &projectUUID, &dbChange.State, &dbChange.Comment,
+			&dueAt, &createdAt, &dbChange.CreatorUUID, &dbChange.CreatorName,
+			&processedAt, &dbChange.ErrorMessage,
+			&serviceType, &resourceName, &quota,
+		)
+		if err != nil {
+			return err
+		}
+
+		change, exists := byID[dbChange.ID]
+		if !exists {
+			change = &ScheduledChange{
+				ID:          dbChange.ID,
+				DomainUUID:  domainUUID,
+				ProjectUUID: projectUUID,
+				State:       dbChange.State,
+				Comment:     dbChange.Comment,
+				DueAt:       time.Time(dueAt).Unix(),
+				CreatedAt:   time.Time(createdAt).Unix(),
+				Creator: QuotaRequestUser{
+					UUID: dbChange.CreatorUUID,
+					Name: dbChange.CreatorName,
+				},
+				ErrorMessage: dbChange.ErrorMessage,
+				Services:     make(QuotaRequestServices),
+			}
+			if processedAt != nil {
+				change.ProcessedAt = time.Time(*processedAt).Unix()
+			}
+			byID[dbChange.ID] = change
+			changes = append(changes, change)
+		}
+
+		if serviceType == nil || resourceName == nil || quota == nil {
+			return nil
+		}
+		if !cluster.HasResource(*serviceType, *resourceName) {
+			return nil
+		}
+
+		service, exists := change.Services[*serviceType]
+		if !exists {
+			service = &QuotaRequestService{
+				Type:      *serviceType,
+				Resources: make(QuotaRequestResources),
+			}
+			change.Services[*serviceType] = service
+		}
+		service.Resources[*resourceName] = &QuotaRequestResource{
+			ResourceInfo: cluster.InfoForResource(*serviceType, *resourceName),
+			Quota:        *quota,
+		}
+		return nil
+	})
+	return changes, err
+}
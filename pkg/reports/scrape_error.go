@@ -0,0 +1,81 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package reports
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/util"
+)
+
+//ProjectScrapeError describes a project service in a cluster whose most
+//recent scrape failed.
+type ProjectScrapeError struct {
+	DomainUUID  string `json:"domain_id"`
+	DomainName  string `json:"domain_name"`
+	ProjectUUID string `json:"project_id"`
+	ProjectName string `json:"project_name"`
+	ServiceType string `json:"service_type"`
+	ScrapedAt   int64  `json:"scraped_at,omitempty"`
+	ScrapeError
+}
+
+var scrapeErrorReportQuery = `
+	SELECT d.uuid, d.name, p.uuid, p.name, ps.type, ps.scraped_at,
+	       ps.scrape_error_message, ps.scrape_error_at, ps.consecutive_scrape_failures
+	  FROM domains d
+	  JOIN projects p ON p.domain_id = d.id
+	  JOIN project_services ps ON ps.project_id = p.id
+	 WHERE d.cluster_id = $1 AND ps.consecutive_scrape_failures > 0
+	 ORDER BY d.name, p.name, ps.type
+`
+
+//GetScrapeErrors returns ProjectScrapeError reports for all project services
+//in the given cluster whose most recent scrape failed.
+func GetScrapeErrors(cluster *limes.Cluster, dbi db.Interface) ([]*ProjectScrapeError, error) {
+	result := []*ProjectScrapeError{}
+	err := db.ForeachRow(dbi, scrapeErrorReportQuery, []interface{}{cluster.ID}, func(rows *sql.Rows) error {
+		var (
+			report    ProjectScrapeError
+			scrapedAt *util.Time
+			failedAt  *util.Time
+		)
+		err := rows.Scan(
+			&report.DomainUUID, &report.DomainName, &report.ProjectUUID, &report.ProjectName,
+			&report.ServiceType, &scrapedAt,
+			&report.Message, &failedAt, &report.ConsecutiveFailures,
+		)
+		if err != nil {
+			return err
+		}
+		if scrapedAt != nil {
+			report.ScrapedAt = time.Time(*scrapedAt).Unix()
+		}
+		if failedAt != nil {
+			report.FailedAt = time.Time(*failedAt).Unix()
+		}
+		result = append(result, &report)
+		return nil
+	})
+	return result, err
+}
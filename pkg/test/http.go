@@ -39,6 +39,7 @@ type APIRequest struct {
 	RequestHeader    map[string]string
 	RequestJSON      interface{} //if non-nil, will be encoded as JSON
 	ExpectStatusCode int
+	ExpectHeader     map[string]string
 	ExpectBody       *string //raw content (not a file path)
 	ExpectJSON       string  //path to JSON file
 	ExpectFile       string  //path to arbitrary file
@@ -75,6 +76,14 @@ func (r APIRequest) Check(t *testing.T, handler http.Handler) {
 			r.Method, r.Path, r.ExpectStatusCode, response.StatusCode,
 		)
 	}
+	for key, value := range r.ExpectHeader {
+		actual := response.Header.Get(key)
+		if actual != value {
+			t.Errorf("%s %s: expected %s header to be %#v, got %#v",
+				r.Method, r.Path, key, value, actual,
+			)
+		}
+	}
 
 	switch {
 	case r.ExpectBody != nil:
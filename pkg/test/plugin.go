@@ -35,6 +35,7 @@ type Plugin struct {
 	OverrideQuota      map[string]map[string]uint64
 	//behavior flags that can be set by a unit test
 	SetQuotaFails bool
+	ScrapeFails   bool
 }
 
 var resources = []limes.ResourceInfo{
@@ -83,6 +84,10 @@ func (p *Plugin) Resources() []limes.ResourceInfo {
 
 //Scrape implements the limes.QuotaPlugin interface.
 func (p *Plugin) Scrape(provider *gophercloud.ProviderClient, domainUUID, projectUUID string) (map[string]limes.ResourceData, error) {
+	if p.ScrapeFails {
+		return nil, errors.New("Scrape failed as requested")
+	}
+
 	result := make(map[string]limes.ResourceData)
 	for key, val := range p.StaticResourceData {
 		result[key] = *val
@@ -124,6 +129,51 @@ func (p *Plugin) SetQuota(provider *gophercloud.ProviderClient, domainUUID, proj
 	return nil
 }
 
+//BulkPlugin is a limes.BulkQuotaPlugin implementation for unit tests. It
+//reports the same data as Plugin, but ScrapeAll() only reports the projects
+//listed in BulkProjectUUIDs.
+type BulkPlugin struct {
+	*Plugin
+	BulkProjectUUIDs []string
+	//behavior flags that can be set by a unit test
+	ScrapeAllFails bool
+	//call records that can be inspected by a unit test
+	ScrapeAllCalls      int
+	ScrapedProjectUUIDs []string
+}
+
+//NewBulkPlugin creates a new BulkPlugin for the given service type.
+func NewBulkPlugin(serviceType string, bulkProjectUUIDs ...string) *BulkPlugin {
+	return &BulkPlugin{
+		Plugin:           NewPlugin(serviceType),
+		BulkProjectUUIDs: bulkProjectUUIDs,
+	}
+}
+
+//Scrape implements the limes.QuotaPlugin interface.
+func (p *BulkPlugin) Scrape(provider *gophercloud.ProviderClient, domainUUID, projectUUID string) (map[string]limes.ResourceData, error) {
+	p.ScrapedProjectUUIDs = append(p.ScrapedProjectUUIDs, projectUUID)
+	return p.Plugin.Scrape(provider, domainUUID, projectUUID)
+}
+
+//ScrapeAll implements the limes.BulkQuotaPlugin interface.
+func (p *BulkPlugin) ScrapeAll(provider *gophercloud.ProviderClient) (map[string]map[string]limes.ResourceData, error) {
+	p.ScrapeAllCalls++
+	if p.ScrapeAllFails {
+		return nil, errors.New("ScrapeAll failed as requested")
+	}
+
+	result := make(map[string]map[string]limes.ResourceData)
+	for _, projectUUID := range p.BulkProjectUUIDs {
+		data, err := p.Plugin.Scrape(provider, "", projectUUID)
+		if err != nil {
+			return nil, err
+		}
+		result[projectUUID] = data
+	}
+	return result, nil
+}
+
 //CapacityPlugin is a limes.CapacityPlugin implementation for unit tests.
 type CapacityPlugin struct {
 	PluginID  string
@@ -0,0 +1,98 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//Secret is a configuration value that contains a credential. In the
+//configuration file, it can be given either as a plain string, or indirectly
+//by referring to an environment variable or a file:
+//
+//	password: swordfish
+//	password: { fromEnv: LIMES_OS_PASSWORD }
+//	password: { fromFile: /run/secrets/os-password }
+//
+//Indirect values are only read when Resolve() is called.
+type Secret struct {
+	Value    string `yaml:"-"`
+	FromEnv  string `yaml:"fromEnv"`
+	FromFile string `yaml:"fromFile"`
+}
+
+//UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Secret) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	//plain string?
+	var value string
+	if unmarshal(&value) == nil {
+		*s = Secret{Value: value}
+		return nil
+	}
+
+	//otherwise, it must be a reference
+	var ref struct {
+		FromEnv  string `yaml:"fromEnv"`
+		FromFile string `yaml:"fromFile"`
+	}
+	err := unmarshal(&ref)
+	if err != nil {
+		return err
+	}
+	if (ref.FromEnv == "") == (ref.FromFile == "") {
+		return errors.New("secret must be a string, or a map with exactly one of the keys \"fromEnv\" and \"fromFile\"")
+	}
+	*s = Secret{FromEnv: ref.FromEnv, FromFile: ref.FromFile}
+	return nil
+}
+
+//IsSet returns whether this Secret has a value, either directly or by
+//reference. This does not require Resolve() to have been called.
+func (s Secret) IsSet() bool {
+	return s.Value != "" || s.FromEnv != "" || s.FromFile != ""
+}
+
+//Resolve reads the Value from the environment variable or file that this
+//Secret refers to. For plain-string Secrets, nothing is done.
+func (s *Secret) Resolve() error {
+	switch {
+	case s.FromEnv != "":
+		value, exists := os.LookupEnv(s.FromEnv)
+		if !exists || value == "" {
+			return fmt.Errorf("environment variable %s is not set", s.FromEnv)
+		}
+		s.Value = value
+	case s.FromFile != "":
+		buf, err := ioutil.ReadFile(s.FromFile)
+		if err != nil {
+			return fmt.Errorf("cannot read secret from file: %s", err.Error())
+		}
+		//files written by editors or `echo` usually end with a newline
+		s.Value = strings.TrimSuffix(string(buf), "\n")
+		if s.Value == "" {
+			return fmt.Errorf("secret file %s is empty", s.FromFile)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package validation
+
+import "fmt"
+
+//Machine-readable reason codes for rejected resource values. These appear in
+//the "reason_code" field of verdicts in the API.
+const (
+	ReasonNoSuchService       = "no_such_service"
+	ReasonNoSuchResource      = "no_such_resource"
+	ReasonInvalidValue        = "invalid_value"
+	ReasonExpiryNotSupported  = "expiry_not_supported"
+	ReasonInvalidExpiry       = "invalid_expiry"
+	ReasonRaiseForbidden      = "raise_forbidden"
+	ReasonLowerForbidden      = "lower_forbidden"
+	ReasonBelowUsage          = "below_usage"
+	ReasonBelowChildQuotas    = "below_child_quotas"
+	ReasonBelowProjectQuotas  = "below_project_quotas"
+	ReasonDomainQuotaExceeded = "domain_quota_exceeded"
+	ReasonParentQuotaExceeded = "parent_quota_exceeded"
+	ReasonParentCycle         = "parent_cycle"
+	ReasonCapacityAutomatic   = "capacity_maintained_automatically"
+	ReasonCommentMissing      = "comment_missing"
+)
+
+//ResourceError is an error concerning the value for a single resource in a
+//PUT request. Besides the human-readable message, it carries a
+//machine-readable reason code and, where applicable, the range of values that
+//would have been acceptable.
+type ResourceError struct {
+	Code          string
+	Message       string
+	MinAcceptable *uint64
+	MaxAcceptable *uint64
+}
+
+//Error implements the builtin/error interface.
+func (e *ResourceError) Error() string {
+	return e.Message
+}
+
+//NewResourceError constructs a ResourceError with the given reason code and
+//a message built from the given format string.
+func NewResourceError(code, msg string, args ...interface{}) *ResourceError {
+	return &ResourceError{Code: code, Message: fmt.Sprintf(msg, args...)}
+}
+
+//WithMinAcceptable records the lowest value that would have been acceptable.
+func (e *ResourceError) WithMinAcceptable(value uint64) *ResourceError {
+	e.MinAcceptable = &value
+	return e
+}
+
+//WithMaxAcceptable records the highest value that would have been acceptable.
+func (e *ResourceError) WithMaxAcceptable(value uint64) *ResourceError {
+	e.MaxAcceptable = &value
+	return e
+}
@@ -0,0 +1,186 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package validation
+
+import (
+	"database/sql"
+
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+)
+
+//ProjectResourceRef identifies a single resource of a single project.
+type ProjectResourceRef struct {
+	ProjectUUID  string
+	ServiceType  string
+	ResourceName string
+}
+
+//ProjectHierarchy contains the parent-child relations between the projects
+//of a single domain, along with their current quotas.
+//
+//Quota delegation is limited to two levels: Each top-level project (i.e. a
+//project whose parent is the domain) can sublease its quota to all projects
+//in its subtree in the same way as domains do to top-level projects, so the
+//quota sum of all projects in the subtree may not exceed the quota of the
+//top-level project. (Projects further down in the subtree do not sublease
+//their quota to their own children; their quota is subleased from the
+//top-level project just like that of their children.)
+type ProjectHierarchy struct {
+	parentOf  map[string]string   //project UUID -> parent project UUID (only if the parent is a project)
+	rootOf    map[string]string   //project UUID -> UUID of top-level project (only for child projects)
+	subtreeOf map[string][]string //UUID of top-level project -> UUIDs of all projects in its subtree (except itself)
+	quotas    map[ProjectResourceRef]uint64
+}
+
+var projectHierarchyQuery = `
+	SELECT p.uuid, COALESCE(parent.uuid, ''), COALESCE(ps.type, ''), COALESCE(pr.name, ''), COALESCE(pr.quota, 0)
+	  FROM projects p
+	  LEFT OUTER JOIN projects parent ON parent.uuid = p.parent_uuid AND parent.domain_id = p.domain_id
+	  LEFT OUTER JOIN project_services ps ON ps.project_id = p.id
+	  LEFT OUTER JOIN project_resources pr ON pr.service_id = ps.id
+	 WHERE p.domain_id = $1
+`
+
+//LoadProjectHierarchy loads the ProjectHierarchy for the given domain.
+func LoadProjectHierarchy(dbi db.Interface, domain *db.Domain) (*ProjectHierarchy, error) {
+	h := &ProjectHierarchy{
+		parentOf:  make(map[string]string),
+		rootOf:    make(map[string]string),
+		subtreeOf: make(map[string][]string),
+		quotas:    make(map[ProjectResourceRef]uint64),
+	}
+	err := db.ForeachRow(dbi, projectHierarchyQuery, []interface{}{domain.ID}, func(rows *sql.Rows) error {
+		var (
+			ref        ProjectResourceRef
+			parentUUID string
+			quota      uint64
+		)
+		err := rows.Scan(&ref.ProjectUUID, &parentUUID, &ref.ServiceType, &ref.ResourceName, &quota)
+		if err != nil {
+			return err
+		}
+		if parentUUID != "" {
+			h.parentOf[ref.ProjectUUID] = parentUUID
+		}
+		//projects without resources (e.g. new projects that have not been
+		//scraped yet) are only recorded with their parent
+		if ref.ResourceName != "" {
+			h.quotas[ref] = quota
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.findRoots()
+	return h, nil
+}
+
+//findRoots finds the top-level project for each child project. Projects whose
+//ancestors form a cycle do not belong to any subtree (see Check).
+func (h *ProjectHierarchy) findRoots() {
+	for projectUUID := range h.parentOf {
+		rootUUID := projectUUID
+		for steps := 0; steps <= len(h.parentOf); steps++ {
+			parentUUID, exists := h.parentOf[rootUUID]
+			if !exists {
+				break
+			}
+			rootUUID = parentUUID
+		}
+		if _, exists := h.parentOf[rootUUID]; !exists {
+			h.rootOf[projectUUID] = rootUUID
+			h.subtreeOf[rootUUID] = append(h.subtreeOf[rootUUID], projectUUID)
+		}
+	}
+}
+
+//IsChildProject returns whether the given project has a parent project. The
+//quota of child projects is subleased from their top-level project, so it
+//does not count towards the domain quota.
+func (h *ProjectHierarchy) IsChildProject(projectUUID string) bool {
+	_, exists := h.parentOf[projectUUID]
+	return exists
+}
+
+//Set records a new quota value for the given project resource. Subsequent
+//checks will be performed against this value.
+func (h *ProjectHierarchy) Set(ref ProjectResourceRef, quota uint64) {
+	h.quotas[ref] = quota
+}
+
+//subtreeQuota returns the quota sum of all projects in the subtree of the
+//given top-level project resource, except for the one with the given UUID.
+func (h *ProjectHierarchy) subtreeQuota(ref ProjectResourceRef, exceptUUID string) uint64 {
+	var sum uint64
+	for _, projectUUID := range h.subtreeOf[ref.ProjectUUID] {
+		if projectUUID != exceptUUID {
+			sum += h.quotas[ProjectResourceRef{projectUUID, ref.ServiceType, ref.ResourceName}]
+		}
+	}
+	return sum
+}
+
+//Check validates a quota change for the given project resource. When the
+//quota of a child project is raised, it is checked against the quota of its
+//top-level project. When the quota of a top-level project is lowered, it is
+//checked against the quotas of the projects in its subtree. The quota of the
+//given project resource is assumed to be newQuota, regardless of which value
+//is currently recorded in the hierarchy.
+//
+//Projects whose ancestors form a cycle have no top-level project to sublease
+//their quota from, but do not count towards the domain quota either (since
+//they have a parent project), so their quotas cannot be raised.
+func (h *ProjectHierarchy) Check(ref ProjectResourceRef, oldQuota, newQuota uint64, unit limes.Unit) error {
+	if newQuota > oldQuota {
+		rootUUID, exists := h.rootOf[ref.ProjectUUID]
+		if !exists {
+			if h.IsChildProject(ref.ProjectUUID) {
+				return NewResourceError(ReasonParentCycle, "cannot raise %s/%s quota: the parent projects of this project form a cycle",
+					ref.ServiceType, ref.ResourceName,
+				)
+			}
+			return nil
+		}
+		rootRef := ProjectResourceRef{rootUUID, ref.ServiceType, ref.ResourceName}
+		rootQuota := h.quotas[rootRef]
+		othersQuota := h.subtreeQuota(rootRef, ref.ProjectUUID)
+		if othersQuota+newQuota > rootQuota {
+			maxQuota := uint64(0)
+			if rootQuota > othersQuota {
+				maxQuota = rootQuota - othersQuota
+			}
+			return NewResourceError(ReasonParentQuotaExceeded, "cannot change %s/%s quota: parent project quota exceeded (maximum acceptable project quota is %s)",
+				ref.ServiceType, ref.ResourceName, unit.Format(maxQuota),
+			).WithMaxAcceptable(maxQuota)
+		}
+		return nil
+	}
+
+	childrenQuota := h.subtreeQuota(ref, "")
+	if newQuota < oldQuota && childrenQuota > newQuota {
+		return NewResourceError(ReasonBelowChildQuotas, "cannot change %s/%s quota: quota may not be lower than sum of child project quotas (%s)",
+			ref.ServiceType, ref.ResourceName, unit.Format(childrenQuota),
+		).WithMinAcceptable(childrenQuota)
+	}
+	return nil
+}
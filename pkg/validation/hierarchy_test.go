@@ -0,0 +1,73 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package validation
+
+import (
+	"testing"
+
+	"github.com/sapcc/limes/pkg/limes"
+)
+
+func Test_ProjectHierarchy_Cycle(t *testing.T) {
+	//"top" is a top-level project with the child "child"; "loop1" and "loop2"
+	//are parents of each other, and "below" is a child of "loop1"
+	h := &ProjectHierarchy{
+		parentOf: map[string]string{
+			"child": "top",
+			"loop1": "loop2",
+			"loop2": "loop1",
+			"below": "loop1",
+		},
+		rootOf:    make(map[string]string),
+		subtreeOf: make(map[string][]string),
+		quotas: map[ProjectResourceRef]uint64{
+			{"top", "shared", "things"}:   10,
+			{"child", "shared", "things"}: 5,
+		},
+	}
+	h.findRoots()
+
+	//regular child projects can be raised up to the quota of their top-level project
+	err := h.Check(ProjectResourceRef{"child", "shared", "things"}, 5, 10, limes.UnitNone)
+	if err != nil {
+		t.Errorf("expected raising child quota to succeed, but got: %s", err.Error())
+	}
+	err = h.Check(ProjectResourceRef{"child", "shared", "things"}, 5, 11, limes.UnitNone)
+	if err == nil {
+		t.Error("expected raising child quota beyond parent quota to fail")
+	}
+
+	//projects in or below a cycle cannot be raised, but can be lowered
+	for _, projectUUID := range []string{"loop1", "loop2", "below"} {
+		if !h.IsChildProject(projectUUID) {
+			t.Errorf("expected %s to be a child project", projectUUID)
+		}
+		err = h.Check(ProjectResourceRef{projectUUID, "shared", "things"}, 0, 1, limes.UnitNone)
+		if err == nil {
+			t.Errorf("expected raising quota of %s to fail", projectUUID)
+		} else if rerr, ok := err.(*ResourceError); !ok || rerr.Code != ReasonParentCycle {
+			t.Errorf("expected raising quota of %s to fail with %s, but got: %s", projectUUID, ReasonParentCycle, err.Error())
+		}
+		err = h.Check(ProjectResourceRef{projectUUID, "shared", "things"}, 1, 0, limes.UnitNone)
+		if err != nil {
+			t.Errorf("expected lowering quota of %s to succeed, but got: %s", projectUUID, err.Error())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package validation
+
+import (
+	"github.com/sapcc/limes/pkg/db"
+	"github.com/sapcc/limes/pkg/limes"
+	"github.com/sapcc/limes/pkg/reports"
+)
+
+//CheckProjectQuotaUpdate validates a change of the given project resource's
+//quota to newQuota. Lowering quota requires canLower and may not go below
+//the current usage. Raising quota requires canRaise and may not exceed the
+//domain quota (this check is skipped if domain is nil). The quotas of parent
+//and child projects are checked by ProjectHierarchy.Check instead.
+func CheckProjectQuotaUpdate(srv db.ProjectService, res db.ProjectResource, domain *reports.Domain, newQuota uint64, canRaise, canLower bool) error {
+	//if quota is being reduced, permission is required and usage must fit into quota
+	//(note that both res.Quota and newQuota are uint64, so we do not need to
+	//cover the case of infinite quotas)
+	if res.Quota > newQuota {
+		if !canLower {
+			return NewResourceError(ReasonLowerForbidden, "cannot change %s/%s quota: user is not allowed to lower quotas in this project", srv.Type, res.Name)
+		}
+		if res.Usage > newQuota {
+			return NewResourceError(ReasonBelowUsage, "cannot change %s/%s quota: quota may not be lower than current usage", srv.Type, res.Name).WithMinAcceptable(res.Usage)
+		}
+		return nil
+	}
+
+	//if quota is being raised, permission is required and also the domain quota may not be exceeded
+	if !canRaise {
+		return NewResourceError(ReasonRaiseForbidden, "cannot change %s/%s quota: user is not allowed to raise quotas in this project", srv.Type, res.Name)
+	}
+	if domain == nil {
+		return nil
+	}
+	domainQuota := uint64(0)
+	projectsQuota := uint64(0)
+	var unit limes.Unit
+	if domainService, exists := domain.Services[srv.Type]; exists {
+		if domainResource, exists := domainService.Resources[res.Name]; exists {
+			domainQuota = domainResource.DomainQuota
+			projectsQuota = domainResource.ProjectsQuota
+			unit = domainResource.Unit
+		}
+	}
+	//NOTE: It looks like an arithmetic overflow (or rather, underflow) is
+	//possible here, but it isn't. projectsQuota is the sum over all current
+	//project quotas, including res.Quota, and thus is always bigger (since these
+	//quotas are all unsigned). Also, we're doing everything in a transaction, so
+	//an overflow because of concurrent quota changes is also out of the
+	//question.
+	newProjectsQuota := projectsQuota - res.Quota + newQuota
+	if newProjectsQuota > domainQuota {
+		maxQuota := domainQuota - (projectsQuota - res.Quota)
+		if domainQuota < projectsQuota-res.Quota {
+			maxQuota = 0
+		}
+		return NewResourceError(ReasonDomainQuotaExceeded, "cannot change %s/%s quota: domain quota exceeded (maximum acceptable project quota is %s)",
+			srv.Type, res.Name,
+			unit.Format(maxQuota),
+		).WithMaxAcceptable(maxQuota)
+	}
+
+	return nil
+}